@@ -2,10 +2,12 @@ package backend
 
 import (
 	"context"
+	"time"
 
 	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/pkg/transfer"
+	"github.com/reproducible-containers/diffoci/pkg/diff"
 )
 
 type Backend interface {
@@ -20,3 +22,40 @@ type Backend interface {
 type Info struct {
 	Name string `json:"Name"`
 }
+
+// CacheManager is implemented by the backends that manage a local cache.
+type CacheManager interface {
+	DiskUsage(ctx context.Context) (*DiskUsage, error)
+	Prune(ctx context.Context, opts PruneOptions) (*PruneReport, error)
+}
+
+// LayerIndexCacheProvider is implemented by the backends that can persist the indexes of the layers
+// in their cache directory.
+type LayerIndexCacheProvider interface {
+	LayerIndexCache() *diff.LayerIndexCache
+}
+
+type DiskUsage struct {
+	Images          int   `json:"Images"`
+	Blobs           int   `json:"Blobs"`
+	Size            int64 `json:"Size"`
+	ReclaimableSize int64 `json:"ReclaimableSize"` // Size of the blobs not referenced by images
+}
+
+type PruneOptions struct {
+	// All removes the images too, not only the unreferenced blobs.
+	All bool
+	// OlderThan limits the removal to the images and blobs that have not been used for the duration.
+	OlderThan time.Duration
+	// MaxSize removes the least recently used images until the cache size fits in MaxSize.
+	// Zero means no limit.
+	MaxSize int64
+}
+
+type PruneReport struct {
+	RemovedImages  []string `json:"RemovedImages,omitempty"`
+	RemovedBlobs   int      `json:"RemovedBlobs"`
+	ReclaimedSize  int64    `json:"ReclaimedSize"`
+	RemainingSize  int64    `json:"RemainingSize"`
+	RemainingBlobs int      `json:"RemainingBlobs"`
+}
@@ -7,6 +7,8 @@ import (
 	"github.com/reproducible-containers/diffoci/cmd/diffoci/backend"
 	"github.com/reproducible-containers/diffoci/cmd/diffoci/backend/containerdbackend"
 	"github.com/reproducible-containers/diffoci/cmd/diffoci/backend/localbackend"
+	"github.com/reproducible-containers/diffoci/cmd/diffoci/backend/memorybackend"
+	"github.com/reproducible-containers/diffoci/cmd/diffoci/backend/ocilayoutbackend"
 	"github.com/reproducible-containers/diffoci/pkg/envutil"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
@@ -15,17 +17,27 @@ import (
 func AddFlags(flags *pflag.FlagSet) {
 	containerdbackend.AddFlags(flags)
 	localbackend.AddFlags(flags)
+	ocilayoutbackend.AddFlags(flags)
 	flags.String("backend", envutil.String("DIFFOCI_BACKEND", "auto"),
-		"backend (auto|containerd|local) [$DIFFOCI_BACKEND]")
+		"backend (auto|containerd|local|oci-layout|memory) [$DIFFOCI_BACKEND]")
 }
 
 func NewBackend(cmd *cobra.Command) (backend.Backend, error) {
-	ctx := cmd.Context()
 	flags := cmd.Flags()
 	b, err := flags.GetString("backend")
 	if err != nil {
 		return nil, err
 	}
+	return NewBackendWithNamespace(cmd, b, "")
+}
+
+// NewBackendWithNamespace creates the backend b, ignoring the `--backend` flag.
+// The namespace ns is optional, and only supported by the containerd backend.
+func NewBackendWithNamespace(cmd *cobra.Command, b, ns string) (backend.Backend, error) {
+	ctx := cmd.Context()
+	if ns != "" && b != containerdbackend.Name {
+		return nil, fmt.Errorf("backend %q does not support namespaces (specified %q)", b, ns)
+	}
 	switch b {
 	case "auto":
 		cb, err := containerdbackend.New(cmd)
@@ -36,10 +48,14 @@ func NewBackend(cmd *cobra.Command) (backend.Backend, error) {
 		log.G(ctx).WithError(err).Debug("auto backend: failed to choose \"containerd\", falling back to \"local\"")
 		return localbackend.New(cmd)
 	case "containerd":
-		return containerdbackend.New(cmd)
+		return containerdbackend.NewWithNamespace(cmd, ns)
 	case "local":
 		return localbackend.New(cmd)
+	case "oci-layout":
+		return ocilayoutbackend.New(cmd)
+	case "memory":
+		return memorybackend.New(), nil
 	default:
-		return nil, fmt.Errorf("unknown backend %q (valid values are \"auto\", \"containerd\", and \"local\")", b)
+		return nil, fmt.Errorf("unknown backend %q (valid values are \"auto\", \"containerd\", \"local\", \"oci-layout\", and \"memory\")", b)
 	}
 }
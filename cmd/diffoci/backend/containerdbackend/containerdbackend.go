@@ -8,11 +8,15 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/defaults"
+	"github.com/containerd/containerd/leases"
+	"github.com/containerd/containerd/mount"
 	"github.com/containerd/containerd/namespaces"
 	"github.com/containerd/log"
+	"github.com/opencontainers/go-digest"
 	"github.com/reproducible-containers/diffoci/cmd/diffoci/backend"
 	"github.com/reproducible-containers/diffoci/pkg/envutil"
 	"github.com/spf13/cobra"
@@ -27,6 +31,8 @@ func AddFlags(flags *pflag.FlagSet) {
 		"containerd address [$CONTAINERD_ADDRESS]")
 	flags.String("containerd-namespace", envutil.String("CONTAINERD_NAMESPACE", namespaces.Default),
 		"containerd namespace [$CONTAINERD_NAMESPACE]")
+	flags.String("containerd-snapshotter", envutil.String("CONTAINERD_SNAPSHOTTER", containerd.DefaultSnapshotter),
+		"containerd snapshotter, used for --use-snapshots [$CONTAINERD_SNAPSHOTTER]")
 }
 
 func defaultContainerdAddress() string {
@@ -60,19 +66,36 @@ func rootlessContainerdAddress() (string, error) {
 }
 
 func New(cmd *cobra.Command) (backend.Backend, error) {
+	return NewWithNamespace(cmd, "")
+}
+
+// NewWithNamespace is similar to New, but overrides the namespace unless ns is empty.
+func NewWithNamespace(cmd *cobra.Command, ns string) (backend.Backend, error) {
 	flags := cmd.Flags()
 	addr, err := flags.GetString("containerd-address")
 	if err != nil {
 		return nil, err
 	}
-	ns, err := flags.GetString("containerd-namespace")
+	if ns == "" {
+		ns, err = flags.GetString("containerd-namespace")
+		if err != nil {
+			return nil, err
+		}
+	}
+	snapshotter, err := flags.GetString("containerd-snapshotter")
 	if err != nil {
 		return nil, err
 	}
-	return newBackend(cmd.Context(), addr, ns)
+	return newBackend(cmd.Context(), addr, ns, snapshotter)
+}
+
+// Open opens the containerd backend for the address and the namespace, without parsing flags.
+// The default snapshotter is used.
+func Open(ctx context.Context, addr, ns string) (backend.Backend, error) {
+	return newBackend(ctx, addr, ns, containerd.DefaultSnapshotter)
 }
 
-func newBackend(ctx context.Context, addr, ns string) (backend.Backend, error) {
+func newBackend(ctx context.Context, addr, ns, snapshotter string) (backend.Backend, error) {
 	if err := unix.Access(addr, unix.R_OK); err != nil {
 		return nil, fmt.Errorf("failed to access containerd socket %q: %w", addr, err)
 	}
@@ -92,11 +115,13 @@ func newBackend(ctx context.Context, addr, ns string) (backend.Backend, error) {
 	if len(plugins.Plugins) == 0 {
 		return nil, fmt.Errorf("containerd plugin \"%s.%s\" seems missing (Hint: upgrade containerd to v1.7 or later)", pluginType, pluginID)
 	}
-	return &containerdBackend{Client: client}, nil
+	return &containerdBackend{Client: client, ns: ns, snapshotter: snapshotter}, nil
 }
 
 type containerdBackend struct {
 	*containerd.Client
+	ns          string
+	snapshotter string
 }
 
 func (b *containerdBackend) Info() backend.Info {
@@ -105,11 +130,38 @@ func (b *containerdBackend) Info() backend.Info {
 	}
 }
 
+// Context sets the namespace explicitly, so that the namespace of another backend is not inherited.
 func (b *containerdBackend) Context(ctx context.Context) context.Context {
-	return ctx
+	return namespaces.WithNamespace(ctx, b.ns)
 }
 
 func (b *containerdBackend) MaybeGC(ctx context.Context) error {
 	// NOP
 	return nil
 }
+
+// WithSnapshot implements [diff.Snapshotter].
+// The snapshot is mounted as a temporary read-only view, and mounting usually requires the root privileges.
+func (b *containerdBackend) WithSnapshot(ctx context.Context, chainID digest.Digest, f func(root string) error) error {
+	ctx, done, err := b.Client.WithLease(b.Context(ctx), leases.WithRandomID(), leases.WithExpiration(time.Hour))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if doneErr := done(ctx); doneErr != nil {
+			log.G(ctx).WithError(doneErr).Warn("Failed to release the lease for the snapshot view")
+		}
+	}()
+	sn := b.Client.SnapshotService(b.snapshotter)
+	key := fmt.Sprintf("diffoci-view-%s-%d", chainID.Encoded(), time.Now().UnixNano())
+	mounts, err := sn.View(ctx, key, chainID.String())
+	if err != nil {
+		return fmt.Errorf("failed to create a view of snapshot %s (snapshotter %q): %w", chainID, b.snapshotter, err)
+	}
+	defer func() {
+		if rmErr := sn.Remove(ctx, key); rmErr != nil {
+			log.G(ctx).WithError(rmErr).Warnf("Failed to remove the snapshot view %q", key)
+		}
+	}()
+	return mount.WithReadonlyTempMount(ctx, mounts, f)
+}
@@ -0,0 +1,158 @@
+package containerdbackend
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/reproducible-containers/diffoci/internal/testutil"
+	"github.com/reproducible-containers/diffoci/pkg/diff"
+)
+
+// startContainerd starts containerd with a temporary root directory, and returns the backend.
+// The test is skipped if containerd is not installed, or if the test is not running as root.
+func startContainerd(t *testing.T) *containerdBackend {
+	t.Helper()
+	bin, err := exec.LookPath("containerd")
+	if err != nil {
+		t.Skipf("containerd is not installed: %v", err)
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("containerd requires the root privileges")
+	}
+	dir := t.TempDir()
+	config := filepath.Join(dir, "config.toml")
+	if err = os.WriteFile(config, []byte("version = 2\ndisabled_plugins = [\"io.containerd.grpc.v1.cri\"]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	addr := filepath.Join(dir, "containerd.sock")
+	cmd := exec.Command(bin, "--config", config,
+		"--root", filepath.Join(dir, "root"), "--state", filepath.Join(dir, "state"), "--address", addr)
+	if testing.Verbose() {
+		cmd.Stderr = os.Stderr
+	}
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	ctx := context.Background()
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		b, err := newBackend(ctx, addr, "diffoci-test", "native")
+		if err == nil {
+			t.Cleanup(func() { _ = b.(*containerdBackend).Close() })
+			return b.(*containerdBackend)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("containerd did not start: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// createImage creates an image with the layers, and unpacks it into the snapshotter.
+func createImage(ctx context.Context, t *testing.T, b *containerdBackend, name string, layers ...[]byte) ocispec.Descriptor {
+	t.Helper()
+	cs := b.ContentStore()
+	write := func(mediaType string, p []byte) ocispec.Descriptor {
+		desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(p), Size: int64(len(p))}
+		if err := content.WriteBlob(ctx, cs, desc.Digest.String(), bytes.NewReader(p), desc); err != nil {
+			t.Fatal(err)
+		}
+		return desc
+	}
+	writeJSON := func(mediaType string, v any) ocispec.Descriptor {
+		p, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return write(mediaType, p)
+	}
+	config := ocispec.Image{Platform: platforms.DefaultSpec(), RootFS: ocispec.RootFS{Type: "layers"}}
+	mani := ocispec.Manifest{MediaType: ocispec.MediaTypeImageManifest}
+	mani.SchemaVersion = 2
+	for _, l := range layers {
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, digest.FromBytes(l))
+		mani.Layers = append(mani.Layers, write(ocispec.MediaTypeImageLayer, l))
+	}
+	mani.Config = writeJSON(ocispec.MediaTypeImageConfig, config)
+	target := writeJSON(ocispec.MediaTypeImageManifest, mani)
+	img, err := b.ImageService().Create(ctx, images.Image{Name: name, Target: target})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = containerd.NewImage(b.Client, img).Unpack(ctx, b.snapshotter); err != nil {
+		t.Fatal(err)
+	}
+	return target
+}
+
+func TestWithSnapshot(t *testing.T) {
+	b := startContainerd(t)
+	ctx := b.Context(context.Background())
+	ctx, done, err := b.WithLease(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done(ctx) //nolint:errcheck
+
+	dir := func(name string) testutil.File {
+		return testutil.File{Name: name, Typeflag: tar.TypeDir, Mode: 0o755}
+	}
+	etc := testutil.Layer(t, dir("etc/"), testutil.File{Name: "etc/hostname", Body: "localhost\n"})
+	etc2 := testutil.Layer(t, dir("etc/"), testutil.File{Name: "etc/hostname", Body: "localhost2\n"})
+	usr := testutil.Layer(t, dir("usr/"), testutil.File{Name: "usr/foo", Body: "foo\n"})
+	// The same pair of the layers appears twice, with different chain IDs
+	descs := [2]ocispec.Descriptor{
+		createImage(ctx, t, b, "test-0", etc, usr, etc),
+		createImage(ctx, t, b, "test-1", etc2, usr, etc2),
+	}
+
+	testCases := []struct {
+		name        string
+		snapshotter diff.Snapshotter
+		expected    int // the number of the events for "etc/hostname"
+	}{
+		{"layers", nil, 2},
+		// The snapshot of the third layer is identical to the second one
+		{"snapshots", b, 1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := &testutil.EventRecorder{}
+			opts := &diff.Options{EventHandler: h, Snapshotter: tc.snapshotter}
+			if _, err := diff.Diff(ctx, b.ContentStore(), descs, platforms.All, opts); err != nil {
+				t.Fatal(err)
+			}
+			var names []string // the names of the differing tar entries
+			for _, ev := range h.Events() {
+				if ev.Type == diff.EventTypeTarEntryMismatch {
+					names = append(names, ev.Name)
+				}
+			}
+			if len(names) != tc.expected {
+				t.Fatalf("expected %d events, got %v", tc.expected, names)
+			}
+			for _, name := range names {
+				if name != "etc/hostname" {
+					t.Fatalf("unexpected event for %q", name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package backend
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/leases"
+)
+
+// NopLeaseManager implements [leases.Manager] for the backends that never garbage-collect blobs during transfers.
+type NopLeaseManager struct{}
+
+func (NopLeaseManager) Create(ctx context.Context, opts ...leases.Opt) (leases.Lease, error) {
+	var l leases.Lease
+	for _, opt := range opts {
+		if err := opt(&l); err != nil {
+			return leases.Lease{}, err
+		}
+	}
+	return l, nil
+}
+
+func (NopLeaseManager) Delete(context.Context, leases.Lease, ...leases.DeleteOpt) error {
+	return nil
+}
+
+func (NopLeaseManager) List(context.Context, ...string) ([]leases.Lease, error) {
+	return nil, nil
+}
+
+func (NopLeaseManager) AddResource(context.Context, leases.Lease, leases.Resource) error {
+	return nil
+}
+
+func (NopLeaseManager) DeleteResource(context.Context, leases.Lease, leases.Resource) error {
+	return nil
+}
+
+func (NopLeaseManager) ListResources(context.Context, leases.Lease) ([]leases.Resource, error) {
+	return nil, nil
+}
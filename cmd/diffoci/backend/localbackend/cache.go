@@ -0,0 +1,359 @@
+package localbackend
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/leases"
+	"github.com/containerd/containerd/metadata"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/reproducible-containers/diffoci/cmd/diffoci/backend"
+	"golang.org/x/sys/unix"
+)
+
+// cacheState is a snapshot of the cache.
+type cacheState struct {
+	images    []images.Image
+	blobs     map[digest.Digest]content.Info // Info.CreatedAt is the last use (mtime, see touch)
+	reachable map[digest.Digest]struct{}     // referenced by images or the live leases
+}
+
+func (st *cacheState) size() (n int64) {
+	for _, info := range st.blobs {
+		n += info.Size
+	}
+	return n
+}
+
+// lastUsed returns the last use of the image, i.e., the last use of the target blob.
+func (st *cacheState) lastUsed(img images.Image) time.Time {
+	return st.blobs[img.Target.Digest].CreatedAt
+}
+
+// blobPath returns the path of the blob in the content store.
+func (b *localBackend) blobPath(d digest.Digest) string {
+	return filepath.Join(b.dir, "blobs", d.Algorithm().String(), d.Encoded())
+}
+
+// touch records the last use of the blob in the mtime, so that the least recently used images can be evicted.
+// The atime is not used, as it is not updated on noatime filesystems, and it is updated by any read on
+// relatime filesystems, including the reads by scan.
+// The mtime is reported as [content.Info.CreatedAt] by the content store.
+func (b *localBackend) touch(ctx context.Context, d digest.Digest) {
+	p := b.blobPath(d)
+	now := time.Now()
+	if err := os.Chtimes(p, now, now); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.G(ctx).WithError(err).Debugf("Failed to update the mtime of %q", p)
+	}
+}
+
+// scan lists the images, the blobs, and the blobs referenced by the images and the live leases.
+// The content store is accessed without leasing the blobs.
+func (b *localBackend) scan(ctx context.Context) (*cacheState, error) {
+	ctx = namespaces.WithNamespace(ctx, b.ns)
+	st := &cacheState{
+		blobs:     make(map[digest.Digest]content.Info),
+		reachable: make(map[digest.Digest]struct{}),
+	}
+	var err error
+	st.images, err = b.imageStore.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err = b.rawContentStore.Walk(ctx, func(info content.Info) error {
+		st.blobs[info.Digest] = info
+		return nil
+	}); err != nil && !errors.Is(err, os.ErrNotExist) { // the blobs directory is created on the first write
+		return nil, err
+	}
+	children := images.ChildrenHandler(b.rawContentStore)
+	handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		st.reachable[desc.Digest] = struct{}{}
+		descs, err := children(ctx, desc)
+		if errors.Is(err, errdefs.ErrNotFound) {
+			// e.g., the manifests for other platforms are not pulled
+			return nil, nil
+		}
+		return descs, err
+	})
+	for _, img := range st.images {
+		if err = images.Walk(ctx, handler, img.Target); err != nil {
+			return nil, err
+		}
+	}
+	// The leases of the running processes (including other processes sharing the cache) are live
+	ls, err := b.leaseManager.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, l := range ls {
+		if leaseIsStale(l, now) {
+			continue
+		}
+		rs, err := b.leaseManager.ListResources(ctx, l)
+		if err != nil {
+			if errors.Is(err, errdefs.ErrNotFound) {
+				// Deleted by another process
+				continue
+			}
+			return nil, err
+		}
+		for _, r := range rs {
+			if r.Type != "content" {
+				continue
+			}
+			if d, err := digest.Parse(r.ID); err == nil {
+				st.reachable[d] = struct{}{}
+			}
+		}
+	}
+	return st, nil
+}
+
+// DiskUsage implements [backend.CacheManager].
+func (b *localBackend) DiskUsage(ctx context.Context) (*backend.DiskUsage, error) {
+	st, err := b.scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	du := &backend.DiskUsage{
+		Images: len(st.images),
+		Blobs:  len(st.blobs),
+		Size:   st.size(),
+	}
+	for d, info := range st.blobs {
+		if _, ok := st.reachable[d]; !ok {
+			du.ReclaimableSize += info.Size
+		}
+	}
+	return du, nil
+}
+
+// Prune implements [backend.CacheManager].
+// The lease of the process is deleted, and a new lease is created on the next use.
+// The exclusive lock of the cache directory is held, so that other processes cannot lease blobs
+// between listing the leases and deleting the blobs.
+func (b *localBackend) Prune(ctx context.Context, opts backend.PruneOptions) (*backend.PruneReport, error) {
+	if err := b.deleteLease(ctx); err != nil {
+		return nil, err
+	}
+	var report *backend.PruneReport
+	err := withFlock(filepath.Join(b.dir, cacheLockFile), unix.LOCK_EX, func() error {
+		var err error
+		report, err = b.prune(ctx, opts)
+		return err
+	})
+	return report, err
+}
+
+func (b *localBackend) prune(ctx context.Context, opts backend.PruneOptions) (*backend.PruneReport, error) {
+	ctx = namespaces.WithNamespace(ctx, b.ns)
+	if err := b.deleteStaleLeases(ctx); err != nil {
+		return nil, err
+	}
+	// Remove the metadata that is no longer referenced
+	if err := b.db.with(func(db *metadata.DB) error {
+		_, err := db.GarbageCollect(ctx)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	var threshold time.Time
+	if opts.OlderThan > 0 {
+		threshold = time.Now().Add(-opts.OlderThan)
+	}
+	report := &backend.PruneReport{}
+	st, err := b.scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if opts.All {
+		for _, img := range st.images {
+			if !threshold.IsZero() && st.lastUsed(img).After(threshold) {
+				continue
+			}
+			if err = b.removeImage(ctx, img.Name, report); err != nil {
+				return report, err
+			}
+		}
+		if st, err = b.scan(ctx); err != nil {
+			return report, err
+		}
+		if err = b.removeOrphanLayerIndexes(ctx, threshold); err != nil {
+			return report, err
+		}
+	}
+	if err = b.removeUnreachableBlobs(ctx, st, threshold, report); err != nil {
+		return report, err
+	}
+	if opts.MaxSize > 0 && st.size() > opts.MaxSize {
+		// Evict the least recently used images
+		imgs := append([]images.Image(nil), st.images...)
+		sort.SliceStable(imgs, func(i, j int) bool {
+			return st.lastUsed(imgs[i]).Before(st.lastUsed(imgs[j]))
+		})
+		for _, img := range imgs {
+			if st.size() <= opts.MaxSize {
+				break
+			}
+			log.G(ctx).Debugf("Evicting image %q (cache size %d > %d)", img.Name, st.size(), opts.MaxSize)
+			if err = b.removeImage(ctx, img.Name, report); err != nil {
+				return report, err
+			}
+			if st, err = b.scan(ctx); err != nil {
+				return report, err
+			}
+			if err = b.removeUnreachableBlobs(ctx, st, time.Time{}, report); err != nil {
+				return report, err
+			}
+		}
+		if size := st.size(); size > opts.MaxSize {
+			log.G(ctx).Warnf("The cache size %d still exceeds the maximum size %d, as the remaining blobs are in use", size, opts.MaxSize)
+		}
+	}
+	report.RemainingBlobs = len(st.blobs)
+	report.RemainingSize = st.size()
+	return report, b.removeOrphanLabels(ctx)
+}
+
+// deleteStaleLeases deletes the leases that have expired, and the leases left by the processes that were killed.
+// The leases of the running processes are kept.
+func (b *localBackend) deleteStaleLeases(ctx context.Context) error {
+	ls, err := b.leaseManager.List(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	var errs []error
+	for _, l := range ls {
+		if !leaseIsStale(l, now) {
+			continue
+		}
+		log.G(ctx).Debugf("Deleting stale lease %q", l.ID)
+		if err := b.leaseManager.Delete(ctx, l); err != nil && !errors.Is(err, errdefs.ErrNotFound) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// leaseExpireLabel is the label set by [leases.WithExpiration].
+const leaseExpireLabel = "containerd.io/gc.expire"
+
+// leaseIsStale returns true if the lease has expired, or if the process that created the lease
+// is no longer running on this host.
+// The leases created by others (e.g., the temporary leases of transfers) are stale only when they have expired.
+func leaseIsStale(l leases.Lease, now time.Time) bool {
+	if s, ok := l.Labels[leaseExpireLabel]; ok {
+		if expire, err := time.Parse(time.RFC3339, s); err == nil && now.After(expire) {
+			return true
+		}
+	}
+	pid, err := strconv.Atoi(l.Labels[leaseLabelPID])
+	if err != nil || pid <= 0 {
+		return false
+	}
+	if hostname, _ := os.Hostname(); l.Labels[leaseLabelHostname] != hostname {
+		// The cache may be shared over a network filesystem
+		return false
+	}
+	return !processExists(pid)
+}
+
+// processExists returns true if the process exists, including the processes of other users.
+func processExists(pid int) bool {
+	err := unix.Kill(pid, 0)
+	return err == nil || errors.Is(err, unix.EPERM)
+}
+
+func (b *localBackend) removeImage(ctx context.Context, name string, report *backend.PruneReport) error {
+	log.G(ctx).Debugf("Removing image %q", name)
+	if err := b.imageStore.Delete(ctx, name); err != nil && !errors.Is(err, errdefs.ErrNotFound) {
+		return err
+	}
+	report.RemovedImages = append(report.RemovedImages, name)
+	return nil
+}
+
+// removeUnreachableBlobs removes the unreachable blobs that have not been used since threshold,
+// and updates st accordingly.
+// A zero threshold matches all the blobs.
+func (b *localBackend) removeUnreachableBlobs(ctx context.Context, st *cacheState, threshold time.Time, report *backend.PruneReport) error {
+	var errs []error
+	for d, info := range st.blobs {
+		if _, ok := st.reachable[d]; ok {
+			continue
+		}
+		if !threshold.IsZero() && info.CreatedAt.After(threshold) {
+			continue
+		}
+		log.G(ctx).Debugf("Removing unreachable blob %s", d)
+		if err := b.rawContentStore.Delete(ctx, d); err != nil && !errors.Is(err, errdefs.ErrNotFound) {
+			errs = append(errs, err)
+			continue
+		}
+		// The content store does not remove the labels
+		if err := b.labelStore.Set(d, nil); err != nil {
+			errs = append(errs, err)
+		}
+		if err := b.layerIndexCache.Remove(d); err != nil {
+			errs = append(errs, err)
+		}
+		delete(st.blobs, d)
+		report.RemovedBlobs++
+		report.ReclaimedSize += info.Size
+	}
+	return errors.Join(errs...)
+}
+
+// removeOrphanLabels removes the label files of the blobs that do not exist,
+// e.g., the blobs removed by the previous versions of diffoci.
+func (b *localBackend) removeOrphanLabels(ctx context.Context) error {
+	return filepath.WalkDir(b.labelStore.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || d.Name() == labelStoreLockFile {
+			return nil
+		}
+		alg := filepath.Base(filepath.Dir(path))
+		dgst := digest.NewDigestFromEncoded(digest.Algorithm(alg), d.Name())
+		if dgst.Validate() != nil {
+			return nil
+		}
+		if _, err := os.Stat(b.blobPath(dgst)); errors.Is(err, os.ErrNotExist) {
+			log.G(ctx).Debugf("Removing orphan labels of %s", dgst)
+			return b.labelStore.Set(dgst, nil)
+		}
+		return nil
+	})
+}
+
+// removeOrphanLayerIndexes removes the layer indexes that have not been used since threshold,
+// and whose layer blobs do not exist, e.g., the layers that were fetched lazily.
+// A zero threshold matches all the indexes.
+func (b *localBackend) removeOrphanLayerIndexes(ctx context.Context, threshold time.Time) error {
+	return b.layerIndexCache.Walk(func(dgst digest.Digest, lastUsed time.Time) error {
+		if !threshold.IsZero() && lastUsed.After(threshold) {
+			return nil
+		}
+		if _, err := os.Stat(b.blobPath(dgst)); !errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		log.G(ctx).Debugf("Removing orphan layer index of %s", dgst)
+		return b.layerIndexCache.Remove(dgst)
+	})
+}
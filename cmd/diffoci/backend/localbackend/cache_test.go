@@ -0,0 +1,627 @@
+package localbackend
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	contentlocal "github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/leases"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/reproducible-containers/diffoci/cmd/diffoci/backend"
+	"github.com/reproducible-containers/diffoci/pkg/diff"
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+// deadPID returns a PID that is not in use.
+func deadPID(t *testing.T) int {
+	t.Helper()
+	for pid := 1 << 22; pid > 1<<21; pid-- {
+		if !processExists(pid) {
+			return pid
+		}
+	}
+	t.Fatal("failed to find a PID that is not in use")
+	return 0
+}
+
+func TestLeaseIsStale(t *testing.T) {
+	now := time.Now()
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadPID := deadPID(t)
+	testCases := []struct {
+		name     string
+		labels   map[string]string
+		expected bool
+	}{
+		{"no labels", nil, false},
+		{"not expired", map[string]string{leaseExpireLabel: now.Add(time.Hour).Format(time.RFC3339)}, false},
+		{"expired", map[string]string{leaseExpireLabel: now.Add(-time.Hour).Format(time.RFC3339)}, true},
+		{"invalid expiration", map[string]string{leaseExpireLabel: "foo"}, false},
+		{"running process", map[string]string{
+			leaseLabelPID:      strconv.Itoa(os.Getpid()),
+			leaseLabelHostname: hostname,
+		}, false},
+		{"dead process", map[string]string{
+			leaseLabelPID:      strconv.Itoa(deadPID),
+			leaseLabelHostname: hostname,
+		}, true},
+		{"dead process on another host", map[string]string{
+			leaseLabelPID:      strconv.Itoa(deadPID),
+			leaseLabelHostname: hostname + "-other",
+		}, false},
+		{"running process with an expired lease", map[string]string{
+			leaseExpireLabel:   now.Add(-time.Hour).Format(time.RFC3339),
+			leaseLabelPID:      strconv.Itoa(os.Getpid()),
+			leaseLabelHostname: hostname,
+		}, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := leaseIsStale(leases.Lease{ID: tc.name, Labels: tc.labels}, now); got != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+// TestMetadataDBShared tests that the database is not locked between transactions,
+// so that multiple processes can share the cache.
+func TestMetadataDBShared(t *testing.T) {
+	dir := t.TempDir()
+	cs, err := contentlocal.NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := namespaces.WithNamespace(context.Background(), "diffoci")
+	var lms []leases.Manager
+	for range 2 {
+		// bbolt does not allow opening the same file twice in a process, even with a timeout,
+		// unless the file is closed between transactions.
+		db := &metadataDB{path: filepath.Join(dir, "diffoci.db"), timeout: time.Second, cs: cs}
+		lms = append(lms, &leaseManager{db: db})
+	}
+	l, err := lms[0].Create(ctx, leases.WithRandomID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls, err := lms[1].List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ls) != 1 || ls[0].ID != l.ID {
+		t.Fatalf("expected the lease %q, got %+v", l.ID, ls)
+	}
+}
+
+// newTestBackend opens the backend with the cache directory and the flags (e.g., "--local-cache-max-size=1KiB").
+func newTestBackend(t *testing.T, dir string, args ...string) *localBackend {
+	t.Helper()
+	cmd := &cobra.Command{}
+	AddFlags(cmd.Flags())
+	if err := cmd.Flags().Parse(append([]string{"--local-cache=" + dir}, args...)); err != nil {
+		t.Fatal(err)
+	}
+	cmd.SetContext(context.Background())
+	b, err := New(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.(*localBackend)
+}
+
+func writeBlob(t *testing.T, cs content.Store, s string) digest.Digest {
+	t.Helper()
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayer,
+		Digest:    digest.FromString(s),
+		Size:      int64(len(s)),
+	}
+	ctx := namespaces.WithNamespace(context.Background(), "diffoci")
+	if err := content.WriteBlob(ctx, cs, desc.Digest.String(), strings.NewReader(s), desc); err != nil {
+		t.Fatal(err)
+	}
+	return desc.Digest
+}
+
+// TestPruneSharedLeases tests that the blobs leased by other running processes are not removed.
+func TestPruneSharedLeases(t *testing.T) {
+	dir := t.TempDir()
+	self := newTestBackend(t, dir)
+	other := newTestBackend(t, dir) // emulates another process
+	ctx := namespaces.WithNamespace(context.Background(), "diffoci")
+
+	unleased := writeBlob(t, self.rawContentStore, "unleased")
+	leasedByOther := writeBlob(t, other.ContentStore(), "leased by other")
+	leasedBySelf := writeBlob(t, self.ContentStore(), "leased by self")
+
+	// The lease left by a killed process
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead, err := self.leaseManager.Create(ctx, leases.WithRandomID(), leases.WithLabels(map[string]string{
+		leaseLabelPID:      strconv.Itoa(deadPID(t)),
+		leaseLabelHostname: hostname,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	leasedByDead := writeBlob(t, self.rawContentStore, "leased by dead")
+	if err = self.leaseManager.AddResource(ctx, dead, leases.Resource{ID: leasedByDead.String(), Type: "content"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = self.Prune(ctx, backend.PruneOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name   string
+		d      digest.Digest
+		exists bool
+	}{
+		{"unleased", unleased, false},
+		{"leased by other", leasedByOther, true},
+		{"leased by self", leasedBySelf, false}, // Prune releases the lease of the process
+		{"leased by dead", leasedByDead, false},
+	}
+	for _, tc := range testCases {
+		_, err := self.rawContentStore.Info(ctx, tc.d)
+		if exists := err == nil; exists != tc.exists {
+			t.Errorf("%s: expected exists=%v, got %v", tc.name, tc.exists, err)
+		}
+	}
+	ls, err := self.leaseManager.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range ls {
+		if l.ID == dead.ID {
+			t.Errorf("expected the lease %q to be deleted", dead.ID)
+		}
+	}
+}
+
+// TestLeaseBeforeAccess tests that the blobs are added to the lease before they are read or written,
+// so that Prune in another process does not remove the blobs being accessed.
+func TestLeaseBeforeAccess(t *testing.T) {
+	b := newTestBackend(t, t.TempDir())
+	ctx := namespaces.WithNamespace(context.Background(), "diffoci")
+	leased := func(d digest.Digest) bool {
+		t.Helper()
+		l, err := b.currentLease(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rs, err := b.leaseManager.ListResources(ctx, l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range rs {
+			if r.ID == d.String() {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Writing with the descriptor
+	s := "written"
+	desc := ocispec.Descriptor{Digest: digest.FromString(s), Size: int64(len(s))}
+	w, err := b.ContentStore().Writer(ctx, content.WithRef("written"), content.WithDescriptor(desc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !leased(desc.Digest) {
+		t.Error("expected the blob to be leased before it is written")
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reading
+	d := writeBlob(t, b.rawContentStore, "read")
+	if leased(d) {
+		t.Fatal("expected the blob not to be leased before it is read")
+	}
+	ra, err := b.ContentStore().ReaderAt(ctx, ocispec.Descriptor{Digest: d})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ra.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !leased(d) {
+		t.Error("expected the blob to be leased when it is read")
+	}
+
+	// Leasing waits for Prune
+	lockPath := filepath.Join(b.dir, cacheLockFile)
+	locked, unlock, done := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	go func() {
+		_ = withFlock(lockPath, unix.LOCK_EX, func() error {
+			close(locked)
+			<-unlock
+			return nil
+		})
+	}()
+	<-locked
+	d = writeBlob(t, b.rawContentStore, "read during prune")
+	go func() {
+		b.addLeaseResource(ctx, d)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("expected leasing to wait for the exclusive lock")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(unlock)
+	<-done
+	if !leased(d) {
+		t.Error("expected the blob to be leased after the exclusive lock is released")
+	}
+}
+
+// createTestImage creates an image "example.com/NAME" with a layer, and records the last use of the blobs.
+// The digests of the manifest, the config, and the layer are returned.
+func createTestImage(t *testing.T, b *localBackend, name string, lastUsed time.Time) []digest.Digest {
+	t.Helper()
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(name)), ModTime: lastUsed}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(name)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layerDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayer,
+		Digest:    writeBlob(t, b.rawContentStore, layer.String()),
+		Size:      int64(layer.Len()),
+	}
+	marshal := func(v any) string {
+		j, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(j)
+	}
+	config := marshal(ocispec.Image{
+		Platform: platforms.DefaultSpec(),
+		RootFS:   ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{layerDesc.Digest}},
+	})
+	mani := ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config: ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageConfig,
+			Digest:    writeBlob(t, b.rawContentStore, config),
+			Size:      int64(len(config)),
+		},
+		Layers: []ocispec.Descriptor{layerDesc},
+	}
+	mani.SchemaVersion = 2
+	maniJSON := marshal(mani)
+	target := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    writeBlob(t, b.rawContentStore, maniJSON),
+		Size:      int64(len(maniJSON)),
+	}
+	ctx := namespaces.WithNamespace(context.Background(), "diffoci")
+	if _, err := b.imageStore.Create(ctx, images.Image{Name: "example.com/" + name, Target: target}); err != nil {
+		t.Fatal(err)
+	}
+	res := []digest.Digest{target.Digest, mani.Config.Digest, layerDesc.Digest}
+	for _, d := range res {
+		setLastUsed(t, b, d, lastUsed)
+	}
+	return res
+}
+
+func setLastUsed(t *testing.T, b *localBackend, d digest.Digest, lastUsed time.Time) {
+	t.Helper()
+	if err := os.Chtimes(b.blobPath(d), lastUsed, lastUsed); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testCache creates the images "old" and "new", and the unreferenced blobs "stale" and "fresh".
+// "old" and "stale" were last used 48 hours ago.
+// The blobs are returned by the names.
+func testCache(t *testing.T, b *localBackend) map[string][]digest.Digest {
+	t.Helper()
+	now := time.Now()
+	old := now.Add(-48 * time.Hour)
+	stale := writeBlob(t, b.rawContentStore, "stale")
+	setLastUsed(t, b, stale, old)
+	return map[string][]digest.Digest{
+		"old":   createTestImage(t, b, "old", old),
+		"new":   createTestImage(t, b, "new", now),
+		"stale": {stale},
+		"fresh": {writeBlob(t, b.rawContentStore, "fresh")},
+	}
+}
+
+// remaining returns the names of the images and the blob groups of [testCache] that remain in the cache.
+func remaining(t *testing.T, b *localBackend, blobs map[string][]digest.Digest) (imgs, groups []string) {
+	t.Helper()
+	ctx := namespaces.WithNamespace(context.Background(), "diffoci")
+	list, err := b.imageStore.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, img := range list {
+		imgs = append(imgs, strings.TrimPrefix(img.Name, "example.com/"))
+	}
+	sort.Strings(imgs)
+	for name, ds := range blobs {
+		var n int
+		for _, d := range ds {
+			if _, err := b.rawContentStore.Info(ctx, d); err == nil {
+				n++
+			}
+		}
+		switch n {
+		case len(ds):
+			groups = append(groups, name)
+		case 0:
+		default:
+			t.Errorf("%d of %d blobs of %q remain", n, len(ds), name)
+		}
+	}
+	sort.Strings(groups)
+	return imgs, groups
+}
+
+// blobsSize returns the total size of the blobs.
+func blobsSize(t *testing.T, b *localBackend, ds ...digest.Digest) (n int64) {
+	t.Helper()
+	ctx := namespaces.WithNamespace(context.Background(), "diffoci")
+	for _, d := range ds {
+		info, err := b.rawContentStore.Info(ctx, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n += info.Size
+	}
+	return n
+}
+
+func TestPrune(t *testing.T) {
+	testCases := []struct {
+		name    string
+		opts    backend.PruneOptions
+		maxSize bool // set opts.MaxSize to the size of "new"
+		images  []string
+		blobs   []string
+	}{
+		{
+			name:   "unreferenced blobs",
+			images: []string{"new", "old"},
+			blobs:  []string{"new", "old"},
+		},
+		{
+			name:   "unreferenced blobs older than",
+			opts:   backend.PruneOptions{OlderThan: 24 * time.Hour},
+			images: []string{"new", "old"},
+			blobs:  []string{"fresh", "new", "old"},
+		},
+		{
+			name: "all",
+			opts: backend.PruneOptions{All: true},
+		},
+		{
+			name:   "all older than",
+			opts:   backend.PruneOptions{All: true, OlderThan: 24 * time.Hour},
+			images: []string{"new"},
+			blobs:  []string{"fresh", "new"},
+		},
+		{
+			// The least recently used image is evicted
+			name:    "max size",
+			maxSize: true,
+			images:  []string{"new"},
+			blobs:   []string{"new"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := newTestBackend(t, t.TempDir())
+			blobs := testCache(t, b)
+			opts := tc.opts
+			if tc.maxSize {
+				opts.MaxSize = blobsSize(t, b, blobs["new"]...)
+			}
+			report, err := b.Prune(context.Background(), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			imgs, groups := remaining(t, b, blobs)
+			if strings.Join(imgs, ",") != strings.Join(tc.images, ",") {
+				t.Errorf("expected the images %v, got %v", tc.images, imgs)
+			}
+			if strings.Join(groups, ",") != strings.Join(tc.blobs, ",") {
+				t.Errorf("expected the blobs %v, got %v", tc.blobs, groups)
+			}
+			var remainingBlobs []digest.Digest
+			for _, name := range groups {
+				remainingBlobs = append(remainingBlobs, blobs[name]...)
+			}
+			if report.RemainingBlobs != len(remainingBlobs) || report.RemainingSize != blobsSize(t, b, remainingBlobs...) {
+				t.Errorf("unexpected report %+v", report)
+			}
+		})
+	}
+}
+
+func TestMaybeGC(t *testing.T) {
+	testCases := []struct {
+		name   string
+		args   []string
+		images []string
+		blobs  []string
+	}{
+		{
+			// Nothing is removed without the limits
+			name:   "no limit",
+			images: []string{"new", "old"},
+			blobs:  []string{"fresh", "new", "old", "stale"},
+		},
+		{
+			name:   "max size",
+			args:   []string{"--local-cache-max-size=1MiB"},
+			images: []string{"new", "old"},
+			blobs:  []string{"new", "old"},
+		},
+		{
+			name:   "older than",
+			args:   []string{"--local-cache-older-than=24h"},
+			images: []string{"new"},
+			blobs:  []string{"fresh", "new"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := newTestBackend(t, t.TempDir(), tc.args...)
+			blobs := testCache(t, b)
+			ctx := b.Context(context.Background()) // creates the lease of the process
+			if err := b.MaybeGC(ctx); err != nil {
+				t.Fatal(err)
+			}
+			imgs, groups := remaining(t, b, blobs)
+			if strings.Join(imgs, ",") != strings.Join(tc.images, ",") {
+				t.Errorf("expected the images %v, got %v", tc.images, imgs)
+			}
+			if strings.Join(groups, ",") != strings.Join(tc.blobs, ",") {
+				t.Errorf("expected the blobs %v, got %v", tc.blobs, groups)
+			}
+			// The lease of the process is not left
+			ls, err := b.leaseManager.List(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ls) != 0 {
+				t.Errorf("expected no lease, got %+v", ls)
+			}
+		})
+	}
+}
+
+func TestDiskUsage(t *testing.T) {
+	b := newTestBackend(t, t.TempDir())
+	blobs := testCache(t, b)
+	var all []digest.Digest
+	for _, ds := range blobs {
+		all = append(all, ds...)
+	}
+	du, err := b.DiskUsage(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := backend.DiskUsage{
+		Images:          2,
+		Blobs:           len(all),
+		Size:            blobsSize(t, b, all...),
+		ReclaimableSize: blobsSize(t, b, blobs["stale"][0], blobs["fresh"][0]),
+	}
+	if *du != expected {
+		t.Errorf("expected %+v, got %+v", expected, du)
+	}
+}
+
+// TestPruneOrphanLayerIndexes tests that the indexes of the layers whose blobs do not exist
+// (e.g., the layers fetched lazily) are removed by Prune with All.
+func TestPruneOrphanLayerIndexes(t *testing.T) {
+	b := newTestBackend(t, t.TempDir())
+	ctx := namespaces.WithNamespace(context.Background(), "diffoci")
+	now := time.Now()
+	blobs := map[string][]digest.Digest{
+		"old": createTestImage(t, b, "old", now),
+		"new": createTestImage(t, b, "new", now),
+	}
+	descs := [2]ocispec.Descriptor{{Digest: blobs["old"][0]}, {Digest: blobs["new"][0]}}
+	for i := range descs {
+		info, err := b.rawContentStore.Info(ctx, descs[i].Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		descs[i].MediaType, descs[i].Size = ocispec.MediaTypeImageManifest, info.Size
+	}
+	if _, err := diff.Diff(ctx, b.rawContentStore, descs, platforms.All, &diff.Options{LayerIndexCache: b.layerIndexCache}); err != nil {
+		t.Fatal(err)
+	}
+	indexes := func() map[digest.Digest]struct{} {
+		t.Helper()
+		res := make(map[digest.Digest]struct{})
+		if err := b.layerIndexCache.Walk(func(dgst digest.Digest, _ time.Time) error {
+			res[dgst] = struct{}{}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	oldLayer, newLayer := blobs["old"][2], blobs["new"][2]
+	if idx := indexes(); len(idx) != 2 {
+		t.Fatalf("expected the indexes of the 2 layers, got %v", idx)
+	}
+	// The layer of "old" is no longer available, as if it was fetched lazily
+	if err := b.rawContentStore.Delete(ctx, oldLayer); err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		opts     backend.PruneOptions
+		age      bool // makes the index of the layer of "old" older than 48 hours
+		expected []digest.Digest
+	}{
+		// Without All, the orphan index is kept
+		{opts: backend.PruneOptions{}, expected: []digest.Digest{oldLayer, newLayer}},
+		// The orphan index used recently is kept
+		{opts: backend.PruneOptions{All: true, OlderThan: 24 * time.Hour}, expected: []digest.Digest{oldLayer, newLayer}},
+		{opts: backend.PruneOptions{All: true, OlderThan: 24 * time.Hour}, age: true, expected: []digest.Digest{newLayer}},
+	}
+	for i, step := range steps {
+		if step.age {
+			matches, err := filepath.Glob(filepath.Join(b.dir, "layer-index", "*", oldLayer.Algorithm().String(), oldLayer.Encoded()+".jsonl.gz"))
+			if err != nil || len(matches) != 1 {
+				t.Fatalf("failed to find the index of %s: %v, %v", oldLayer, matches, err)
+			}
+			old := now.Add(-48 * time.Hour)
+			if err = os.Chtimes(matches[0], old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := b.Prune(ctx, step.opts); err != nil {
+			t.Fatal(err)
+		}
+		idx := indexes()
+		if len(idx) != len(step.expected) {
+			t.Errorf("step %d: expected the indexes of %v, got %v", i, step.expected, idx)
+		}
+		for _, d := range step.expected {
+			if _, ok := idx[d]; !ok {
+				t.Errorf("step %d: expected the index of %s, got %v", i, d, idx)
+			}
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package localbackend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/leases"
+	"github.com/containerd/containerd/metadata"
+	"go.etcd.io/bbolt"
+)
+
+// metadataDB opens the bbolt database for each transaction.
+// bbolt holds an exclusive flock on the database file while the file is open,
+// so keeping the file open would block the other diffoci processes sharing the cache until this process exits.
+type metadataDB struct {
+	path    string
+	timeout time.Duration
+	cs      content.Store
+	mu      sync.Mutex // the file cannot be opened twice in a process
+}
+
+// with opens the database, calls f, and closes the database.
+// f must not call with.
+func (m *metadataDB) with(f func(db *metadata.DB) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	raw, err := bbolt.Open(m.path, 0644, &bbolt.Options{Timeout: m.timeout})
+	if err != nil {
+		if errors.Is(err, bbolt.ErrTimeout) {
+			return fmt.Errorf("timed out after %v waiting for %q to be released by another diffoci process "+
+				"(Hint: specify a longer --local-db-timeout, or a different --local-cache): %w", m.timeout, m.path, err)
+		}
+		return err
+	}
+	return errors.Join(f(metadata.NewDB(raw, m.cs, nil)), raw.Close())
+}
+
+// imageStore implements [images.Store] with a transaction per call.
+type imageStore struct {
+	db *metadataDB
+}
+
+func (s *imageStore) Get(ctx context.Context, name string) (img images.Image, err error) {
+	err = s.db.with(func(db *metadata.DB) error {
+		var err error
+		img, err = metadata.NewImageStore(db).Get(ctx, name)
+		return err
+	})
+	return img, err
+}
+
+func (s *imageStore) List(ctx context.Context, filters ...string) (imgs []images.Image, err error) {
+	err = s.db.with(func(db *metadata.DB) error {
+		var err error
+		imgs, err = metadata.NewImageStore(db).List(ctx, filters...)
+		return err
+	})
+	return imgs, err
+}
+
+func (s *imageStore) Create(ctx context.Context, image images.Image) (img images.Image, err error) {
+	err = s.db.with(func(db *metadata.DB) error {
+		var err error
+		img, err = metadata.NewImageStore(db).Create(ctx, image)
+		return err
+	})
+	return img, err
+}
+
+func (s *imageStore) Update(ctx context.Context, image images.Image, fieldpaths ...string) (img images.Image, err error) {
+	err = s.db.with(func(db *metadata.DB) error {
+		var err error
+		img, err = metadata.NewImageStore(db).Update(ctx, image, fieldpaths...)
+		return err
+	})
+	return img, err
+}
+
+func (s *imageStore) Delete(ctx context.Context, name string, opts ...images.DeleteOpt) error {
+	return s.db.with(func(db *metadata.DB) error {
+		return metadata.NewImageStore(db).Delete(ctx, name, opts...)
+	})
+}
+
+// leaseManager implements [leases.Manager] with a transaction per call.
+type leaseManager struct {
+	db *metadataDB
+}
+
+func (lm *leaseManager) Create(ctx context.Context, opts ...leases.Opt) (l leases.Lease, err error) {
+	err = lm.db.with(func(db *metadata.DB) error {
+		var err error
+		l, err = metadata.NewLeaseManager(db).Create(ctx, opts...)
+		return err
+	})
+	return l, err
+}
+
+func (lm *leaseManager) Delete(ctx context.Context, l leases.Lease, opts ...leases.DeleteOpt) error {
+	return lm.db.with(func(db *metadata.DB) error {
+		return metadata.NewLeaseManager(db).Delete(ctx, l, opts...)
+	})
+}
+
+func (lm *leaseManager) List(ctx context.Context, filters ...string) (ls []leases.Lease, err error) {
+	err = lm.db.with(func(db *metadata.DB) error {
+		var err error
+		ls, err = metadata.NewLeaseManager(db).List(ctx, filters...)
+		return err
+	})
+	return ls, err
+}
+
+func (lm *leaseManager) AddResource(ctx context.Context, l leases.Lease, r leases.Resource) error {
+	return lm.db.with(func(db *metadata.DB) error {
+		return metadata.NewLeaseManager(db).AddResource(ctx, l, r)
+	})
+}
+
+func (lm *leaseManager) DeleteResource(ctx context.Context, l leases.Lease, r leases.Resource) error {
+	return lm.db.with(func(db *metadata.DB) error {
+		return metadata.NewLeaseManager(db).DeleteResource(ctx, l, r)
+	})
+}
+
+func (lm *leaseManager) ListResources(ctx context.Context, l leases.Lease) (rs []leases.Resource, err error) {
+	err = lm.db.with(func(db *metadata.DB) error {
+		var err error
+		rs, err = metadata.NewLeaseManager(db).ListResources(ctx, l)
+		return err
+	})
+	return rs, err
+}
@@ -4,24 +4,31 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/containerd/containerd/content"
 	contentlocal "github.com/containerd/containerd/content/local"
 	"github.com/containerd/containerd/images"
-	"github.com/containerd/containerd/metadata"
+	"github.com/containerd/containerd/leases"
 	"github.com/containerd/containerd/namespaces"
 	"github.com/containerd/containerd/pkg/transfer"
 	transferlocal "github.com/containerd/containerd/pkg/transfer/local"
+	"github.com/containerd/errdefs"
 	"github.com/containerd/log"
+	"github.com/docker/go-units"
 	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/reproducible-containers/diffoci/cmd/diffoci/backend"
+	"github.com/reproducible-containers/diffoci/pkg/diff"
 	"github.com/reproducible-containers/diffoci/pkg/envutil"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
-	"go.etcd.io/bbolt"
+	"golang.org/x/sys/unix"
 )
 
 const Name = "local"
@@ -29,6 +36,12 @@ const Name = "local"
 func AddFlags(flags *pflag.FlagSet) {
 	flags.String("local-cache", envutil.String("DIFFOCI_LOCAL_CACHE", defaultLocalCache()),
 		"local cache [$DIFFOCI_LOCAL_CACHE]")
+	flags.Duration("local-db-timeout", envutil.Duration("DIFFOCI_LOCAL_DB_TIMEOUT", 5*time.Minute),
+		"timeout for waiting for other diffoci processes to release the local cache [$DIFFOCI_LOCAL_DB_TIMEOUT]")
+	flags.String("local-cache-max-size", envutil.String("DIFFOCI_LOCAL_CACHE_MAX_SIZE", ""),
+		"maximum size of the local cache (e.g., \"10GiB\"); the least recently used images are evicted after each diff [$DIFFOCI_LOCAL_CACHE_MAX_SIZE]")
+	flags.Duration("local-cache-older-than", envutil.Duration("DIFFOCI_LOCAL_CACHE_OLDER_THAN", 0),
+		"remove the images and the blobs that have not been used for the duration (e.g., \"168h\") after each diff [$DIFFOCI_LOCAL_CACHE_OLDER_THAN]")
 }
 
 func defaultLocalCache() string {
@@ -49,6 +62,25 @@ func New(cmd *cobra.Command) (backend.Backend, error) {
 	if err != nil {
 		return nil, err
 	}
+	dbTimeout, err := flags.GetDuration("local-db-timeout")
+	if err != nil {
+		return nil, err
+	}
+	maxSizeStr, err := flags.GetString("local-cache-max-size")
+	if err != nil {
+		return nil, err
+	}
+	olderThan, err := flags.GetDuration("local-cache-older-than")
+	if err != nil {
+		return nil, err
+	}
+	var maxSize int64
+	if maxSizeStr != "" {
+		maxSize, err = units.RAMInBytes(maxSizeStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid local-cache-max-size %q: %w", maxSizeStr, err)
+		}
+	}
 	labelsDir := filepath.Join(dir, "labels")
 	for _, f := range []string{dir, labelsDir} {
 		if err := os.MkdirAll(f, 0700); err != nil {
@@ -56,23 +88,28 @@ func New(cmd *cobra.Command) (backend.Backend, error) {
 		}
 	}
 	b := &localBackend{
-		ns: "diffoci",
+		ns:        "diffoci",
+		dir:       dir,
+		maxSize:   maxSize,
+		olderThan: olderThan,
+		labelStore: &labelStore{
+			dir: labelsDir,
+		},
+		layerIndexCache: diff.NewLayerIndexCache(filepath.Join(dir, "layer-index")),
 	}
-	labelStore := &labelStore{
-		dir: labelsDir,
-	}
-	b.contentStore, err = contentlocal.NewLabeledStore(dir, labelStore)
+	b.rawContentStore, err = contentlocal.NewLabeledStore(dir, b.labelStore)
 	if err != nil {
 		return nil, err
 	}
-	dbRaw, err := bbolt.Open(filepath.Join(dir, "diffoci.db"), 0644, nil)
-	if err != nil {
-		return nil, err
+	b.db = &metadataDB{
+		path:    filepath.Join(dir, "diffoci.db"),
+		timeout: dbTimeout,
+		cs:      b.rawContentStore,
 	}
-	b.db = metadata.NewDB(dbRaw, b.contentStore, nil)
-	b.imageStore = metadata.NewImageStore(b.db)
-	lm := metadata.NewLeaseManager(b.db)
-	b.transferrer = transferlocal.NewTransferService(lm,
+	b.imageStore = &imageStore{db: b.db}
+	b.leaseManager = &leaseManager{db: b.db}
+	b.contentStore = &leasedContentStore{Store: b.rawContentStore, b: b}
+	b.transferrer = transferlocal.NewTransferService(b.leaseManager,
 		b.contentStore,
 		b.imageStore,
 		&transferlocal.TransferConfig{},
@@ -81,11 +118,115 @@ func New(cmd *cobra.Command) (backend.Backend, error) {
 }
 
 type localBackend struct {
-	ns           string
-	db           *metadata.DB
-	contentStore content.Store
-	imageStore   images.Store
-	transferrer  transfer.Transferrer
+	ns              string
+	dir             string
+	maxSize         int64         // 0 means no limit
+	olderThan       time.Duration // 0 means no limit
+	db              *metadataDB
+	rawContentStore content.Store
+	labelStore      *labelStore
+	layerIndexCache *diff.LayerIndexCache
+	contentStore    content.Store
+	imageStore      images.Store
+	transferrer     transfer.Transferrer
+	leaseManager    leases.Manager
+	leaseMu         sync.Mutex
+	lease           leases.Lease // created on the first use, and deleted by MaybeGC
+	leased          map[digest.Digest]struct{}
+}
+
+// leaseExpiration is the expiration of the lease held by a process.
+// The lease is deleted by MaybeGC, but it may remain when the process is killed.
+const leaseExpiration = 24 * time.Hour
+
+// Labels of the lease held by a process, for detecting the leases of the processes that were killed.
+const (
+	leaseLabelPID      = "diffoci/pid"
+	leaseLabelHostname = "diffoci/hostname"
+)
+
+// currentLease returns the lease of the process, creating the lease if it does not exist.
+func (b *localBackend) currentLease(ctx context.Context) (leases.Lease, error) {
+	b.leaseMu.Lock()
+	defer b.leaseMu.Unlock()
+	if b.lease.ID != "" {
+		return b.lease, nil
+	}
+	hostname, _ := os.Hostname()
+	l, err := b.leaseManager.Create(namespaces.WithNamespace(ctx, b.ns),
+		leases.WithRandomID(), leases.WithExpiration(leaseExpiration),
+		leases.WithLabels(map[string]string{
+			leaseLabelPID:      strconv.Itoa(os.Getpid()),
+			leaseLabelHostname: hostname,
+		}))
+	if err != nil {
+		return leases.Lease{}, fmt.Errorf("failed to create a lease: %w", err)
+	}
+	b.lease = l
+	b.leased = make(map[digest.Digest]struct{})
+	return l, nil
+}
+
+// deleteLease deletes the lease of the process, if any.
+// A new lease is created on the next use.
+func (b *localBackend) deleteLease(ctx context.Context) error {
+	b.leaseMu.Lock()
+	defer b.leaseMu.Unlock()
+	if b.lease.ID == "" {
+		return nil
+	}
+	err := b.leaseManager.Delete(namespaces.WithNamespace(ctx, b.ns), b.lease)
+	if errors.Is(err, errdefs.ErrNotFound) {
+		err = nil
+	}
+	if err == nil {
+		b.lease = leases.Lease{}
+		b.leased = nil
+	}
+	return err
+}
+
+// addLeaseResource adds the blob to the lease of the process,
+// so that the blob is not removed by GC (in another process) while this process is using it.
+// The blob has to be added before it is read or written, as Prune only respects the leases
+// that exist when it lists the leases.
+// The last use of the blob is recorded too.
+func (b *localBackend) addLeaseResource(ctx context.Context, d digest.Digest) {
+	l, err := b.currentLease(ctx)
+	if err != nil {
+		log.G(ctx).WithError(err).Warnf("Failed to add %s to the lease", d)
+		return
+	}
+	b.leaseMu.Lock()
+	_, ok := b.leased[d]
+	b.leaseMu.Unlock()
+	if ok {
+		return
+	}
+	r := leases.Resource{
+		ID:   d.String(),
+		Type: "content",
+	}
+	// The shared lock waits for Prune, which may be running in another goroutine or in another process.
+	// leaseMu is not held here, as Prune needs it while holding the exclusive lock.
+	err = withFlock(filepath.Join(b.dir, cacheLockFile), unix.LOCK_SH, func() error {
+		b.touch(ctx, d)
+		return b.leaseManager.AddResource(namespaces.WithNamespace(ctx, b.ns), l, r)
+	})
+	if err != nil {
+		log.G(ctx).WithError(err).Warnf("Failed to add %s to lease %q", d, l.ID)
+		return
+	}
+	b.leaseMu.Lock()
+	defer b.leaseMu.Unlock()
+	if b.lease.ID == l.ID {
+		b.leased[d] = struct{}{}
+	}
+}
+
+// LayerIndexCache implements [backend.LayerIndexCacheProvider].
+func (b *localBackend) LayerIndexCache() *diff.LayerIndexCache {
+	return b.layerIndexCache
 }
 
 func (b *localBackend) Info() backend.Info {
@@ -95,7 +236,13 @@ func (b *localBackend) Info() backend.Info {
 }
 
 func (b *localBackend) Context(ctx context.Context) context.Context {
-	return namespaces.WithNamespace(ctx, b.ns)
+	ctx = namespaces.WithNamespace(ctx, b.ns)
+	l, err := b.currentLease(ctx)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("The blobs are not protected from GC in other processes")
+		return ctx
+	}
+	return leases.WithLease(ctx, l.ID)
 }
 
 func (b *localBackend) ContentStore() content.Store {
@@ -110,25 +257,122 @@ func (b *localBackend) Transfer(ctx context.Context, source interface{}, destina
 	return b.transferrer.Transfer(ctx, source, destination, opts...)
 }
 
+// MaybeGC deletes the lease of the process.
+//
+// When --local-cache-max-size or --local-cache-older-than is specified, MaybeGC also removes the blobs
+// that are no longer referenced, and evicts the images that have not been used for the duration, and
+// the least recently used images while the cache exceeds the size.
+// Otherwise the blobs are kept until `diffoci cache prune`, so that they can be reused in the later runs.
 func (b *localBackend) MaybeGC(ctx context.Context) error {
-	_, err := b.db.GarbageCollect(ctx)
-	return err
+	if b.maxSize == 0 && b.olderThan == 0 {
+		return b.deleteLease(ctx)
+	}
+	report, err := b.Prune(ctx, backend.PruneOptions{
+		All:       b.olderThan > 0,
+		OlderThan: b.olderThan,
+		MaxSize:   b.maxSize,
+	})
+	if err != nil {
+		return err
+	}
+	if report.RemovedBlobs > 0 {
+		log.G(ctx).Debugf("Removed %d blobs (%d bytes), evicted %d images",
+			report.RemovedBlobs, report.ReclaimedSize, len(report.RemovedImages))
+	}
+	return nil
+}
+
+// leasedContentStore adds the blobs to the lease of the process on reading and writing.
+type leasedContentStore struct {
+	content.Store
+	b *localBackend
+}
+
+func (cs *leasedContentStore) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	cs.b.addLeaseResource(ctx, desc.Digest)
+	return cs.Store.ReaderAt(ctx, desc)
+}
+
+func (cs *leasedContentStore) Writer(ctx context.Context, opts ...content.WriterOpt) (content.Writer, error) {
+	var wOpts content.WriterOpts
+	for _, opt := range opts {
+		if err := opt(&wOpts); err != nil {
+			return nil, err
+		}
+	}
+	if wOpts.Desc.Digest != "" {
+		cs.b.addLeaseResource(ctx, wOpts.Desc.Digest)
+	}
+	w, err := cs.Store.Writer(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &leasedWriter{Writer: w, b: cs.b}, nil
+}
+
+type leasedWriter struct {
+	content.Writer
+	b *localBackend
+}
+
+func (w *leasedWriter) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) error {
+	d := expected
+	if d == "" {
+		// The digest of the content written so far, as the writer is not opened with the descriptor
+		d = w.Writer.Digest()
+	}
+	w.b.addLeaseResource(ctx, d)
+	return w.Writer.Commit(ctx, size, expected, opts...)
 }
 
+// labelStore implements [contentlocal.LabelStore].
+// The store is protected by a mutex for goroutines, and by flock for other processes.
 type labelStore struct {
 	dir string
 	mu  sync.RWMutex
 }
 
+// labelStoreLockFile is the name of the lock file in the labels directory.
+const labelStoreLockFile = ".lock"
+
+// cacheLockFile is the name of the lock file in the cache directory.
+// Prune holds the exclusive lock while it lists the leases and deletes the blobs,
+// and addLeaseResource holds the shared lock while it adds a blob to the lease.
+const cacheLockFile = ".lock"
+
+// withFlock calls f while holding flock(2) on lockPath with how (unix.LOCK_SH or unix.LOCK_EX).
+func withFlock(lockPath string, how int, f func() error) error {
+	lockFile, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer lockFile.Close()
+	if err = unix.Flock(int(lockFile.Fd()), how); err != nil {
+		return fmt.Errorf("failed to lock %q: %w", lockPath, err)
+	}
+	defer unix.Flock(int(lockFile.Fd()), unix.LOCK_UN) //nolint:errcheck
+	return f()
+}
+
+// withFlock calls f while holding flock(2) on the lock file of the labels directory.
+func (ls *labelStore) withFlock(how int, f func() error) error {
+	return withFlock(filepath.Join(ls.dir, labelStoreLockFile), how, f)
+}
+
 func (ls *labelStore) filepath(d digest.Digest) string {
 	return filepath.Join(ls.dir, filepath.Clean(d.Algorithm().String()), filepath.Clean(d.Encoded()))
 }
 
-// TODO: flock
 func (ls *labelStore) Get(d digest.Digest) (map[string]string, error) {
 	ls.mu.RLock()
 	defer ls.mu.RUnlock()
-	return ls.getUnlocked(d)
+	var m map[string]string
+	err := ls.withFlock(unix.LOCK_SH, func() error {
+		var err error
+		m, err = ls.getUnlocked(d)
+		return err
+	})
+	return m, err
 }
 
 func (ls *labelStore) getUnlocked(d digest.Digest) (map[string]string, error) {
@@ -147,11 +391,12 @@ func (ls *labelStore) getUnlocked(d digest.Digest) (map[string]string, error) {
 	return m, nil
 }
 
-// TODO: flock
 func (ls *labelStore) Set(d digest.Digest, m map[string]string) error {
 	ls.mu.Lock()
 	defer ls.mu.Unlock()
-	return ls.setUnlocked(d, m)
+	return ls.withFlock(unix.LOCK_EX, func() error {
+		return ls.setUnlocked(d, m)
+	})
 }
 
 func (ls *labelStore) setUnlocked(d digest.Digest, m map[string]string) error {
@@ -170,23 +415,30 @@ func (ls *labelStore) setUnlocked(d digest.Digest, m map[string]string) error {
 	return os.WriteFile(f, b, 0600)
 }
 
-// TODO: flock
 func (ls *labelStore) Update(d digest.Digest, m map[string]string) (map[string]string, error) {
 	ls.mu.Lock()
 	defer ls.mu.Unlock()
-	mm, err := ls.getUnlocked(d)
+	var mm map[string]string
+	err := ls.withFlock(unix.LOCK_EX, func() error {
+		var err error
+		mm, err = ls.getUnlocked(d)
+		if err != nil {
+			return err
+		}
+		if mm == nil {
+			mm = make(map[string]string)
+		}
+		for k, v := range m {
+			if k == "" {
+				delete(mm, k)
+			} else {
+				mm[k] = v
+			}
+		}
+		return ls.setUnlocked(d, mm)
+	})
 	if err != nil {
 		return nil, err
 	}
-	if mm == nil {
-		mm = make(map[string]string)
-	}
-	for k, v := range m {
-		if k == "" {
-			delete(mm, k)
-		} else {
-			mm[k] = v
-		}
-	}
-	return mm, ls.setUnlocked(d, mm)
+	return mm, nil
 }
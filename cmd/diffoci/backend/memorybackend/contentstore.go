@@ -0,0 +1,326 @@
+package memorybackend
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/filters"
+	"github.com/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+type blob struct {
+	info content.Info
+	data []byte
+}
+
+// contentStore implements [content.Store] in memory.
+type contentStore struct {
+	mu      sync.RWMutex
+	blobs   map[digest.Digest]*blob
+	ingests map[string]*writer
+}
+
+// NewContentStore returns an empty in-memory content store.
+func NewContentStore() content.Store {
+	return &contentStore{
+		blobs:   make(map[digest.Digest]*blob),
+		ingests: make(map[string]*writer),
+	}
+}
+
+func (s *contentStore) Info(ctx context.Context, dgst digest.Digest) (content.Info, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	b, ok := s.blobs[dgst]
+	if !ok {
+		return content.Info{}, fmt.Errorf("content %v: %w", dgst, errdefs.ErrNotFound)
+	}
+	return copyInfo(b.info), nil
+}
+
+func copyInfo(info content.Info) content.Info {
+	if info.Labels != nil {
+		labels := make(map[string]string, len(info.Labels))
+		for k, v := range info.Labels {
+			labels[k] = v
+		}
+		info.Labels = labels
+	}
+	return info
+}
+
+func (s *contentStore) Update(ctx context.Context, info content.Info, fieldpaths ...string) (content.Info, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.blobs[info.Digest]
+	if !ok {
+		return content.Info{}, fmt.Errorf("content %v: %w", info.Digest, errdefs.ErrNotFound)
+	}
+	if b.info.Labels == nil {
+		b.info.Labels = make(map[string]string)
+	}
+	if len(fieldpaths) == 0 {
+		b.info.Labels = make(map[string]string)
+		for k, v := range info.Labels {
+			b.info.Labels[k] = v
+		}
+	}
+	for _, path := range fieldpaths {
+		switch {
+		case path == "labels":
+			b.info.Labels = make(map[string]string)
+			for k, v := range info.Labels {
+				b.info.Labels[k] = v
+			}
+		case strings.HasPrefix(path, "labels."):
+			k := strings.TrimPrefix(path, "labels.")
+			if v := info.Labels[k]; v != "" {
+				b.info.Labels[k] = v
+			} else {
+				delete(b.info.Labels, k)
+			}
+		default:
+			return content.Info{}, fmt.Errorf("cannot update %q field on content info %q: %w", path, info.Digest, errdefs.ErrInvalidArgument)
+		}
+	}
+	b.info.UpdatedAt = time.Now()
+	return copyInfo(b.info), nil
+}
+
+func (s *contentStore) Walk(ctx context.Context, fn content.WalkFunc, fs ...string) error {
+	filter, err := filters.ParseAll(fs...)
+	if err != nil {
+		return err
+	}
+	s.mu.RLock()
+	infos := make([]content.Info, 0, len(s.blobs))
+	for _, b := range s.blobs {
+		if filter.Match(content.AdaptInfo(b.info)) {
+			infos = append(infos, copyInfo(b.info))
+		}
+	}
+	s.mu.RUnlock()
+	for _, info := range infos {
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *contentStore) Delete(ctx context.Context, dgst digest.Digest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.blobs[dgst]; !ok {
+		return fmt.Errorf("content %v: %w", dgst, errdefs.ErrNotFound)
+	}
+	delete(s.blobs, dgst)
+	return nil
+}
+
+func (s *contentStore) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	b, ok := s.blobs[desc.Digest]
+	if !ok {
+		return nil, fmt.Errorf("content %v: %w", desc.Digest, errdefs.ErrNotFound)
+	}
+	return &readerAt{Reader: bytes.NewReader(b.data)}, nil
+}
+
+type readerAt struct {
+	*bytes.Reader
+}
+
+func (ra *readerAt) Close() error {
+	return nil
+}
+
+func (s *contentStore) Status(ctx context.Context, ref string) (content.Status, error) {
+	s.mu.RLock()
+	w, ok := s.ingests[ref]
+	s.mu.RUnlock()
+	if !ok {
+		return content.Status{}, fmt.Errorf("ingest %q: %w", ref, errdefs.ErrNotFound)
+	}
+	return w.Status()
+}
+
+// ListStatuses supports a regular expression for the ref, as in the local content store.
+func (s *contentStore) ListStatuses(ctx context.Context, filters ...string) ([]content.Status, error) {
+	var re *regexp.Regexp
+	if len(filters) > 1 {
+		return nil, fmt.Errorf("multiple filters are not supported: %w", errdefs.ErrNotImplemented)
+	}
+	if len(filters) == 1 && filters[0] != "" {
+		var err error
+		re, err = regexp.Compile(filters[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter %q: %w", filters[0], errdefs.ErrInvalidArgument)
+		}
+	}
+	// Do not hold s.mu while calling w.Status, as w.Commit locks w.mu and s.mu in this order
+	s.mu.RLock()
+	var ws []*writer
+	for ref, w := range s.ingests {
+		if re == nil || re.MatchString(ref) {
+			ws = append(ws, w)
+		}
+	}
+	s.mu.RUnlock()
+	var res []content.Status
+	for _, w := range ws {
+		st, err := w.Status()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, st)
+	}
+	return res, nil
+}
+
+func (s *contentStore) Abort(ctx context.Context, ref string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.ingests[ref]; !ok {
+		return fmt.Errorf("ingest %q: %w", ref, errdefs.ErrNotFound)
+	}
+	delete(s.ingests, ref)
+	return nil
+}
+
+func (s *contentStore) Writer(ctx context.Context, opts ...content.WriterOpt) (content.Writer, error) {
+	var wOpts content.WriterOpts
+	for _, opt := range opts {
+		if err := opt(&wOpts); err != nil {
+			return nil, err
+		}
+	}
+	if wOpts.Ref == "" {
+		return nil, fmt.Errorf("ref must not be empty: %w", errdefs.ErrInvalidArgument)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if wOpts.Desc.Digest != "" {
+		if _, ok := s.blobs[wOpts.Desc.Digest]; ok {
+			return nil, fmt.Errorf("content %v: %w", wOpts.Desc.Digest, errdefs.ErrAlreadyExists)
+		}
+	}
+	if w, ok := s.ingests[wOpts.Ref]; ok {
+		// Resume the ingestion
+		return w, nil
+	}
+	now := time.Now()
+	w := &writer{
+		s:         s,
+		ref:       wOpts.Ref,
+		total:     wOpts.Desc.Size,
+		expected:  wOpts.Desc.Digest,
+		startedAt: now,
+		updatedAt: now,
+	}
+	s.ingests[wOpts.Ref] = w
+	return w, nil
+}
+
+// writer implements [content.Writer].
+type writer struct {
+	s         *contentStore
+	mu        sync.Mutex
+	ref       string
+	buf       bytes.Buffer
+	total     int64
+	expected  digest.Digest
+	startedAt time.Time
+	updatedAt time.Time
+	committed digest.Digest
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.updatedAt = time.Now()
+	return w.buf.Write(p)
+}
+
+// Close keeps the ingestion, so that it can be resumed.
+func (w *writer) Close() error {
+	return nil
+}
+
+func (w *writer) Digest() digest.Digest {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.committed != "" {
+		return w.committed
+	}
+	return digest.FromBytes(w.buf.Bytes())
+}
+
+func (w *writer) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	data := bytes.Clone(w.buf.Bytes())
+	w.s.mu.Lock()
+	defer w.s.mu.Unlock()
+	delete(w.s.ingests, w.ref)
+	if size > 0 && size != int64(len(data)) {
+		return fmt.Errorf("unexpected commit size %d, expected %d: %w", len(data), size, errdefs.ErrFailedPrecondition)
+	}
+	dgst := digest.FromBytes(data)
+	if expected != "" {
+		dgst = expected.Algorithm().FromBytes(data)
+		if dgst != expected {
+			return fmt.Errorf("unexpected commit digest %s, expected %s: %w", dgst, expected, errdefs.ErrFailedPrecondition)
+		}
+	}
+	w.committed = dgst
+	if _, ok := w.s.blobs[dgst]; ok {
+		return fmt.Errorf("content %v: %w", dgst, errdefs.ErrAlreadyExists)
+	}
+	now := time.Now()
+	info := content.Info{
+		Digest:    dgst,
+		Size:      int64(len(data)),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	for _, opt := range opts {
+		if err := opt(&info); err != nil {
+			return err
+		}
+	}
+	w.s.blobs[dgst] = &blob{info: copyInfo(info), data: data}
+	return nil
+}
+
+func (w *writer) Status() (content.Status, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return content.Status{
+		Ref:       w.ref,
+		Offset:    int64(w.buf.Len()),
+		Total:     w.total,
+		Expected:  w.expected,
+		StartedAt: w.startedAt,
+		UpdatedAt: w.updatedAt,
+	}, nil
+}
+
+func (w *writer) Truncate(size int64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if size < 0 || size > int64(w.buf.Len()) {
+		return fmt.Errorf("invalid truncate size %d: %w", size, errdefs.ErrInvalidArgument)
+	}
+	w.buf.Truncate(int(size))
+	return nil
+}
@@ -0,0 +1,257 @@
+package memorybackend
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestContentStoreRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	testCases := []string{"", "foo", strings.Repeat("bar", 100000)}
+	cs := NewContentStore()
+	for _, s := range testCases {
+		desc := ocispec.Descriptor{Digest: digest.FromString(s), Size: int64(len(s))}
+		if err := content.WriteBlob(ctx, cs, "ref-"+desc.Digest.String(), strings.NewReader(s), desc); err != nil {
+			t.Fatalf("%d bytes: %v", len(s), err)
+		}
+		b, err := content.ReadBlob(ctx, cs, desc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != s {
+			t.Fatalf("%d bytes: unexpected content", len(s))
+		}
+		info, err := cs.Info(ctx, desc.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size != desc.Size {
+			t.Fatalf("expected size %d, got %d", desc.Size, info.Size)
+		}
+		// WriteBlob ignores ErrAlreadyExists
+		if err = content.WriteBlob(ctx, cs, "ref-"+desc.Digest.String(), strings.NewReader(s), desc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var walked int
+	if err := cs.Walk(ctx, func(content.Info) error {
+		walked++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if walked != len(testCases) {
+		t.Fatalf("expected %d blobs, got %d", len(testCases), walked)
+	}
+	if statuses, err := cs.ListStatuses(ctx); err != nil || len(statuses) != 0 {
+		t.Fatalf("expected no ingestion, got %v (%v)", statuses, err)
+	}
+	for _, s := range testCases {
+		if err := cs.Delete(ctx, digest.FromString(s)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cs.ReaderAt(ctx, ocispec.Descriptor{Digest: digest.FromString(s)}); !errors.Is(err, errdefs.ErrNotFound) {
+			t.Fatalf("expected ErrNotFound, got %v", err)
+		}
+	}
+}
+
+func TestContentStoreCommitErrors(t *testing.T) {
+	ctx := context.Background()
+	testCases := []struct {
+		name     string
+		data     string
+		size     int64
+		expected digest.Digest
+		err      error
+	}{
+		{"ok", "foo", 3, digest.FromString("foo"), nil},
+		{"ok (unknown size and digest)", "bar", 0, "", nil},
+		{"size mismatch", "baz", 4, "", errdefs.ErrFailedPrecondition},
+		{"digest mismatch", "qux", 3, digest.FromString("QUX"), errdefs.ErrFailedPrecondition},
+		{"already exists", "foo", 3, "", errdefs.ErrAlreadyExists},
+	}
+	cs := NewContentStore()
+	for _, tc := range testCases {
+		w, err := cs.Writer(ctx, content.WithRef(tc.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = w.Write([]byte(tc.data)); err != nil {
+			t.Fatal(err)
+		}
+		err = w.Commit(ctx, tc.size, tc.expected)
+		switch {
+		case tc.err == nil && err != nil:
+			t.Errorf("%s: %v", tc.name, err)
+		case tc.err != nil && !errors.Is(err, tc.err):
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.err, err)
+		}
+		// The ingestion is removed even on failures
+		if _, err = cs.Status(ctx, tc.name); !errors.Is(err, errdefs.ErrNotFound) {
+			t.Errorf("%s: expected the ingestion to be removed, got %v", tc.name, err)
+		}
+	}
+	if _, err := cs.Writer(ctx); !errors.Is(err, errdefs.ErrInvalidArgument) {
+		t.Fatalf("expected ErrInvalidArgument for an empty ref, got %v", err)
+	}
+	if _, err := cs.Writer(ctx, content.WithRef("foo"), content.WithDescriptor(ocispec.Descriptor{Digest: digest.FromString("foo")})); !errors.Is(err, errdefs.ErrAlreadyExists) {
+		t.Fatalf("expected ErrAlreadyExists, got %v", err)
+	}
+}
+
+func TestContentStoreResume(t *testing.T) {
+	ctx := context.Background()
+	cs := NewContentStore()
+	w, err := cs.Writer(ctx, content.WithRef("ref"), content.WithDescriptor(ocispec.Descriptor{Size: 6}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write([]byte("fooXX")); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Truncate(3); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	statuses, err := cs.ListStatuses(ctx, "^re")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 1 || statuses[0].Offset != 3 || statuses[0].Total != 6 {
+		t.Fatalf("unexpected statuses %+v", statuses)
+	}
+	w, err = cs.Writer(ctx, content.WithRef("ref"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write([]byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Commit(ctx, 6, digest.FromString("foobar")); err != nil {
+		t.Fatal(err)
+	}
+	if w.Digest() != digest.FromString("foobar") {
+		t.Fatalf("unexpected digest %s", w.Digest())
+	}
+	b, err := content.ReadBlob(ctx, cs, ocispec.Descriptor{Digest: digest.FromString("foobar"), Size: 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, []byte("foobar")) {
+		t.Fatalf("unexpected content %q", b)
+	}
+
+	if _, err = cs.Writer(ctx, content.WithRef("aborted")); err != nil {
+		t.Fatal(err)
+	}
+	if err = cs.Abort(ctx, "aborted"); err != nil {
+		t.Fatal(err)
+	}
+	if err = cs.Abort(ctx, "aborted"); !errors.Is(err, errdefs.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestContentStoreUpdate(t *testing.T) {
+	ctx := context.Background()
+	cs := NewContentStore()
+	dgst := digest.FromString("foo")
+	if err := content.WriteBlob(ctx, cs, "ref", strings.NewReader("foo"), ocispec.Descriptor{Digest: dgst, Size: 3},
+		content.WithLabels(map[string]string{"a": "1", "b": "2"})); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		labels     map[string]string
+		fieldpaths []string
+		expected   map[string]string
+	}{
+		{map[string]string{"a": "10", "c": "3"}, []string{"labels.a"}, map[string]string{"a": "10", "b": "2"}},
+		{nil, []string{"labels.b"}, map[string]string{"a": "10"}},
+		{map[string]string{"c": "3"}, []string{"labels"}, map[string]string{"c": "3"}},
+		{map[string]string{"d": "4"}, nil, map[string]string{"d": "4"}},
+	}
+	for i, tc := range testCases {
+		info, err := cs.Update(ctx, content.Info{Digest: dgst, Labels: tc.labels}, tc.fieldpaths...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(info.Labels) != len(tc.expected) {
+			t.Fatalf("#%d: expected %v, got %v", i, tc.expected, info.Labels)
+		}
+		for k, v := range tc.expected {
+			if info.Labels[k] != v {
+				t.Fatalf("#%d: expected %v, got %v", i, tc.expected, info.Labels)
+			}
+		}
+		// The returned labels must not alias the stored labels
+		info.Labels["mutated"] = "1"
+		if stored, _ := cs.Info(ctx, dgst); stored.Labels["mutated"] != "" {
+			t.Fatalf("#%d: the labels are aliased", i)
+		}
+	}
+	if _, err := cs.Update(ctx, content.Info{Digest: dgst}, "size"); !errors.Is(err, errdefs.ErrInvalidArgument) {
+		t.Fatalf("expected ErrInvalidArgument, got %v", err)
+	}
+}
+
+func TestContentStoreWalkFilters(t *testing.T) {
+	ctx := context.Background()
+	cs := NewContentStore()
+	blobs := map[string]map[string]string{
+		"foo": {"containerd.io/distribution.source.docker.io": "library/foo"},
+		"bar": {"containerd.io/uncompressed": digest.FromString("baz").String()},
+		"qux": nil,
+	}
+	for s, labels := range blobs {
+		desc := ocispec.Descriptor{Digest: digest.FromString(s), Size: int64(len(s))}
+		if err := content.WriteBlob(ctx, cs, s, strings.NewReader(s), desc, content.WithLabels(labels)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testCases := []struct {
+		filters  []string
+		expected []string
+	}{
+		{nil, []string{"bar", "foo", "qux"}},
+		{[]string{"digest==" + digest.FromString("foo").String()}, []string{"foo"}},
+		{[]string{`labels."containerd.io/uncompressed"==` + digest.FromString("baz").String()}, []string{"bar"}},
+		{[]string{`labels."containerd.io/uncompressed"`}, []string{"bar"}},
+		// The filters are ORed
+		{[]string{`labels."containerd.io/uncompressed"`, "digest==" + digest.FromString("qux").String()}, []string{"bar", "qux"}},
+		{[]string{"digest==" + digest.FromString("missing").String()}, nil},
+	}
+	for _, tc := range testCases {
+		t.Run(strings.Join(tc.filters, ","), func(t *testing.T) {
+			var got []string
+			if err := cs.Walk(ctx, func(info content.Info) error {
+				for s := range blobs {
+					if digest.FromString(s) == info.Digest {
+						got = append(got, s)
+					}
+				}
+				return nil
+			}, tc.filters...); err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(tc.expected, ",") {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+	if err := cs.Walk(ctx, func(content.Info) error { return nil }, "labels.=="); err == nil {
+		t.Error("expected an error for an invalid filter")
+	}
+}
@@ -0,0 +1,90 @@
+package memorybackend
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/errdefs"
+)
+
+// imageStore implements [images.Store] in memory.
+type imageStore struct {
+	mu     sync.RWMutex
+	images map[string]images.Image
+}
+
+// NewImageStore returns an empty in-memory image store.
+func NewImageStore() images.Store {
+	return &imageStore{
+		images: make(map[string]images.Image),
+	}
+}
+
+func (s *imageStore) Get(ctx context.Context, name string) (images.Image, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	img, ok := s.images[name]
+	if !ok {
+		return images.Image{}, fmt.Errorf("image %q: %w", name, errdefs.ErrNotFound)
+	}
+	return img, nil
+}
+
+// List does not support filters.
+// The images are sorted by name.
+func (s *imageStore) List(ctx context.Context, filters ...string) ([]images.Image, error) {
+	if len(filters) > 0 {
+		return nil, fmt.Errorf("filters are not supported: %w", errdefs.ErrNotImplemented)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	res := make([]images.Image, 0, len(s.images))
+	for _, img := range s.images {
+		res = append(res, img)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res, nil
+}
+
+func (s *imageStore) Create(ctx context.Context, image images.Image) (images.Image, error) {
+	if image.Name == "" {
+		return images.Image{}, fmt.Errorf("image name must not be empty: %w", errdefs.ErrInvalidArgument)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.images[image.Name]; ok {
+		return images.Image{}, fmt.Errorf("image %q: %w", image.Name, errdefs.ErrAlreadyExists)
+	}
+	now := time.Now()
+	image.CreatedAt, image.UpdatedAt = now, now
+	s.images[image.Name] = image
+	return image, nil
+}
+
+// Update ignores fieldpaths, and replaces the whole image except CreatedAt.
+func (s *imageStore) Update(ctx context.Context, image images.Image, fieldpaths ...string) (images.Image, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.images[image.Name]
+	if !ok {
+		return images.Image{}, fmt.Errorf("image %q: %w", image.Name, errdefs.ErrNotFound)
+	}
+	image.CreatedAt = old.CreatedAt
+	image.UpdatedAt = time.Now()
+	s.images[image.Name] = image
+	return image, nil
+}
+
+func (s *imageStore) Delete(ctx context.Context, name string, opts ...images.DeleteOpt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.images[name]; !ok {
+		return fmt.Errorf("image %q: %w", name, errdefs.ErrNotFound)
+	}
+	delete(s.images, name)
+	return nil
+}
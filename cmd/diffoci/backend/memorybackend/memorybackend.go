@@ -0,0 +1,62 @@
+// Package memorybackend provides a backend that keeps everything in memory.
+// Useful for tests, and for one-shot comparisons of image archives.
+package memorybackend
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/pkg/transfer"
+	transferlocal "github.com/containerd/containerd/pkg/transfer/local"
+	"github.com/reproducible-containers/diffoci/cmd/diffoci/backend"
+)
+
+const Name = "memory"
+
+// New creates an empty in-memory backend.
+func New() backend.Backend {
+	b := &memoryBackend{
+		contentStore: NewContentStore(),
+		imageStore:   NewImageStore(),
+	}
+	b.transferrer = transferlocal.NewTransferService(backend.NopLeaseManager{},
+		b.contentStore,
+		b.imageStore,
+		&transferlocal.TransferConfig{},
+	)
+	return b
+}
+
+type memoryBackend struct {
+	contentStore content.Store
+	imageStore   images.Store
+	transferrer  transfer.Transferrer
+}
+
+func (b *memoryBackend) Info() backend.Info {
+	return backend.Info{
+		Name: Name,
+	}
+}
+
+func (b *memoryBackend) Context(ctx context.Context) context.Context {
+	return ctx
+}
+
+func (b *memoryBackend) ContentStore() content.Store {
+	return b.contentStore
+}
+
+func (b *memoryBackend) ImageService() images.Store {
+	return b.imageStore
+}
+
+func (b *memoryBackend) Transfer(ctx context.Context, source interface{}, destination interface{}, opts ...transfer.Opt) error {
+	return b.transferrer.Transfer(ctx, source, destination, opts...)
+}
+
+// MaybeGC is a no-op, as the memory is released on exit.
+func (b *memoryBackend) MaybeGC(ctx context.Context) error {
+	return nil
+}
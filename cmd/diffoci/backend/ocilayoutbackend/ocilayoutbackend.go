@@ -0,0 +1,237 @@
+package ocilayoutbackend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/containerd/containerd/content"
+	contentlocal "github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/pkg/transfer"
+	transferlocal "github.com/containerd/containerd/pkg/transfer/local"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/reproducible-containers/diffoci/cmd/diffoci/backend"
+	"github.com/reproducible-containers/diffoci/pkg/envutil"
+	"github.com/reproducible-containers/diffoci/pkg/localpathutil"
+	"github.com/reproducible-containers/diffoci/pkg/ocilayout"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+const Name = "oci-layout"
+
+func AddFlags(flags *pflag.FlagSet) {
+	flags.String("oci-layout-dir", envutil.String("DIFFOCI_OCI_LAYOUT_DIR", ""),
+		"OCI image layout directory for the oci-layout backend; created if missing [$DIFFOCI_OCI_LAYOUT_DIR]")
+}
+
+func New(cmd *cobra.Command) (backend.Backend, error) {
+	flags := cmd.Flags()
+	dir, err := flags.GetString("oci-layout-dir")
+	if err != nil {
+		return nil, err
+	}
+	if dir == "" {
+		return nil, errors.New("backend \"oci-layout\" requires --oci-layout-dir to be specified")
+	}
+	dir, err = localpathutil.Expand(dir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid oci-layout-dir path %q: %w", dir, err)
+	}
+	return newBackend(dir)
+}
+
+func newBackend(dir string) (*ociLayoutBackend, error) {
+	if err := ocilayout.Init(dir); err != nil {
+		return nil, err
+	}
+	b := &ociLayoutBackend{
+		dir:        dir,
+		imageStore: ocilayout.NewImageStore(dir),
+	}
+	if _, err := os.Stat(filepath.Join(dir, "ingest")); err == nil {
+		b.ingestExisted = true
+	}
+	// The labels are used only during transfers, so they are not persisted.
+	labeledStore, err := contentlocal.NewLabeledStore(dir, &memoryLabelStore{m: make(map[digest.Digest]map[string]string)})
+	if err != nil {
+		return nil, err
+	}
+	b.contentStore = &trackingStore{Store: labeledStore, written: make(map[digest.Digest]struct{})}
+	b.transferrer = transferlocal.NewTransferService(backend.NopLeaseManager{},
+		b.contentStore,
+		b.imageStore,
+		&transferlocal.TransferConfig{},
+	)
+	return b, nil
+}
+
+type ociLayoutBackend struct {
+	dir           string
+	contentStore  *trackingStore
+	imageStore    images.Store
+	transferrer   transfer.Transferrer
+	ingestExisted bool
+}
+
+func (b *ociLayoutBackend) Info() backend.Info {
+	return backend.Info{
+		Name: Name,
+	}
+}
+
+func (b *ociLayoutBackend) Context(ctx context.Context) context.Context {
+	return ctx
+}
+
+func (b *ociLayoutBackend) ContentStore() content.Store {
+	return b.contentStore
+}
+
+func (b *ociLayoutBackend) ImageService() images.Store {
+	return b.imageStore
+}
+
+func (b *ociLayoutBackend) Transfer(ctx context.Context, source interface{}, destination interface{}, opts ...transfer.Opt) error {
+	return b.transferrer.Transfer(ctx, source, destination, opts...)
+}
+
+// MaybeGC removes the blobs written by this process (e.g., the blobs of the temporary images)
+// that are no longer reachable from index.json.
+// The other blobs are never removed, as the directory is owned by the user.
+func (b *ociLayoutBackend) MaybeGC(ctx context.Context) error {
+	written := b.contentStore.writtenBlobs()
+	if len(written) == 0 {
+		return nil
+	}
+	idx, err := ocilayout.ReadIndex(b.dir)
+	if err != nil {
+		return err
+	}
+	reachable := make(map[digest.Digest]struct{})
+	children := images.ChildrenHandler(b.contentStore)
+	handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		reachable[desc.Digest] = struct{}{}
+		descs, err := children(ctx, desc)
+		if errors.Is(err, errdefs.ErrNotFound) {
+			// e.g., the manifests for other platforms are not pulled
+			return nil, nil
+		}
+		return descs, err
+	})
+	if err = images.Walk(ctx, handler, idx.Manifests...); err != nil {
+		return err
+	}
+	var errs []error
+	for _, d := range written {
+		if _, ok := reachable[d]; ok {
+			continue
+		}
+		log.G(ctx).Debugf("Removing unreachable blob %s", d)
+		if err := b.contentStore.Delete(ctx, d); err != nil && !errors.Is(err, errdefs.ErrNotFound) {
+			errs = append(errs, err)
+		}
+		b.contentStore.forget(d)
+	}
+	if !b.ingestExisted {
+		// The ingest directory is created by the content store, but not a part of the OCI image layout.
+		// Remove it if it is empty.
+		_ = os.Remove(filepath.Join(b.dir, "ingest"))
+	}
+	return errors.Join(errs...)
+}
+
+// trackingStore records the blobs written by this process.
+// The blobs that already existed are not recorded.
+type trackingStore struct {
+	content.Store
+	written map[digest.Digest]struct{}
+	mu      sync.Mutex
+}
+
+func (s *trackingStore) Writer(ctx context.Context, opts ...content.WriterOpt) (content.Writer, error) {
+	w, err := s.Store.Writer(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &trackingWriter{Writer: w, s: s}, nil
+}
+
+func (s *trackingStore) writtenBlobs() []digest.Digest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make([]digest.Digest, 0, len(s.written))
+	for d := range s.written {
+		res = append(res, d)
+	}
+	return res
+}
+
+func (s *trackingStore) forget(d digest.Digest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.written, d)
+}
+
+type trackingWriter struct {
+	content.Writer
+	s *trackingStore
+}
+
+// Commit records the blob, unless the blob already exists.
+func (w *trackingWriter) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) error {
+	if err := w.Writer.Commit(ctx, size, expected, opts...); err != nil {
+		return err
+	}
+	d := expected
+	if d == "" {
+		d = w.Writer.Digest()
+	}
+	w.s.mu.Lock()
+	w.s.written[d] = struct{}{}
+	w.s.mu.Unlock()
+	return nil
+}
+
+type memoryLabelStore struct {
+	m  map[digest.Digest]map[string]string
+	mu sync.Mutex
+}
+
+func (ls *memoryLabelStore) Get(d digest.Digest) (map[string]string, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return ls.m[d], nil
+}
+
+func (ls *memoryLabelStore) Set(d digest.Digest, m map[string]string) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.m[d] = m
+	return nil
+}
+
+func (ls *memoryLabelStore) Update(d digest.Digest, m map[string]string) (map[string]string, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	mm := ls.m[d]
+	if mm == nil {
+		mm = make(map[string]string)
+	}
+	for k, v := range m {
+		if v == "" {
+			delete(mm, k)
+		} else {
+			mm[k] = v
+		}
+	}
+	ls.m[d] = mm
+	return mm, nil
+}
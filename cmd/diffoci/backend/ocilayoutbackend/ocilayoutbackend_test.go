@@ -0,0 +1,76 @@
+package ocilayoutbackend
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func writeBlob(t *testing.T, cs content.Store, s string) ocispec.Descriptor {
+	t.Helper()
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageConfig,
+		Digest:    digest.FromString(s),
+		Size:      int64(len(s)),
+	}
+	if err := content.WriteBlob(context.Background(), cs, desc.Digest.String(), strings.NewReader(s), desc); err != nil {
+		t.Fatal(err)
+	}
+	return desc
+}
+
+func TestMaybeGC(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	// The blobs of the user, which are not reachable from index.json
+	b, err := newBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userBlob := writeBlob(t, b.contentStore, "user")
+	sharedBlob := writeBlob(t, b.contentStore, "shared")
+	if err = os.Remove(filepath.Join(dir, "ingest")); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = newBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempBlob := writeBlob(t, b.contentStore, "temp")
+	writeBlob(t, b.contentStore, "shared")
+	keptBlob := writeBlob(t, b.contentStore, "kept")
+	if _, err = b.imageStore.Create(ctx, images.Image{Name: "kept", Target: keptBlob}); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.MaybeGC(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		desc   ocispec.Descriptor
+		exists bool
+	}{
+		{userBlob, true},
+		{sharedBlob, true},
+		{keptBlob, true},
+		{tempBlob, false},
+	}
+	for _, tc := range testCases {
+		_, err := os.Stat(filepath.Join(dir, "blobs", tc.desc.Digest.Algorithm().String(), tc.desc.Digest.Encoded()))
+		if exists := err == nil; exists != tc.exists {
+			t.Errorf("blob %s: expected exists=%v, got %v", tc.desc.Digest, tc.exists, err)
+		}
+	}
+	if _, err = os.Stat(filepath.Join(dir, "ingest")); !os.IsNotExist(err) {
+		t.Errorf("expected the ingest directory to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"text/tabwriter"
+
+	"github.com/docker/go-units"
+	"github.com/reproducible-containers/diffoci/cmd/diffoci/backend"
+	"github.com/reproducible-containers/diffoci/cmd/diffoci/backend/backendmanager"
+	"github.com/spf13/cobra"
+)
+
+func NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:                   "cache",
+		Short:                 "Manage the cache of the backend",
+		Args:                  cobra.NoArgs,
+		DisableFlagsInUseLine: true,
+	}
+	cmd.AddCommand(
+		newDUCommand(),
+		newPruneCommand(),
+	)
+	return cmd
+}
+
+func newDUCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:                   "du",
+		Short:                 "Display the disk usage of the cache",
+		Args:                  cobra.NoArgs,
+		RunE:                  duAction,
+		DisableFlagsInUseLine: true,
+	}
+	flags := cmd.Flags()
+	flags.Bool("json", false, "Display the result as JSON")
+	return cmd
+}
+
+func newPruneCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Remove the blobs that are not referenced by images",
+		Long: `Remove the blobs that are not referenced by images.
+
+With --all, the images are removed too.
+With --older-than, only the images and the blobs that have not been used for the duration are removed.
+`,
+		Args:                  cobra.NoArgs,
+		RunE:                  pruneAction,
+		DisableFlagsInUseLine: true,
+	}
+	flags := cmd.Flags()
+	flags.Bool("all", false, "Remove the images too")
+	flags.Duration("older-than", 0, "Remove only the images and the blobs that have not been used for the duration (e.g., \"168h\")")
+	flags.Bool("json", false, "Display the result as JSON")
+	return cmd
+}
+
+func cacheManager(cmd *cobra.Command) (backend.CacheManager, error) {
+	b, err := backendmanager.NewBackend(cmd)
+	if err != nil {
+		return nil, err
+	}
+	cm, ok := b.(backend.CacheManager)
+	if !ok {
+		return nil, fmt.Errorf("backend %q does not manage a cache", b.Info().Name)
+	}
+	return cm, nil
+}
+
+func duAction(cmd *cobra.Command, args []string) error {
+	flags := cmd.Flags()
+	flagJSON, err := flags.GetBool("json")
+	if err != nil {
+		return err
+	}
+	cm, err := cacheManager(cmd)
+	if err != nil {
+		return err
+	}
+	du, err := cm.DiskUsage(cmd.Context())
+	if err != nil {
+		return err
+	}
+	w := cmd.OutOrStdout()
+	if flagJSON {
+		b, err := json.MarshalIndent(du, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, string(b))
+		return nil
+	}
+	tw := tabwriter.NewWriter(w, 4, 8, 4, ' ', 0)
+	defer tw.Flush()
+	fmt.Fprintln(tw, "IMAGES\tBLOBS\tSIZE\tRECLAIMABLE")
+	fmt.Fprintf(tw, "%d\t%d\t%s\t%s\n", du.Images, du.Blobs, units.BytesSize(float64(du.Size)), units.BytesSize(float64(du.ReclaimableSize)))
+	return nil
+}
+
+func pruneAction(cmd *cobra.Command, args []string) error {
+	flags := cmd.Flags()
+	var opts backend.PruneOptions
+	var err error
+	opts.All, err = flags.GetBool("all")
+	if err != nil {
+		return err
+	}
+	opts.OlderThan, err = flags.GetDuration("older-than")
+	if err != nil {
+		return err
+	}
+	flagJSON, err := flags.GetBool("json")
+	if err != nil {
+		return err
+	}
+	cm, err := cacheManager(cmd)
+	if err != nil {
+		return err
+	}
+	report, err := cm.Prune(cmd.Context(), opts)
+	if err != nil {
+		return err
+	}
+	w := cmd.OutOrStdout()
+	if flagJSON {
+		b, err := json.MarshalIndent(report, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, string(b))
+		return nil
+	}
+	for _, name := range report.RemovedImages {
+		fmt.Fprintf(w, "Removed image: %s\n", name)
+	}
+	fmt.Fprintf(w, "Removed %d blobs, reclaimed %s\n", report.RemovedBlobs, units.BytesSize(float64(report.ReclaimedSize)))
+	fmt.Fprintf(w, "Remaining: %d blobs, %s\n", report.RemainingBlobs, units.BytesSize(float64(report.RemainingSize)))
+	return nil
+}
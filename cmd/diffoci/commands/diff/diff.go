@@ -1,14 +1,18 @@
 package diff
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/containerd/errdefs"
 	"github.com/containerd/log"
 	"github.com/containerd/platforms"
+	"github.com/docker/go-units"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/reproducible-containers/diffoci/cmd/diffoci/backend"
 	"github.com/reproducible-containers/diffoci/cmd/diffoci/backend/backendmanager"
 	"github.com/reproducible-containers/diffoci/cmd/diffoci/flagutil"
 	"github.com/reproducible-containers/diffoci/cmd/diffoci/imagegetter"
@@ -16,6 +20,7 @@ import (
 	"github.com/reproducible-containers/diffoci/pkg/localpathutil"
 	"github.com/reproducible-containers/diffoci/pkg/platformutil"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 const Example = `  # Basic
@@ -26,6 +31,15 @@ const Example = `  # Basic
 
   # Compare local Docker images
   diffoci diff --semantic docker://foo docker://bar
+
+  # Compare image archives (Docker or OCI) without loading them
+  diffoci diff --semantic oci-archive:./foo.tar docker-archive:./bar.tar.gz
+
+  # Compare images in OCI layout directories
+  diffoci diff --semantic oci-layout:///tmp/foo:latest oci-layout:///tmp/bar:latest
+
+  # Compare an image in the "k8s.io" namespace of containerd with an image in the local cache
+  diffoci diff --semantic containerd://k8s.io/example.com/app:1 local://example.com/app:1
 `
 
 func NewCommand() *cobra.Command {
@@ -34,45 +48,53 @@ func NewCommand() *cobra.Command {
 		Short:   "Diff images",
 		Example: Example,
 		Args:    cobra.ExactArgs(2),
-
-		PreRunE: func(cmd *cobra.Command, args []string) error {
-			flags := cmd.Flags()
-			if semantic, _ := cmd.Flags().GetBool("semantic"); semantic {
-				flagNames := []string{
-					"ignore-history",
-					"ignore-file-order",
-					"ignore-file-mode-redundant-bits",
-					"ignore-file-timestamps",
-					"ignore-image-timestamps",
-					"ignore-image-name",
-					"ignore-tar-format",
-					"treat-canonical-paths-equal",
-				}
-				for _, f := range flagNames {
-					if err := flags.Set(f, "true"); err != nil {
-						return err
-					}
-				}
-			}
-			if ignoreTimestamps, _ := cmd.Flags().GetBool("ignore-timestamps"); ignoreTimestamps {
-				flagNames := []string{
-					"ignore-file-timestamps",
-					"ignore-image-timestamps",
-				}
-				for _, f := range flagNames {
-					if err := flags.Set(f, "true"); err != nil {
-						return err
-					}
-				}
-			}
-			return nil
-		},
-		RunE: action,
+		PreRunE: preRunE,
+		RunE:    action,
 
 		DisableFlagsInUseLine: true,
 	}
+	flags := cmd.Flags()
+	addFlags(flags)
+	flags.Bool("use-snapshots", false, "Compare the unpacked snapshots of the layers instead of decompressing the layer blobs (containerd backend only; EXPERIMENTAL)")
+	flags.Bool("flatten", false, "Compare the root filesystems flattened from the layers, instead of comparing each pair of the layers")
+	flags.Bool("layer-index-cache", true, "Cache the indexes of the layers, so that the layers are not decompressed again (local backend only)")
+	return cmd
+}
 
+func preRunE(cmd *cobra.Command, args []string) error {
 	flags := cmd.Flags()
+	if semantic, _ := cmd.Flags().GetBool("semantic"); semantic {
+		flagNames := []string{
+			"ignore-history",
+			"ignore-file-order",
+			"ignore-file-mode-redundant-bits",
+			"ignore-file-timestamps",
+			"ignore-image-timestamps",
+			"ignore-image-name",
+			"ignore-tar-format",
+			"treat-canonical-paths-equal",
+		}
+		for _, f := range flagNames {
+			if err := flags.Set(f, "true"); err != nil {
+				return err
+			}
+		}
+	}
+	if ignoreTimestamps, _ := cmd.Flags().GetBool("ignore-timestamps"); ignoreTimestamps {
+		flagNames := []string{
+			"ignore-file-timestamps",
+			"ignore-image-timestamps",
+		}
+		for _, f := range flagNames {
+			if err := flags.Set(f, "true"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func addFlags(flags *pflag.FlagSet) {
 	flagutil.AddPlatformFlags(flags)
 	flags.Bool("ignore-timestamps", false, "Ignore timestamps - Alias for --ignore-*-timestamps=true")
 	flags.Bool("ignore-history", false, "Ignore history")
@@ -83,105 +105,216 @@ func NewCommand() *cobra.Command {
 	flags.Bool("ignore-image-name", false, "Ignore image name annotation")
 	flags.Bool("ignore-tar-format", false, "Ignore tar format")
 	flags.Bool("treat-canonical-paths-equal", false, "Treat leading `./` `/` `` in file paths as canonical")
+	flags.Bool("ignore-elf-build-id", false, "Ignore ELF files that only differ in the build IDs (not implied by --semantic)")
+	flags.Bool("ignore-debug-sections", false, "Ignore ELF files that only differ in the debug sections (not implied by --semantic)")
+	flags.StringSlice("normalize", nil, "Normalize the contents of the files in the nondeterministic formats before comparing them ("+strings.Join(diff.NormalizerNames(), ",")+"; not implied by --semantic)")
 	flags.Bool("semantic", false, "[Recommended] Alias for --ignore-*=true --treat-canonical-paths-equal")
 
 	flags.Bool("verbose", false, "Verbose output")
 	flags.String("report-file", "", "Create a report file to the specified path (EXPERIMENTAL)")
 	flags.String("report-dir", "", "Create a detailed report in the specified directory")
-	flags.String("pull", imagegetter.PullMissing, "Pull mode (always|missing|never)")
+	flags.String("pull", imagegetter.PullMissing, "Pull mode (always|missing|never|lazy)")
+	flags.Bool("keep", false, "Keep the temporary images loaded from archives (oci-archive:, docker-archive:)")
 	flags.Float64("max-scale", 1.0, "Scale factor for maximum values (e.g., maxTarBlobSize = 4GiB)")
-	return cmd
+	flags.Int("parallel", 1, "Maximum number of manifests, layers, and inputs to be compared concurrently (e.g., the number of the CPUs). "+
+		"The peak memory usage grows with the number of the layers loaded at once")
+	flags.String("memory-budget", "0", "Approximate memory for retaining the tar entries of each pair of layers (e.g., \"512MiB\"). The excess is spilled to temporary files. 0 means unlimited")
+	flags.String("text-diff-max-size", "64KiB", "Maximum size of the text files to be compared with a unified diff (printed with --verbose, and saved in --report-dir and --report-file). "+
+		"0 disables the text diffs. Unless specified, the text diffs are disabled without --verbose, --report-dir, and --report-file")
+	flags.Int("text-diff-max-lines", 1000, "Maximum number of the lines of a text diff. 0 means unlimited")
+	flags.Bool("nested-archives", false, "Compare the entries of the differing archives (zip, jar, tar, gzip, etc.) in the layers")
+	flags.Bool("elf-sections", false, "Compare the differing ELF files section by section")
+	flags.Bool("go-buildinfo", false, "Compare the build information (Go version, modules, and build settings) of the differing Go executables")
 }
 
-func action(cmd *cobra.Command, args []string) error {
-	backend, err := backendmanager.NewBackend(cmd)
-	if err != nil {
-		return err
-	}
-	ctx := backend.Context(cmd.Context())
-	flags := cmd.Flags()
-	plats, err := flagutil.ParsePlatformFlags(flags)
-	if err != nil {
-		return err
-	}
-	log.G(ctx).Infof("Target platforms: %v", platformutil.FormatSlice(plats))
-	platMC := platforms.Any(plats...)
-
-	var options diff.Options
+func parseOptions(ctx context.Context, flags *pflag.FlagSet) (*diff.Options, error) {
+	var (
+		options diff.Options
+		err     error
+	)
 	options.IgnoreHistory, err = flags.GetBool("ignore-history")
 	if err != nil {
-		return err
+		return nil, err
 	}
 	options.IgnoreFileOrder, err = flags.GetBool("ignore-file-order")
 	if err != nil {
-		return err
+		return nil, err
 	}
 	options.IgnoreFileModeRedundantBits, err = flags.GetBool("ignore-file-mode-redundant-bits")
 	if err != nil {
-		return err
+		return nil, err
 	}
 	options.IgnoreFileTimestamps, err = flags.GetBool("ignore-file-timestamps")
 	if err != nil {
-		return err
+		return nil, err
 	}
 	options.IgnoreImageTimestamps, err = flags.GetBool("ignore-image-timestamps")
 	if err != nil {
-		return err
+		return nil, err
 	}
 	options.IgnoreImageName, err = flags.GetBool("ignore-image-name")
 	if err != nil {
-		return err
+		return nil, err
 	}
 	options.IgnoreTarFormat, err = flags.GetBool("ignore-tar-format")
 	if err != nil {
-		return err
+		return nil, err
 	}
 	options.CanonicalPaths, err = flags.GetBool("treat-canonical-paths-equal")
 	if err != nil {
-		return err
+		return nil, err
+	}
+	options.IgnoreELFBuildID, err = flags.GetBool("ignore-elf-build-id")
+	if err != nil {
+		return nil, err
+	}
+	options.IgnoreDebugSections, err = flags.GetBool("ignore-debug-sections")
+	if err != nil {
+		return nil, err
 	}
 	options.ReportFile, err = flags.GetString("report-file")
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if options.ReportFile != "" {
 		log.G(ctx).Warn("report-file is experimental. The file format is subject to change.")
 		options.ReportFile, err = localpathutil.Expand(options.ReportFile)
 		if err != nil {
-			return fmt.Errorf("invalid report-file path %q: %w", options.ReportFile, err)
+			return nil, fmt.Errorf("invalid report-file path %q: %w", options.ReportFile, err)
 		}
 	}
 	options.ReportDir, err = flags.GetString("report-dir")
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if options.ReportDir != "" {
 		options.ReportDir, err = localpathutil.Expand(options.ReportDir)
 		if err != nil {
-			return fmt.Errorf("invalid report-dir path %q: %w", options.ReportDir, err)
+			return nil, fmt.Errorf("invalid report-dir path %q: %w", options.ReportDir, err)
 		}
 	}
 
 	options.EventHandler = diff.DefaultEventHandler
 	verbose, err := flags.GetBool("verbose")
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if verbose {
 		options.EventHandler = diff.VerboseEventHandler
 	}
 
 	options.MaxScale, err = flags.GetFloat64("max-scale")
+	if err != nil {
+		return nil, err
+	}
+	options.Concurrency, err = flags.GetInt("parallel")
+	if err != nil {
+		return nil, err
+	}
+	if options.Concurrency < 1 {
+		return nil, fmt.Errorf("invalid parallel value %d (must be >= 1)", options.Concurrency)
+	}
+	memoryBudget, err := flags.GetString("memory-budget")
+	if err != nil {
+		return nil, err
+	}
+	options.MemoryBudget, err = units.RAMInBytes(memoryBudget)
+	if err != nil {
+		return nil, fmt.Errorf("invalid memory-budget value %q: %w", memoryBudget, err)
+	}
+	if options.MemoryBudget < 0 {
+		return nil, fmt.Errorf("invalid memory-budget value %q (must be >= 0)", memoryBudget)
+	}
+	textDiffMaxSize, err := flags.GetString("text-diff-max-size")
+	if err != nil {
+		return nil, err
+	}
+	options.TextDiffMaxSize, err = units.RAMInBytes(textDiffMaxSize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid text-diff-max-size value %q: %w", textDiffMaxSize, err)
+	}
+	if options.TextDiffMaxSize < 0 {
+		return nil, fmt.Errorf("invalid text-diff-max-size value %q (must be >= 0)", textDiffMaxSize)
+	}
+	if !flags.Changed("text-diff-max-size") && !verbose && options.ReportDir == "" && options.ReportFile == "" {
+		// The texts would be retained in memory without being printed or saved
+		options.TextDiffMaxSize = 0
+	}
+	options.TextDiffMaxLines, err = flags.GetInt("text-diff-max-lines")
+	if err != nil {
+		return nil, err
+	}
+	if options.TextDiffMaxLines < 0 {
+		return nil, fmt.Errorf("invalid text-diff-max-lines value %d (must be >= 0)", options.TextDiffMaxLines)
+	}
+	options.NestedArchives, err = flags.GetBool("nested-archives")
+	if err != nil {
+		return nil, err
+	}
+	options.ELFSections, err = flags.GetBool("elf-sections")
+	if err != nil {
+		return nil, err
+	}
+	options.GoBuildInfo, err = flags.GetBool("go-buildinfo")
+	if err != nil {
+		return nil, err
+	}
+	options.Normalizers, err = flags.GetStringSlice("normalize")
+	if err != nil {
+		return nil, err
+	}
+	return &options, nil
+}
+
+func action(cmd *cobra.Command, args []string) error {
+	backend, err := backendmanager.NewBackend(cmd)
+	if err != nil {
+		return err
+	}
+	ctx := backend.Context(cmd.Context())
+	flags := cmd.Flags()
+	plats, err := flagutil.ParsePlatformFlags(flags)
+	if err != nil {
+		return err
+	}
+	log.G(ctx).Infof("Target platforms: %v", platformutil.FormatSlice(plats))
+	platMC := platforms.Any(plats...)
+
+	options, err := parseOptions(ctx, flags)
+	if err != nil {
+		return err
+	}
+	useSnapshots, err := flags.GetBool("use-snapshots")
 	if err != nil {
 		return err
 	}
+	if useSnapshots {
+		snapshotter, ok := backend.(diff.Snapshotter)
+		if !ok {
+			return fmt.Errorf("backend %q does not support --use-snapshots", backend.Info().Name)
+		}
+		options.Snapshotter = snapshotter
+	}
+
+	options.Flatten, err = flags.GetBool("flatten")
+	if err != nil {
+		return err
+	}
+
+	layerIndexCache, err := flags.GetBool("layer-index-cache")
+	if err != nil {
+		return err
+	}
+	if layerIndexCache {
+		options.LayerIndexCache = layerIndexCacheOf(backend)
+	}
 
 	pullMode, err := flags.GetString("pull")
 	if err != nil {
 		return err
 	}
 
-	ig, err := imagegetter.New(cmd.ErrOrStderr(), backend)
+	ig, cleanup, err := newImageGetter(ctx, cmd, backend)
 	if err != nil {
 		return err
 	}
@@ -190,16 +323,66 @@ func action(cmd *cobra.Command, args []string) error {
 	for i := 0; i < 2; i++ {
 		img, err := ig.Get(ctx, args[i], plats, imagegetter.PullMode(pullMode))
 		if err != nil {
+			cleanup()
 			return err
 		}
 		log.G(ctx).Debugf("Input %d: Image %q (%s)", i, img.Name, img.Target.Digest)
 		imageDescs[i] = img.Target
 	}
 
-	contentStore := backend.ContentStore()
+	contentProvider := ig.ContentProvider()
+
+	report, err := diff.Diff(ctx, contentProvider, imageDescs, platMC, options)
+	cleanup()
+	exit(ctx, report, err)
+	/* NOTREACHED */
+	return nil
+}
+
+// layerIndexCacheOf returns the layer index cache of the backend, or nil.
+func layerIndexCacheOf(b backend.Backend) *diff.LayerIndexCache {
+	if p, ok := b.(backend.LayerIndexCacheProvider); ok {
+		return p.LayerIndexCache()
+	}
+	return nil
+}
+
+// newImageGetter returns an image getter, with a function to remove the temporary images
+// unless `--keep` is specified.
+func newImageGetter(ctx context.Context, cmd *cobra.Command, b backend.Backend) (ig *imagegetter.ImageGetter, cleanup func(), err error) {
+	keep, err := cmd.Flags().GetBool("keep")
+	if err != nil {
+		return nil, nil, err
+	}
+	ig, err = imagegetter.New(cmd.ErrOrStderr(), b)
+	if err != nil {
+		return nil, nil, err
+	}
+	ig.SetBackendOpener(func(_ context.Context, name, ns string) (backend.Backend, error) {
+		return backendmanager.NewBackendWithNamespace(cmd, name, ns)
+	})
+	cleanup = func() {
+		defer func() {
+			if closeErr := ig.Close(); closeErr != nil {
+				log.G(ctx).WithError(closeErr).Warn("Failed to close the backends")
+			}
+		}()
+		if keep {
+			for _, name := range ig.TemporaryImages() {
+				log.G(ctx).Infof("Keeping temporary image %q", name)
+			}
+			return
+		}
+		if cleanupErr := ig.Cleanup(ctx); cleanupErr != nil {
+			log.G(ctx).WithError(cleanupErr).Warn("Failed to clean up temporary images")
+		}
+	}
+	return ig, cleanup, nil
+}
 
+// exit exits with 0 (no difference), 1 (difference), or 2 (error).
+func exit(ctx context.Context, report *diff.EventTreeNode, err error) {
 	var exitCode int
-	report, err := diff.Diff(ctx, contentStore, imageDescs, platMC, &options)
 	if report != nil && len(report.Children) > 0 {
 		exitCode = 1
 	}
@@ -214,6 +397,4 @@ func action(cmd *cobra.Command, args []string) error {
 		log.G(ctx).Debugf("exiting with code %d", exitCode)
 	}
 	os.Exit(exitCode)
-	/* NOTREACHED */
-	return nil
 }
@@ -0,0 +1,156 @@
+package diff
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/reproducible-containers/diffoci/cmd/diffoci/backend/memorybackend"
+	"github.com/reproducible-containers/diffoci/cmd/diffoci/imagegetter"
+	"github.com/reproducible-containers/diffoci/internal/testutil"
+	"github.com/spf13/pflag"
+)
+
+func TestParseOptionsTextDiff(t *testing.T) {
+	testCases := []struct {
+		name     string
+		args     []string
+		expected int64
+	}{
+		{"default", nil, 0},
+		{"verbose", []string{"--verbose"}, 64 * 1024},
+		{"report dir", []string{"--report-dir=" + t.TempDir()}, 64 * 1024},
+		{"report file", []string{"--report-file=" + t.TempDir() + "/report.json"}, 64 * 1024},
+		{"explicit", []string{"--text-diff-max-size=1KiB"}, 1024},
+		{"explicitly disabled", []string{"--verbose", "--text-diff-max-size=0"}, 0},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			flags := pflag.NewFlagSet("diff", pflag.ContinueOnError)
+			addFlags(flags)
+			if err := flags.Parse(tc.args); err != nil {
+				t.Fatal(err)
+			}
+			options, err := parseOptions(context.Background(), flags)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if options.TextDiffMaxSize != tc.expected {
+				t.Errorf("expected %d, got %d", tc.expected, options.TextDiffMaxSize)
+			}
+		})
+	}
+}
+
+func TestParseOptionsParallel(t *testing.T) {
+	testCases := []struct {
+		name     string
+		args     []string
+		expected int // 0 for an error
+	}{
+		// Opt-in, as the peak memory usage grows with the concurrency
+		{"default", nil, 1},
+		{"explicit", []string{"--parallel=4"}, 4},
+		{"invalid", []string{"--parallel=0"}, 0},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			flags := pflag.NewFlagSet("diff", pflag.ContinueOnError)
+			addFlags(flags)
+			if err := flags.Parse(tc.args); err != nil {
+				t.Fatal(err)
+			}
+			options, err := parseOptions(context.Background(), flags)
+			if tc.expected == 0 {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if options.Concurrency != tc.expected {
+				t.Errorf("expected %d, got %d", tc.expected, options.Concurrency)
+			}
+		})
+	}
+}
+
+func TestParseOptionsSemantic(t *testing.T) {
+	testCases := []struct {
+		name        string
+		args        []string
+		normalizers []string
+	}{
+		// The normalizers are opt-in, as they decompress the matching files
+		{"semantic", []string{"--semantic"}, nil},
+		{"semantic with normalizers", []string{"--semantic", "--normalize=pyc,gzip"}, []string{"pyc", "gzip"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cmd := NewCommand()
+			if err := cmd.Flags().Parse(tc.args); err != nil {
+				t.Fatal(err)
+			}
+			if err := preRunE(cmd, nil); err != nil {
+				t.Fatal(err)
+			}
+			options, err := parseOptions(context.Background(), cmd.Flags())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !options.IgnoreFileOrder || !options.IgnoreFileTimestamps || !options.CanonicalPaths {
+				t.Errorf("expected the ignorance options to be set, got %+v", options.IgnoranceOptions)
+			}
+			if strings.Join(options.Normalizers, ",") != strings.Join(tc.normalizers, ",") {
+				t.Errorf("expected %v, got %v", tc.normalizers, options.Normalizers)
+			}
+		})
+	}
+}
+
+func TestNewImageGetterKeep(t *testing.T) {
+	testCases := []struct {
+		name string
+		args []string
+		kept bool
+	}{
+		{"default", nil, false},
+		{"keep", []string{"--keep"}, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			p := filepath.Join(t.TempDir(), "archive.tar")
+			archive, _ := testutil.OCIArchive(t, []byte("layer"))
+			if err := os.WriteFile(p, archive, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			cmd := NewCommand()
+			cmd.SetErr(io.Discard)
+			if err := cmd.Flags().Parse(tc.args); err != nil {
+				t.Fatal(err)
+			}
+			b := memorybackend.New()
+			ig, cleanup, err := newImageGetter(ctx, cmd, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			img, err := ig.Get(ctx, "oci-archive:"+p, []ocispec.Platform{platforms.DefaultSpec()}, imagegetter.PullNever)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cleanup()
+			_, err = b.ImageService().Get(ctx, img.Name)
+			if kept := err == nil; kept != tc.kept {
+				t.Errorf("expected kept=%v, got %v", tc.kept, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package diff
+
+import (
+	"fmt"
+
+	"github.com/containerd/log"
+	"github.com/containerd/platforms"
+	"github.com/reproducible-containers/diffoci/cmd/diffoci/backend/backendmanager"
+	"github.com/reproducible-containers/diffoci/cmd/diffoci/flagutil"
+	"github.com/reproducible-containers/diffoci/cmd/diffoci/imagegetter"
+	"github.com/reproducible-containers/diffoci/pkg/diff"
+	"github.com/reproducible-containers/diffoci/pkg/localpathutil"
+	"github.com/reproducible-containers/diffoci/pkg/platformutil"
+	"github.com/spf13/cobra"
+)
+
+const RootFSExample = `  # Compare an image with a root filesystem directory
+  diffoci diff-rootfs --semantic alpine:3.18.3 /mnt/rootfs
+`
+
+func NewRootFSCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "diff-rootfs IMAGE DIR",
+		Short: "Diff an image with a root filesystem directory",
+		Long: `Diff an image with a root filesystem directory.
+
+The layers of the image are flattened with the OCI whiteout rules.
+The following attributes are not compared, as they cannot be retained in a directory:
+the order of the entries, the tar format, the user and group names, atime, ctime, and
+the PAX records except xattrs.
+Hard links are compared as regular files.
+`,
+		Example: RootFSExample,
+		Args:    cobra.ExactArgs(2),
+		PreRunE: preRunE,
+		RunE:    rootFSAction,
+
+		DisableFlagsInUseLine: true,
+	}
+	addFlags(cmd.Flags())
+	return cmd
+}
+
+func rootFSAction(cmd *cobra.Command, args []string) error {
+	backend, err := backendmanager.NewBackend(cmd)
+	if err != nil {
+		return err
+	}
+	ctx := backend.Context(cmd.Context())
+	flags := cmd.Flags()
+	plats, err := flagutil.ParsePlatformFlags(flags)
+	if err != nil {
+		return err
+	}
+	log.G(ctx).Infof("Target platforms: %v", platformutil.FormatSlice(plats))
+	platMC := platforms.Any(plats...)
+
+	options, err := parseOptions(ctx, flags)
+	if err != nil {
+		return err
+	}
+
+	pullMode, err := flags.GetString("pull")
+	if err != nil {
+		return err
+	}
+
+	dir, err := localpathutil.Expand(args[1])
+	if err != nil {
+		return fmt.Errorf("invalid directory path %q: %w", args[1], err)
+	}
+
+	ig, cleanup, err := newImageGetter(ctx, cmd, backend)
+	if err != nil {
+		return err
+	}
+	img, err := ig.Get(ctx, args[0], plats, imagegetter.PullMode(pullMode))
+	if err != nil {
+		cleanup()
+		return err
+	}
+	log.G(ctx).Debugf("Input 0: Image %q (%s)", img.Name, img.Target.Digest)
+	log.G(ctx).Debugf("Input 1: Directory %q", dir)
+
+	report, err := diff.DiffRootFS(ctx, ig.ContentProvider(), img.Target, dir, platMC, options)
+	cleanup()
+	exit(ctx, report, err)
+	/* NOTREACHED */
+	return nil
+}
@@ -38,6 +38,7 @@ func action(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+	defer ig.Close()
 
 	img, err := ig.Get(ctx, args[0], plats, imagegetter.PullAlways)
 	if err != nil {
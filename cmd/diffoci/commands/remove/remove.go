@@ -13,15 +13,9 @@ import (
 
 func NewCommand() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:     "remove IMAGE...",
-		Aliases: []string{"rm", "rmi"},
-		Short:   "Remove images",
-		Long: `Remove images
-
-BUG: when using the "local" backend, the remove command
-does not remove blobs associated with the image.
-(Workaround: remove the cache directory periodically by yourself.)
-		`,
+		Use:                   "remove IMAGE...",
+		Aliases:               []string{"rm", "rmi"},
+		Short:                 "Remove images",
 		Args:                  cobra.MinimumNArgs(1),
 		RunE:                  action,
 		DisableFlagsInUseLine: true,
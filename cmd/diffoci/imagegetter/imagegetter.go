@@ -2,6 +2,8 @@ package imagegetter
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -18,14 +20,23 @@ import (
 	"github.com/containerd/containerd/pkg/transfer/image"
 	transimage "github.com/containerd/containerd/pkg/transfer/image"
 	"github.com/containerd/containerd/pkg/transfer/registry"
+	"github.com/containerd/containerd/remotes/docker"
+	dockerconfig "github.com/containerd/containerd/remotes/docker/config"
 	"github.com/containerd/errdefs"
 	"github.com/containerd/log"
 	"github.com/containerd/platforms"
 	refdocker "github.com/distribution/reference"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/reproducible-containers/diffoci/cmd/diffoci/backend"
+	"github.com/reproducible-containers/diffoci/cmd/diffoci/backend/containerdbackend"
+	"github.com/reproducible-containers/diffoci/cmd/diffoci/backend/localbackend"
+	"github.com/reproducible-containers/diffoci/pkg/containersstorage"
 	"github.com/reproducible-containers/diffoci/pkg/dockercred"
+	"github.com/reproducible-containers/diffoci/pkg/dockerengine"
+	"github.com/reproducible-containers/diffoci/pkg/localpathutil"
+	"github.com/reproducible-containers/diffoci/pkg/ocilayout"
 	"github.com/reproducible-containers/diffoci/pkg/platformutil"
+	"github.com/reproducible-containers/diffoci/pkg/registryprovider"
 )
 
 func wrapTransferProgressFunc(ctx context.Context, pf transfer.ProgressFunc) transfer.ProgressFunc {
@@ -36,6 +47,11 @@ func wrapTransferProgressFunc(ctx context.Context, pf transfer.ProgressFunc) tra
 }
 
 func Load(ctx context.Context, stdout io.Writer, transferrer transfer.Transferrer, tarR io.Reader, plats []ocispec.Platform, foreknownRef string) error {
+	return load(ctx, stdout, transferrer, tarR, plats, foreknownRef, image.WithNamedPrefix("unused", true))
+}
+
+func load(ctx context.Context, stdout io.Writer, transferrer transfer.Transferrer, tarR io.Reader, plats []ocispec.Platform, foreknownRef string,
+	extraStoreOpts ...transimage.StoreOpt) error {
 	decompressed, err := compression.DecompressStream(tarR)
 	if err != nil {
 		return err
@@ -46,8 +62,8 @@ func Load(ctx context.Context, stdout io.Writer, transferrer transfer.Transferre
 		transimage.WithPlatforms(plats...),
 		image.WithPlatforms(plats...),
 		image.WithAllMetadata,
-		image.WithNamedPrefix("unused", true),
 	}
+	sOpts = append(sOpts, extraStoreOpts...)
 	is := transimage.NewStore(foreknownRef, sOpts...)
 
 	pf, done := ctrimages.ProgressHandler(ctx, stdout)
@@ -82,6 +98,26 @@ type ImageGetter struct {
 	contentStore   content.Store
 	transferrer    transfer.Transferrer
 	credHelper     registry.CredentialHelper
+	maybeGC        func(context.Context) error
+	extraProviders []content.Provider // providers outside the backend, such as OCI layouts
+	tempImages     []string           // names of the images to be removed on Cleanup
+	backend        backend.Backend
+	backendOpener  BackendOpener
+	subGetters     []subGetter // per-input backends
+}
+
+type subGetter struct {
+	key string // "NAME/NAMESPACE"
+	*ImageGetter
+}
+
+// BackendOpener opens a backend for a per-input reference such as "containerd://k8s.io/foo:latest".
+// The namespace may be empty.
+type BackendOpener func(ctx context.Context, name, namespace string) (backend.Backend, error)
+
+// SetBackendOpener enables per-input references such as "containerd://k8s.io/foo:latest" and "local://foo:latest".
+func (g *ImageGetter) SetBackendOpener(opener BackendOpener) {
+	g.backendOpener = opener
 }
 
 func New(progressWriter io.Writer, backend backend.Backend) (*ImageGetter, error) {
@@ -95,6 +131,8 @@ func New(progressWriter io.Writer, backend backend.Backend) (*ImageGetter, error
 		contentStore:   backend.ContentStore(),
 		transferrer:    backend,
 		credHelper:     credHelper,
+		maybeGC:        backend.MaybeGC,
+		backend:        backend,
 	}, nil
 }
 
@@ -104,11 +142,35 @@ const (
 	PullAlways  = "always"
 	PullMissing = "missing"
 	PullNever   = "never"
+	PullLazy    = "lazy" // Fetch blobs lazily from the registry, without storing them in the backend
 
-	dockerImagePrefix = "docker://"
-	podmanImagePrefix = "podman://"
+	dockerImagePrefix            = "docker://"
+	podmanImagePrefix            = "podman://"
+	ociLayoutImagePrefix         = "oci-layout://"
+	containersStorageImagePrefix = "containers-storage:"
+	containerdImagePrefix        = "containerd://" // "containerd://NAMESPACE/NAME"; NAMESPACE may be empty
+	localImagePrefix             = "local://"
+	ociArchiveImagePrefix        = "oci-archive:"
+	dockerArchiveImagePrefix     = "docker-archive:"
+
+	// tempImageNamePrefix is the name prefix of the images that are temporarily loaded from archives.
+	tempImageNamePrefix = "localhost/diffoci-tmp"
 )
 
+// ContentProvider returns the content provider for the images returned by Get.
+// The provider covers the backend content store as well as the content outside the backend,
+// such as OCI layout directories.
+func (g *ImageGetter) ContentProvider() content.Provider {
+	if len(g.extraProviders) == 0 && len(g.subGetters) == 0 {
+		return g.contentStore
+	}
+	providers := append([]content.Provider{g.contentStore}, g.extraProviders...)
+	for _, sub := range g.subGetters {
+		providers = append(providers, &backendProvider{Provider: sub.ContentProvider(), backend: sub.backend})
+	}
+	return newMultiProvider(providers)
+}
+
 func (g *ImageGetter) isDocker(rawRef string) bool {
 	return strings.HasPrefix(rawRef, dockerImagePrefix)
 }
@@ -117,6 +179,23 @@ func (g *ImageGetter) isPodman(rawRef string) bool {
 	return strings.HasPrefix(rawRef, podmanImagePrefix)
 }
 
+func (g *ImageGetter) isContainersStorage(rawRef string) bool {
+	return strings.HasPrefix(rawRef, containersStorageImagePrefix)
+}
+
+func (g *ImageGetter) isOCILayout(rawRef string) bool {
+	return strings.HasPrefix(rawRef, ociLayoutImagePrefix)
+}
+
+func (g *ImageGetter) archivePrefix(rawRef string) string {
+	for _, prefix := range []string{ociArchiveImagePrefix, dockerArchiveImagePrefix} {
+		if strings.HasPrefix(rawRef, prefix) {
+			return prefix
+		}
+	}
+	return ""
+}
+
 func (g *ImageGetter) getDocker(ctx context.Context, rawRef string, plats []ocispec.Platform) (*images.Image, error) {
 	rawRefTrimmed := strings.TrimPrefix(rawRef, dockerImagePrefix)
 	ref, err := refdocker.ParseDockerRef(rawRefTrimmed)
@@ -124,11 +203,98 @@ func (g *ImageGetter) getDocker(ctx context.Context, rawRef string, plats []ocis
 		return nil, fmt.Errorf("failed to parse %q: %w", rawRefTrimmed, err)
 	}
 	name := ref.String()
-	docker := os.Getenv("DOCKER")
-	if docker == "" {
-		docker = "docker"
+	if docker := os.Getenv("DOCKER"); docker != "" {
+		// An explicitly specified CLI, such as a wrapper script
+		return g.loadCLI(ctx, docker, name, plats)
+	}
+	client, err := dockerengine.NewFromEnv()
+	if err != nil {
+		// e.g., ssh:// and npipe:// hosts
+		log.G(ctx).WithError(err).Debug("Failed to create a Docker Engine API client, falling back to `docker save`")
+		return g.loadCLI(ctx, "docker", name, plats)
+	}
+	img, err := g.getDockerContainerd(ctx, client, name, plats)
+	if err == nil {
+		return img, nil
+	}
+	log.G(ctx).WithError(err).Debug("Failed to access the containerd image store of Docker, falling back to exporting the image")
+	img, err = g.loadDockerEngine(ctx, client, name, plats)
+	if err == nil {
+		return img, nil
+	}
+	log.G(ctx).WithError(err).Warn("Failed to export the image via the Docker Engine API, falling back to `docker save`")
+	img, cliErr := g.loadCLI(ctx, "docker", name, plats)
+	if cliErr != nil {
+		return nil, errors.Join(err, cliErr)
+	}
+	return img, nil
+}
+
+// getDockerContainerd resolves an image in the containerd image store of Docker, without copying the blobs.
+// An error is returned when Docker is not using the containerd image store, or when the store is not accessible.
+//
+// The store is only accessed when the daemon is connected via a local socket, as the containerd address
+// reported by a remote daemon (or a daemon in a VM) is not meaningful on this host.
+func (g *ImageGetter) getDockerContainerd(ctx context.Context, client *dockerengine.Client, name string, plats []ocispec.Platform) (*images.Image, error) {
+	if !client.IsLocal() {
+		return nil, fmt.Errorf("docker (%q) is not local: %w", client.Host(), errdefs.ErrNotImplemented)
+	}
+	info, err := client.Info(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !info.UsesContainerdImageStore() || info.Containerd == nil || info.Containerd.Address == "" {
+		return nil, fmt.Errorf("docker (%q) is not using the containerd image store: %w", client.Host(), errdefs.ErrNotImplemented)
+	}
+	ns := info.Containerd.Namespaces.Containers
+	if ns == "" {
+		ns = dockerengine.DefaultContainerdNamespace
+	}
+	sub, err := g.dockerContainerdGetter(ctx, info.Containerd.Address, ns)
+	if err != nil {
+		return nil, err
+	}
+	img, err := sub.imageStore.Get(sub.backend.Context(ctx), name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get image %q from containerd namespace %q: %w", name, ns, err)
+	}
+	// The socket may belong to another containerd, e.g., in another mount namespace, or to a containerd that
+	// merely shares the namespace name with the daemon.
+	inspect, err := client.ImageInspect(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if inspect.ID != img.Target.Digest.String() {
+		return nil, fmt.Errorf("image %q in containerd namespace %q (%s) does not match the image of docker (%q, daemon %q, %s)",
+			name, ns, img.Target.Digest, client.Host(), info.ID, inspect.ID)
+	}
+	provider := &backendProvider{Provider: sub.contentStore, backend: sub.backend}
+	if err = checkPlatforms(ctx, provider, img, plats); err != nil {
+		return nil, err
+	}
+	log.G(ctx).Infof("Using image %q in containerd namespace %q (%q)", name, ns, info.Containerd.Address)
+	return &img, nil
+}
+
+// dockerContainerdGetter returns the image getter for the containerd of Docker.
+// The getter is registered as a sub getter, so that the connection is closed by Close.
+func (g *ImageGetter) dockerContainerdGetter(ctx context.Context, addr, ns string) (*ImageGetter, error) {
+	key := "docker/" + addr + "/" + ns
+	for _, sub := range g.subGetters {
+		if sub.key == key {
+			return sub.ImageGetter, nil
+		}
 	}
-	return g.loadDocker(ctx, docker, name, plats)
+	b, err := containerdbackend.Open(ctx, addr, ns)
+	if err != nil {
+		return nil, err
+	}
+	sub, err := New(g.progressWriter, b)
+	if err != nil {
+		return nil, errors.Join(err, closeBackend(b))
+	}
+	g.subGetters = append(g.subGetters, subGetter{key: key, ImageGetter: sub})
+	return sub, nil
 }
 
 func (g *ImageGetter) getPodman(ctx context.Context, rawRef string, plats []ocispec.Platform) (*images.Image, error) {
@@ -138,11 +304,297 @@ func (g *ImageGetter) getPodman(ctx context.Context, rawRef string, plats []ocis
 		return nil, fmt.Errorf("failed to parse %q: %w", rawRefTrimmed, err)
 	}
 	name := ref.String()
+	root, err := containersstorage.DefaultRootForCurrentUser()
+	if err == nil {
+		var img *images.Image
+		img, err = g.getContainersStorageWithRoot(ctx, root, rawRefTrimmed, plats)
+		if err == nil {
+			return img, nil
+		}
+	}
+	log.G(ctx).WithError(err).Debug("Failed to access the containers-storage of Podman, falling back to exporting the image")
 	podman := os.Getenv("PODMAN")
 	if podman == "" {
 		podman = "podman"
 	}
-	return g.loadDocker(ctx, podman, name, plats)
+	return g.loadCLI(ctx, podman, name, plats)
+}
+
+// getContainersStorage resolves an image in containers-storage, without copying the blobs to the backend.
+// The reference is "containers-storage:[ROOT]NAME", where "[ROOT]" is optional.
+func (g *ImageGetter) getContainersStorage(ctx context.Context, rawRef string, plats []ocispec.Platform) (*images.Image, error) {
+	rawRefTrimmed := strings.TrimPrefix(strings.TrimPrefix(rawRef, containersStorageImagePrefix), "//")
+	var root string
+	if strings.HasPrefix(rawRefTrimmed, "[") {
+		end := strings.Index(rawRefTrimmed, "]")
+		if end < 0 {
+			return nil, fmt.Errorf("failed to parse %q: missing \"]\"", rawRef)
+		}
+		root, rawRefTrimmed = rawRefTrimmed[1:end], rawRefTrimmed[end+1:]
+		// "[DRIVER@ROOT+RUNROOT]" (the syntax of Skopeo) is also accepted
+		if _, after, ok := strings.Cut(root, "@"); ok {
+			root = after
+		}
+		root, _, _ = strings.Cut(root, "+")
+		var err error
+		root, err = localpathutil.Expand(root)
+		if err != nil {
+			return nil, fmt.Errorf("invalid storage root %q: %w", root, err)
+		}
+	} else {
+		var err error
+		root, err = containersstorage.DefaultRootForCurrentUser()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return g.getContainersStorageWithRoot(ctx, root, rawRefTrimmed, plats)
+}
+
+func (g *ImageGetter) getContainersStorageWithRoot(ctx context.Context, root, name string, plats []ocispec.Platform) (*images.Image, error) {
+	store, err := containersstorage.Open(root)
+	if err != nil {
+		return nil, err
+	}
+	img, err := store.Lookup(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkPlatforms(ctx, store, img, plats); err != nil {
+		return nil, err
+	}
+	log.G(ctx).Infof("Using image %q in containers-storage %q (driver %q)", img.Name, root, store.Driver())
+	g.extraProviders = append(g.extraProviders, store)
+	return &img, nil
+}
+
+// getOCILayout resolves an image from an OCI layout directory, without copying the blobs to the backend.
+func (g *ImageGetter) getOCILayout(ctx context.Context, rawRef string, plats []ocispec.Platform) (*images.Image, error) {
+	rawRefTrimmed := strings.TrimPrefix(rawRef, ociLayoutImagePrefix)
+	ref, err := ocilayout.ParseRef(rawRefTrimmed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %w", rawRefTrimmed, err)
+	}
+	log.G(ctx).Infof("Opening image %q from OCI layout %q", ref.String(), ref.Dir)
+	provider, err := ocilayout.NewProvider(ref.Dir)
+	if err != nil {
+		return nil, err
+	}
+	desc, err := ocilayout.Resolve(ctx, *ref)
+	if err != nil {
+		return nil, err
+	}
+	img := images.Image{
+		Name:   rawRef,
+		Target: *desc,
+	}
+	if err = checkPlatforms(ctx, provider, img, plats); err != nil {
+		return nil, err
+	}
+	g.extraProviders = append(g.extraProviders, provider)
+	return &img, nil
+}
+
+// getArchive loads an image archive (Docker or OCI; optionally compressed) under a temporary name.
+// The image is removed on Cleanup.
+func (g *ImageGetter) getArchive(ctx context.Context, rawRef, prefix string, plats []ocispec.Platform) (*images.Image, error) {
+	rawRefTrimmed := strings.TrimPrefix(rawRef, prefix)
+	p, err := localpathutil.Expand(rawRefTrimmed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid archive path %q: %w", rawRefTrimmed, err)
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	name, err := tempImageName()
+	if err != nil {
+		return nil, err
+	}
+	log.G(ctx).Infof("Loading archive %q as a temporary image %q", p, name)
+	// Register the name before loading, so that Cleanup can remove a partially loaded image too
+	g.tempImages = append(g.tempImages, name)
+	if err = load(ctx, g.progressWriter, g.transferrer, f, plats, name); err != nil {
+		return nil, fmt.Errorf("failed to load an archive %q: %w", p, err)
+	}
+	img, err := g.imageStore.Get(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("should have loaded an archive %q, but the loaded image is not accessible: %w", p, err)
+	}
+	if err = checkPlatforms(ctx, g.contentStore, img, plats); err != nil {
+		return nil, err
+	}
+	return &img, nil
+}
+
+func tempImageName() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return tempImageNamePrefix + ":" + hex.EncodeToString(b), nil
+}
+
+// TemporaryImages returns the names of the temporary images created by Get.
+func (g *ImageGetter) TemporaryImages() []string {
+	res := g.tempImages
+	for _, sub := range g.subGetters {
+		res = append(res, sub.TemporaryImages()...)
+	}
+	return res
+}
+
+// Cleanup removes the temporary images created by Get, and lets the backend run GC.
+func (g *ImageGetter) Cleanup(ctx context.Context) error {
+	var errs []error
+	for _, sub := range g.subGetters {
+		if err := sub.Cleanup(sub.backend.Context(ctx)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, name := range g.tempImages {
+		log.G(ctx).Debugf("Removing temporary image %q", name)
+		if err := g.imageStore.Delete(ctx, name, images.SynchronousDelete()); err != nil && !errors.Is(err, errdefs.ErrNotFound) {
+			errs = append(errs, fmt.Errorf("failed to remove temporary image %q: %w", name, err))
+		}
+	}
+	g.tempImages = nil
+	if err := g.maybeGC(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes the connections of the per-input backends.
+// The default backend is not closed, as it is owned by the caller.
+func (g *ImageGetter) Close() error {
+	var errs []error
+	for _, sub := range g.subGetters {
+		if err := sub.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		if err := closeBackend(sub.backend); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	g.subGetters = nil
+	return errors.Join(errs...)
+}
+
+// closeBackend closes the backend if it implements [io.Closer], such as the containerd backend.
+func closeBackend(b backend.Backend) error {
+	if c, ok := b.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// getLazy resolves an image on a registry, without pulling the image into the backend.
+// The layer blobs are fetched on demand.
+func (g *ImageGetter) getLazy(ctx context.Context, name string, plats []ocispec.Platform) (*images.Image, error) {
+	log.G(ctx).Infof("Resolving %q (lazy)", name)
+	resolver := docker.NewResolver(docker.ResolverOptions{
+		Hosts: dockerconfig.ConfigureHosts(ctx, dockerconfig.HostOptions{
+			Credentials: func(host string) (string, string, error) {
+				cred, err := g.credHelper.GetCredentials(ctx, name, host)
+				if err != nil {
+					return "", "", err
+				}
+				return cred.Username, cred.Secret, nil
+			},
+		}),
+	})
+	provider, desc, err := registryprovider.New(ctx, resolver, name)
+	if err != nil {
+		return nil, err
+	}
+	platMC := platforms.Any(plats...)
+	if err = provider.Prefetch(ctx, *desc, platMC); err != nil {
+		return nil, fmt.Errorf("failed to fetch the metadata of %q: %w", name, err)
+	}
+	img := images.Image{
+		Name:   name,
+		Target: *desc,
+	}
+	if err = checkPlatforms(ctx, provider, img, plats); err != nil {
+		return nil, err
+	}
+	g.extraProviders = append(g.extraProviders, provider)
+	return &img, nil
+}
+
+// parseBackendRef parses "containerd://NAMESPACE/NAME" and "local://NAME".
+func parseBackendRef(rawRef string) (backendName, ns, rest string, ok bool) {
+	if after, found := strings.CutPrefix(rawRef, containerdImagePrefix); found {
+		ns, rest, _ = strings.Cut(after, "/")
+		return containerdbackend.Name, ns, rest, true
+	}
+	if after, found := strings.CutPrefix(rawRef, localImagePrefix); found {
+		return localbackend.Name, "", after, true
+	}
+	return "", "", "", false
+}
+
+// getWithBackend gets an image from the specified backend, not from the default backend.
+func (g *ImageGetter) getWithBackend(ctx context.Context, backendName, ns, rawRef string, plats []ocispec.Platform, pullMode PullMode) (*images.Image, error) {
+	if rawRef == "" {
+		return nil, fmt.Errorf("empty image name for backend %q", backendName)
+	}
+	sub, err := g.backendGetter(ctx, backendName, ns)
+	if err != nil {
+		return nil, err
+	}
+	if sub == g {
+		return g.Get(ctx, rawRef, plats, pullMode)
+	}
+	log.G(ctx).Infof("Using backend %q (namespace %q) for %q", backendName, ns, rawRef)
+	img, err := sub.Get(sub.backend.Context(ctx), rawRef, plats, pullMode)
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// backendGetter returns the image getter for the backend.
+// The default backend is reused when the name matches and the namespace is not specified,
+// as the local backend cannot be opened twice.
+func (g *ImageGetter) backendGetter(ctx context.Context, backendName, ns string) (*ImageGetter, error) {
+	if backendName == g.backend.Info().Name && ns == "" {
+		return g, nil
+	}
+	key := backendName + "/" + ns
+	for _, sub := range g.subGetters {
+		if sub.key == key {
+			return sub.ImageGetter, nil
+		}
+	}
+	if g.backendOpener == nil {
+		return nil, fmt.Errorf("per-input backends are not supported by this command: %w", errdefs.ErrNotImplemented)
+	}
+	b, err := g.backendOpener(ctx, backendName, ns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open backend %q (namespace %q): %w", backendName, ns, err)
+	}
+	sub, err := New(g.progressWriter, b)
+	if err != nil {
+		return nil, errors.Join(err, closeBackend(b))
+	}
+	g.subGetters = append(g.subGetters, subGetter{key: key, ImageGetter: sub})
+	return sub, nil
+}
+
+func checkPlatforms(ctx context.Context, provider content.Provider, img images.Image, plats []ocispec.Platform) error {
+	platMC := platforms.Any(plats...)
+	available, _, _, _, err := images.Check(ctx, provider, img.Target, platMC)
+	if err != nil {
+		return err
+	}
+	if !available {
+		return fmt.Errorf("image %q lacks blobs for additional platforms (%v): %w",
+			img.Name, platformutil.FormatSlice(plats), errdefs.ErrUnavailable)
+	}
+	return nil
 }
 
 type readerWithEOF struct {
@@ -180,8 +632,29 @@ func getDockerMajorVersion(ctx context.Context, docker string) int {
 	return major
 }
 
-// loadDocker runs `docker save` and loads the result
-func (g *ImageGetter) loadDocker(ctx context.Context, docker, name string, plats []ocispec.Platform) (*images.Image, error) {
+// loadDockerEngine exports the image via the Docker Engine API ($DOCKER_HOST) and loads the result
+func (g *ImageGetter) loadDockerEngine(ctx context.Context, client *dockerengine.Client, name string, plats []ocispec.Platform) (*images.Image, error) {
+	log.G(ctx).Infof("Loading image %q from %q", name, client.Host())
+	r, err := client.Save(ctx, name, plats)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if err = Load(ctx, g.progressWriter, g.transferrer, r, plats, name); err != nil {
+		return nil, fmt.Errorf("failed to load an archive (from %q): %w", client.Host(), err)
+	}
+	img, err := g.imageStore.Get(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("should have loaded an archive (from %q), but the loaded image is not accessible: %w", client.Host(), err)
+	}
+	if err = checkPlatforms(ctx, g.contentStore, img, plats); err != nil {
+		return nil, err
+	}
+	return &img, nil
+}
+
+// loadCLI runs `<cli> save` (e.g., `podman save`) and loads the result
+func (g *ImageGetter) loadCLI(ctx context.Context, docker, name string, plats []ocispec.Platform) (*images.Image, error) {
 	log.G(ctx).Infof("Loading image %q from %q", name, docker)
 
 	// Build docker save command with platform filtering
@@ -229,26 +702,31 @@ func (g *ImageGetter) loadDocker(ctx context.Context, docker, name string, plats
 		return nil, fmt.Errorf("should have loaded an archive (from %v), but the loaded image is not accessible: %w", dockerCmd.Args, err)
 	}
 
-	// Check platforms
-	platMC := platforms.Any(plats...)
-	available, _, _, _, err := images.Check(ctx, g.contentStore, img.Target, platMC)
-	if err != nil {
+	if err = checkPlatforms(ctx, g.contentStore, img, plats); err != nil {
 		return nil, err
 	}
-	if !available {
-		return nil, fmt.Errorf("image %q lacks blobs for additional platforms (%v): %w",
-			name, platformutil.FormatSlice(plats), errdefs.ErrUnavailable)
-	}
 	return &img, nil
 }
 
 func (g *ImageGetter) Get(ctx context.Context, rawRef string, plats []ocispec.Platform, pullMode PullMode) (*images.Image, error) {
+	if backendName, ns, rest, ok := parseBackendRef(rawRef); ok {
+		return g.getWithBackend(ctx, backendName, ns, rest, plats, pullMode)
+	}
 	if g.isDocker(rawRef) {
 		return g.getDocker(ctx, rawRef, plats)
 	}
 	if g.isPodman(rawRef) {
 		return g.getPodman(ctx, rawRef, plats)
 	}
+	if g.isContainersStorage(rawRef) {
+		return g.getContainersStorage(ctx, rawRef, plats)
+	}
+	if g.isOCILayout(rawRef) {
+		return g.getOCILayout(ctx, rawRef, plats)
+	}
+	if prefix := g.archivePrefix(rawRef); prefix != "" {
+		return g.getArchive(ctx, rawRef, prefix, plats)
+	}
 	ref, err := refdocker.ParseDockerRef(rawRef)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse %q: %w", rawRef, err)
@@ -256,6 +734,8 @@ func (g *ImageGetter) Get(ctx context.Context, rawRef string, plats []ocispec.Pl
 	name := ref.String()
 
 	switch pullMode {
+	case PullLazy:
+		return g.getLazy(ctx, name, plats)
 	case PullAlways:
 		log.G(ctx).Infof("Pulling %q", name)
 		if err := Pull(ctx, g.progressWriter, g.transferrer, g.credHelper, name, plats); err != nil {
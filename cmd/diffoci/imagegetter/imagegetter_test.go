@@ -0,0 +1,380 @@
+package imagegetter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/reproducible-containers/diffoci/cmd/diffoci/backend"
+	"github.com/reproducible-containers/diffoci/cmd/diffoci/backend/memorybackend"
+	"github.com/reproducible-containers/diffoci/internal/testutil"
+	"github.com/reproducible-containers/diffoci/pkg/dockerengine"
+)
+
+var tempImageNameRegexp = regexp.MustCompile(`^localhost/diffoci-tmp:[0-9a-f]{16}$`)
+
+func TestGetArchive(t *testing.T) {
+	layer := []byte("layer")
+	ociArchive, ociConfig := testutil.OCIArchive(t, layer)
+	dockerArchive, dockerConfig := testutil.DockerArchive(t, "example.com/foo:latest", layer)
+	testCases := []struct {
+		name     string
+		prefix   string
+		archive  []byte
+		err      bool
+		expected digest.Digest // the digest of the image config
+	}{
+		{name: "oci-archive", prefix: ociArchiveImagePrefix, archive: ociArchive, expected: ociConfig},
+		{name: "docker-archive", prefix: dockerArchiveImagePrefix, archive: dockerArchive, expected: dockerConfig},
+		{name: "invalid archive", prefix: ociArchiveImagePrefix, archive: []byte("not an archive"), err: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			p := filepath.Join(t.TempDir(), "archive.tar")
+			if err := os.WriteFile(p, tc.archive, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			b := memorybackend.New()
+			g, err := New(io.Discard, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			img, err := g.Get(ctx, tc.prefix+p, []ocispec.Platform{platforms.DefaultSpec()}, PullNever)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !tempImageNameRegexp.MatchString(img.Name) {
+					t.Errorf("unexpected temporary image name %q", img.Name)
+				}
+				mani, err := images.Manifest(ctx, b.ContentStore(), img.Target, platforms.Default())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if mani.Config.Digest != tc.expected {
+					t.Errorf("expected the config %s, got %s", tc.expected, mani.Config.Digest)
+				}
+				if _, err = b.ImageService().Get(ctx, img.Name); err != nil {
+					t.Fatalf("expected the temporary image to exist, got %v", err)
+				}
+			}
+			// The name is registered even if the archive cannot be loaded, so that a partially loaded image is removed
+			temps := g.TemporaryImages()
+			if len(temps) != 1 || !tempImageNameRegexp.MatchString(temps[0]) {
+				t.Fatalf("unexpected temporary images %v", temps)
+			}
+			if err = g.Cleanup(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = b.ImageService().Get(ctx, temps[0]); !errors.Is(err, errdefs.ErrNotFound) {
+				t.Errorf("expected the temporary image to be removed, got %v", err)
+			}
+			if temps = g.TemporaryImages(); len(temps) != 0 {
+				t.Errorf("expected no temporary image after Cleanup, got %v", temps)
+			}
+		})
+	}
+}
+
+func TestGetArchiveMissing(t *testing.T) {
+	g, err := New(io.Discard, memorybackend.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = g.Get(context.Background(), ociArchiveImagePrefix+filepath.Join(t.TempDir(), "missing.tar"), nil, PullNever); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+	if temps := g.TemporaryImages(); len(temps) != 0 {
+		t.Errorf("expected no temporary image, got %v", temps)
+	}
+}
+
+func TestTempImageName(t *testing.T) {
+	names := make(map[string]struct{})
+	for range 10 {
+		name, err := tempImageName()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !tempImageNameRegexp.MatchString(name) {
+			t.Errorf("unexpected name %q", name)
+		}
+		names[name] = struct{}{}
+	}
+	if len(names) != 10 {
+		t.Errorf("expected unique names, got %v", names)
+	}
+}
+
+// fakeDockerEngine serves the subset of the Docker Engine API used by getDocker.
+type fakeDockerEngine struct {
+	info    dockerengine.Info
+	id      string // the ID of the image
+	archive []byte // the archive of `docker save`
+}
+
+func (e *fakeDockerEngine) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	const apiVersion = "1.52"
+	if req.URL.Path == "/version" {
+		_ = json.NewEncoder(w).Encode(dockerengine.Version{Version: "0.0.0-fake", APIVersion: apiVersion})
+		return
+	}
+	switch strings.TrimPrefix(req.URL.Path, "/v"+apiVersion) {
+	case "/info":
+		_ = json.NewEncoder(w).Encode(e.info)
+	case "/images/" + fakeDockerImageName + "/json":
+		_ = json.NewEncoder(w).Encode(dockerengine.ImageInspect{ID: e.id})
+	case "/images/get":
+		_, _ = w.Write(e.archive)
+	default:
+		http.Error(w, "page not found", http.StatusNotFound)
+	}
+}
+
+const fakeDockerImageName = "docker.io/library/foo:latest"
+
+// createTestImage creates an image with the layer in the backend, and returns the image and the digest of its config.
+func createTestImage(t *testing.T, b backend.Backend, name string, layer []byte) (images.Image, digest.Digest) {
+	t.Helper()
+	ctx := context.Background()
+	archive, config := testutil.OCIArchive(t, layer)
+	p := filepath.Join(t.TempDir(), "archive.tar")
+	if err := os.WriteFile(p, archive, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	g, err := New(io.Discard, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := g.Get(ctx, ociArchiveImagePrefix+p, []ocispec.Platform{platforms.DefaultSpec()}, PullNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := b.ImageService().Create(ctx, images.Image{Name: name, Target: tmp.Target})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = g.Cleanup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return img, config
+}
+
+func TestGetDocker(t *testing.T) {
+	ctx := context.Background()
+	plats := []ocispec.Platform{platforms.DefaultSpec()}
+	archive, archiveConfig := testutil.DockerArchive(t, fakeDockerImageName, []byte("layer0"))
+
+	const ctrdAddress = "/run/fake/containerd.sock"
+	var ctrdInfo dockerengine.Info
+	ctrdInfoJSON := `{"ID":"fake","Driver":"overlayfs","DriverStatus":[["driver-type","` + dockerengine.ContainerdSnapshotterDriverType +
+		`"]],"Containerd":{"Address":"` + ctrdAddress + `"}}`
+	if err := json.Unmarshal([]byte(ctrdInfoJSON), &ctrdInfo); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name       string
+		info       dockerengine.Info
+		id         string // the ID of the image; the digest of the image in containerd if empty
+		tcp        bool
+		containerd bool // expected to use the image in the containerd image store
+	}{
+		{name: "containerd image store", info: ctrdInfo, containerd: true},
+		{name: "ID mismatch", info: ctrdInfo, id: "sha256:" + strings.Repeat("0", 64)},
+		{name: "classic image store", info: dockerengine.Info{ID: "fake", Driver: "overlay2"}},
+		{name: "non-local engine", info: ctrdInfo, tcp: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := memorybackend.New()
+			g, err := New(io.Discard, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer g.Close()
+
+			// Register the backend of the containerd image store, as if it was opened by dockerContainerdGetter
+			ctrdBackend := memorybackend.New()
+			ctrdImg, ctrdConfig := createTestImage(t, ctrdBackend, fakeDockerImageName, []byte("layer1"))
+			ctrd, err := New(io.Discard, ctrdBackend)
+			if err != nil {
+				t.Fatal(err)
+			}
+			g.subGetters = append(g.subGetters, subGetter{key: "docker/" + ctrdAddress + "/" + dockerengine.DefaultContainerdNamespace, ImageGetter: ctrd})
+
+			e := &fakeDockerEngine{info: tc.info, id: tc.id, archive: archive}
+			if e.id == "" {
+				e.id = ctrdImg.Target.Digest.String()
+			}
+			var host string
+			if tc.tcp {
+				srv := httptest.NewServer(e)
+				t.Cleanup(srv.Close)
+				host = "tcp://" + srv.Listener.Addr().String()
+			} else {
+				sock := filepath.Join(t.TempDir(), "docker.sock")
+				l, err := net.Listen("unix", sock)
+				if err != nil {
+					t.Skipf("unix sockets are not available: %v", err)
+				}
+				srv := httptest.NewUnstartedServer(e)
+				srv.Listener = l
+				srv.Start()
+				t.Cleanup(srv.Close)
+				host = "unix://" + sock
+			}
+			t.Setenv("DOCKER", "")
+			t.Setenv("DOCKER_CONFIG", t.TempDir())
+			t.Setenv("DOCKER_CONTEXT", "")
+			t.Setenv("DOCKER_HOST", host)
+			t.Setenv("DOCKER_TLS_VERIFY", "")
+
+			img, err := g.Get(ctx, dockerImagePrefix+"foo", plats, PullNever)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if img.Name != fakeDockerImageName {
+				t.Errorf("unexpected image name %q", img.Name)
+			}
+			expected := archiveConfig
+			if tc.containerd {
+				expected = ctrdConfig
+			}
+			mani, err := images.Manifest(ctx, g.ContentProvider(), img.Target, platforms.Default())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mani.Config.Digest != expected {
+				t.Errorf("expected the config %s, got %s", expected, mani.Config.Digest)
+			}
+			// The image is exported to the backend only when the containerd image store is not used
+			_, err = b.ImageService().Get(ctx, fakeDockerImageName)
+			if exported := err == nil; exported == tc.containerd {
+				t.Errorf("expected exported=%v, got %v", !tc.containerd, err)
+			}
+		})
+	}
+}
+
+func TestParseBackendRef(t *testing.T) {
+	testCases := []struct {
+		rawRef      string
+		backendName string
+		ns          string
+		rest        string
+		ok          bool
+	}{
+		{"containerd://k8s.io/foo:latest", "containerd", "k8s.io", "foo:latest", true},
+		{"containerd://k8s.io/example.com/foo:latest", "containerd", "k8s.io", "example.com/foo:latest", true},
+		{"containerd:///foo:latest", "containerd", "", "foo:latest", true},
+		{"containerd://k8s.io", "containerd", "k8s.io", "", true},
+		{"local://foo:latest", "local", "", "foo:latest", true},
+		{"foo:latest", "", "", "", false},
+		{"docker://foo:latest", "", "", "", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.rawRef, func(t *testing.T) {
+			backendName, ns, rest, ok := parseBackendRef(tc.rawRef)
+			if backendName != tc.backendName || ns != tc.ns || rest != tc.rest || ok != tc.ok {
+				t.Errorf("expected (%q, %q, %q, %v), got (%q, %q, %q, %v)",
+					tc.backendName, tc.ns, tc.rest, tc.ok, backendName, ns, rest, ok)
+			}
+		})
+	}
+}
+
+// namedBackend is a memory backend with another name.
+type namedBackend struct {
+	backend.Backend
+	name string
+}
+
+func (b *namedBackend) Info() backend.Info {
+	return backend.Info{Name: b.name}
+}
+
+func TestGetWithBackend(t *testing.T) {
+	ctx := context.Background()
+	plats := []ocispec.Platform{platforms.DefaultSpec()}
+	const name = "docker.io/library/foo:latest"
+	defaultBackend := &namedBackend{Backend: memorybackend.New(), name: "local"}
+	_, defaultConfig := createTestImage(t, defaultBackend, name, []byte("layer0"))
+	k8sBackend := memorybackend.New()
+	_, k8sConfig := createTestImage(t, k8sBackend, name, []byte("layer1"))
+	testCases := []struct {
+		rawRef   string
+		expected digest.Digest // the digest of the image config; empty for an error
+	}{
+		// The default backend is reused
+		{"local://foo", defaultConfig},
+		{"containerd://k8s.io/foo", k8sConfig},
+		{"containerd://k8s.io/", ""},
+		{"containerd://k8s.io/bar", ""},
+		{"containerd://default/foo", ""}, // the opener fails
+	}
+	g, err := New(io.Discard, defaultBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	if _, err = g.Get(ctx, "containerd://k8s.io/foo", plats, PullNever); !errors.Is(err, errdefs.ErrNotImplemented) {
+		t.Fatalf("expected ErrNotImplemented without a backend opener, got %v", err)
+	}
+	opened := make(map[string]int)
+	g.SetBackendOpener(func(_ context.Context, backendName, ns string) (backend.Backend, error) {
+		opened[backendName+"/"+ns]++
+		if backendName == "containerd" && ns == "k8s.io" {
+			return k8sBackend, nil
+		}
+		return nil, fmt.Errorf("unexpected backend %q (namespace %q)", backendName, ns)
+	})
+	// Each reference is resolved twice, to check the reuse of the backends
+	for range 2 {
+		for _, tc := range testCases {
+			img, err := g.Get(ctx, tc.rawRef, plats, PullNever)
+			if tc.expected == "" {
+				if err == nil {
+					t.Errorf("%s: expected an error, got %+v", tc.rawRef, img)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", tc.rawRef, err)
+			}
+			mani, err := images.Manifest(ctx, g.ContentProvider(), img.Target, platforms.Default())
+			if err != nil {
+				t.Fatalf("%s: %v", tc.rawRef, err)
+			}
+			if mani.Config.Digest != tc.expected {
+				t.Errorf("%s: expected the config %s, got %s", tc.rawRef, tc.expected, mani.Config.Digest)
+			}
+		}
+	}
+	// The failed opener is retried, while the opened backend is reused
+	expectedOpened := map[string]int{"containerd/k8s.io": 1, "containerd/default": 2}
+	if !reflect.DeepEqual(opened, expectedOpened) {
+		t.Errorf("expected the backends to be opened %v, got %v", expectedOpened, opened)
+	}
+}
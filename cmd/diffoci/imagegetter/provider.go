@@ -0,0 +1,49 @@
+package imagegetter
+
+import (
+	"context"
+	"errors"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/errdefs"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/reproducible-containers/diffoci/cmd/diffoci/backend"
+)
+
+// multiProvider tries the providers in order.
+// As the blobs are content-addressable, the first provider that has the blob wins.
+// A provider that fails for any reason (e.g., a closed connection) is skipped, and the errors
+// are returned only when no provider has the blob.
+type multiProvider struct {
+	providers []content.Provider
+}
+
+func newMultiProvider(providers []content.Provider) content.Provider {
+	return &multiProvider{providers: providers}
+}
+
+func (p *multiProvider) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	var errs []error
+	for _, provider := range p.providers {
+		ra, err := provider.ReaderAt(ctx, desc)
+		if err == nil {
+			return ra, nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return nil, errdefs.ErrNotFound
+	}
+	return nil, errors.Join(errs...)
+}
+
+// backendProvider is a provider that always uses the context of the backend (e.g., the containerd namespace),
+// regardless of the context of the caller.
+type backendProvider struct {
+	content.Provider
+	backend backend.Backend
+}
+
+func (p *backendProvider) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	return p.Provider.ReaderAt(p.backend.Context(ctx), desc)
+}
@@ -0,0 +1,82 @@
+package imagegetter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/reproducible-containers/diffoci/cmd/diffoci/backend/memorybackend"
+)
+
+// errProvider is a provider that always fails.
+type errProvider struct {
+	err error
+}
+
+func (p *errProvider) ReaderAt(context.Context, ocispec.Descriptor) (content.ReaderAt, error) {
+	return nil, p.err
+}
+
+func TestMultiProvider(t *testing.T) {
+	ctx := context.Background()
+	blob := []byte("blob")
+	desc := ocispec.Descriptor{Digest: digest.FromBytes(blob), Size: int64(len(blob))}
+	withBlob := memorybackend.NewContentStore()
+	if err := content.WriteBlob(ctx, withBlob, "blob", bytes.NewReader(blob), desc); err != nil {
+		t.Fatal(err)
+	}
+	empty := memorybackend.NewContentStore()
+	closed := &errProvider{err: errors.New("connection closed")}
+	testCases := []struct {
+		name      string
+		providers []content.Provider
+		found     bool
+		notFound  bool     // the error is ErrNotFound
+		errs      []string // the substrings of the error
+	}{
+		{name: "first", providers: []content.Provider{withBlob, empty}, found: true},
+		{name: "second", providers: []content.Provider{empty, withBlob}, found: true},
+		{name: "after a failure", providers: []content.Provider{closed, withBlob}, found: true},
+		{name: "no provider", notFound: true},
+		{name: "not found", providers: []content.Provider{empty, empty}, notFound: true},
+		{name: "failure and not found", providers: []content.Provider{empty, closed}, notFound: true, errs: []string{"connection closed"}},
+		{name: "failure", providers: []content.Provider{closed}, errs: []string{"connection closed"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ra, err := newMultiProvider(tc.providers).ReaderAt(ctx, desc)
+			if tc.found {
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer ra.Close()
+				b, err := io.ReadAll(content.NewReader(ra))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(b, blob) {
+					t.Errorf("expected %q, got %q", blob, b)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if notFound := errors.Is(err, errdefs.ErrNotFound); notFound != tc.notFound {
+				t.Errorf("expected notFound=%v, got %v", tc.notFound, err)
+			}
+			for _, s := range tc.errs {
+				if !strings.Contains(err.Error(), s) {
+					t.Errorf("expected the error to contain %q, got %v", s, err)
+				}
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/containerd/log"
 	"github.com/reproducible-containers/diffoci/cmd/diffoci/backend/backendmanager"
+	"github.com/reproducible-containers/diffoci/cmd/diffoci/commands/cache"
 	"github.com/reproducible-containers/diffoci/cmd/diffoci/commands/diff"
 	"github.com/reproducible-containers/diffoci/cmd/diffoci/commands/images"
 	"github.com/reproducible-containers/diffoci/cmd/diffoci/commands/info"
@@ -47,11 +48,13 @@ func newRootCommand() *cobra.Command {
 
 	cmd.AddCommand(
 		diff.NewCommand(),
+		diff.NewRootFSCommand(),
 		images.NewCommand(),
 		pull.NewCommand(),
 		load.NewCommand(),
 		remove.NewCommand(),
 		info.NewCommand(),
+		cache.NewCommand(),
 	)
 	return cmd
 }
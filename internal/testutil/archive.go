@@ -0,0 +1,138 @@
+// Package testutil provides the helpers shared by the tests of the packages.
+package testutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ModTime is the default timestamp of the test files and images.
+var ModTime = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// archiveFile is a file of an image archive.
+type archiveFile struct {
+	name string
+	body []byte
+}
+
+func writeTar(t testing.TB, files []archiveFile) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		hdr := &tar.Header{Name: f.name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(f.body)), ModTime: ModTime}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(f.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func marshalJSON(t testing.TB, v any) []byte {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// imageBlobs returns the config and the manifest of an image of the default platform with the uncompressed layers.
+func imageBlobs(t testing.TB, layers [][]byte) (config, manifest []byte) {
+	t.Helper()
+	created := ModTime
+	img := ocispec.Image{
+		Created:  &created,
+		Platform: platforms.DefaultSpec(),
+		RootFS:   ocispec.RootFS{Type: "layers"},
+	}
+	var layerDescs []ocispec.Descriptor
+	for _, l := range layers {
+		img.RootFS.DiffIDs = append(img.RootFS.DiffIDs, digest.FromBytes(l))
+		layerDescs = append(layerDescs, ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageLayer,
+			Digest:    digest.FromBytes(l),
+			Size:      int64(len(l)),
+		})
+	}
+	config = marshalJSON(t, img)
+	mani := ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config: ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageConfig,
+			Digest:    digest.FromBytes(config),
+			Size:      int64(len(config)),
+		},
+		Layers: layerDescs,
+	}
+	mani.SchemaVersion = 2
+	return config, marshalJSON(t, mani)
+}
+
+func blobName(b []byte) string {
+	d := digest.FromBytes(b)
+	return path.Join(ocispec.ImageBlobsDir, d.Algorithm().String(), d.Encoded())
+}
+
+// OCIArchive creates an OCI image archive ("oci-archive:") of an image with the layers.
+// The digest of the image config is returned too.
+func OCIArchive(t testing.TB, layers ...[]byte) ([]byte, digest.Digest) {
+	t.Helper()
+	config, manifest := imageBlobs(t, layers)
+	idx := ocispec.Index{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Digest:    digest.FromBytes(manifest),
+			Size:      int64(len(manifest)),
+		}},
+	}
+	idx.SchemaVersion = 2
+	files := []archiveFile{
+		{ocispec.ImageLayoutFile, marshalJSON(t, ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})},
+		{ocispec.ImageIndexFile, marshalJSON(t, idx)},
+		{blobName(config), config},
+		{blobName(manifest), manifest},
+	}
+	for _, l := range layers {
+		files = append(files, archiveFile{blobName(l), l})
+	}
+	return writeTar(t, files), digest.FromBytes(config)
+}
+
+// DockerArchive creates a Docker image archive ("docker-archive:", the format of `docker save`)
+// of an image with the layers, tagged with the name.
+// The digest of the image config is returned too.
+func DockerArchive(t testing.TB, name string, layers ...[]byte) ([]byte, digest.Digest) {
+	t.Helper()
+	config, _ := imageBlobs(t, layers)
+	configName := digest.FromBytes(config).Encoded() + ".json"
+	files := []archiveFile{{configName, config}}
+	var layerNames []string
+	for _, l := range layers {
+		layerName := digest.FromBytes(l).Encoded() + "/layer.tar"
+		layerNames = append(layerNames, layerName)
+		files = append(files, archiveFile{layerName, l})
+	}
+	manifest := []map[string]any{{
+		"Config":   configName,
+		"RepoTags": []string{name},
+		"Layers":   layerNames,
+	}}
+	files = append(files, archiveFile{"manifest.json", marshalJSON(t, manifest)})
+	return writeTar(t, files), digest.FromBytes(config)
+}
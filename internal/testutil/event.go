@@ -0,0 +1,58 @@
+package testutil
+
+import (
+	"context"
+	"sync"
+
+	"github.com/reproducible-containers/diffoci/pkg/diff"
+)
+
+// Event is a flattened [diff.EventTreeNode].
+type Event struct {
+	Type diff.EventType
+	Name string // the name of the tar entry, or the whiteout target
+	Note string
+}
+
+// FlattenEvent flattens the node, without the children.
+func FlattenEvent(node *diff.EventTreeNode) Event {
+	ev := Event{Type: node.Type, Name: node.Path, Note: node.Note}
+	for _, in := range node.Inputs {
+		if in.TarEntry != nil && ev.Name == "" {
+			ev.Name = in.TarEntry.Header.Name
+		}
+	}
+	return ev
+}
+
+// FlattenTree flattens the tree in the depth-first post-order, as a node is passed to the event handler
+// after its children.
+func FlattenTree(node *diff.EventTreeNode) []Event {
+	var res []Event
+	for _, child := range node.Children {
+		res = append(res, FlattenTree(child)...)
+		res = append(res, FlattenEvent(child))
+	}
+	return res
+}
+
+// EventRecorder is a [diff.EventHandler] that records the events passed to the handler.
+type EventRecorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+// HandleEventTreeNode implements [diff.EventHandler].
+func (h *EventRecorder) HandleEventTreeNode(_ context.Context, node *diff.EventTreeNode) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, FlattenEvent(node))
+	return nil
+}
+
+// Events returns the recorded events, in the order passed to the handler.
+func (h *EventRecorder) Events() []Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]Event(nil), h.events...)
+}
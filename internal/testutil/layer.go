@@ -0,0 +1,63 @@
+package testutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// File is an entry of a test layer.
+// Typeflag defaults to tar.TypeReg, Mode to 0644, and ModTime to [ModTime].
+type File struct {
+	Name     string
+	Body     string
+	Typeflag byte
+	Mode     int64
+	Linkname string
+	ModTime  time.Time
+	Uid      int
+	Gid      int
+}
+
+// Layer creates an uncompressed tar layer in the PAX format.
+func Layer(t testing.TB, files ...File) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		hdr := &tar.Header{
+			Name:     f.Name,
+			Typeflag: f.Typeflag,
+			Mode:     f.Mode,
+			Linkname: f.Linkname,
+			ModTime:  f.ModTime,
+			Uid:      f.Uid,
+			Gid:      f.Gid,
+			Format:   tar.FormatPAX,
+		}
+		if hdr.Typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0o644
+		}
+		if hdr.ModTime.IsZero() {
+			hdr.ModTime = ModTime
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(f.Body))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, f.Body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,430 @@
+// Package containersstorage provides read-only access to the image store of
+// Podman, Buildah, and CRI-O ("containers-storage").
+//
+// The blobs are served without copying:
+//   - Manifests and configs are read from the "big data" files of the images.
+//   - Layers are reassembled from the tar-split metadata and the extracted layer directories.
+//     The reassembled layers are uncompressed, but bit-for-bit identical to the decompressed original layers.
+//     The manifests are rewritten to refer to the uncompressed layers.
+package containersstorage
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/errdefs"
+	refdocker "github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// DefaultRoot is the default storage root for rootful Podman.
+	DefaultRoot = "/var/lib/containers/storage"
+)
+
+// drivers are the supported storage drivers.
+// Other drivers (e.g., btrfs, zfs) are not supported.
+var drivers = []string{"overlay", "vfs"}
+
+// RootlessRoot returns the default storage root for rootless Podman.
+func RootlessRoot() (string, error) {
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dataHome = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(dataHome, "containers", "storage"), nil
+}
+
+// DefaultRootForCurrentUser returns the storage root configured in storage.conf, in the same way as Podman.
+// Falls back to [DefaultRoot] for root, [RootlessRoot] otherwise.
+func DefaultRootForCurrentUser() (string, error) {
+	return defaultRoot(os.Geteuid() != 0)
+}
+
+type imageRecord struct {
+	ID             string                   `json:"id"`
+	Digest         digest.Digest            `json:"digest,omitempty"`
+	Names          []string                 `json:"names,omitempty"`
+	TopLayer       string                   `json:"layer,omitempty"`
+	BigDataNames   []string                 `json:"big-data-names,omitempty"`
+	BigDataSizes   map[string]int64         `json:"big-data-sizes,omitempty"`
+	BigDataDigests map[string]digest.Digest `json:"big-data-digests,omitempty"`
+	Created        time.Time                `json:"created,omitempty"`
+}
+
+type layerRecord struct {
+	ID                 string        `json:"id"`
+	Parent             string        `json:"parent,omitempty"`
+	CompressedDigest   digest.Digest `json:"compressed-diff-digest,omitempty"`
+	CompressedSize     int64         `json:"compressed-size,omitempty"`
+	UncompressedDigest digest.Digest `json:"diff-digest,omitempty"`
+	UncompressedSize   int64         `json:"diff-size,omitempty"`
+}
+
+type bigDataRef struct {
+	image *imageRecord
+	key   string
+}
+
+// Store implements [images.Store] and [content.Provider] for a storage root.
+// The store is read-only.
+//
+// As the layers are served uncompressed, the manifests are rewritten to refer to the layers
+// by the uncompressed digests. So the digest of an image may differ from the digest in the registry.
+type Store struct {
+	root       string
+	driver     string
+	images     []imageRecord
+	bigData    map[digest.Digest]bigDataRef
+	layers     map[digest.Digest]*layerRecord // by the uncompressed digest
+	compressed map[digest.Digest]*layerRecord // by the compressed digest, for rewriting the manifests
+
+	mu          sync.Mutex
+	rewritten   map[digest.Digest]ocispec.Descriptor // by the digest of the original manifest
+	synthesized map[digest.Digest][]byte             // the rewritten manifests
+}
+
+// Open opens the storage root.
+// The storage driver is detected automatically.
+func Open(root string) (*Store, error) {
+	s := &Store{
+		root:        root,
+		bigData:     make(map[digest.Digest]bigDataRef),
+		layers:      make(map[digest.Digest]*layerRecord),
+		compressed:  make(map[digest.Digest]*layerRecord),
+		rewritten:   make(map[digest.Digest]ocispec.Descriptor),
+		synthesized: make(map[digest.Digest][]byte),
+	}
+	var errs []error
+	for _, driver := range drivers {
+		if err := s.load(driver); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		s.driver = driver
+		return s, nil
+	}
+	return nil, fmt.Errorf("%q does not seem a containers-storage root (supported drivers: %v): %w", root, drivers, errors.Join(errs...))
+}
+
+func (s *Store) load(driver string) error {
+	imagesDir := filepath.Join(s.root, driver+"-images")
+	imagesJSON := filepath.Join(imagesDir, "images.json")
+	b, err := readFileRLocked(imagesJSON, filepath.Join(imagesDir, "images.lock"))
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(b, &s.images); err != nil {
+		return fmt.Errorf("failed to parse %q: %w", imagesJSON, err)
+	}
+	layersDir := filepath.Join(s.root, driver+"-layers")
+	layersJSON := filepath.Join(layersDir, "layers.json")
+	b, err = readFileRLocked(layersJSON, filepath.Join(layersDir, "layers.lock"))
+	if err != nil {
+		return err
+	}
+	var layers []layerRecord
+	if err = json.Unmarshal(b, &layers); err != nil {
+		return fmt.Errorf("failed to parse %q: %w", layersJSON, err)
+	}
+	for i := range s.images {
+		img := &s.images[i]
+		for key, d := range img.BigDataDigests {
+			s.bigData[d] = bigDataRef{image: img, key: key}
+		}
+	}
+	for i := range layers {
+		l := &layers[i]
+		if l.UncompressedDigest != "" {
+			s.layers[l.UncompressedDigest] = l
+		}
+		if l.CompressedDigest != "" {
+			s.compressed[l.CompressedDigest] = l
+		}
+	}
+	return nil
+}
+
+// Driver returns the detected storage driver.
+func (s *Store) Driver() string {
+	return s.driver
+}
+
+// bigDataPath returns the path of a big data file.
+// Keys that contain characters other than [.0-9a-z] are encoded in base64, with "=" prefix.
+func (s *Store) bigDataPath(imageID, key string) string {
+	base := key
+	for _, ch := range key {
+		if ch != '.' && (ch < '0' || ch > '9') && (ch < 'a' || ch > 'z') {
+			base = "=" + base64.StdEncoding.EncodeToString([]byte(key))
+			break
+		}
+	}
+	return filepath.Join(s.root, s.driver+"-images", imageID, base)
+}
+
+// readBigData reads the big data file of the digest.
+func (s *Store) readBigData(d digest.Digest) ([]byte, error) {
+	ref, ok := s.bigData[d]
+	if !ok {
+		return nil, fmt.Errorf("blob %s not found in %q: %w", d, s.root, errdefs.ErrNotFound)
+	}
+	b, err := os.ReadFile(s.bigDataPath(ref.image.ID, ref.key))
+	if err != nil {
+		return nil, err
+	}
+	if got := d.Algorithm().FromBytes(b); got != d {
+		return nil, fmt.Errorf("blob %s: unexpected digest %s", d, got)
+	}
+	return b, nil
+}
+
+// layerDir returns the path of the extracted layer directory.
+func (s *Store) layerDir(layerID string) string {
+	switch s.driver {
+	case "vfs":
+		return filepath.Join(s.root, "vfs", "dir", layerID)
+	default:
+		return filepath.Join(s.root, s.driver, layerID, "diff")
+	}
+}
+
+func (s *Store) tarSplitPath(layerID string) string {
+	return filepath.Join(s.root, s.driver+"-layers", layerID+".tar-split.gz")
+}
+
+// Lookup looks up an image by a name or an ID.
+// A short name like "foo" matches "docker.io/library/foo:latest" and "localhost/foo:latest".
+func (s *Store) Lookup(ctx context.Context, name string) (images.Image, error) {
+	candidates := []string{name}
+	if ref, err := refdocker.ParseDockerRef(name); err == nil {
+		candidates = append(candidates, ref.String())
+	}
+	if ref, err := refdocker.ParseDockerRef("localhost/" + name); err == nil {
+		candidates = append(candidates, ref.String())
+	}
+	for _, c := range candidates {
+		img, err := s.Get(ctx, c)
+		if err == nil {
+			return img, nil
+		}
+		if !errors.Is(err, errdefs.ErrNotFound) {
+			return images.Image{}, err
+		}
+	}
+	return s.getByID(name)
+}
+
+func (s *Store) getByID(id string) (images.Image, error) {
+	id = strings.TrimPrefix(id, "sha256:")
+	var found *imageRecord
+	if len(id) >= 12 {
+		for i := range s.images {
+			if strings.HasPrefix(s.images[i].ID, id) {
+				if found != nil {
+					return images.Image{}, fmt.Errorf("image ID %q is ambiguous", id)
+				}
+				found = &s.images[i]
+			}
+		}
+	}
+	if found == nil {
+		return images.Image{}, fmt.Errorf("image %q not found in %q: %w", id, s.root, errdefs.ErrNotFound)
+	}
+	return s.image(found, found.ID)
+}
+
+// image converts the record to [images.Image].
+func (s *Store) image(img *imageRecord, name string) (images.Image, error) {
+	d := img.Digest
+	if d == "" {
+		d = img.BigDataDigests["manifest"]
+	}
+	if _, ok := s.bigData[d]; d == "" || !ok {
+		return images.Image{}, fmt.Errorf("image %q (%s) lacks the manifest: %w", name, img.ID, errdefs.ErrNotFound)
+	}
+	b, err := s.readBigData(d)
+	if err != nil {
+		return images.Image{}, err
+	}
+	var probe struct {
+		MediaType string          `json:"mediaType,omitempty"`
+		Config    json.RawMessage `json:"config,omitempty"`
+		Manifests json.RawMessage `json:"manifests,omitempty"`
+	}
+	if err = json.Unmarshal(b, &probe); err != nil {
+		return images.Image{}, fmt.Errorf("failed to parse the manifest of image %q (%s): %w", name, img.ID, err)
+	}
+	mt := probe.MediaType
+	if mt == "" {
+		switch {
+		case probe.Manifests != nil:
+			mt = ocispec.MediaTypeImageIndex
+		case probe.Config != nil:
+			mt = ocispec.MediaTypeImageManifest
+		default:
+			return images.Image{}, fmt.Errorf("failed to detect the media type of the manifest of image %q (%s)", name, img.ID)
+		}
+	}
+	s.mu.Lock()
+	target, err := s.rewriteManifest(ocispec.Descriptor{
+		MediaType: mt,
+		Digest:    d,
+		Size:      int64(len(b)),
+	})
+	s.mu.Unlock()
+	if err != nil {
+		return images.Image{}, fmt.Errorf("failed to rewrite the manifest of image %q (%s): %w", name, img.ID, err)
+	}
+	return images.Image{
+		Name:      name,
+		Target:    target,
+		CreatedAt: img.Created,
+		UpdatedAt: img.Created,
+	}, nil
+}
+
+// rewriteManifest returns the descriptor of the manifest (or the index) that refers to the layers
+// by the uncompressed digests, as the layers are served uncompressed.
+// The descriptor is returned unmodified when the manifest does not need to be rewritten,
+// or when the manifest is not stored (e.g., the manifests for other platforms).
+//
+// s.mu has to be locked.
+func (s *Store) rewriteManifest(desc ocispec.Descriptor) (ocispec.Descriptor, error) {
+	if res, ok := s.rewritten[desc.Digest]; ok {
+		return res, nil
+	}
+	b, err := s.readBigData(desc.Digest)
+	if err != nil {
+		if errors.Is(err, errdefs.ErrNotFound) {
+			return desc, nil
+		}
+		return desc, err
+	}
+	var changed bool
+	switch desc.MediaType {
+	case images.MediaTypeDockerSchema2Manifest, ocispec.MediaTypeImageManifest:
+		var mani ocispec.Manifest
+		if err = json.Unmarshal(b, &mani); err != nil {
+			return desc, fmt.Errorf("failed to parse manifest %s: %w", desc.Digest, err)
+		}
+		for i, l := range mani.Layers {
+			lr, ok := s.compressed[l.Digest]
+			if !ok || lr.UncompressedDigest == "" || lr.UncompressedDigest == l.Digest {
+				continue
+			}
+			mani.Layers[i].MediaType = uncompressedMediaType(l.MediaType)
+			mani.Layers[i].Digest = lr.UncompressedDigest
+			mani.Layers[i].Size = lr.UncompressedSize
+			changed = true
+		}
+		if changed {
+			b, err = json.Marshal(&mani)
+		}
+	case images.MediaTypeDockerSchema2ManifestList, ocispec.MediaTypeImageIndex:
+		var idx ocispec.Index
+		if err = json.Unmarshal(b, &idx); err != nil {
+			return desc, fmt.Errorf("failed to parse index %s: %w", desc.Digest, err)
+		}
+		for i, m := range idx.Manifests {
+			rewritten, err := s.rewriteManifest(m)
+			if err != nil {
+				return desc, err
+			}
+			if rewritten.Digest != m.Digest {
+				idx.Manifests[i] = rewritten
+				changed = true
+			}
+		}
+		if changed {
+			b, err = json.Marshal(&idx)
+		}
+	}
+	if err != nil {
+		return desc, err
+	}
+	res := desc
+	if changed {
+		res.Digest = digest.FromBytes(b)
+		res.Size = int64(len(b))
+		s.synthesized[res.Digest] = b
+	}
+	s.rewritten[desc.Digest] = res
+	return res, nil
+}
+
+// uncompressedMediaType returns the media type of the uncompressed layer.
+func uncompressedMediaType(mt string) string {
+	switch mt {
+	case images.MediaTypeDockerSchema2LayerGzip:
+		return images.MediaTypeDockerSchema2Layer
+	case images.MediaTypeDockerSchema2LayerForeignGzip:
+		return images.MediaTypeDockerSchema2LayerForeign
+	}
+	for _, suffix := range []string{"+gzip", "+zstd"} {
+		if strings.HasSuffix(mt, suffix) {
+			return strings.TrimSuffix(mt, suffix)
+		}
+	}
+	return mt
+}
+
+// Get implements [images.Store].
+func (s *Store) Get(ctx context.Context, name string) (images.Image, error) {
+	for i := range s.images {
+		for _, n := range s.images[i].Names {
+			if n == name {
+				return s.image(&s.images[i], name)
+			}
+		}
+	}
+	return images.Image{}, fmt.Errorf("image %q not found in %q: %w", name, s.root, errdefs.ErrNotFound)
+}
+
+// List implements [images.Store].
+// Filters are not supported.
+func (s *Store) List(ctx context.Context, filters ...string) ([]images.Image, error) {
+	if len(filters) > 0 {
+		return nil, fmt.Errorf("filters are not supported: %w", errdefs.ErrNotImplemented)
+	}
+	var res []images.Image
+	for i := range s.images {
+		for _, n := range s.images[i].Names {
+			img, err := s.image(&s.images[i], n)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, img)
+		}
+	}
+	return res, nil
+}
+
+// Create implements [images.Store]. Not supported.
+func (s *Store) Create(ctx context.Context, image images.Image) (images.Image, error) {
+	return images.Image{}, fmt.Errorf("containers-storage is read-only: %w", errdefs.ErrNotImplemented)
+}
+
+// Update implements [images.Store]. Not supported.
+func (s *Store) Update(ctx context.Context, image images.Image, fieldpaths ...string) (images.Image, error) {
+	return images.Image{}, fmt.Errorf("containers-storage is read-only: %w", errdefs.ErrNotImplemented)
+}
+
+// Delete implements [images.Store]. Not supported.
+func (s *Store) Delete(ctx context.Context, name string, opts ...images.DeleteOpt) error {
+	return fmt.Errorf("containers-storage is read-only: %w", errdefs.ErrNotImplemented)
+}
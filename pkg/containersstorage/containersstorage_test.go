@@ -0,0 +1,343 @@
+package containersstorage
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// writeLayer writes a layer with the files to the storage root, and returns the uncompressed tar.
+// The file contents are extracted in the layer directory, and the rest is recorded in the tar-split metadata.
+func writeLayer(t *testing.T, root, layerID string, files map[string]string, names []string) []byte {
+	t.Helper()
+	var (
+		w        bytes.Buffer
+		tw       = tar.NewWriter(&w)
+		tarSplit bytes.Buffer
+		gz       = gzip.NewWriter(&tarSplit)
+		enc      = json.NewEncoder(gz)
+		segStart int
+	)
+	diffDir := filepath.Join(root, "overlay", layerID, "diff")
+	if err := os.MkdirAll(diffDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	segment := func(end int) {
+		if err := enc.Encode(tarSplitEntry{Type: tarSplitSegmentType, Payload: w.Bytes()[segStart:end]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range names {
+		body := files[name]
+		hdr := &tar.Header{Name: name, Mode: 0o644, Size: int64(len(body)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		segment(w.Len())
+		if err := enc.Encode(tarSplitEntry{Type: tarSplitFileType, Name: name, Size: hdr.Size}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+		segStart = w.Len()
+		if err := os.WriteFile(filepath.Join(diffDir, name), []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	segment(w.Len())
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layersDir := filepath.Join(root, "overlay-layers")
+	if err := os.MkdirAll(layersDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(layersDir, layerID+".tar-split.gz"), tarSplit.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return w.Bytes()
+}
+
+func writeJSON(t *testing.T, p string, v any) {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(p, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fixture is a storage root with an image "localhost/foo:latest" that has a single layer.
+type fixture struct {
+	root       string
+	layer      []byte
+	compressed digest.Digest // the digest of the original compressed layer
+	config     ocispec.Descriptor
+	manifest   ocispec.Descriptor
+}
+
+func newFixture(t *testing.T) *fixture {
+	f := &fixture{root: t.TempDir()}
+	f.layer = writeLayer(t, f.root, "layer0", map[string]string{"foo": "foo\n", "bar": "bar\n"}, []string{"foo", "bar"})
+	var gzLayer bytes.Buffer
+	gz := gzip.NewWriter(&gzLayer)
+	if _, err := gz.Write(f.layer); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.compressed = digest.FromBytes(gzLayer.Bytes())
+	writeJSON(t, filepath.Join(f.root, "overlay-layers", "layers.json"), []layerRecord{
+		{
+			ID:                 "layer0",
+			CompressedDigest:   f.compressed,
+			CompressedSize:     int64(gzLayer.Len()),
+			UncompressedDigest: digest.FromBytes(f.layer),
+			UncompressedSize:   int64(len(f.layer)),
+		},
+	})
+
+	config, err := json.Marshal(ocispec.Image{
+		Platform: platforms.DefaultSpec(),
+		RootFS:   ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{digest.FromBytes(f.layer)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.config = ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig, Digest: digest.FromBytes(config), Size: int64(len(config))}
+	mani := ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    f.config,
+		Layers: []ocispec.Descriptor{
+			{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: f.compressed, Size: int64(gzLayer.Len())},
+		},
+	}
+	mani.SchemaVersion = 2
+	manifest, err := json.Marshal(mani)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.manifest = ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(manifest), Size: int64(len(manifest))}
+
+	const imageID = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	imageDir := filepath.Join(f.root, "overlay-images", imageID)
+	if err = os.MkdirAll(imageDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	configKey := f.config.Digest.String()
+	manifestKey := "manifest-" + f.manifest.Digest.String()
+	// keys other than [.0-9a-z] are encoded in base64
+	bigData := map[string]struct {
+		file string
+		b    []byte
+	}{
+		"manifest":  {"manifest", manifest},
+		manifestKey: {"=" + base64.StdEncoding.EncodeToString([]byte(manifestKey)), manifest},
+		configKey:   {"=" + base64.StdEncoding.EncodeToString([]byte(configKey)), config},
+	}
+	digests := make(map[string]digest.Digest)
+	for key, v := range bigData {
+		if err = os.WriteFile(filepath.Join(imageDir, v.file), v.b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		digests[key] = digest.FromBytes(v.b)
+	}
+	writeJSON(t, filepath.Join(f.root, "overlay-images", "images.json"), []imageRecord{
+		{
+			ID:             imageID,
+			Digest:         f.manifest.Digest,
+			Names:          []string{"localhost/foo:latest"},
+			TopLayer:       "layer0",
+			BigDataDigests: digests,
+		},
+	})
+	// lock files are created by containers-storage
+	for _, p := range []string{"overlay-images/images.lock", "overlay-layers/layers.lock"} {
+		if err = os.WriteFile(filepath.Join(f.root, p), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return f
+}
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	f := newFixture(t)
+	s, err := Open(f.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Driver() != "overlay" {
+		t.Fatalf("unexpected driver %q", s.Driver())
+	}
+	for _, name := range []string{"foo", "localhost/foo:latest", "0123456789ab"} {
+		if _, err := s.Lookup(ctx, name); err != nil {
+			t.Fatalf("Lookup(%q): %v", name, err)
+		}
+	}
+	if _, err := s.Lookup(ctx, "bar"); !errors.Is(err, errdefs.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	img, err := s.Lookup(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Target.Digest == f.manifest.Digest {
+		t.Fatal("the manifest must be rewritten to refer to the uncompressed layer")
+	}
+	manifest, err := images.Manifest(ctx, s, img.Target, platforms.All)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Config.Digest != f.config.Digest {
+		t.Fatalf("unexpected config %v", manifest.Config)
+	}
+	if len(manifest.Layers) != 1 {
+		t.Fatalf("unexpected layers %v", manifest.Layers)
+	}
+	layerDesc := manifest.Layers[0]
+	expected := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayer,
+		Digest:    digest.FromBytes(f.layer),
+		Size:      int64(len(f.layer)),
+	}
+	if layerDesc.MediaType != expected.MediaType || layerDesc.Digest != expected.Digest || layerDesc.Size != expected.Size {
+		t.Fatalf("expected %v, got %v", expected, layerDesc)
+	}
+	b, err := content.ReadBlob(ctx, s, layerDesc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, f.layer) {
+		t.Fatal("the reassembled layer differs from the original layer")
+	}
+	// The uncompressed data must not be served as the compressed blob
+	if _, err = s.ReaderAt(ctx, ocispec.Descriptor{Digest: f.compressed}); !errors.Is(err, errdefs.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for the compressed digest, got %v", err)
+	}
+	if available, _, _, missing, err := images.Check(ctx, s, img.Target, platforms.All); err != nil || !available {
+		t.Fatalf("expected the image to be available, got missing %v: %v", missing, err)
+	}
+}
+
+func TestStoreCorruptedLayer(t *testing.T) {
+	ctx := context.Background()
+	f := newFixture(t)
+	if err := os.WriteFile(filepath.Join(f.root, "overlay", "layer0", "diff", "foo"), []byte("FOO\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(f.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ra, err := s.ReaderAt(ctx, ocispec.Descriptor{Digest: digest.FromBytes(f.layer), Size: int64(len(f.layer))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ra.Close()
+	// The digest is verified on reaching EOF
+	if _, err = io.ReadAll(content.NewReader(ra)); err == nil || !strings.Contains(err.Error(), "unexpected digest") {
+		t.Fatalf("expected a digest mismatch, got %v", err)
+	}
+}
+
+func TestUncompressedMediaType(t *testing.T) {
+	testCases := map[string]string{
+		images.MediaTypeDockerSchema2LayerGzip:        images.MediaTypeDockerSchema2Layer,
+		images.MediaTypeDockerSchema2LayerForeignGzip: images.MediaTypeDockerSchema2LayerForeign,
+		ocispec.MediaTypeImageLayerGzip:               ocispec.MediaTypeImageLayer,
+		ocispec.MediaTypeImageLayerZstd:               ocispec.MediaTypeImageLayer,
+		ocispec.MediaTypeImageLayer:                   ocispec.MediaTypeImageLayer,
+	}
+	for mt, expected := range testCases {
+		if got := uncompressedMediaType(mt); got != expected {
+			t.Errorf("%q: expected %q, got %q", mt, expected, got)
+		}
+	}
+}
+
+func TestDefaultRoot(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	t.Setenv("XDG_DATA_HOME", "")
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "config"))
+	conf := filepath.Join(dir, "storage.conf")
+	testCases := []struct {
+		conf     string // empty for the user storage.conf that does not exist
+		rootless bool
+		expected string
+	}{
+		{
+			conf:     "[storage]\ngraphroot = \"/srv/containers\"\n",
+			expected: "/srv/containers",
+		},
+		{
+			conf:     "[storage]\ndriver = \"overlay\"\n",
+			expected: DefaultRoot,
+		},
+		{
+			conf:     "[storage]\ngraphroot = \"$HOME/storage\"\n",
+			rootless: true,
+			expected: filepath.Join(dir, "storage"),
+		},
+		{
+			conf:     "[storage]\ngraphroot = \"/srv/containers\"\nrootless_storage_path = \"$HOME/rootless\"\n",
+			rootless: true,
+			expected: filepath.Join(dir, "rootless"),
+		},
+		{
+			rootless: true,
+			expected: filepath.Join(dir, ".local", "share", "containers", "storage"),
+		},
+	}
+	for i, tc := range testCases {
+		if tc.conf != "" {
+			if err := os.WriteFile(conf, []byte(tc.conf), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("CONTAINERS_STORAGE_CONF", conf)
+		} else {
+			t.Setenv("CONTAINERS_STORAGE_CONF", "")
+		}
+		got, err := defaultRoot(tc.rootless)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if tc.conf == "" {
+			// The system-wide storage.conf of the host may be used
+			if _, err := os.Stat(SystemStorageConf); err == nil {
+				continue
+			}
+		}
+		if got != tc.expected {
+			t.Errorf("#%d: expected %q, got %q", i, tc.expected, got)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package containersstorage
+
+import "os"
+
+// readFileRLocked reads the file without locking lockPath, as containers-storage does not support
+// this platform.
+func readFileRLocked(p, _ string) ([]byte, error) {
+	return os.ReadFile(p)
+}
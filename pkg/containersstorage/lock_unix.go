@@ -0,0 +1,34 @@
+//go:build unix
+
+package containersstorage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// readFileRLocked reads the file while holding the read lock of lockPath.
+// The lock is compatible with the lock files of containers-storage (github.com/containers/storage/pkg/lockfile),
+// which use POSIX record locks.
+// The file is read without the lock when lockPath does not exist.
+func readFileRLocked(p, lockPath string) ([]byte, error) {
+	lockFile, err := os.Open(lockPath)
+	switch {
+	case err == nil:
+		defer lockFile.Close() // releases the lock
+		lk := unix.Flock_t{
+			Type:   unix.F_RDLCK,
+			Whence: io.SeekStart,
+		}
+		if err = unix.FcntlFlock(lockFile.Fd(), unix.F_SETLKW, &lk); err != nil {
+			return nil, fmt.Errorf("failed to lock %q: %w", lockPath, err)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+	return os.ReadFile(p)
+}
@@ -0,0 +1,244 @@
+package containersstorage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ReaderAt implements [content.Provider].
+func (s *Store) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	s.mu.Lock()
+	b, ok := s.synthesized[desc.Digest]
+	s.mu.Unlock()
+	if ok {
+		return &bytesReaderAt{Reader: bytes.NewReader(b)}, nil
+	}
+	if _, ok := s.bigData[desc.Digest]; ok {
+		b, err := s.readBigData(desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		return &bytesReaderAt{Reader: bytes.NewReader(b)}, nil
+	}
+	if l, ok := s.layers[desc.Digest]; ok {
+		return &layerReaderAt{
+			s:     s,
+			layer: l,
+		}, nil
+	}
+	return nil, fmt.Errorf("blob %s not found in %q: %w", desc.Digest, s.root, errdefs.ErrNotFound)
+}
+
+type bytesReaderAt struct {
+	*bytes.Reader
+}
+
+func (ra *bytesReaderAt) Close() error {
+	return nil
+}
+
+// layerReaderAt reassembles an uncompressed layer on the first read.
+// Only sequential reads are supported.
+type layerReaderAt struct {
+	s     *Store
+	layer *layerRecord
+	r     *layerReader
+	off   int64
+}
+
+func (ra *layerReaderAt) open() error {
+	if ra.r != nil {
+		return nil
+	}
+	r, err := ra.s.openLayer(ra.layer)
+	if err != nil {
+		return err
+	}
+	ra.r = r
+	return nil
+}
+
+// Reader is used by [content.NewReader].
+func (ra *layerReaderAt) Reader() io.Reader {
+	return &sequentialReader{ra: ra}
+}
+
+type sequentialReader struct {
+	ra *layerReaderAt
+}
+
+func (r *sequentialReader) Read(p []byte) (int, error) {
+	return r.ra.ReadAt(p, r.ra.off)
+}
+
+func (ra *layerReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if err := ra.open(); err != nil {
+		return 0, err
+	}
+	if off != ra.off {
+		return 0, fmt.Errorf("layer %s: non-sequential read (offset %d, expected %d): %w", ra.layer.ID, off, ra.off, errdefs.ErrNotImplemented)
+	}
+	// ReadAt must not return a short read without an error
+	n, err := io.ReadFull(ra.r, p)
+	ra.off += int64(n)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Size returns the uncompressed size, as the reassembled layer is uncompressed.
+func (ra *layerReaderAt) Size() int64 {
+	return ra.layer.UncompressedSize
+}
+
+func (ra *layerReaderAt) Close() error {
+	if ra.r == nil {
+		return nil
+	}
+	return ra.r.Close()
+}
+
+// tarSplitEntry is an entry of the tar-split metadata (github.com/vbatts/tar-split/tar/storage).
+type tarSplitEntry struct {
+	Type    int    `json:"type"`
+	Name    string `json:"name,omitempty"`
+	NameRaw []byte `json:"name_raw,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+	Payload []byte `json:"payload"`
+}
+
+const (
+	tarSplitFileType    = 1
+	tarSplitSegmentType = 2
+)
+
+// layerReader reassembles the tar stream of a layer from the tar-split metadata.
+type layerReader struct {
+	dir      string
+	layerID  string
+	f        *os.File
+	gz       *gzip.Reader
+	dec      *json.Decoder
+	cur      io.Reader
+	curFile  *os.File
+	digester digest.Digester
+	expected digest.Digest
+}
+
+func (s *Store) openLayer(l *layerRecord) (*layerReader, error) {
+	f, err := os.Open(s.tarSplitPath(l.ID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the tar-split metadata of layer %s: %w", l.ID, err)
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to decompress the tar-split metadata of layer %s: %w", l.ID, err)
+	}
+	r := &layerReader{
+		dir:      s.layerDir(l.ID),
+		layerID:  l.ID,
+		f:        f,
+		gz:       gz,
+		dec:      json.NewDecoder(bufio.NewReader(gz)),
+		expected: l.UncompressedDigest,
+	}
+	if r.expected != "" {
+		r.digester = r.expected.Algorithm().Digester()
+	}
+	return r, nil
+}
+
+func (r *layerReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur != nil {
+			n, err := r.cur.Read(p)
+			if r.digester != nil {
+				r.digester.Hash().Write(p[:n])
+			}
+			if errors.Is(err, io.EOF) {
+				r.cur = nil
+				if r.curFile != nil {
+					r.curFile.Close()
+					r.curFile = nil
+				}
+				err = nil
+			}
+			if n > 0 || err != nil {
+				return n, err
+			}
+			continue
+		}
+		var ent tarSplitEntry
+		if err := r.dec.Decode(&ent); err != nil {
+			if errors.Is(err, io.EOF) {
+				if r.digester != nil {
+					if got := r.digester.Digest(); got != r.expected {
+						return 0, fmt.Errorf("layer %s: unexpected digest %s (expected %s)", r.layerID, got, r.expected)
+					}
+				}
+				return 0, io.EOF
+			}
+			return 0, fmt.Errorf("failed to decode the tar-split metadata of layer %s: %w", r.layerID, err)
+		}
+		switch ent.Type {
+		case tarSplitSegmentType:
+			r.cur = bytes.NewReader(ent.Payload)
+		case tarSplitFileType:
+			if ent.Size == 0 {
+				continue
+			}
+			name := ent.Name
+			if len(ent.NameRaw) > 0 {
+				name = string(ent.NameRaw)
+			}
+			f, err := os.Open(filepath.Join(r.dir, filepath.Clean("/"+name)))
+			if err != nil {
+				return 0, fmt.Errorf("layer %s: %w", r.layerID, err)
+			}
+			r.curFile = f
+			r.cur = &exactReader{r: io.LimitReader(f, ent.Size), remaining: ent.Size, name: name}
+		default:
+			return 0, fmt.Errorf("layer %s: unknown tar-split entry type %d", r.layerID, ent.Type)
+		}
+	}
+}
+
+func (r *layerReader) Close() error {
+	var errs []error
+	if r.curFile != nil {
+		errs = append(errs, r.curFile.Close())
+	}
+	errs = append(errs, r.gz.Close(), r.f.Close())
+	return errors.Join(errs...)
+}
+
+// exactReader fails when the file is shorter than recorded in the tar-split metadata.
+type exactReader struct {
+	r         io.Reader
+	remaining int64
+	name      string
+}
+
+func (r *exactReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.remaining -= int64(n)
+	if errors.Is(err, io.EOF) && r.remaining > 0 {
+		return n, fmt.Errorf("file %q is shorter than expected: %w", r.name, io.ErrUnexpectedEOF)
+	}
+	return n, err
+}
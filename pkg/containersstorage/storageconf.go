@@ -0,0 +1,110 @@
+package containersstorage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+const (
+	// SystemStorageConf is the system-wide storage.conf.
+	SystemStorageConf = "/etc/containers/storage.conf"
+	// systemStorageConfFallback is used when [SystemStorageConf] does not exist.
+	systemStorageConfFallback = "/usr/share/containers/storage.conf"
+)
+
+// storageConf is the subset of storage.conf (containers-storage.conf(5)) used by diffoci.
+type storageConf struct {
+	Storage struct {
+		GraphRoot           string `toml:"graphroot"`
+		RootlessStoragePath string `toml:"rootless_storage_path"`
+	} `toml:"storage"`
+}
+
+// loadStorageConf loads storage.conf.
+// Returns nil if the file does not exist.
+func loadStorageConf(p string) (*storageConf, error) {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var conf storageConf
+	if err = toml.Unmarshal(b, &conf); err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %w", p, err)
+	}
+	return &conf, nil
+}
+
+// storageConfPaths returns the candidates of storage.conf, in the order of precedence.
+// userConf is true for the files owned by the user ($CONTAINERS_STORAGE_CONF and ~/.config/containers/storage.conf).
+func storageConfPaths(rootless bool) (paths []string, userConf []bool) {
+	if p := os.Getenv("CONTAINERS_STORAGE_CONF"); p != "" {
+		return []string{p}, []bool{true}
+	}
+	if rootless {
+		configHome := os.Getenv("XDG_CONFIG_HOME")
+		if configHome == "" {
+			if home, err := os.UserHomeDir(); err == nil {
+				configHome = filepath.Join(home, ".config")
+			}
+		}
+		if configHome != "" {
+			paths = append(paths, filepath.Join(configHome, "containers", "storage.conf"))
+			userConf = append(userConf, true)
+		}
+	}
+	paths = append(paths, SystemStorageConf, systemStorageConfFallback)
+	userConf = append(userConf, false, false)
+	return paths, userConf
+}
+
+// defaultRoot returns the storage root configured in storage.conf.
+// Only the first existing storage.conf is used, as in containers-storage.
+//
+// For rootless, "rootless_storage_path" is used if set, and "graphroot" is used only when storage.conf is
+// owned by the user.
+func defaultRoot(rootless bool) (string, error) {
+	paths, userConf := storageConfPaths(rootless)
+	for i, p := range paths {
+		conf, err := loadStorageConf(p)
+		if err != nil {
+			return "", err
+		}
+		if conf == nil {
+			continue
+		}
+		if rootless && conf.Storage.RootlessStoragePath != "" {
+			return expandStoragePath(conf.Storage.RootlessStoragePath), nil
+		}
+		if (!rootless || userConf[i]) && conf.Storage.GraphRoot != "" {
+			return expandStoragePath(conf.Storage.GraphRoot), nil
+		}
+		break
+	}
+	if !rootless {
+		return DefaultRoot, nil
+	}
+	return RootlessRoot()
+}
+
+// expandStoragePath expands $HOME, $UID, and $USER, as well as other environment variables.
+func expandStoragePath(p string) string {
+	return os.Expand(p, func(k string) string {
+		switch k {
+		case "UID":
+			return strconv.Itoa(os.Geteuid())
+		case "HOME":
+			if home, err := os.UserHomeDir(); err == nil {
+				return home
+			}
+		}
+		return os.Getenv(k)
+	})
+}
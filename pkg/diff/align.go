@@ -0,0 +1,442 @@
+package diff
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/containerd/log"
+	"github.com/google/go-cmp/cmp"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// emptyLayerDiffID is the DiffID of an empty tar (1024 zero bytes).
+// BuildKit omits the empty layers that are created by the legacy builder for metadata-only instructions.
+const emptyLayerDiffID = digest.Digest("sha256:5f70bf18a086007016e948b04aed3b82103a36bea41755b6cddfaf10ace3c6ef")
+
+// maxLayerAlignmentCells is the maximum size of the table for aligning the layers with the longest common subsequence.
+const maxLayerAlignmentCells = 1 << 20
+
+// layerRun is the layers [start, end) of an input.
+type layerRun struct {
+	start, end int
+}
+
+func (r layerRun) len() int {
+	return r.end - r.start
+}
+
+func (r layerRun) String() string {
+	switch r.len() {
+	case 0:
+		return "none"
+	case 1:
+		return strconv.Itoa(r.start)
+	default:
+		return fmt.Sprintf("%d-%d", r.start, r.end-1)
+	}
+}
+
+// layerAlignment is a pair of the layer runs to be compared.
+// A run with multiple layers is merged into a single layer.
+type layerAlignment [2]layerRun
+
+func (a layerAlignment) String() string {
+	return a[0].String() + ":" + a[1].String()
+}
+
+func formatLayerAlignments(aligns []layerAlignment) string {
+	ss := make([]string, len(aligns))
+	for i, a := range aligns {
+		ss[i] = a.String()
+	}
+	return "[" + strings.Join(ss, " ") + "]"
+}
+
+// layerIdentities returns the identities of the layers for the alignment.
+// The DiffIDs are used if available for both the inputs, so that the layers compressed differently are aligned.
+func (d *differ) layerIdentities(ctx context.Context, in [2]EventInput) (ids [2][]digest.Digest, empty [2][]bool) {
+	var diffIDs [2][]digest.Digest
+	for i := 0; i < 2; i++ {
+		config, err := readBlobWithType[ocispec.Image](ctx, d.cs, in[i].Manifest.Config, d.o.MaxScale)
+		if err != nil {
+			log.G(ctx).WithError(err).Debugf("Failed to read the config of input %d, aligning the layers with the digests", i)
+			break
+		}
+		if len(config.RootFS.DiffIDs) != len(in[i].Manifest.Layers) {
+			break
+		}
+		diffIDs[i] = config.RootFS.DiffIDs
+	}
+	useDiffIDs := diffIDs[0] != nil && diffIDs[1] != nil
+	for i := 0; i < 2; i++ {
+		layers := in[i].Manifest.Layers
+		ids[i] = make([]digest.Digest, len(layers))
+		empty[i] = make([]bool, len(layers))
+		for j, desc := range layers {
+			ids[i][j] = desc.Digest
+			if useDiffIDs {
+				ids[i][j] = diffIDs[i][j]
+				empty[i][j] = diffIDs[i][j] == emptyLayerDiffID
+			}
+		}
+	}
+	return ids, empty
+}
+
+// layerNamesFunc returns the names of the non-directory entries of the layer j of the input i,
+// for splitting the differing layers by the similarity.
+// Returns nil if the names are not available.
+type layerNamesFunc func(i, j int) map[string]struct{}
+
+// alignLayers aligns the layers of the two inputs.
+//
+// The identical layers are paired one-to-one, using the longest common subsequence of the identities.
+// Between the identical layers, the differing layers are paired one-to-one if the numbers of the non-empty
+// layers match, ignoring the empty layers.
+// Otherwise the differing layers are split into the smallest runs by the similarity of the entry names (see alignGap),
+// or merged into a single run for each of the inputs.
+func alignLayers(ids [2][]digest.Digest, empty [2][]bool, names layerNamesFunc) []layerAlignment {
+	n0, n1 := len(ids[0]), len(ids[1])
+	// Pair the identical prefix and suffix
+	prefix := 0
+	for prefix < n0 && prefix < n1 && ids[0][prefix] == ids[1][prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < n0-prefix && suffix < n1-prefix && ids[0][n0-1-suffix] == ids[1][n1-1-suffix] {
+		suffix++
+	}
+	var aligns []layerAlignment
+	for j := 0; j < prefix; j++ {
+		aligns = append(aligns, layerAlignment{{j, j + 1}, {j, j + 1}})
+	}
+	mid := layerAlignment{{prefix, n0 - suffix}, {prefix, n1 - suffix}}
+	for _, anchor := range commonLayers(ids, mid) {
+		gap := layerAlignment{{mid[0].start, anchor[0]}, {mid[1].start, anchor[1]}}
+		aligns = append(aligns, alignGap(gap, empty, names)...)
+		aligns = append(aligns, layerAlignment{{anchor[0], anchor[0] + 1}, {anchor[1], anchor[1] + 1}})
+		mid[0].start, mid[1].start = anchor[0]+1, anchor[1]+1
+	}
+	aligns = append(aligns, alignGap(mid, empty, names)...)
+	for j := 0; j < suffix; j++ {
+		aligns = append(aligns, layerAlignment{{n0 - suffix + j, n0 - suffix + j + 1}, {n1 - suffix + j, n1 - suffix + j + 1}})
+	}
+	return aligns
+}
+
+// commonLayers returns the pairs of the indexes of the longest common subsequence of the identities in mid.
+func commonLayers(ids [2][]digest.Digest, mid layerAlignment) [][2]int {
+	m, n := mid[0].len(), mid[1].len()
+	if m == 0 || n == 0 || (m+1)*(n+1) > maxLayerAlignmentCells {
+		return nil
+	}
+	a, b := ids[0][mid[0].start:mid[0].end], ids[1][mid[1].start:mid[1].end]
+	// lcs[i*(n+1)+j] is the length of the LCS of a[i:] and b[j:]
+	lcs := make([]int32, (m+1)*(n+1))
+	for i := m - 1; i >= 0; i-- {
+		for j := n - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i*(n+1)+j] = lcs[(i+1)*(n+1)+j+1] + 1
+			default:
+				lcs[i*(n+1)+j] = max(lcs[(i+1)*(n+1)+j], lcs[i*(n+1)+j+1])
+			}
+		}
+	}
+	var res [][2]int
+	for i, j := 0, 0; i < m && j < n; {
+		switch {
+		case a[i] == b[j]:
+			res = append(res, [2]int{mid[0].start + i, mid[1].start + j})
+			i++
+			j++
+		case lcs[(i+1)*(n+1)+j] >= lcs[i*(n+1)+j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return res
+}
+
+// alignGap aligns the differing layers between the identical layers.
+func alignGap(gap layerAlignment, empty [2][]bool, names layerNamesFunc) []layerAlignment {
+	if gap[0].len() == 0 && gap[1].len() == 0 {
+		return nil
+	}
+	var nonEmpty [2][]int
+	for i, r := range gap {
+		for j := r.start; j < r.end; j++ {
+			if !empty[i][j] {
+				nonEmpty[i] = append(nonEmpty[i], j)
+			}
+		}
+	}
+	if len(nonEmpty[0]) == len(nonEmpty[1]) {
+		aligns := make([]layerAlignment, len(nonEmpty[0]))
+		for k := range nonEmpty[0] {
+			j0, j1 := nonEmpty[0][k], nonEmpty[1][k]
+			aligns[k] = layerAlignment{{j0, j0 + 1}, {j1, j1 + 1}}
+		}
+		return aligns
+	}
+	if aligns := splitGap(nonEmpty, names); aligns != nil {
+		return aligns
+	}
+	return []layerAlignment{gap}
+}
+
+// splitGap splits the non-empty differing layers into the runs that are paired with single layers,
+// e.g., when a layer was split into multiple layers by another builder.
+//
+// Among the splits, the one with the largest sum of the similarities of the pairs is chosen.
+// The similarity of a pair is the Jaccard index of the entry names of the merged runs.
+// Returns nil if the names are not available, or if any pair does not share any name.
+func splitGap(nonEmpty [2][]int, names layerNamesFunc) []layerAlignment {
+	m, n := len(nonEmpty[0]), len(nonEmpty[1])
+	if m == 0 || n == 0 || names == nil || (m+1)*(n+1)*(m+n) > maxLayerAlignmentCells {
+		return nil
+	}
+	var sets [2][]map[string]struct{}
+	for i := range nonEmpty {
+		for _, j := range nonEmpty[i] {
+			set := names(i, j)
+			if set == nil {
+				return nil
+			}
+			sets[i] = append(sets[i], set)
+		}
+	}
+	// score[k0*(n+1)+k1] is the best sum of the similarities for splitting the first k0 and k1 layers,
+	// and prev[k0*(n+1)+k1] is the end of the previous pair.
+	const unreachable = -1
+	score := make([]float64, (m+1)*(n+1))
+	prev := make([][2]int, (m+1)*(n+1))
+	for k := 1; k < len(score); k++ {
+		score[k] = unreachable
+	}
+	update := func(k0, k1, p0, p1 int, sim float64) {
+		if sim == 0 || score[p0*(n+1)+p1] == unreachable {
+			return
+		}
+		if v := score[p0*(n+1)+p1] + sim; v > score[k0*(n+1)+k1] {
+			score[k0*(n+1)+k1] = v
+			prev[k0*(n+1)+k1] = [2]int{p0, p1}
+		}
+	}
+	for k0 := 1; k0 <= m; k0++ {
+		for k1 := 1; k1 <= n; k1++ {
+			// The run of the input 0 ending at k0 is paired with the layer k1-1 of the input 1
+			sims := runSimilarities(sets[0][:k0], sets[1][k1-1])
+			for r, sim := range sims {
+				update(k0, k1, k0-1-r, k1-1, sim)
+			}
+			// The run of the input 1 ending at k1 is paired with the layer k0-1 of the input 0
+			// (The one-to-one pair has been considered above)
+			sims = runSimilarities(sets[1][:k1], sets[0][k0-1])
+			for r := 1; r < len(sims); r++ {
+				update(k0, k1, k0-1, k1-1-r, sims[r])
+			}
+		}
+	}
+	if score[m*(n+1)+n] == unreachable {
+		return nil
+	}
+	var aligns []layerAlignment
+	for k0, k1 := m, n; k0 > 0 || k1 > 0; {
+		p := prev[k0*(n+1)+k1]
+		aligns = append(aligns, layerAlignment{
+			{nonEmpty[0][p[0]], nonEmpty[0][k0-1] + 1},
+			{nonEmpty[1][p[1]], nonEmpty[1][k1-1] + 1},
+		})
+		k0, k1 = p[0], p[1]
+	}
+	slices.Reverse(aligns)
+	return aligns
+}
+
+// runSimilarities returns the Jaccard indexes of set and the merged runs of the last 1, 2, ..., len(run) sets of run.
+func runSimilarities(run []map[string]struct{}, set map[string]struct{}) []float64 {
+	sims := make([]float64, len(run))
+	merged := make(map[string]struct{})
+	var inter int
+	for r := range run {
+		for name := range run[len(run)-1-r] {
+			if _, ok := merged[name]; ok {
+				continue
+			}
+			merged[name] = struct{}{}
+			if _, ok := set[name]; ok {
+				inter++
+			}
+		}
+		if union := len(merged) + len(set) - inter; union > 0 {
+			sims[r] = float64(inter) / float64(union)
+		}
+	}
+	return sims
+}
+
+// layerEntryNames returns the names of the non-directory entries of the layer.
+// The cached layer index is used if available.
+func (d *differ) layerEntryNames(ctx context.Context, desc ocispec.Descriptor) (map[string]struct{}, error) {
+	var (
+		tr     tarReader
+		closer func() error
+		err    error
+	)
+	if c := d.o.LayerIndexCache; c != nil {
+		var ir *layerIndexReader
+		if ir, err = c.open(desc.Digest, d.normalizers); err == nil {
+			tr, closer = ir, ir.Close
+		}
+	}
+	if tr == nil {
+		if tr, closer, err = openTarReader(ctx, d.cs, desc, d.o.MaxScale); err != nil {
+			return nil, err
+		}
+	}
+	defer func() {
+		if closerErr := closer(); closerErr != nil {
+			log.G(ctx).WithError(closerErr).Warnf("failed to close tar reader of %s", desc.Digest)
+		}
+	}()
+	names := make(map[string]struct{})
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return names, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeDir {
+			names[cleanTarPath(hdr.Name)] = struct{}{}
+		}
+	}
+}
+
+// diffAlignedLayers compares the layers of the manifests with different numbers of layers.
+// The alignment is reported as an event, as the numbers of the layers differ.
+func (d *differ) diffAlignedLayers(ctx context.Context, node *EventTreeNode, in [2]EventInput) error {
+	layers := [2][]ocispec.Descriptor{in[0].Manifest.Layers, in[1].Manifest.Layers}
+	for i := 0; i < 2; i++ {
+		if len(layers[i]) > int(maxLayers*d.o.MaxScale) {
+			return fmt.Errorf("too many layers (> %d) (input-%d)", int(maxLayers*d.o.MaxScale), i)
+		}
+	}
+	ids, empty := d.layerIdentities(ctx, in)
+	names := func(i, j int) map[string]struct{} {
+		set, err := d.layerEntryNames(ctx, layers[i][j])
+		if err != nil {
+			log.G(ctx).WithError(err).Debugf("Failed to read the entry names of the layer %d of input %d, merging the differing layers", j, i)
+		}
+		return set
+	}
+	aligns := alignLayers(ids, empty, names)
+	log.G(ctx).Infof("Layer length mismatch (%d vs %d), aligned the layers as %s", len(layers[0]), len(layers[1]), formatLayerAlignments(aligns))
+	var errs []error
+	ev := Event{
+		Type:   EventTypeManifestBlobMismatch,
+		Inputs: in,
+		Diff:   cmp.Diff(layers[0], layers[1]),
+		Note: fmt.Sprintf("field \"Layers\": length mismatch (%d vs %d), aligned as %s",
+			len(layers[0]), len(layers[1]), formatLayerAlignments(aligns)),
+	}
+	if err := d.raiseEvent(ctx, node, ev, "layers"); err != nil {
+		errs = append(errs, err)
+	}
+	var (
+		tasks = make([]*childTask, len(aligns))
+		wg    sync.WaitGroup
+	)
+	for k, a := range aligns {
+		fieldName := fmt.Sprintf("Layers[%s]", a)
+		t := &childTask{
+			node: &EventTreeNode{
+				Context: path.Join(node.Context, "layers-"+a.String()),
+				Event: Event{
+					Type:   EventTypeManifestBlobMismatch,
+					Inputs: in,
+					Diff:   cmp.Diff(layers[0][a[0].start:a[0].end], layers[1][a[1].start:a[1].end]),
+					Note:   fmt.Sprintf("field %q", fieldName),
+				},
+			},
+		}
+		tasks[k] = t
+		d.goOrRun(&wg, func() {
+			var err error
+			if a[0].len() == 1 && a[1].len() == 1 {
+				childInputs := [2]EventInput{
+					{
+						Descriptor: &layers[0][a[0].start],
+					}, {
+						Descriptor: &layers[1][a[1].start],
+					},
+				}
+				err = d.forTask(t).diff(ctx, t.node, childInputs)
+			} else {
+				err = d.forTask(t).diffMergedLayers(ctx, t.node, in, a)
+			}
+			if err != nil {
+				t.err = fmt.Errorf("field %q: %w", fieldName, err)
+			}
+		})
+		if d.sem == nil {
+			if err := d.finishTask(ctx, node, t); err != nil {
+				errs = append(errs, err)
+			}
+			tasks[k] = nil
+		}
+	}
+	wg.Wait()
+	// Raise the events in the order of the alignments, regardless of the scheduling
+	for _, t := range tasks {
+		if t == nil {
+			continue
+		}
+		if err := d.finishTask(ctx, node, t); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// diffMergedLayers merges each of the layer runs into a single layer, and compares them.
+func (d *differ) diffMergedLayers(ctx context.Context, node *EventTreeNode, in [2]EventInput, a layerAlignment) error {
+	var (
+		l     [2]*loadLayerResult
+		l1Err error
+		wg    sync.WaitGroup
+	)
+	d.goOrRun(&wg, func() {
+		l[1], l1Err = d.loadMergedLayers(ctx, node, 1, in[1].Manifest.Layers[a[1].start:a[1].end])
+	})
+	var err error
+	l[0], err = d.loadMergedLayers(ctx, node, 0, in[0].Manifest.Layers[a[0].start:a[0].end])
+	wg.Wait()
+	if err != nil {
+		return fmt.Errorf("failed to merge layers (input-0): %w", err)
+	}
+	if l1Err != nil {
+		return fmt.Errorf("failed to merge layers (input-1): %w", l1Err)
+	}
+	for _, ll := range l {
+		for _, ents := range ll.entriesByName {
+			for _, ent := range ents {
+				// The order of the entries is not meaningful across the layers
+				ent.Index = -1
+			}
+		}
+	}
+	return d.diffLoadedLayers(ctx, node, in, l[0], l[1])
+}
@@ -0,0 +1,191 @@
+package diff
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// testLayerSpec describes a test layer for alignLayers: the identity, and the comma-separated entry names.
+// The identity "empty" is an empty layer.
+type testLayerSpec struct {
+	id    string
+	names string
+}
+
+func TestAlignLayers(t *testing.T) {
+	var (
+		a  = testLayerSpec{"a", "bin/a"}
+		b  = testLayerSpec{"b", "bin/b"}
+		c  = testLayerSpec{"c", "etc/c"}
+		c2 = testLayerSpec{"c2", "etc/c"}
+		e  = testLayerSpec{"empty", ""}
+		// A layer "usr" split into "usr-bin" and "usr-lib"
+		usr    = testLayerSpec{"usr", "usr/bin/sh,usr/bin/ls,usr/lib/libc.so"}
+		usrBin = testLayerSpec{"usr-bin", "usr/bin/sh,usr/bin/ls"}
+		usrLib = testLayerSpec{"usr-lib", "usr/lib/libc.so"}
+		// Modified versions of usr-bin and usr-lib
+		usrBin2 = testLayerSpec{"usr-bin2", "usr/bin/sh,usr/bin/ls"}
+		usrLib2 = testLayerSpec{"usr-lib2", "usr/lib/libc.so"}
+		varLog  = testLayerSpec{"var", "var/log/x"}
+		varLog2 = testLayerSpec{"var2", "var/log/x"}
+		// The layers sharing no names
+		x = testLayerSpec{"x", "x"}
+		y = testLayerSpec{"y", "y"}
+		z = testLayerSpec{"z", "z"}
+	)
+	testCases := []struct {
+		name           string
+		layers         [2][]testLayerSpec
+		namesAvailable bool
+		expected       string
+	}{
+		{
+			name:     "identical",
+			layers:   [2][]testLayerSpec{{a, b}, {a, b}},
+			expected: "[0:0 1:1]",
+		},
+		{
+			name:     "one-to-one",
+			layers:   [2][]testLayerSpec{{a, c, b}, {a, c2, b}},
+			expected: "[0:0 1:1 2:2]",
+		},
+		{
+			name:     "empty layer dropped",
+			layers:   [2][]testLayerSpec{{a, e, b}, {a, b}},
+			expected: "[0:0 2:1]",
+		},
+		{
+			name:     "empty layer dropped between differing layers",
+			layers:   [2][]testLayerSpec{{a, c, e, usrBin}, {a, c2, usrBin2}},
+			expected: "[0:0 1:1 3:2]",
+		},
+		{
+			name:     "layer inserted",
+			layers:   [2][]testLayerSpec{{a, b}, {a, c, b}},
+			expected: "[0:0 none:1 1:2]",
+		},
+		{
+			name:           "layer split",
+			layers:         [2][]testLayerSpec{{a, usr, b}, {a, usrBin, usrLib, b}},
+			namesAvailable: true,
+			expected:       "[0:0 1:1-2 2:3]",
+		},
+		{
+			name:           "layers merged",
+			layers:         [2][]testLayerSpec{{a, usrBin, usrLib, b}, {a, usr, b}},
+			namesAvailable: true,
+			expected:       "[0:0 1-2:1 3:2]",
+		},
+		{
+			// Only the split layer is merged, and the other differing layers are paired one-to-one
+			name:           "layer split and layers modified",
+			layers:         [2][]testLayerSpec{{c, usr, varLog}, {c2, usrBin2, usrLib2, varLog2}},
+			namesAvailable: true,
+			expected:       "[0:0 1:1-2 2:3]",
+		},
+		{
+			name:           "layer split at the end",
+			layers:         [2][]testLayerSpec{{c, varLog, usr}, {c2, varLog2, usrBin2, usrLib2}},
+			namesAvailable: true,
+			expected:       "[0:0 1:1 2:2-3]",
+		},
+		{
+			name:           "layer split with an empty layer",
+			layers:         [2][]testLayerSpec{{c, usr}, {c2, usrBin2, e, usrLib2}},
+			namesAvailable: true,
+			expected:       "[0:0 1:1-3]",
+		},
+		{
+			name:     "layer split without names",
+			layers:   [2][]testLayerSpec{{c, usr, varLog}, {c2, usrBin2, usrLib2, varLog2}},
+			expected: "[0-2:0-3]",
+		},
+		{
+			// Falls back to merging, as the split would pair the layers sharing no names
+			name:           "dissimilar layers",
+			layers:         [2][]testLayerSpec{{a, x, y, b}, {a, z, b}},
+			namesAvailable: true,
+			expected:       "[0:0 1-2:1 3:2]",
+		},
+		{
+			name:           "dissimilar layers split",
+			layers:         [2][]testLayerSpec{{x, y, z}, {x, testLayerSpec{"yz", "y,z"}}},
+			namesAvailable: true,
+			expected:       "[0:0 1-2:1]",
+		},
+		{
+			name:     "common layers in the middle",
+			layers:   [2][]testLayerSpec{{c, a, x, b, y}, {c2, a, b, z}},
+			expected: "[0:0 1:1 2:none 3:2 4:3]",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				ids   [2][]digest.Digest
+				empty [2][]bool
+			)
+			for i, layers := range tc.layers {
+				for _, l := range layers {
+					ids[i] = append(ids[i], digest.FromString(l.id))
+					empty[i] = append(empty[i], l.id == "empty")
+				}
+			}
+			var names layerNamesFunc
+			if tc.namesAvailable {
+				names = func(i, j int) map[string]struct{} {
+					set := make(map[string]struct{})
+					for _, name := range strings.Split(tc.layers[i][j].names, ",") {
+						if name != "" {
+							set[name] = struct{}{}
+						}
+					}
+					return set
+				}
+			} else {
+				names = func(int, int) map[string]struct{} { return nil }
+			}
+			if got := formatLayerAlignments(alignLayers(ids, empty, names)); got != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestRunSimilarities(t *testing.T) {
+	set := func(names ...string) map[string]struct{} {
+		m := make(map[string]struct{})
+		for _, name := range names {
+			m[name] = struct{}{}
+		}
+		return m
+	}
+	testCases := []struct {
+		name     string
+		run      []map[string]struct{}
+		set      map[string]struct{}
+		expected []float64
+	}{
+		{"identical", []map[string]struct{}{set("a", "b")}, set("a", "b"), []float64{1}},
+		{"disjoint", []map[string]struct{}{set("a")}, set("b"), []float64{0}},
+		{"empty", []map[string]struct{}{set()}, set(), []float64{0}},
+		// The runs are [c], [b c], [a b c]
+		{"merged", []map[string]struct{}{set("a"), set("b"), set("c")}, set("b", "c"), []float64{0.5, 1, 2.0 / 3}},
+		{"overlapping", []map[string]struct{}{set("a", "b"), set("b", "c")}, set("a", "b", "c"), []float64{2.0 / 3, 1}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := runSimilarities(tc.run, tc.set)
+			if len(got) != len(tc.expected) {
+				t.Fatalf("expected %v, got %v", tc.expected, got)
+			}
+			for i := range got {
+				if got[i] != tc.expected[i] {
+					t.Errorf("expected %v, got %v", tc.expected, got)
+				}
+			}
+		})
+	}
+}
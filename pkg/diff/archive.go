@@ -0,0 +1,281 @@
+package diff
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/containerd/log"
+)
+
+// archiveSeparator separates the name of an archive and the name of an entry in the archive,
+// e.g., "app.jar!/META-INF/MANIFEST.MF".
+const archiveSeparator = "!/"
+
+// maxNestedArchiveDepth is the maximum depth of the nested archives to be compared.
+const maxNestedArchiveDepth = 4
+
+// archiveHeadSize is the size of the head of a file for detecting the archive format.
+const archiveHeadSize = 512
+
+type archiveFormat int
+
+const (
+	archiveFormatNone archiveFormat = iota
+	archiveFormatZip                // zip, jar, war, ear, whl, Android apk
+	archiveFormatTar                // tar
+	archiveFormatGzip               // tar.gz, Alpine apk, or a single gzipped file
+)
+
+// detectArchiveFormat detects the archive format from the magic bytes.
+func detectArchiveFormat(head []byte) archiveFormat {
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return archiveFormatZip
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return archiveFormatGzip
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		return archiveFormatTar
+	default:
+		return archiveFormatNone
+	}
+}
+
+// nestedArchiveAllowed returns true if the entry with the name may be compared as a nested archive.
+func (d *differ) nestedArchiveAllowed(name string) bool {
+	return d.o.NestedArchives && d.spoolDir != "" && strings.Count(name, archiveSeparator) < maxNestedArchiveDepth
+}
+
+// diffNestedArchives compares the entries of the archives, when both the regular files are archives.
+// The events are raised under node, which is the node of the mismatch of the archive files.
+// Returns false if the files were not compared as archives.
+func (d *differ) diffNestedArchives(ctx context.Context, node *EventTreeNode, in [2]EventInput, ent0, ent1 *TarEntry) (bool, error) {
+	name := ent0.Header.Name
+	if !d.nestedArchiveAllowed(name) || ent0.Digest == ent1.Digest {
+		return false, nil
+	}
+	if ent0.Header.Typeflag != tar.TypeReg || ent1.Header.Typeflag != tar.TypeReg {
+		return false, nil
+	}
+	p0, p1 := ent0.localPath(), ent1.localPath()
+	if p0 == "" || p1 == "" {
+		return false, nil
+	}
+	var l [2]*loadLayerResult
+	for i, p := range []string{p0, p1} {
+		var err error
+		l[i], err = d.loadArchive(ctx, name, p)
+		if err != nil {
+			log.G(ctx).WithError(err).Warnf("Failed to load the archive %q (input-%d)", name, i)
+			return false, nil
+		}
+		if l[i] == nil {
+			// not an archive
+			return false, nil
+		}
+	}
+	var errs []error
+	for _, entName := range sortedEntryNames(l[0], l[1]) {
+		ents0, ents1 := l[0].entriesByName[entName], l[1].entriesByName[entName]
+		if len(ents0) != len(ents1) {
+			if err := d.raiseNameAppearanceMismatch(ctx, node, in, entName, len(ents0), len(ents1)); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		// No file is extracted from the archives, so no directory has to be removed
+		if _, err := d.diffTarEntries(ctx, node, in, [2][]*TarEntry{ents0, ents1}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return true, errors.Join(errs...)
+}
+
+// loadArchive loads the entries of the archive file p, which is the content of the entry with the name.
+// The names of the loaded entries are prefixed with name and archiveSeparator.
+// Returns nil if p is not an archive.
+func (d *differ) loadArchive(ctx context.Context, name, p string) (*loadLayerResult, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	head := make([]byte, archiveHeadSize)
+	n, err := io.ReadFull(f, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+	format := detectArchiveFormat(head[:n])
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	limit := int64(maxTarStreamSize * d.o.MaxScale)
+	switch format {
+	case archiveFormatZip:
+		fi, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		zr, err := zip.NewReader(f, fi.Size())
+		if err != nil {
+			return nil, err
+		}
+		return d.loadZipArchive(ctx, name, zr, limit)
+	case archiveFormatTar:
+		return d.loadTarArchive(ctx, name, tar.NewReader(io.LimitReader(f, limit)))
+	case archiveFormatGzip:
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		br := bufio.NewReaderSize(io.LimitReader(gz, limit), archiveHeadSize)
+		if head, _ := br.Peek(archiveHeadSize); detectArchiveFormat(head) == archiveFormatTar {
+			return d.loadTarArchive(ctx, name, tar.NewReader(br))
+		}
+		// A single gzipped file, such as "foo.1.gz!/foo.1"
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     strings.TrimSuffix(path.Base(name), ".gz"),
+			Mode:     0644,
+			ModTime:  gz.ModTime,
+		}
+		res := newArchiveLoadResult()
+		cr := &countingReader{r: br}
+		ent, err := d.loadArchiveEntry(ctx, name, 0, hdr, cr)
+		if err != nil {
+			return nil, err
+		}
+		hdr.Size = cr.n
+		res.add(ent)
+		return res, nil
+	default:
+		return nil, nil
+	}
+}
+
+func newArchiveLoadResult() *loadLayerResult {
+	return &loadLayerResult{
+		entriesByName: make(map[string][]*TarEntry),
+	}
+}
+
+func (res *loadLayerResult) add(ent *TarEntry) {
+	res.entries++
+	res.entriesByName[ent.Header.Name] = append(res.entriesByName[ent.Header.Name], ent)
+}
+
+func (d *differ) loadTarArchive(ctx context.Context, name string, tr *tar.Reader) (*loadLayerResult, error) {
+	res := newArchiveLoadResult()
+	for i := 0; ; i++ {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		ent, err := d.loadArchiveEntry(ctx, name, i, hdr, tr)
+		if err != nil {
+			return nil, err
+		}
+		res.add(ent)
+	}
+	return res, nil
+}
+
+func (d *differ) loadZipArchive(ctx context.Context, name string, zr *zip.Reader, limit int64) (*loadLayerResult, error) {
+	res := newArchiveLoadResult()
+	for i, zf := range zr.File {
+		hdr, err := zipHeader(zf, limit)
+		if err != nil {
+			return nil, err
+		}
+		r := io.ReadCloser(io.NopCloser(eofReader{}))
+		if hdr.Typeflag == tar.TypeReg {
+			if r, err = zf.Open(); err != nil {
+				return nil, fmt.Errorf("failed to open %q: %w", zf.Name, err)
+			}
+		}
+		ent, err := d.loadArchiveEntry(ctx, name, i, hdr, io.LimitReader(r, limit))
+		_ = r.Close()
+		if err != nil {
+			return nil, err
+		}
+		res.add(ent)
+	}
+	return res, nil
+}
+
+// zipHeader converts the header of a zip entry to a tar header.
+// The zip-specific fields, such as the compression method and the extra fields, are not compared.
+func zipHeader(zf *zip.File, limit int64) (*tar.Header, error) {
+	fi := zf.FileInfo()
+	var link string
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		rc, err := zf.Open()
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %q: %w", zf.Name, err)
+		}
+		b, err := io.ReadAll(io.LimitReader(rc, limit))
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %q: %w", zf.Name, err)
+		}
+		link = string(b)
+	}
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert the header of %q: %w", zf.Name, err)
+	}
+	hdr.Name = zf.Name
+	hdr.Format = tar.FormatUnknown
+	return hdr, nil
+}
+
+// loadArchiveEntry loads the i-th entry of the archive with the name.
+// Unlike loadEntry, the entry is never extracted to the report directory.
+func (d *differ) loadArchiveEntry(ctx context.Context, name string, i int, hdr *tar.Header, r io.Reader) (*TarEntry, error) {
+	d.normalizeHeader(ctx, hdr)
+	hdr.Name = name + archiveSeparator + hdr.Name
+	ent := &TarEntry{
+		Index:  i,
+		Header: hdr,
+	}
+	cr, spooled, err := d.spoolContent(hdr.Name, r)
+	if err != nil {
+		return nil, err
+	}
+	limit := int64(0)
+	if hdr.Typeflag == tar.TypeReg {
+		limit = d.o.TextDiffMaxSize
+	}
+	ent.text, err = d.digestNormalizedContent(ent, cr, limit)
+	p, spoolErr := spooled()
+	if err = errors.Join(err, spoolErr); err != nil {
+		return nil, fmt.Errorf("failed to read %q: %w", hdr.Name, err)
+	}
+	ent.contentPath = p
+	return ent, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
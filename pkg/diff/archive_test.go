@@ -0,0 +1,288 @@
+package diff
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// testArchiveFile is an entry of a test archive. The names ending with "/" are directories.
+type testArchiveFile struct {
+	name    string
+	body    string
+	modTime time.Time
+}
+
+var testArchiveModTime = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func testZip(t *testing.T, files ...testArchiveFile) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range files {
+		fh := &zip.FileHeader{Name: f.name, Method: zip.Deflate, Modified: f.modTime}
+		if fh.Modified.IsZero() {
+			fh.Modified = testArchiveModTime
+		}
+		fh.SetMode(0o644)
+		if strings.HasSuffix(f.name, "/") {
+			fh.SetMode(0o755 | os.ModeDir)
+		}
+		w, err := zw.CreateHeader(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = w.Write([]byte(f.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testTar(t *testing.T, files ...testArchiveFile) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		hdr := &tar.Header{Name: f.name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(f.body)), ModTime: f.modTime}
+		if hdr.ModTime.IsZero() {
+			hdr.ModTime = testArchiveModTime
+		}
+		if strings.HasSuffix(f.name, "/") {
+			hdr.Typeflag, hdr.Mode, hdr.Size = tar.TypeDir, 0o755, 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(f.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testGzip(t *testing.T, b []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.ModTime = testArchiveModTime
+	if _, err := gw.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDetectArchiveFormat(t *testing.T) {
+	testCases := []struct {
+		name     string
+		head     func(t *testing.T) []byte
+		expected archiveFormat
+	}{
+		{"zip", func(t *testing.T) []byte { return testZip(t, testArchiveFile{name: "foo", body: "foo"}) }, archiveFormatZip},
+		{"empty zip", func(t *testing.T) []byte { return testZip(t) }, archiveFormatZip},
+		{"tar", func(t *testing.T) []byte { return testTar(t, testArchiveFile{name: "foo", body: "foo"}) }, archiveFormatTar},
+		{"gzip", func(t *testing.T) []byte { return testGzip(t, []byte("foo")) }, archiveFormatGzip},
+		{"text", func(*testing.T) []byte { return []byte("PK is not a zip\n") }, archiveFormatNone},
+		{"short", func(*testing.T) []byte { return []byte{0x1f} }, archiveFormatNone},
+		{"empty", func(*testing.T) []byte { return nil }, archiveFormatNone},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			head := tc.head(t)
+			if len(head) > archiveHeadSize {
+				head = head[:archiveHeadSize]
+			}
+			if got := detectArchiveFormat(head); got != tc.expected {
+				t.Errorf("expected %d, got %d", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestNestedArchiveAllowed(t *testing.T) {
+	testCases := []struct {
+		desc           string
+		name           string
+		nestedArchives bool
+		spoolDir       string
+		expected       bool
+	}{
+		{"allowed", "app.jar", true, "/tmp", true},
+		{"disabled", "app.jar", false, "/tmp", false},
+		{"no spool directory", "app.jar", true, "", false},
+		{"max depth", "a.tar!/b.tar!/c.tar!/d.jar", true, "/tmp", true},
+		{"too deep", "a.tar!/b.tar!/c.tar!/d.tar!/e.jar", true, "/tmp", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			d := &differ{o: Options{NestedArchives: tc.nestedArchives}, spoolDir: tc.spoolDir}
+			if got := d.nestedArchiveAllowed(tc.name); got != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestLoadArchive(t *testing.T) {
+	files := []testArchiveFile{
+		{name: "META-INF/"},
+		{name: "META-INF/MANIFEST.MF", body: "Manifest-Version: 1.0\n"},
+		{name: "foo.class", body: "\xca\xfe\xba\xbe"},
+	}
+	testCases := []struct {
+		name     string
+		content  func(t *testing.T) []byte
+		expected []string // the names of the entries with the digests of the contents of the regular files
+	}{
+		{
+			name:    "zip",
+			content: func(t *testing.T) []byte { return testZip(t, files...) },
+			expected: []string{
+				"app.jar!/META-INF/",
+				"app.jar!/META-INF/MANIFEST.MF " + digest.FromString("Manifest-Version: 1.0\n").String(),
+				"app.jar!/foo.class " + digest.FromString("\xca\xfe\xba\xbe").String(),
+			},
+		},
+		{
+			name:    "tar",
+			content: func(t *testing.T) []byte { return testTar(t, files...) },
+			expected: []string{
+				"app.jar!/META-INF/",
+				"app.jar!/META-INF/MANIFEST.MF " + digest.FromString("Manifest-Version: 1.0\n").String(),
+				"app.jar!/foo.class " + digest.FromString("\xca\xfe\xba\xbe").String(),
+			},
+		},
+		{
+			name:    "tar.gz",
+			content: func(t *testing.T) []byte { return testGzip(t, testTar(t, files...)) },
+			expected: []string{
+				"app.jar!/META-INF/",
+				"app.jar!/META-INF/MANIFEST.MF " + digest.FromString("Manifest-Version: 1.0\n").String(),
+				"app.jar!/foo.class " + digest.FromString("\xca\xfe\xba\xbe").String(),
+			},
+		},
+		{
+			// The name of the entry is the base name without ".gz"
+			name:     "single gzipped file",
+			content:  func(t *testing.T) []byte { return testGzip(t, []byte("foo\n")) },
+			expected: []string{"app.jar!/app.jar " + digest.FromString("foo\n").String()},
+		},
+		{
+			name:    "not an archive",
+			content: func(*testing.T) []byte { return []byte("foo\n") },
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "app.jar")
+			if err := os.WriteFile(p, tc.content(t), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			d := &differ{o: Options{MaxScale: 1}}
+			res, err := d.loadArchive(context.Background(), "app.jar", p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.expected == nil {
+				if res != nil {
+					t.Fatalf("expected nil, got %v", res.entriesByName)
+				}
+				return
+			}
+			var got []string
+			for name, ents := range res.entriesByName {
+				for _, ent := range ents {
+					s := name
+					if ent.Header.Typeflag == tar.TypeReg {
+						s += " " + ent.Digest.String()
+					}
+					got = append(got, s)
+				}
+			}
+			sort.Strings(got)
+			if strings.Join(got, "\n") != strings.Join(tc.expected, "\n") {
+				t.Errorf("expected %q, got %q", tc.expected, got)
+			}
+			if res.entries != len(tc.expected) {
+				t.Errorf("expected %d entries, got %d", len(tc.expected), res.entries)
+			}
+		})
+	}
+}
+
+func TestLoadArchiveInvalid(t *testing.T) {
+	zipBlob := testZip(t, testArchiveFile{name: "foo", body: "foo"})
+	testCases := []struct {
+		name    string
+		content []byte
+	}{
+		{"truncated zip", zipBlob[:len(zipBlob)/2]},
+		{"truncated gzip", testGzip(t, []byte("foo"))[:12]},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "app.jar")
+			if err := os.WriteFile(p, tc.content, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			d := &differ{o: Options{MaxScale: 1}}
+			if _, err := d.loadArchive(context.Background(), "app.jar", p); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestZipHeader(t *testing.T) {
+	modTime := time.Date(2026, 1, 2, 3, 4, 6, 0, time.UTC)
+	b := testZip(t,
+		testArchiveFile{name: "dir/"},
+		testArchiveFile{name: "dir/foo", body: "foo", modTime: modTime})
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		typeflag byte
+		name     string
+		size     int64
+		modTime  time.Time
+	}{
+		{tar.TypeDir, "dir/", 0, testArchiveModTime},
+		{tar.TypeReg, "dir/foo", 3, modTime},
+	}
+	for i, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			hdr, err := zipHeader(zr.File[i], 1024)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hdr.Typeflag != tc.typeflag || hdr.Name != tc.name || hdr.Size != tc.size || !hdr.ModTime.Equal(tc.modTime) {
+				t.Errorf("expected (%q, %q, %d, %v), got (%q, %q, %d, %v)",
+					tc.typeflag, tc.name, tc.size, tc.modTime, hdr.Typeflag, hdr.Name, hdr.Size, hdr.ModTime)
+			}
+			if hdr.Format != tar.FormatUnknown {
+				t.Errorf("expected the unknown format, got %v", hdr.Format)
+			}
+		})
+	}
+}
@@ -0,0 +1,712 @@
+package diff
+
+import (
+	"archive/tar"
+	"bufio"
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/containerd/log"
+	"github.com/reproducible-containers/diffoci/pkg/untar"
+)
+
+// diffLayerWithTarReaderBounded is the variant of diffLayerWithTarReader that does not retain
+// all the entries of the layers in memory.
+//
+// Unless IgnoreFileOrder is set, the entries are compared in a streaming manner as long as
+// the entries at the same position have the same name.
+// The rest of the entries (or all the entries, when IgnoreFileOrder is set) are sorted by name
+// in entryIndex, which spills them to temporary files when MemoryBudget is exceeded.
+//
+// The events are raised in the same order as diffLoadedLayers.
+// The events of the entries compared in the streaming manner are retained in an entryIndex too,
+// until they can be raised in order.
+// MemoryBudget is split across the entry indexes and the timestamps of the extracted directories.
+func (d *differ) diffLayerWithTarReaderBounded(ctx context.Context, node *EventTreeNode, in [2]EventInput, tr0, tr1 tarReader) error {
+	var (
+		budget = d.o.MemoryBudget / 4
+		// idx[0] and idx[1] are the entries of the inputs that have not been compared yet.
+		// idx[2] is the names and the events of the entries that have been compared in the streaming manner.
+		idx = [3]*entryIndex{{budget: budget}, {budget: budget}, {budget: budget}}
+		// dirTimes is the timestamps of the directories extracted to the report directory,
+		// to be set after extracting the layers.
+		dirTimes = &spillList[dirTimesRecord]{budget: budget}
+	)
+	defer func() {
+		if err := dirTimes.each(func(rec dirTimesRecord) error {
+			return untar.SetDirTimes(rec.Path, rec.AccessTime, rec.ModTime)
+		}); err != nil {
+			log.G(ctx).WithError(err).Debug("Failed to set the timestamps of the extracted directories")
+		}
+		if closeErr := dirTimes.close(); closeErr != nil {
+			log.G(ctx).WithError(closeErr).Warn("Failed to remove the temporary list of the directories")
+		}
+		for _, x := range idx {
+			if closeErr := x.close(); closeErr != nil {
+				log.G(ctx).WithError(closeErr).Warn("Failed to remove the temporary entry index")
+			}
+		}
+	}()
+	newNode := EventTreeNode{
+		Context: path.Join(node.Context, "layer"),
+		Event: Event{
+			Type:   EventTypeLayerBlobMismatch,
+			Inputs: in,
+		},
+	}
+
+	sr := newStreamingDiffer(d, newNode.Context)
+	aligned := !d.o.IgnoreFileOrder
+	trs := [2]tarReader{tr0, tr1}
+	var (
+		entries [2]int
+		eof     [2]bool
+		errs    []error
+	)
+	for !eof[0] || !eof[1] {
+		var ents [2]*TarEntry
+		for i, tr := range trs {
+			if eof[i] {
+				continue
+			}
+			hdr, err := tr.Next()
+			if errors.Is(err, io.EOF) {
+				eof[i] = true
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to load layer (input-%d): %w", i, err)
+			}
+			ent, finalizer, err := d.loadEntry(ctx, node, i, entries[i], hdr, tr)
+			if err != nil {
+				return fmt.Errorf("failed to load layer (input-%d): %w", i, err)
+			}
+			if finalizer != nil {
+				// The finalizer only sets the timestamps of the directory, and it retains the header
+				rec := dirTimesRecord{Path: ent.extractedPath, AccessTime: hdr.AccessTime, ModTime: hdr.ModTime}
+				if err = dirTimes.add(rec, rec.size()); err != nil {
+					return err
+				}
+			}
+			entries[i]++
+			ents[i] = ent
+		}
+		if aligned && ents[0] != nil && ents[1] != nil && ents[0].Header.Name == ents[1].Header.Name {
+			rec, err := sr.diff(ctx, in, ents)
+			if err != nil {
+				errs = append(errs, err)
+			}
+			if err := idx[2].add(rec); err != nil {
+				return err
+			}
+			continue
+		}
+		if aligned {
+			log.G(ctx).Debugf("The entries are not aligned at %d, switching to the entry index", entries[0]-1)
+			aligned = false
+			// No more records are added; release the memory for the rest
+			if err := idx[2].spill(); err != nil {
+				return err
+			}
+		}
+		for i, ent := range ents {
+			if ent == nil {
+				continue
+			}
+			if err := idx[i].add(newIndexRecord(ent)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if entries[0] != entries[1] {
+		ev := Event{
+			Type:   EventTypeLayerBlobMismatch,
+			Inputs: in,
+			Note:   fmt.Sprintf("length mismatch (%d vs %d)", entries[0], entries[1]),
+		}
+		if err := d.raiseEvent(ctx, node, ev, "layer"); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// The names that appear differently are raised first, as they precede newNode in node.
+	if err := d.raiseNameAppearanceMismatches(ctx, node /* not newNode */, in, idx); err != nil {
+		errs = append(errs, err)
+	}
+	its, err := indexIterators(idx)
+	if err != nil {
+		return err
+	}
+	defer closeIndexIterators(its)
+	dirsToBeRemovedIfEmpty := sr.dirsToBeRemovedIfEmpty
+	for {
+		name, ok := minIndexName(its)
+		if !ok {
+			break
+		}
+		recs, err := takeIndexGroup(its, name)
+		if err != nil {
+			return err
+		}
+		if len(recs[0]) != len(recs[1]) {
+			// The events of the compared entries are discarded, as diffLoadedLayers does not compare them either.
+			// Still, the files of the compared entries may have been removed from the report directory.
+			continue
+		}
+		for _, rec := range recs[2] {
+			if err := rec.replay(ctx, d.o.EventHandler, in, &newNode); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if len(recs[0]) == 0 {
+			continue
+		}
+		var ents [2][]*TarEntry
+		for i := 0; i < 2; i++ {
+			for _, rec := range recs[i] {
+				ents[i] = append(ents[i], rec.tarEntry())
+			}
+		}
+		dd, err := d.diffTarEntries(ctx, &newNode, in, ents)
+		dirsToBeRemovedIfEmpty = append(dirsToBeRemovedIfEmpty, dd...)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	removeDirsIfEmpty(dirsToBeRemovedIfEmpty)
+
+	if len(newNode.Children) > 0 {
+		if err2 := d.raiseEventWithEventTreeNode(ctx, node, &newNode); err2 != nil {
+			errs = append(errs, err2)
+		}
+	} // else no event happens
+	return errors.Join(errs...)
+}
+
+// raiseNameAppearanceMismatches raises the events for the names that appear differently in the inputs.
+func (d *differ) raiseNameAppearanceMismatches(ctx context.Context, node *EventTreeNode, in [2]EventInput, idx [3]*entryIndex) error {
+	its, err := indexIterators(idx)
+	if err != nil {
+		return err
+	}
+	defer closeIndexIterators(its)
+	var errs []error
+	for {
+		name, ok := minIndexName(its)
+		if !ok {
+			break
+		}
+		recs, err := takeIndexGroup(its, name)
+		if err != nil {
+			return err
+		}
+		// The compared entries appear equally in both inputs
+		if compared := len(recs[2]); len(recs[0]) != len(recs[1]) {
+			if err := d.raiseNameAppearanceMismatch(ctx, node, in, name, compared+len(recs[0]), compared+len(recs[1])); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// streamingDiffer compares the aligned entries, and records the events, so that they can be raised in order.
+type streamingDiffer struct {
+	d                      *differ
+	events                 *bufferedEventHandler
+	node                   *EventTreeNode
+	dirsToBeRemovedIfEmpty []string
+}
+
+func newStreamingDiffer(d *differ, nodeContext string) *streamingDiffer {
+	sr := &streamingDiffer{
+		events: &bufferedEventHandler{},
+		node:   &EventTreeNode{Context: nodeContext},
+	}
+	dd := *d
+	dd.o.EventHandler = sr.events
+	sr.d = &dd
+	return sr
+}
+
+// diff compares the entries, and returns the record of the name and the events for entryIndex.
+func (sr *streamingDiffer) diff(ctx context.Context, in [2]EventInput, ents [2]*TarEntry) (*indexRecord, error) {
+	dd, err := sr.d.diffTarEntries(ctx, sr.node, in, [2][]*TarEntry{{ents[0]}, {ents[1]}})
+	sr.dirsToBeRemovedIfEmpty = append(sr.dirsToBeRemovedIfEmpty, dd...)
+	rec := &indexRecord{
+		Name:     ents[0].Header.Name,
+		Seq:      ents[0].Index,
+		Children: sr.node.Children,
+		Events:   sr.events.nodes,
+	}
+	sr.node.Children = nil
+	sr.events.nodes = nil
+	rec.walkEvents(func(node *EventTreeNode) { stripSharedInputs(node, in) })
+	return rec, err
+}
+
+// indexRecord is a record of entryIndex.
+type indexRecord struct {
+	Name string `json:"name"`
+	// Seq is the index of the entry in the layer.
+	Seq int `json:"seq"`
+	// Entry is nil for the names of the entries that have been compared.
+	Entry         *TarEntry `json:"entry,omitempty"`
+	ExtractedPath string    `json:"extractedPath,omitempty"`
+	Text          *string   `json:"text,omitempty"`
+	ContentPath   string    `json:"contentPath,omitempty"`
+	// Children and Events are the events of the entries that have been compared.
+	Children []*EventTreeNode `json:"children,omitempty"` // to be appended to the layer node
+	Events   []*EventTreeNode `json:"events,omitempty"`   // to be passed to the event handler
+}
+
+func newIndexRecord(ent *TarEntry) *indexRecord {
+	return &indexRecord{
+		Name:          ent.Header.Name,
+		Seq:           ent.Index,
+		Entry:         ent,
+		ExtractedPath: ent.extractedPath,
+		Text:          ent.text,
+		ContentPath:   ent.contentPath,
+	}
+}
+
+// replay passes the events of the compared entries to h, and appends the children to node.
+// The inputs shared by the events are restored from in.
+func (rec *indexRecord) replay(ctx context.Context, h EventHandler, in [2]EventInput, node *EventTreeNode) error {
+	rec.walkEvents(func(node *EventTreeNode) { restoreSharedInputs(node, in) })
+	var errs []error
+	for _, ev := range rec.Events {
+		if err := h.HandleEventTreeNode(ctx, ev); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, child := range rec.Children {
+		node.Append(child)
+	}
+	return errors.Join(errs...)
+}
+
+// walkEvents calls f for the events and the children, including their descendants.
+// A node may be visited more than once, as the children are also in the events until the record is spilled.
+func (rec *indexRecord) walkEvents(f func(*EventTreeNode)) {
+	var walk func(nodes []*EventTreeNode)
+	walk = func(nodes []*EventTreeNode) {
+		for _, node := range nodes {
+			f(node)
+			walk(node.Children)
+		}
+	}
+	walk(rec.Events)
+	walk(rec.Children)
+}
+
+// sharedInput returns the part of the input that is shared by all the events of the layer.
+func sharedInput(in EventInput) EventInput {
+	in.TarEntry = nil
+	return in
+}
+
+// stripSharedInputs removes the descriptors, the manifests, and the configs of the layer from the inputs of the event,
+// so that they are not copied to every record when the records are spilled.
+func stripSharedInputs(node *EventTreeNode, in [2]EventInput) {
+	for i := range node.Inputs {
+		if sharedInput(node.Inputs[i]) == sharedInput(in[i]) {
+			node.Inputs[i] = EventInput{TarEntry: node.Inputs[i].TarEntry}
+		}
+	}
+}
+
+// restoreSharedInputs reverts stripSharedInputs.
+func restoreSharedInputs(node *EventTreeNode, in [2]EventInput) {
+	for i := range node.Inputs {
+		if sharedInput(node.Inputs[i]) == (EventInput{}) {
+			tarEntry := node.Inputs[i].TarEntry
+			node.Inputs[i] = in[i]
+			node.Inputs[i].TarEntry = tarEntry
+		}
+	}
+}
+
+func (rec *indexRecord) tarEntry() *TarEntry {
+	rec.Entry.extractedPath = rec.ExtractedPath
+	rec.Entry.text = rec.Text
+	rec.Entry.contentPath = rec.ContentPath
+	return rec.Entry
+}
+
+// size estimates the memory used by the record.
+func (rec *indexRecord) size() int64 {
+	n := int64(64 + len(rec.Name))
+	if ent := rec.Entry; ent != nil {
+		n += headerSize(ent.Header) + int64(len(rec.ExtractedPath)+len(rec.ContentPath))
+		if rec.Text != nil {
+			n += int64(len(*rec.Text))
+		}
+	}
+	// The children are also in the events
+	for _, ev := range rec.Events {
+		n += eventSize(ev)
+	}
+	return n
+}
+
+// headerSize estimates the memory used by the tar header.
+func headerSize(hdr *tar.Header) int64 {
+	n := int64(512 + len(hdr.Name) + len(hdr.Linkname) + len(hdr.Uname) + len(hdr.Gname))
+	for k, v := range hdr.PAXRecords {
+		n += int64(len(k) + len(v))
+	}
+	//nolint:staticcheck // SA1019: hdr.Xattrs has been deprecated since Go 1.10: Use PAXRecords instead.
+	for k, v := range hdr.Xattrs {
+		n += int64(len(k) + len(v))
+	}
+	return n
+}
+
+// eventSize estimates the memory used by the event node, excluding the children.
+// The descriptors, the manifests, and the configs of the inputs are not counted, as they are
+// stripped by stripSharedInputs.
+func eventSize(node *EventTreeNode) int64 {
+	n := int64(256 + len(node.Context) + len(node.Diff) + len(node.Note) + len(node.Path) + len(node.TextDiff))
+	for _, in := range node.Inputs {
+		if in.TarEntry != nil {
+			n += headerSize(in.TarEntry.Header)
+		}
+	}
+	if node.ELF != nil || node.GoBuildInfo != nil {
+		n += 4096
+	}
+	return n
+}
+
+func (rec *indexRecord) less(other *indexRecord) bool {
+	if rec.Name != other.Name {
+		return rec.Name < other.Name
+	}
+	return rec.Seq < other.Seq
+}
+
+// entryIndex sorts the records by the name, using the external merge sort.
+// When the estimated size of the records exceeds the budget, the records are sorted and spilled
+// to a temporary file ("run").
+type entryIndex struct {
+	budget int64
+	recs   []*indexRecord
+	size   int64
+	dir    string // created on the first spill
+	runs   []string
+}
+
+func (x *entryIndex) add(rec *indexRecord) error {
+	x.recs = append(x.recs, rec)
+	x.size += rec.size()
+	if x.size > x.budget {
+		return x.spill()
+	}
+	return nil
+}
+
+func (x *entryIndex) sortRecords() {
+	sort.Slice(x.recs, func(i, j int) bool {
+		return x.recs[i].less(x.recs[j])
+	})
+}
+
+// spill writes the records in memory to a new run.
+func (x *entryIndex) spill() error {
+	if len(x.recs) == 0 {
+		return nil
+	}
+	if x.dir == "" {
+		dir, err := os.MkdirTemp("", "diffoci-index-")
+		if err != nil {
+			return err
+		}
+		x.dir = dir
+	}
+	x.sortRecords()
+	f, err := os.CreateTemp(x.dir, "run-*.jsonl")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	for _, rec := range x.recs {
+		if err = enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	x.runs = append(x.runs, f.Name())
+	x.recs = nil
+	x.size = 0
+	return f.Close()
+}
+
+// iterator returns the iterator that merges the runs and the records in memory.
+func (x *entryIndex) iterator() (*indexIterator, error) {
+	x.sortRecords()
+	it := &indexIterator{}
+	cursors := []indexCursor{&sliceCursor{recs: x.recs}}
+	for _, run := range x.runs {
+		f, err := os.Open(run)
+		if err != nil {
+			it.close()
+			return nil, err
+		}
+		it.closers = append(it.closers, f)
+		cursors = append(cursors, &runCursor{dec: json.NewDecoder(bufio.NewReader(f))})
+	}
+	for _, c := range cursors {
+		if err := it.push(c); err != nil {
+			it.close()
+			return nil, err
+		}
+	}
+	return it, nil
+}
+
+// close removes the runs.
+func (x *entryIndex) close() error {
+	x.recs = nil
+	if x.dir == "" {
+		return nil
+	}
+	return os.RemoveAll(x.dir)
+}
+
+// indexCursor returns io.EOF after the last record.
+type indexCursor interface {
+	next() (*indexRecord, error)
+}
+
+type sliceCursor struct {
+	recs []*indexRecord
+}
+
+func (c *sliceCursor) next() (*indexRecord, error) {
+	if len(c.recs) == 0 {
+		return nil, io.EOF
+	}
+	rec := c.recs[0]
+	c.recs = c.recs[1:]
+	return rec, nil
+}
+
+type runCursor struct {
+	dec *json.Decoder
+}
+
+func (c *runCursor) next() (*indexRecord, error) {
+	var rec indexRecord
+	if err := c.dec.Decode(&rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+type cursorHeapItem struct {
+	rec    *indexRecord
+	cursor indexCursor
+}
+
+type cursorHeap []cursorHeapItem
+
+func (h cursorHeap) Len() int           { return len(h) }
+func (h cursorHeap) Less(i, j int) bool { return h[i].rec.less(h[j].rec) }
+func (h cursorHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *cursorHeap) Push(x any)        { *h = append(*h, x.(cursorHeapItem)) }
+func (h *cursorHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// indexIterator yields the records of entryIndex in the sorted order.
+type indexIterator struct {
+	h       cursorHeap
+	closers []io.Closer
+}
+
+// push pushes the next record of c.
+func (it *indexIterator) push(c indexCursor) error {
+	rec, err := c.next()
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	heap.Push(&it.h, cursorHeapItem{rec: rec, cursor: c})
+	return nil
+}
+
+// peek returns the next record without consuming it, or nil.
+func (it *indexIterator) peek() *indexRecord {
+	if len(it.h) == 0 {
+		return nil
+	}
+	return it.h[0].rec
+}
+
+func (it *indexIterator) next() (*indexRecord, error) {
+	item := heap.Pop(&it.h).(cursorHeapItem)
+	return item.rec, it.push(item.cursor)
+}
+
+func (it *indexIterator) close() {
+	for _, c := range it.closers {
+		_ = c.Close()
+	}
+	it.closers = nil
+}
+
+// indexIterators returns the iterators of the indexes.
+func indexIterators(idx [3]*entryIndex) ([3]*indexIterator, error) {
+	var its [3]*indexIterator
+	for i, x := range idx {
+		it, err := x.iterator()
+		if err != nil {
+			closeIndexIterators(its)
+			return its, err
+		}
+		its[i] = it
+	}
+	return its, nil
+}
+
+func closeIndexIterators(its [3]*indexIterator) {
+	for _, it := range its {
+		if it != nil {
+			it.close()
+		}
+	}
+}
+
+// minIndexName returns the smallest name of the next records of the iterators.
+func minIndexName(its [3]*indexIterator) (name string, ok bool) {
+	for _, it := range its {
+		if rec := it.peek(); rec != nil && (!ok || rec.Name < name) {
+			name, ok = rec.Name, true
+		}
+	}
+	return name, ok
+}
+
+// takeIndexGroup consumes the records with the name from the iterators.
+func takeIndexGroup(its [3]*indexIterator, name string) (recs [3][]*indexRecord, err error) {
+	for i, it := range its {
+		for rec := it.peek(); rec != nil && rec.Name == name; rec = it.peek() {
+			if rec, err = it.next(); err != nil {
+				return recs, err
+			}
+			recs[i] = append(recs[i], rec)
+		}
+	}
+	return recs, nil
+}
+
+// dirTimesRecord is the timestamps of a directory extracted by [untar.Entry].
+type dirTimesRecord struct {
+	Path       string    `json:"path"`
+	AccessTime time.Time `json:"accessTime"`
+	ModTime    time.Time `json:"modTime"`
+}
+
+func (rec dirTimesRecord) size() int64 {
+	return int64(64 + len(rec.Path))
+}
+
+// spillList is an append-only list that spills the items to a temporary file when the budget is exceeded.
+type spillList[T any] struct {
+	budget int64
+	items  []T
+	size   int64
+	f      *os.File // created on the first spill
+	w      *bufio.Writer
+}
+
+// add appends the item, with the estimated size.
+func (l *spillList[T]) add(item T, size int64) error {
+	l.items = append(l.items, item)
+	l.size += size
+	if l.size > l.budget {
+		return l.spill()
+	}
+	return nil
+}
+
+func (l *spillList[T]) spill() error {
+	if l.f == nil {
+		f, err := os.CreateTemp("", "diffoci-list-*.jsonl")
+		if err != nil {
+			return err
+		}
+		l.f, l.w = f, bufio.NewWriter(f)
+	}
+	enc := json.NewEncoder(l.w)
+	enc.SetEscapeHTML(false)
+	for _, item := range l.items {
+		if err := enc.Encode(item); err != nil {
+			return err
+		}
+	}
+	l.items = nil
+	l.size = 0
+	return nil
+}
+
+// each calls f for the items, in the order of the addition.
+func (l *spillList[T]) each(f func(T) error) error {
+	var errs []error
+	if l.f != nil {
+		if err := l.w.Flush(); err != nil {
+			return err
+		}
+		if _, err := l.f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		dec := json.NewDecoder(bufio.NewReader(l.f))
+		for {
+			var item T
+			if err := dec.Decode(&item); errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				return err
+			}
+			if err := f(item); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	for _, item := range l.items {
+		if err := f(item); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// close removes the temporary file.
+func (l *spillList[T]) close() error {
+	l.items = nil
+	if l.f == nil {
+		return nil
+	}
+	return errors.Join(l.f.Close(), os.Remove(l.f.Name()))
+}
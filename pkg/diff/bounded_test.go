@@ -0,0 +1,245 @@
+package diff
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestEntryIndex(t *testing.T) {
+	testCases := []struct {
+		name   string
+		budget int64
+		spills bool
+	}{
+		{"every record spilled", 0, true},
+		{"small budget", 4096, true},
+		{"large budget", 1 << 30, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			x := &entryIndex{budget: tc.budget}
+			t.Cleanup(func() {
+				if err := x.close(); err != nil {
+					t.Error(err)
+				}
+			})
+			const n = 100
+			for seq := range n {
+				// The names are not sorted, and each name appears twice
+				name := fmt.Sprintf("file%02d", (seq*7)%(n/2))
+				rec := &indexRecord{Name: name, Seq: seq}
+				if seq%3 == 0 {
+					rec.Entry = &TarEntry{Index: seq, Header: &tar.Header{Name: name, Typeflag: tar.TypeReg}}
+					rec.ContentPath = "/content/" + name
+				} else {
+					rec.Events = []*EventTreeNode{{Context: "/layer", Event: Event{Type: EventTypeTarEntryMismatch, Note: name}}}
+					rec.Children = rec.Events
+				}
+				if err := x.add(rec); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if spilled := len(x.runs) > 0; spilled != tc.spills {
+				t.Fatalf("expected spilled=%v, got %d runs", tc.spills, len(x.runs))
+			}
+			it, err := x.iterator()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer it.close()
+			var prev *indexRecord
+			seen := make(map[int]bool)
+			for it.peek() != nil {
+				rec, err := it.next()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if prev != nil && !prev.less(rec) {
+					t.Fatalf("records are not sorted: %q (%d) before %q (%d)", prev.Name, prev.Seq, rec.Name, rec.Seq)
+				}
+				prev = rec
+				seen[rec.Seq] = true
+				if rec.Seq%3 == 0 {
+					if ent := rec.tarEntry(); ent.Header.Name != rec.Name || ent.localPath() != "/content/"+rec.Name {
+						t.Fatalf("unexpected entry %+v (%q)", ent.Header, ent.localPath())
+					}
+				} else if len(rec.Events) != 1 || rec.Events[0].Note != rec.Name || len(rec.Children) != 1 {
+					t.Fatalf("unexpected events %+v", rec.Events)
+				}
+			}
+			if len(seen) != n {
+				t.Fatalf("expected %d records, got %d", n, len(seen))
+			}
+		})
+	}
+}
+
+// TestSharedInputs tests that the inputs shared by the events of the layer are not spilled,
+// and that they are restored on replay.
+func TestSharedInputs(t *testing.T) {
+	const marker = "shared-manifest-annotation"
+	var in [2]EventInput
+	for i := range in {
+		in[i] = EventInput{
+			Descriptor: &ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer},
+			Manifest:   &ocispec.Manifest{Annotations: map[string]string{"test": marker}},
+			Config:     &ocispec.Image{},
+		}
+	}
+	childInputs := in
+	childInputs[0].TarEntry = &TarEntry{Index: 0, Header: &tar.Header{Name: "foo"}}
+	childInputs[1].TarEntry = &TarEntry{Index: 0, Header: &tar.Header{Name: "foo"}}
+	child := &EventTreeNode{Context: "/layer/gobuildinfo", Event: Event{Type: EventTypeGoBuildInfoMismatch, Inputs: childInputs}}
+	ev := &EventTreeNode{Context: "/layer", Event: Event{Type: EventTypeTarEntryMismatch, Inputs: childInputs}, Children: []*EventTreeNode{child}}
+	rec := &indexRecord{Name: "foo", Events: []*EventTreeNode{ev}, Children: []*EventTreeNode{ev}}
+	rec.walkEvents(func(node *EventTreeNode) { stripSharedInputs(node, in) })
+
+	x := &entryIndex{budget: 0} // spills every record
+	t.Cleanup(func() { _ = x.close() })
+	if err := x.add(rec); err != nil {
+		t.Fatal(err)
+	}
+	if len(x.runs) != 1 {
+		t.Fatalf("expected 1 run, got %d", len(x.runs))
+	}
+	b, err := os.ReadFile(x.runs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte(marker)) {
+		t.Fatalf("the shared inputs are spilled: %s", b)
+	}
+
+	it, err := x.iterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.close()
+	spilled, err := it.next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &bufferedEventHandler{}
+	node := &EventTreeNode{Context: "/"}
+	if err := spilled.replay(context.Background(), h, in, node); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.nodes) != 1 || len(node.Children) != 1 {
+		t.Fatalf("expected 1 event and 1 child, got %d and %d", len(h.nodes), len(node.Children))
+	}
+	for _, n := range []*EventTreeNode{h.nodes[0], h.nodes[0].Children[0], node.Children[0], node.Children[0].Children[0]} {
+		for i, got := range n.Inputs {
+			if got.Descriptor == nil || got.Manifest == nil || got.Config == nil ||
+				got.Manifest.Annotations["test"] != marker {
+				t.Fatalf("%s: the shared inputs of input %d are not restored: %+v", n.Context, i, got)
+			}
+			if got.TarEntry == nil || got.TarEntry.Header.Name != "foo" {
+				t.Fatalf("%s: unexpected tar entry of input %d: %+v", n.Context, i, got.TarEntry)
+			}
+		}
+	}
+}
+
+func TestTakeIndexGroup(t *testing.T) {
+	records := [3][]string{
+		{"a", "b", "b", "d"},
+		{"b", "c"},
+		{"a", "d", "d"},
+	}
+	expected := []struct {
+		name  string
+		count [3]int
+	}{
+		{"a", [3]int{1, 0, 1}},
+		{"b", [3]int{2, 1, 0}},
+		{"c", [3]int{0, 1, 0}},
+		{"d", [3]int{1, 0, 2}},
+	}
+	var its [3]*indexIterator
+	for i, names := range records {
+		x := &entryIndex{budget: 1} // spills every record
+		for seq, name := range names {
+			if err := x.add(&indexRecord{Name: name, Seq: seq}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		t.Cleanup(func() { _ = x.close() })
+		it, err := x.iterator()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(it.close)
+		its[i] = it
+	}
+	for _, exp := range expected {
+		name, ok := minIndexName(its)
+		if !ok || name != exp.name {
+			t.Fatalf("expected %q, got %q (%v)", exp.name, name, ok)
+		}
+		recs, err := takeIndexGroup(its, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range recs {
+			if len(recs[i]) != exp.count[i] {
+				t.Fatalf("%q: expected %v records, got %d in index %d", name, exp.count, len(recs[i]), i)
+			}
+		}
+	}
+	if name, ok := minIndexName(its); ok {
+		t.Fatalf("unexpected name %q", name)
+	}
+}
+
+func TestSpillList(t *testing.T) {
+	for _, budget := range []int64{0, 200, 1 << 30} {
+		t.Run(fmt.Sprint(budget), func(t *testing.T) {
+			l := &spillList[dirTimesRecord]{budget: budget}
+			t.Cleanup(func() {
+				if err := l.close(); err != nil {
+					t.Error(err)
+				}
+			})
+			mtime := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+			for i := range 10 {
+				rec := dirTimesRecord{Path: fmt.Sprintf("/dir%d", i), ModTime: mtime.Add(time.Duration(i) * time.Hour)}
+				if err := l.add(rec, rec.size()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var i int
+			if err := l.each(func(rec dirTimesRecord) error {
+				if rec.Path != fmt.Sprintf("/dir%d", i) || !rec.ModTime.Equal(mtime.Add(time.Duration(i)*time.Hour)) {
+					t.Errorf("unexpected record %d: %+v", i, rec)
+				}
+				i++
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if i != 10 {
+				t.Fatalf("expected 10 records, got %d", i)
+			}
+		})
+	}
+	// The temporary file is removed
+	l := &spillList[dirTimesRecord]{}
+	if err := l.add(dirTimesRecord{Path: "/"}, 1); err != nil {
+		t.Fatal(err)
+	}
+	p := l.f.Name()
+	if err := l.close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		t.Fatalf("expected %q to be removed, got %v", filepath.Base(p), err)
+	}
+}
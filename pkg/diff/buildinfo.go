@@ -0,0 +1,185 @@
+package diff
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"debug/buildinfo"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	"github.com/containerd/log"
+)
+
+// executableMagics are the magic bytes of the executable formats that may contain the Go build information.
+var executableMagics = [][]byte{
+	elfMagic,                 // ELF
+	[]byte("MZ"),             // PE
+	{0xfe, 0xed, 0xfa, 0xce}, // Mach-O 32-bit (big endian)
+	{0xfe, 0xed, 0xfa, 0xcf}, // Mach-O 64-bit (big endian)
+	{0xce, 0xfa, 0xed, 0xfe}, // Mach-O 32-bit (little endian)
+	{0xcf, 0xfa, 0xed, 0xfe}, // Mach-O 64-bit (little endian)
+}
+
+// isExecutable returns true if head is the head of an executable file that may contain the Go build information.
+func isExecutable(head []byte) bool {
+	for _, magic := range executableMagics {
+		if bytes.HasPrefix(head, magic) {
+			return true
+		}
+	}
+	return false
+}
+
+// GoBuildInfoDiff describes a difference of the build information of the Go executables.
+type GoBuildInfoDiff struct {
+	// Field is the differing field, in the format of the output of `go version -m`:
+	// "go", "path", "mod", "dep <module path>", or "build <key>".
+	Field string `json:"field"`
+	// Values are the values of the field. Nil if the field is missing.
+	Values [2]*string `json:"values"`
+}
+
+// String implements [fmt.Stringer].
+// The returned string is not machine-parsable.
+func (g *GoBuildInfoDiff) String() string {
+	var v [2]string
+	for i, p := range g.Values {
+		v[i] = "missing"
+		if p != nil {
+			v[i] = fmt.Sprintf("%q", *p)
+		}
+	}
+	return fmt.Sprintf("Go build info %q differs: %s vs %s", g.Field, v[0], v[1])
+}
+
+// goBuildInfoFields flattens the build information into the fields of GoBuildInfoDiff.
+func goBuildInfoFields(bi *debug.BuildInfo) map[string]string {
+	m := map[string]string{
+		"go":   bi.GoVersion,
+		"path": bi.Path,
+	}
+	if bi.Main.Path != "" {
+		m["mod"] = goModuleString(&bi.Main)
+	}
+	for _, dep := range bi.Deps {
+		m["dep "+dep.Path] = goModuleString(dep)
+	}
+	for _, s := range bi.Settings {
+		m["build "+s.Key] = s.Value
+	}
+	return m
+}
+
+// goModuleString returns the version, the checksum, and the replacement of the module.
+func goModuleString(mod *debug.Module) string {
+	s := strings.TrimSpace(mod.Version + " " + mod.Sum)
+	if r := mod.Replace; r != nil {
+		s += " => " + r.Path + " " + goModuleString(r)
+	}
+	return s
+}
+
+// goBuildInfoFieldOrder orders the fields as in the output of `go version -m`.
+func goBuildInfoFieldOrder(field string) int {
+	switch kind, _, _ := strings.Cut(field, " "); kind {
+	case "go":
+		return 0
+	case "path":
+		return 1
+	case "mod":
+		return 2
+	case "dep":
+		return 3
+	default: // "build"
+		return 4
+	}
+}
+
+// compareGoBuildInfo returns the differing fields of the build information.
+func compareGoBuildInfo(bi0, bi1 *debug.BuildInfo) []GoBuildInfoDiff {
+	m0, m1 := goBuildInfoFields(bi0), goBuildInfoFields(bi1)
+	fields := make([]string, 0, len(m0))
+	for k := range m0 {
+		fields = append(fields, k)
+	}
+	for k := range m1 {
+		if _, ok := m0[k]; !ok {
+			fields = append(fields, k)
+		}
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		oi, oj := goBuildInfoFieldOrder(fields[i]), goBuildInfoFieldOrder(fields[j])
+		if oi != oj {
+			return oi < oj
+		}
+		return fields[i] < fields[j]
+	})
+	var res []GoBuildInfoDiff
+	for _, k := range fields {
+		v0, ok0 := m0[k]
+		v1, ok1 := m1[k]
+		if ok0 && ok1 && v0 == v1 {
+			continue
+		}
+		g := GoBuildInfoDiff{Field: k}
+		if ok0 {
+			g.Values[0] = &v0
+		}
+		if ok1 {
+			g.Values[1] = &v1
+		}
+		res = append(res, g)
+	}
+	return res
+}
+
+// readGoBuildInfo reads the build information of the Go executable.
+// Returns nil if the file is not a Go executable.
+func readGoBuildInfo(ctx context.Context, name, p string) *debug.BuildInfo {
+	bi, err := buildinfo.ReadFile(p)
+	if err != nil {
+		// buildinfo does not export the errors for the non-Go executables and for the unknown formats
+		log.G(ctx).WithError(err).Debugf("Failed to read the Go build info of %q", name)
+		return nil
+	}
+	return bi
+}
+
+// diffGoBuildInfo compares the build information, when both the regular files are Go executables.
+// The events are raised under node, which is the node of the mismatch of the executable files.
+func (d *differ) diffGoBuildInfo(ctx context.Context, node *EventTreeNode, in [2]EventInput, ent0, ent1 *TarEntry) error {
+	if !d.o.GoBuildInfo || ent0.Digest == ent1.Digest {
+		return nil
+	}
+	if ent0.Header.Typeflag != tar.TypeReg || ent1.Header.Typeflag != tar.TypeReg {
+		return nil
+	}
+	p0, p1 := ent0.localPath(), ent1.localPath()
+	if p0 == "" || p1 == "" {
+		return nil
+	}
+	bi0 := readGoBuildInfo(ctx, ent0.Header.Name, p0)
+	if bi0 == nil {
+		return nil
+	}
+	bi1 := readGoBuildInfo(ctx, ent1.Header.Name, p1)
+	if bi1 == nil {
+		return nil
+	}
+	var errs []error
+	for _, g := range compareGoBuildInfo(bi0, bi1) {
+		ev := Event{
+			Type:        EventTypeGoBuildInfoMismatch,
+			Inputs:      in,
+			GoBuildInfo: &g,
+		}
+		if err := d.raiseEvent(ctx, node, ev, "gobuildinfo"); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
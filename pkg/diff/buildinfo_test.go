@@ -0,0 +1,220 @@
+package diff
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime/debug"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestIsExecutable(t *testing.T) {
+	testCases := []struct {
+		name     string
+		head     string
+		expected bool
+	}{
+		{"elf", "\x7fELF\x02\x01\x01", true},
+		{"pe", "MZ\x90\x00", true},
+		{"mach-o 64-bit", "\xcf\xfa\xed\xfe", true},
+		{"mach-o 32-bit big endian", "\xfe\xed\xfa\xce", true},
+		{"script", "#!/bin/sh\n", false},
+		{"empty", "", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isExecutable([]byte(tc.head)); got != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+// testBuildInfo returns the build information of a Go executable built with "go build -trimpath".
+func testBuildInfo() *debug.BuildInfo {
+	return &debug.BuildInfo{
+		GoVersion: "go1.22.0",
+		Path:      "example.com/foo/cmd/foo",
+		Main:      debug.Module{Path: "example.com/foo", Version: "(devel)"},
+		Deps: []*debug.Module{
+			{Path: "example.com/bar", Version: "v1.0.0", Sum: "h1:bar="},
+			{Path: "example.com/baz", Version: "v1.0.0", Sum: "h1:baz="},
+		},
+		Settings: []debug.BuildSetting{
+			{Key: "-trimpath", Value: "true"},
+			{Key: "CGO_ENABLED", Value: "0"},
+			{Key: "vcs.revision", Value: "aaaa"},
+			{Key: "vcs.modified", Value: "false"},
+		},
+	}
+}
+
+func TestCompareGoBuildInfo(t *testing.T) {
+	testCases := []struct {
+		name     string
+		mutate   func(bi *debug.BuildInfo)
+		expected []GoBuildInfoDiff
+	}{
+		{
+			name:   "identical",
+			mutate: func(*debug.BuildInfo) {},
+		},
+		{
+			name:     "toolchain",
+			mutate:   func(bi *debug.BuildInfo) { bi.GoVersion = "go1.22.1" },
+			expected: []GoBuildInfoDiff{{Field: "go", Values: [2]*string{ptrTo("go1.22.0"), ptrTo("go1.22.1")}}},
+		},
+		{
+			name: "vcs",
+			mutate: func(bi *debug.BuildInfo) {
+				bi.Settings[2].Value = "bbbb"
+				bi.Settings[3].Value = "true"
+			},
+			expected: []GoBuildInfoDiff{
+				{Field: "build vcs.modified", Values: [2]*string{ptrTo("false"), ptrTo("true")}},
+				{Field: "build vcs.revision", Values: [2]*string{ptrTo("aaaa"), ptrTo("bbbb")}},
+			},
+		},
+		{
+			name:     "trimpath missing",
+			mutate:   func(bi *debug.BuildInfo) { bi.Settings = bi.Settings[1:] },
+			expected: []GoBuildInfoDiff{{Field: "build -trimpath", Values: [2]*string{ptrTo("true"), nil}}},
+		},
+		{
+			name: "dependency",
+			mutate: func(bi *debug.BuildInfo) {
+				bi.Deps[0] = &debug.Module{Path: "example.com/bar", Version: "v1.1.0", Sum: "h1:bar2="}
+			},
+			expected: []GoBuildInfoDiff{
+				{Field: "dep example.com/bar", Values: [2]*string{ptrTo("v1.0.0 h1:bar="), ptrTo("v1.1.0 h1:bar2=")}},
+			},
+		},
+		{
+			name: "replaced dependency",
+			mutate: func(bi *debug.BuildInfo) {
+				bi.Deps[1] = &debug.Module{Path: "example.com/baz", Version: "v1.0.0",
+					Replace: &debug.Module{Path: "../baz", Version: "(devel)"}}
+			},
+			expected: []GoBuildInfoDiff{
+				{Field: "dep example.com/baz", Values: [2]*string{ptrTo("v1.0.0 h1:baz="), ptrTo("v1.0.0 => ../baz (devel)")}},
+			},
+		},
+		{
+			name: "dependency added",
+			mutate: func(bi *debug.BuildInfo) {
+				bi.Deps = append(bi.Deps, &debug.Module{Path: "example.com/qux", Version: "v0.1.0", Sum: "h1:qux="})
+			},
+			expected: []GoBuildInfoDiff{{Field: "dep example.com/qux", Values: [2]*string{nil, ptrTo("v0.1.0 h1:qux=")}}},
+		},
+		{
+			// The fields are ordered as in the output of `go version -m`
+			name: "multiple fields",
+			mutate: func(bi *debug.BuildInfo) {
+				bi.GoVersion = "go1.22.1"
+				bi.Path = "example.com/foo/cmd/foo2"
+				bi.Main.Version = "v1.0.0"
+				bi.Deps = bi.Deps[:1]
+				bi.Settings[1].Value = "1"
+			},
+			expected: []GoBuildInfoDiff{
+				{Field: "go", Values: [2]*string{ptrTo("go1.22.0"), ptrTo("go1.22.1")}},
+				{Field: "path", Values: [2]*string{ptrTo("example.com/foo/cmd/foo"), ptrTo("example.com/foo/cmd/foo2")}},
+				{Field: "mod", Values: [2]*string{ptrTo("(devel)"), ptrTo("v1.0.0")}},
+				{Field: "dep example.com/baz", Values: [2]*string{ptrTo("v1.0.0 h1:baz="), nil}},
+				{Field: "build CGO_ENABLED", Values: [2]*string{ptrTo("0"), ptrTo("1")}},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			bi0, bi1 := testBuildInfo(), testBuildInfo()
+			tc.mutate(bi1)
+			got := compareGoBuildInfo(bi0, bi1)
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestGoBuildInfoDiffString(t *testing.T) {
+	v0, v1 := "go1.22.0", "go1.22.1"
+	testCases := []struct {
+		g        GoBuildInfoDiff
+		expected string
+	}{
+		{GoBuildInfoDiff{Field: "go", Values: [2]*string{&v0, &v1}}, `Go build info "go" differs: "go1.22.0" vs "go1.22.1"`},
+		{GoBuildInfoDiff{Field: "build -trimpath", Values: [2]*string{nil, &v1}}, `Go build info "build -trimpath" differs: missing vs "go1.22.1"`},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.expected, func(t *testing.T) {
+			if got := tc.g.String(); got != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestDiffGoBuildInfo(t *testing.T) {
+	// The test binary is a Go executable
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(t.TempDir(), "script")
+	if err = os.WriteFile(script, []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name        string
+		paths       [2]string
+		goBuildInfo bool
+	}{
+		{"same build info", [2]string{exe, exe}, true},
+		{"disabled", [2]string{exe, exe}, false},
+		{"not a Go executable", [2]string{exe, script}, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var ents [2]*TarEntry
+			for i, p := range tc.paths {
+				ents[i] = &TarEntry{
+					Header: &tar.Header{Name: "bin/foo", Typeflag: tar.TypeReg},
+					// The digests are assumed to differ
+					Digest:      digest.FromString(fmt.Sprint(i)),
+					contentPath: p,
+				}
+			}
+			h := &testEventCounter{}
+			d := &differ{o: Options{GoBuildInfo: tc.goBuildInfo, EventHandler: h}}
+			node := &EventTreeNode{Context: "/manifests-0/layers-0/layer/tarentry"}
+			if err := d.diffGoBuildInfo(context.Background(), node, [2]EventInput{}, ents[0], ents[1]); err != nil {
+				t.Fatal(err)
+			}
+			if len(node.Children) != 0 || h.n != 0 {
+				t.Errorf("expected no event, got %d", len(node.Children))
+			}
+		})
+	}
+	if bi := readGoBuildInfo(context.Background(), "test", exe); bi == nil || bi.GoVersion == "" {
+		t.Errorf("failed to read the build info of the test binary")
+	}
+	if bi := readGoBuildInfo(context.Background(), "script", script); bi != nil {
+		t.Errorf("expected nil for a script, got %v", bi)
+	}
+}
+
+// testEventCounter counts the events.
+type testEventCounter struct {
+	n int
+}
+
+func (h *testEventCounter) HandleEventTreeNode(context.Context, *EventTreeNode) error {
+	h.n++
+	return nil
+}
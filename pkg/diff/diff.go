@@ -2,6 +2,7 @@ package diff
 
 import (
 	"archive/tar"
+	"bufio"
 	"context"
 	"encoding/json"
 	"errors"
@@ -40,6 +41,8 @@ type IgnoranceOptions struct {
 	IgnoreImageName             bool
 	IgnoreTarFormat             bool
 	CanonicalPaths              bool
+	IgnoreELFBuildID            bool // Ignore the ELF files that only differ in the build IDs
+	IgnoreDebugSections         bool // Ignore the ELF files that only differ in the debug sections
 }
 
 type Options struct {
@@ -48,10 +51,56 @@ type Options struct {
 	ReportFile string
 	ReportDir  string
 	MaxScale   float64
+	// Snapshotter, if set, is used for comparing the unpacked snapshots of the layers
+	// instead of decompressing the layer blobs.
+	// The layer blobs are used when the snapshots are not available.
+	Snapshotter Snapshotter
+	// Concurrency is the maximum number of the manifests, the layers, and the inputs
+	// to be compared concurrently.
+	// Zero means 1 (no concurrency).
+	Concurrency int
+	// MemoryBudget, if positive, is the approximate number of bytes that may be used for
+	// retaining the tar entries of a pair of layers.
+	// The entries exceeding the budget are spilled to temporary files.
+	// Zero means unlimited.
+	MemoryBudget int64
+	// LayerIndexCache, if set, is used for persisting the entries of the layers across runs.
+	LayerIndexCache *LayerIndexCache
+	// Flatten compares the root filesystems flattened from the layers with the OCI whiteout rules,
+	// instead of comparing each pair of the layers.
+	// When Flatten is false and the numbers of the layers differ, the layers are aligned, and only the
+	// differing runs of the layers are merged.
+	Flatten bool
+	// TextDiffMaxSize, if positive, is the maximum size of the regular files to be compared
+	// with a unified diff, when both files are detected as texts.
+	// Zero disables the text diffs.
+	// The texts are retained in memory while the layers are compared, unless ReportDir is set,
+	// in which case the texts of the differing entries are read from the extracted files.
+	TextDiffMaxSize int64
+	// TextDiffMaxLines, if positive, is the maximum number of the lines of a text diff.
+	// The excess lines are truncated.
+	TextDiffMaxLines int
+	// NestedArchives compares the entries of the archives (zip, jar, tar, gzip, etc.) in the layers,
+	// when the archive files differ.
+	// The archives are copied to temporary files while comparing the layers.
+	NestedArchives bool
+	// ELFSections compares the differing ELF files section by section, and explains the differences.
+	// Implied by IgnoreELFBuildID and IgnoreDebugSections.
+	// The ELF files are copied to temporary files while comparing the layers.
+	ELFSections bool
+	// GoBuildInfo compares the build information (debug/buildinfo) of the differing Go executables,
+	// and raises EventTypeGoBuildInfoMismatch for each differing field.
+	// The executable files are copied to temporary files while comparing the layers.
+	GoBuildInfo bool
+	// Normalizers are the names of the normalizers (see [RegisterNormalizer]) applied to the contents of the files
+	// before comparing them, e.g., "pyc", "gzip", "ar".
+	// The digests of the normalized contents are stored in TarEntry.NormalizedDigest.
+	// The normalizers are tried in the order, and only the first matching one is applied.
+	Normalizers []string
 }
 
 func (o *Options) digestMayChange() bool {
-	return o.IgnoranceOptions != IgnoranceOptions{}
+	return o.IgnoranceOptions != IgnoranceOptions{} || len(o.Normalizers) > 0
 }
 
 func (o *Options) sizeMayChange() bool {
@@ -62,21 +111,43 @@ func (o *Options) sizeMayChange() bool {
 func Diff(ctx context.Context, cs content.Provider, descs [2]ocispec.Descriptor,
 	platMC platforms.MatchComparer, opts *Options) (*EventTreeNode, error) {
 	for i, desc := range descs {
-		available, _, _, missing, err := images.Check(ctx, cs, desc, platMC)
-		if err == nil && !available {
-			err = errdefs.ErrUnavailable
+		if err := checkAvailable(ctx, cs, i, desc, platMC); err != nil {
+			return nil, err
 		}
-		if err != nil {
-			log.G(ctx).Debugf("missing=%+v", missing)
-			for _, f := range missing {
-				if f.Platform != nil {
-					p := platforms.Format(*f.Platform)
-					return nil, fmt.Errorf("image %d is not available for platform %q: %w", i, p, err)
-				}
+	}
+	return run(ctx, cs, platMC, opts, func(ctx context.Context, d *differ, node *EventTreeNode) error {
+		inputs := [2]EventInput{
+			{
+				Descriptor: &descs[0],
+			}, {
+				Descriptor: &descs[1],
+			},
+		}
+		return d.diff(ctx, node, inputs)
+	})
+}
+
+func checkAvailable(ctx context.Context, cs content.Provider, inputIdx int, desc ocispec.Descriptor, platMC platforms.MatchComparer) error {
+	available, _, _, missing, err := images.Check(ctx, cs, desc, platMC)
+	if err == nil && !available {
+		err = errdefs.ErrUnavailable
+	}
+	if err != nil {
+		log.G(ctx).Debugf("missing=%+v", missing)
+		for _, f := range missing {
+			if f.Platform != nil {
+				p := platforms.Format(*f.Platform)
+				return fmt.Errorf("image %d is not available for platform %q: %w", inputIdx, p, err)
 			}
-			return nil, fmt.Errorf("image %d is not available for the requested platform: %w", i, err)
 		}
+		return fmt.Errorf("image %d is not available for the requested platform: %w", inputIdx, err)
 	}
+	return nil
+}
+
+// run runs f with a differ, and flushes the event handler and writes the report files.
+func run(ctx context.Context, cs content.Provider, platMC platforms.MatchComparer, opts *Options,
+	f func(ctx context.Context, d *differ, node *EventTreeNode) error) (*EventTreeNode, error) {
 	var o Options
 	if opts != nil {
 		o = *opts
@@ -108,22 +179,35 @@ func Diff(ctx context.Context, cs content.Provider, descs [2]ocispec.Descriptor,
 		o.MaxScale = 1.0
 	}
 	d := differ{
-		cs:     cs,
-		platMC: platMC,
-		o:      o,
+		cs:             cs,
+		platMC:         platMC,
+		o:              o,
+		snapshotLayers: &snapshotLayerMap{},
+	}
+	if o.Concurrency > 1 {
+		d.sem = make(chan struct{}, o.Concurrency-1)
+	}
+	var err error
+	if d.normalizers, err = lookupNormalizers(o.Normalizers); err != nil {
+		return nil, err
+	}
+	if o.NestedArchives || o.elfEnabled() || o.GoBuildInfo {
+		spoolDir, err := os.MkdirTemp("", "diffoci-contents-")
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err := os.RemoveAll(spoolDir); err != nil {
+				log.G(ctx).WithError(err).Warnf("Failed to remove %q", spoolDir)
+			}
+		}()
+		d.spoolDir = spoolDir
 	}
 	eventTreeRootNode := &EventTreeNode{
 		Context: "/",
 	}
-	inputs := [2]EventInput{
-		{
-			Descriptor: &descs[0],
-		}, {
-			Descriptor: &descs[1],
-		},
-	}
 	var errs []error
-	if err := d.diff(ctx, eventTreeRootNode, inputs); err != nil {
+	if err := f(ctx, &d, eventTreeRootNode); err != nil {
 		errs = append(errs, err)
 	}
 	if flusher, ok := o.EventHandler.(Flusher); ok {
@@ -154,6 +238,11 @@ type differ struct {
 	cs     content.Provider
 	platMC platforms.MatchComparer
 	o      Options
+
+	sem            chan struct{} // tokens for the extra goroutines; nil for no concurrency
+	snapshotLayers *snapshotLayerMap
+	spoolDir       string // temporary directory for the contents compared after loading the layers (NestedArchives, ELF, GoBuildInfo)
+	normalizers    []*Normalizer
 }
 
 func (d *differ) raiseEvent(ctx context.Context, node *EventTreeNode, ev Event, evContextName string) error {
@@ -334,26 +423,32 @@ func (d *differ) diffDescriptorSliceField(ctx context.Context, node *EventTreeNo
 	if len(descSlices[0]) > maxEnts {
 		return fmt.Errorf("field %q: too many manifests (> %d)", fieldName, maxEnts)
 	}
-	var errs []error
-	// TODO: paralellize the loop
+	var (
+		errs  []error
+		tasks = make([]*childTask, len(descSlices[0]))
+		wg    sync.WaitGroup
+	)
 	for i := range descSlices[0] {
 		i := i
 		fieldNameI := fmt.Sprintf("%s[%d]", fieldName, i)
-		newNode := EventTreeNode{
-			Context: path.Join(node.Context, path.Clean(strings.ToLower(fieldName)+"-"+strconv.Itoa(i))),
-			Event: Event{
-				Type:   evType,
-				Inputs: in,
-				Diff:   cmp.Diff(descSlices[0][i], descSlices[1][i]),
-				Note:   fmt.Sprintf("field %q", fieldNameI),
-			},
-		}
 		if tolerable, err := validateDesc(descSlices[0][i]); err != nil {
 			if !tolerable {
 				errs = append(errs, fmt.Errorf("field %q: invalid: %w", fieldNameI, err))
 			}
 			continue
 		}
+		t := &childTask{
+			node: &EventTreeNode{
+				Context: path.Join(node.Context, path.Clean(strings.ToLower(fieldName)+"-"+strconv.Itoa(i))),
+				Event: Event{
+					Type:   evType,
+					Inputs: in,
+					Diff:   cmp.Diff(descSlices[0][i], descSlices[1][i]),
+					Note:   fmt.Sprintf("field %q", fieldNameI),
+				},
+			},
+		}
+		tasks[i] = t
 		childInputs := [2]EventInput{
 			{
 				Descriptor: &descSlices[0][i],
@@ -361,14 +456,28 @@ func (d *differ) diffDescriptorSliceField(ctx context.Context, node *EventTreeNo
 				Descriptor: &descSlices[1][i],
 			},
 		}
-		if err := d.diff(ctx, &newNode, childInputs); err != nil {
-			errs = append(errs, fmt.Errorf("field %q: %w", fieldNameI, err))
-		}
-		if len(newNode.Children) > 0 {
-			if err2 := d.raiseEventWithEventTreeNode(ctx, node, &newNode); err2 != nil {
-				errs = append(errs, err2)
+		childCtx := context.WithValue(ctx, fieldIndexKey{}, i)
+		d.goOrRun(&wg, func() {
+			if err := d.forTask(t).diff(childCtx, t.node, childInputs); err != nil {
+				t.err = fmt.Errorf("field %q: %w", fieldNameI, err)
 			}
-		} // else no event happens
+		})
+		if d.sem == nil {
+			if err := d.finishTask(ctx, node, t); err != nil {
+				errs = append(errs, err)
+			}
+			tasks[i] = nil
+		}
+	}
+	wg.Wait()
+	// Raise the events in the order of the descriptors, regardless of the scheduling
+	for _, t := range tasks {
+		if t == nil {
+			continue
+		}
+		if err := d.finishTask(ctx, node, t); err != nil {
+			errs = append(errs, err)
+		}
 	}
 	return errors.Join(errs...)
 }
@@ -505,8 +614,19 @@ func (d *differ) diffManifest(ctx context.Context, node *EventTreeNode, in [2]Ev
 	}
 
 	// Compare Layers
-	if len(in[0].Manifest.Layers) == len(in[1].Manifest.Layers) {
-		if err := d.diffDescriptorSliceField(ctx, node, in, EventTypeManifestBlobMismatch, [2][]ocispec.Descriptor{
+	if d.o.Flatten {
+		if err := d.diffFlattenedLayers(ctx, node, in); err != nil {
+			errs = append(errs, err)
+		}
+	} else if len(in[0].Manifest.Layers) == len(in[1].Manifest.Layers) {
+		layersCtx := ctx
+		if d.o.Snapshotter != nil {
+			var err error
+			if layersCtx, err = d.registerSnapshotLayers(ctx, in); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if err := d.diffDescriptorSliceField(layersCtx, node, in, EventTypeManifestBlobMismatch, [2][]ocispec.Descriptor{
 			in[0].Manifest.Layers,
 			in[1].Manifest.Layers,
 		}, "Layers", int(maxLayers*d.o.MaxScale),
@@ -519,8 +639,7 @@ func (d *differ) diffManifest(ctx context.Context, node *EventTreeNode, in [2]Ev
 			errs = append(errs, err)
 		}
 	} else {
-		log.G(ctx).Warningf("Layer length mismatch (%d vs %d), squashing for comparison (EXPERIMENTAL)", len(in[0].Manifest.Layers), len(in[1].Manifest.Layers))
-		if err := d.diffLayersWithSquashing(ctx, node, in); err != nil {
+		if err := d.diffAlignedLayers(ctx, node, in); err != nil {
 			errs = append(errs, err)
 		}
 	}
@@ -627,31 +746,23 @@ func (d *differ) diffConfig(ctx context.Context, node *EventTreeNode, in [2]Even
 	return errors.Join(errs...)
 }
 
-func (d *differ) diffLayersWithSquashing(ctx context.Context, node *EventTreeNode, in [2]EventInput) error {
-	tr0, trCloser0, err := openTarReaderWithSquashing(ctx, d.cs, in[0].Manifest.Layers, d.o.MaxScale)
-	if err != nil {
-		return err
+func (d *differ) diffLayer(ctx context.Context, node *EventTreeNode, in [2]EventInput) error {
+	if in[0].Descriptor.Digest == in[1].Descriptor.Digest {
+		// Identical blobs never raise events, so skip opening (and possibly fetching) them.
+		// The report directory would not contain their files either, as the identical files are removed.
+		log.G(ctx).Debugf("Skipping identical layer %s", in[0].Descriptor.Digest)
+		return nil
 	}
-	defer func() {
-		if trCloserErr0 := trCloser0(); trCloserErr0 != nil {
-			log.G(ctx).WithError(trCloserErr0).Warn("failed to close tar reader 0")
+	if d.o.Snapshotter != nil {
+		if sl, ok := d.lookupSnapshotLayers(ctx); ok {
+			err := d.diffLayerWithSnapshots(ctx, node, in, sl)
+			if !errors.Is(err, errdefs.ErrNotFound) {
+				return err
+			}
+			log.G(ctx).WithError(err).Debug("Snapshots are not available, comparing the layer blobs")
 		}
-	}()
-
-	tr1, trCloser1, err := openTarReaderWithSquashing(ctx, d.cs, in[1].Manifest.Layers, d.o.MaxScale)
-	if err != nil {
-		return err
 	}
-	defer func() {
-		if trCloserErr1 := trCloser1(); trCloserErr1 != nil {
-			log.G(ctx).WithError(trCloserErr1).Warn("failed to close tar reader 1")
-		}
-	}()
-	return d.diffLayerWithTarReader(ctx, node, in, tr0, tr1)
-}
-
-func (d *differ) diffLayer(ctx context.Context, node *EventTreeNode, in [2]EventInput) error {
-	tr0, trCloser0, err := openTarReader(ctx, d.cs, *in[0].Descriptor, d.o.MaxScale)
+	tr0, trCloser0, err := d.openLayerTarReader(ctx, *in[0].Descriptor)
 	if err != nil {
 		return err
 	}
@@ -661,7 +772,7 @@ func (d *differ) diffLayer(ctx context.Context, node *EventTreeNode, in [2]Event
 		}
 	}()
 
-	tr1, trCloser1, err := openTarReader(ctx, d.cs, *in[1].Descriptor, d.o.MaxScale)
+	tr1, trCloser1, err := d.openLayerTarReader(ctx, *in[1].Descriptor)
 	if err != nil {
 		return err
 	}
@@ -695,83 +806,169 @@ func (d *differ) loadLayer(ctx context.Context, node *EventTreeNode, inputIdx in
 		if errors.Is(err, io.EOF) {
 			break
 		}
-		if d.o.IgnoreTarFormat {
-			hdr.Format = tar.FormatUnknown
-		}
-		if d.o.CanonicalPaths {
-			hdr.Name = strings.TrimPrefix(hdr.Name, "/")
-			hdr.Name = strings.TrimPrefix(hdr.Name, "./")
-			hdr.Linkname = strings.TrimPrefix(hdr.Linkname, "/")
-			hdr.Linkname = strings.TrimPrefix(hdr.Linkname, "./")
-			if path, ok := hdr.PAXRecords["path"]; ok {
-				path = strings.TrimPrefix(path, "/")
-				hdr.PAXRecords["path"] = strings.TrimPrefix(path, "./")
-			}
-			if path, ok := hdr.PAXRecords["linkpath"]; ok {
-				path = strings.TrimPrefix(path, "/")
-				hdr.PAXRecords["linkpath"] = strings.TrimPrefix(path, "./")
-			}
+		if err != nil {
+			return res, err
 		}
-		if os.Geteuid() != 0 && runtime.GOOS == "linux" {
-			//nolint:staticcheck // SA1019: hdr.Xattrs has been deprecated since Go 1.10: Use PAXRecords instead.
-			for k := range hdr.Xattrs {
-				if strings.HasPrefix(k, "security.") {
-					log.G(ctx).Debugf("Ignoring xattr %q", k)
-					delete(hdr.Xattrs, k)
-				}
-			}
-			for k := range hdr.PAXRecords {
-				if strings.HasPrefix(k, "SCHILY.xattr.security.") {
-					log.G(ctx).Debugf("Ignoring PAX record %q", k)
-					delete(hdr.PAXRecords, k)
-				}
-			}
+		ent, finalizer, err := d.loadEntry(ctx, node, inputIdx, i, hdr, tr)
+		if finalizer != nil {
+			res.finalizers = append(res.finalizers, finalizer)
 		}
-		res.entries++
-		ent := &TarEntry{
-			Index:  i,
-			Header: hdr,
-		}
-		if repDir := d.o.ReportDir; repDir != "" {
-			dirx := filepath.Clean(node.Context) // "/manifests-0/layers-0"
-			dir := filepath.Join(repDir, ReportDirInput0, dirx)
-			switch inputIdx {
-			case 0: // NOP
-			case 1:
-				dir = filepath.Join(repDir, ReportDirInput1, dirx)
-			default:
-				return res, fmt.Errorf("invalid input index %d", inputIdx)
-			}
-			ut, err := untar.Entry(ctx, dir, hdr, tr)
-			if err != nil {
-				return res, err
-			}
-			ent.Digest = ut.Digest
-			ent.extractedPath = ut.Path
-			if ut.Finalizer != nil {
-				res.finalizers = append(res.finalizers, ut.Finalizer)
-			}
-		} else {
-			ent.Digest, err = digest.SHA256.FromReader(tr)
-			if err != nil {
-				return res, err
-			}
+		if err != nil {
+			return res, err
 		}
+		res.entries++
 		res.entriesByName[hdr.Name] = append(res.entriesByName[hdr.Name], ent)
 	}
 
 	return res, nil
 }
 
+// loadEntry loads the i-th entry of the layer, and extracts it to the report directory if needed.
+func (d *differ) loadEntry(ctx context.Context, node *EventTreeNode, inputIdx, i int, hdr *tar.Header, r io.Reader) (ent *TarEntry, finalizer func() error, err error) {
+	d.normalizeHeader(ctx, hdr)
+	ent = &TarEntry{
+		Index:  i,
+		Header: hdr,
+	}
+	if ir, ok := r.(*layerIndexReader); ok {
+		ir.loadDigests(ent)
+		ent.text = d.retainedText(ir.entryText())
+	} else if repDir := d.o.ReportDir; repDir != "" {
+		dirx := filepath.Clean(node.Context) // "/manifests-0/layers-0"
+		dir := filepath.Join(repDir, ReportDirInput0, dirx)
+		switch inputIdx {
+		case 0: // NOP
+		case 1:
+			dir = filepath.Join(repDir, ReportDirInput1, dirx)
+		default:
+			return nil, nil, fmt.Errorf("invalid input index %d", inputIdx)
+		}
+		ut, err := untar.Entry(ctx, dir, hdr, r)
+		if err != nil {
+			return nil, nil, err
+		}
+		ent.Digest = ut.Digest
+		ent.extractedPath = ut.Path
+		finalizer = ut.Finalizer
+		if len(d.normalizers) > 0 && hdr.Typeflag == tar.TypeReg {
+			// The extracted file is not normalized, but its normalized digest is computed
+			if _, err = d.digestFile(ent, ut.Path, 0); err != nil {
+				return nil, nil, err
+			}
+		}
+	} else {
+		cr, spooled, err := d.spoolContent(hdr.Name, r)
+		if err != nil {
+			return nil, nil, err
+		}
+		text, err := d.digestNormalizedContent(ent, cr, d.textSizeLimit(hdr, r))
+		p, spoolErr := spooled()
+		if err = errors.Join(err, spoolErr); err != nil {
+			return nil, nil, err
+		}
+		ent.contentPath = p
+		if itr, ok := r.(*indexingTarReader); ok {
+			itr.entryLoaded(ent, text)
+		}
+		ent.text = d.retainedText(text)
+	}
+	return ent, finalizer, nil
+}
+
+// normalizeHeader normalizes the tar header for IgnoreTarFormat and CanonicalPaths.
+func (d *differ) normalizeHeader(ctx context.Context, hdr *tar.Header) {
+	if d.o.IgnoreTarFormat {
+		hdr.Format = tar.FormatUnknown
+	}
+	if d.o.CanonicalPaths {
+		hdr.Name = strings.TrimPrefix(hdr.Name, "/")
+		hdr.Name = strings.TrimPrefix(hdr.Name, "./")
+		hdr.Linkname = strings.TrimPrefix(hdr.Linkname, "/")
+		hdr.Linkname = strings.TrimPrefix(hdr.Linkname, "./")
+		if path, ok := hdr.PAXRecords["path"]; ok {
+			path = strings.TrimPrefix(path, "/")
+			hdr.PAXRecords["path"] = strings.TrimPrefix(path, "./")
+		}
+		if path, ok := hdr.PAXRecords["linkpath"]; ok {
+			path = strings.TrimPrefix(path, "/")
+			hdr.PAXRecords["linkpath"] = strings.TrimPrefix(path, "./")
+		}
+	}
+	dropSecurityXattrs(ctx, hdr)
+}
+
+// spoolContent returns the reader of the content, which copies the content to a temporary file
+// if the content is compared after loading the layer, i.e., if the content is an archive (NestedArchives),
+// an ELF file, or an executable file (GoBuildInfo).
+// The returned function must be called after reading the content, and returns the path of the temporary file
+// (or an empty string if the content is not copied).
+func (d *differ) spoolContent(name string, r io.Reader) (io.Reader, func() (string, error), error) {
+	nop := func() (string, error) { return "", nil }
+	if d.spoolDir == "" {
+		return r, nop, nil
+	}
+	br := bufio.NewReaderSize(r, archiveHeadSize)
+	head, _ := br.Peek(archiveHeadSize) // may be shorter than archiveHeadSize
+	archive := d.nestedArchiveAllowed(name) && detectArchiveFormat(head) != archiveFormatNone
+	if !archive && !(d.o.elfEnabled() && isELF(head)) && !(d.o.GoBuildInfo && isExecutable(head)) {
+		return br, nop, nil
+	}
+	f, err := os.CreateTemp(d.spoolDir, "content-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	return io.TeeReader(br, f), func() (string, error) {
+		if err := f.Close(); err != nil {
+			return "", err
+		}
+		return f.Name(), nil
+	}, nil
+}
+
+// dropSecurityXattrs drops "security.*" xattrs, which cannot be extracted by non-root users on Linux.
+func dropSecurityXattrs(ctx context.Context, hdr *tar.Header) {
+	if os.Geteuid() == 0 || runtime.GOOS != "linux" {
+		return
+	}
+	//nolint:staticcheck // SA1019: hdr.Xattrs has been deprecated since Go 1.10: Use PAXRecords instead.
+	for k := range hdr.Xattrs {
+		if strings.HasPrefix(k, "security.") {
+			log.G(ctx).Debugf("Ignoring xattr %q", k)
+			delete(hdr.Xattrs, k)
+		}
+	}
+	for k := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "SCHILY.xattr.security.") {
+			log.G(ctx).Debugf("Ignoring PAX record %q", k)
+			delete(hdr.PAXRecords, k)
+		}
+	}
+}
+
 func (d *differ) diffLayerWithTarReader(ctx context.Context, node *EventTreeNode, in [2]EventInput, tr0, tr1 tarReader) error {
+	if d.o.MemoryBudget > 0 {
+		return d.diffLayerWithTarReaderBounded(ctx, node, in, tr0, tr1)
+	}
+	var (
+		l1    *loadLayerResult
+		l1Err error
+		wg    sync.WaitGroup
+	)
+	d.goOrRun(&wg, func() {
+		l1, l1Err = d.loadLayer(ctx, node, 1, tr1)
+	})
 	l0, err := d.loadLayer(ctx, node, 0, tr0)
+	wg.Wait()
 	if err != nil {
 		return fmt.Errorf("failed to load layer (input-0): %w", err)
 	}
-	l1, err := d.loadLayer(ctx, node, 1, tr1)
-	if err != nil {
-		return fmt.Errorf("failed to load layer (input-1): %w", err)
+	if l1Err != nil {
+		return fmt.Errorf("failed to load layer (input-1): %w", l1Err)
 	}
+	return d.diffLoadedLayers(ctx, node, in, l0, l1)
+}
+
+func (d *differ) diffLoadedLayers(ctx context.Context, node *EventTreeNode, in [2]EventInput, l0, l1 *loadLayerResult) error {
 	defer func() {
 		for _, finalizer := range append(l0.finalizers, l1.finalizers...) {
 			if finalizerErr := finalizer(); finalizerErr != nil {
@@ -798,17 +995,20 @@ func (d *differ) diffLayerWithTarReader(ctx context.Context, node *EventTreeNode
 		},
 	}
 	var dirsToBeRemovedIfEmpty []string
-	for name, ents0 := range l0.entriesByName {
-		ents1 := l1.entriesByName[name]
-		if len(ents0) != len(ents1) {
-			ev := Event{
-				Type:   EventTypeLayerBlobMismatch,
-				Inputs: in,
-				Note:   eventNoteNameAppearanceMismatch(name, len(ents0), len(ents1)),
-			}
-			if err := d.raiseEvent(ctx, node /* not NewNode */, ev, "layer"); err != nil {
+	// Iterate over the names in the sorted order, so that the events are raised deterministically.
+	// The names that appear differently are raised first, as they precede newNode in node.
+	// See the order documented in EventTreeNode.
+	names := sortedEntryNames(l0, l1)
+	for _, name := range names {
+		if ents0, ents1 := l0.entriesByName[name], l1.entriesByName[name]; len(ents0) != len(ents1) {
+			if err := d.raiseNameAppearanceMismatch(ctx, node /* not newNode */, in, name, len(ents0), len(ents1)); err != nil {
 				errs = append(errs, err)
 			}
+		}
+	}
+	for _, name := range names {
+		ents0, ents1 := l0.entriesByName[name], l1.entriesByName[name]
+		if len(ents0) != len(ents1) {
 			continue
 		}
 		dd, err := d.diffTarEntries(ctx, &newNode, in, [2][]*TarEntry{ents0, ents1})
@@ -817,24 +1017,7 @@ func (d *differ) diffLayerWithTarReader(ctx context.Context, node *EventTreeNode
 			errs = append(errs, err)
 		}
 	}
-	// Iterate again to find entries that only appear in input 1
-	for name, ents1 := range l1.entriesByName {
-		ents0 := l0.entriesByName[name]
-		if len(ents0) != len(ents1) {
-			ev := Event{
-				Type:   EventTypeLayerBlobMismatch,
-				Inputs: in,
-				Note:   eventNoteNameAppearanceMismatch(name, len(ents0), len(ents1)),
-			}
-			if err := d.raiseEvent(ctx, node /* not newNode */, ev, "layer"); err != nil {
-				errs = append(errs, err)
-			}
-		}
-	}
-	sort.Sort(sort.Reverse(sort.StringSlice(dirsToBeRemovedIfEmpty)))
-	for _, d := range dirsToBeRemovedIfEmpty {
-		_ = os.Remove(d) // Not RemoveAll
-	}
+	removeDirsIfEmpty(dirsToBeRemovedIfEmpty)
 
 	if len(newNode.Children) > 0 {
 		if err2 := d.raiseEventWithEventTreeNode(ctx, node, &newNode); err2 != nil {
@@ -844,6 +1027,43 @@ func (d *differ) diffLayerWithTarReader(ctx context.Context, node *EventTreeNode
 	return errors.Join(errs...)
 }
 
+func (d *differ) raiseNameAppearanceMismatch(ctx context.Context, node *EventTreeNode, in [2]EventInput, name string, len0, len1 int) error {
+	ev := Event{
+		Type:   EventTypeLayerBlobMismatch,
+		Inputs: in,
+		Note:   eventNoteNameAppearanceMismatch(name, len0, len1),
+	}
+	if evType, target := whiteoutTarget(name); evType != EventTypeNone {
+		ev.Type = evType
+		ev.Path = target
+		ev.Note = eventNoteWhiteoutAppearanceMismatch(evType, target, len0, len1)
+	}
+	return d.raiseEvent(ctx, node, ev, "layer")
+}
+
+// removeDirsIfEmpty removes the extracted directories that became empty, from the deepest one.
+func removeDirsIfEmpty(dirs []string) {
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, d := range dirs {
+		_ = os.Remove(d) // Not RemoveAll
+	}
+}
+
+// sortedEntryNames returns the sorted union of the entry names of the layers.
+func sortedEntryNames(l0, l1 *loadLayerResult) []string {
+	names := make([]string, 0, len(l0.entriesByName))
+	for name := range l0.entriesByName {
+		names = append(names, name)
+	}
+	for name := range l1.entriesByName {
+		if _, ok := l0.entriesByName[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
 func eventNoteNameAppearanceMismatch(name string, len0, len1 int) string {
 	if len0 != 0 && len1 == 0 {
 		return fmt.Sprintf("name %q only appears in input 0", name)
@@ -855,6 +1075,40 @@ func eventNoteNameAppearanceMismatch(name string, len0, len1 int) string {
 		name, len0, len1)
 }
 
+func eventNoteWhiteoutAppearanceMismatch(evType EventType, target string, len0, len1 int) string {
+	what := fmt.Sprintf("path %q is deleted", target)
+	if evType == EventTypeOpaqueDirectoryMismatch {
+		what = fmt.Sprintf("directory %q is made opaque", target)
+	}
+	if len0 != 0 && len1 == 0 {
+		return what + " only in input 0"
+	}
+	if len0 == 0 && len1 != 0 {
+		return what + " only in input 1"
+	}
+	return fmt.Sprintf("%s %d times in input 0, %d times in input 1", what, len0, len1)
+}
+
+// tarEntryMismatchEvent returns the event for the mismatch of the tar entries with the name.
+// The whiteouts are reported as the deleted paths and the opaque directories.
+func tarEntryMismatchEvent(in [2]EventInput, name, diff string) Event {
+	ev := Event{
+		Type:   EventTypeTarEntryMismatch,
+		Inputs: in,
+		Diff:   diff,
+		Note:   fmt.Sprintf("name %q", name),
+	}
+	switch evType, target := whiteoutTarget(name); evType {
+	case EventTypeDeletedPathMismatch:
+		ev.Type, ev.Path = evType, target
+		ev.Note = fmt.Sprintf("deleted path %q", target)
+	case EventTypeOpaqueDirectoryMismatch:
+		ev.Type, ev.Path = evType, target
+		ev.Note = fmt.Sprintf("opaque directory %q", target)
+	}
+	return ev
+}
+
 func (d *differ) diffTarEntries(ctx context.Context, node *EventTreeNode, in [2]EventInput, ents [2][]*TarEntry) (dirsToBeRemoved []string, retErr error) {
 	var (
 		dirsToBeRemovedIfEmpty []string
@@ -909,24 +1163,44 @@ func (d *differ) diffTarEntry(ctx context.Context, node *EventTreeNode, in [2]Ev
 	if pax1 == nil {
 		pax1 = map[string]string{}
 	}
+	if ent0.Normalizer != "" && sameContent(&ent0, &ent1) {
+		// The normalized contents are equal, even if the original contents and the sizes differ
+		// (e.g., a jar manifest with different timestamps)
+		cmpOpts = append(cmpOpts, cmpopts.IgnoreFields(TarEntry{}, "Digest"), cmpopts.IgnoreFields(tar.Header{}, "Size"))
+	}
 	var errs []error
 	if diff := cmp.Diff(ent0, ent1, cmpOpts...); diff != "" {
-		ev := Event{
-			Type:   EventTypeTarEntryMismatch,
-			Inputs: in,
-			Diff:   diff,
-			Note:   fmt.Sprintf("name %q", ent0.Header.Name),
+		ev := tarEntryMismatchEvent(in, ent0.Header.Name, diff)
+		newNode := &EventTreeNode{
+			Context: path.Join(node.Context, "tarentry"),
+			Event:   ev,
+		}
+		if ev.Type == EventTypeTarEntryMismatch {
+			newNode.Event.TextDiff = d.textDiff(ctx, ent0.Header.Name, &ent0, &ent1)
+			d.writePatch(ctx, node, ent0.Header.Name, newNode.Event.TextDiff)
+			newNode.Event.ELF = d.diffELF(ctx, &ent0, &ent1)
+			// The events of the entries of the nested archives are raised as the children
+			nested, err := d.diffNestedArchives(ctx, newNode, in, &ent0, &ent1)
+			if err != nil {
+				errs = append(errs, err)
+			}
+			// The events of the fields of the Go build information are raised as the children too
+			if err := d.diffGoBuildInfo(ctx, newNode, in, &ent0, &ent1); err != nil {
+				errs = append(errs, err)
+			}
+			if d.equivalentContents(newNode, nested) &&
+				cmp.Diff(ent0, ent1, append(cmpOpts, cmpopts.IgnoreFields(TarEntry{}, "Digest", "NormalizedDigest"), cmpopts.IgnoreFields(tar.Header{}, "Size"))...) == "" &&
+				cmp.Diff(pax0, pax1, paxOpts...) == "" {
+				// The contents only differ in the attributes ignored by IgnoranceOptions
+				log.G(ctx).Debugf("Ignoring %q, as the contents are equivalent", ent0.Header.Name)
+				return dirsToBeRemovedIfEmpty, errors.Join(errs...)
+			}
 		}
-		if err := d.raiseEvent(ctx, node, ev, "tarentry"); err != nil {
+		if err := d.raiseEventWithEventTreeNode(ctx, node, newNode); err != nil {
 			errs = append(errs, err)
 		}
 	} else if diff := cmp.Diff(pax0, pax1, paxOpts...); diff != "" {
-		ev := Event{
-			Type:   EventTypeTarEntryMismatch,
-			Inputs: in,
-			Diff:   diff,
-			Note:   fmt.Sprintf("name %q", ent0.Header.Name),
-		}
+		ev := tarEntryMismatchEvent(in, ent0.Header.Name, diff)
 		if err := d.raiseEvent(ctx, node, ev, "tarentry"); err != nil {
 			errs = append(errs, err)
 		}
@@ -952,6 +1226,22 @@ func (d *differ) diffTarEntry(ctx context.Context, node *EventTreeNode, in [2]Ev
 	return dirsToBeRemovedIfEmpty, errors.Join(errs...)
 }
 
+// equivalentContents returns true if the contents of the regular files of the node are equivalent
+// under IgnoranceOptions, i.e., if the entries of the nested archives do not differ, or if the ELF files
+// only differ in the ignored sections.
+func (d *differ) equivalentContents(node *EventTreeNode, nested bool) bool {
+	if !d.o.digestMayChange() {
+		return false
+	}
+	if nested {
+		return len(node.Children) == 0
+	}
+	if e := node.Event.ELF; e != nil {
+		return len(node.Children) == 0 && e.ignorable(d.o.IgnoranceOptions)
+	}
+	return false
+}
+
 func openTarReader(ctx context.Context, cs content.Provider, desc ocispec.Descriptor, maxScale float64) (tr tarReader, closer func() error, err error) {
 	if desc.Size > int64(maxTarBlobSize*maxScale) {
 		return nil, nil, fmt.Errorf("too large tar blob (%d > %d bytes)", desc.Size, int64(maxTarBlobSize*maxScale))
@@ -970,55 +1260,6 @@ func openTarReader(ctx context.Context, cs content.Provider, desc ocispec.Descri
 	return tar.NewReader(lr), ra.Close, nil
 }
 
-func openTarReaderWithSquashing(ctx context.Context, cs content.Provider, descs []ocispec.Descriptor, maxScale float64) (tr tarReader, closer func() error, err error) {
-	tarReaders := make([]tarReader, len(descs))
-	closers := make([]func() error, len(descs))
-	for i := 0; i < len(descs); i++ {
-		var err error
-		tarReaders[i], closers[i], err = openTarReader(ctx, cs, descs[i], maxScale)
-		if err != nil {
-			return nil, nil, err
-		}
-	}
-	tr = newSquashedTarReader(tarReaders)
-	closer = func() error {
-		var errs []error
-		for _, f := range closers {
-			if err := f(); err != nil {
-				errs = append(errs, err)
-			}
-		}
-		return errors.Join(errs...)
-	}
-	return tr, closer, nil
-}
-
-func newSquashedTarReader(tarReaders []tarReader) tarReader {
-	return &squashedTarReader{
-		tarReaders: tarReaders,
-		current:    0,
-	}
-}
-
-type squashedTarReader struct {
-	tarReaders []tarReader
-	current    int
-}
-
-func (r *squashedTarReader) Read(p []byte) (int, error) {
-	return r.tarReaders[r.current].Read(p)
-}
-
-func (r *squashedTarReader) Next() (*tar.Header, error) {
-begin:
-	hdr, err := r.tarReaders[r.current].Next()
-	if errors.Is(err, io.EOF) && r.current < len(r.tarReaders)-1 {
-		r.current++
-		goto begin
-	}
-	return hdr, err
-}
-
 func readBlobWithType[T interface {
 	ocispec.Index | ocispec.Manifest | ocispec.Image
 }](ctx context.Context, cs content.Provider, desc ocispec.Descriptor, maxScale float64) (*T, error) {
@@ -1036,6 +1277,13 @@ func readBlobWithType[T interface {
 	return &t, nil
 }
 
+// EventTreeNode is a node of the event tree.
+// The children are ordered deterministically: by the manifest, by the layer, by the path,
+// and then by the event type.
+// Within a layer, the events of the names that appear differently in the inputs
+// (e.g., the files that only exist in one of the inputs) precede all the events of the tar entries,
+// as they are the siblings of the layer node rather than its children.
+// The events are passed to the [EventHandler] in the same order.
 type EventTreeNode struct {
 	Context      string `json:"context"` // Not unique
 	Event        `json:"event"`
@@ -1054,6 +1302,13 @@ type Event struct {
 	Inputs [2]EventInput `json:"inputs,omitempty"`
 	Diff   string        `json:"diff,omitempty"` // Not machine-parsable
 	Note   string        `json:"note,omitempty"` // Not machine-parsable
+	Path   string        `json:"path,omitempty"` // The target of the whiteout (EventTypeDeletedPathMismatch, EventTypeOpaqueDirectoryMismatch)
+	// TextDiff is the unified diff of the contents of the text files (EventTypeTarEntryMismatch).
+	TextDiff string `json:"textDiff,omitempty"`
+	// ELF describes the differences of the ELF files (EventTypeTarEntryMismatch).
+	ELF *ELFDiff `json:"elf,omitempty"`
+	// GoBuildInfo describes the differing field of the build information of the Go executables (EventTypeGoBuildInfoMismatch).
+	GoBuildInfo *GoBuildInfoDiff `json:"goBuildInfo,omitempty"`
 }
 
 // String implements [fmt.Stringer].
@@ -1066,6 +1321,15 @@ func (ev *Event) String() string {
 	if ev.Diff != "" {
 		s += "\n" + ev.Diff
 	}
+	if ev.ELF != nil {
+		s += "\n" + ev.ELF.String()
+	}
+	if ev.GoBuildInfo != nil {
+		s += "\n" + ev.GoBuildInfo.String()
+	}
+	if ev.TextDiff != "" {
+		s += "\n" + ev.TextDiff
+	}
 	return s
 }
 
@@ -1073,8 +1337,21 @@ type TarEntry struct {
 	Index  int           `json:"index"`
 	Header *tar.Header   `json:"header,omitempty"`
 	Digest digest.Digest `json:"digest,omitempty"`
+	// NormalizedDigest is the digest of the content normalized by Normalizer (see Options.Normalizers).
+	NormalizedDigest digest.Digest `json:"normalizedDigest,omitempty"`
+	Normalizer       string        `json:"normalizer,omitempty"`
 
-	extractedPath string `json:"-"` // path on local filesystem
+	extractedPath string  `json:"-"` // path on local filesystem
+	text          *string `json:"-"` // content of the text file, for the text diff
+	contentPath   string  `json:"-"` // path of the content on local filesystem, not to be removed (NestedArchives, ELF, GoBuildInfo)
+}
+
+// localPath returns the path of the content on local filesystem, if available.
+func (ent *TarEntry) localPath() string {
+	if ent.extractedPath != "" {
+		return ent.extractedPath
+	}
+	return ent.contentPath
 }
 
 type EventInput struct {
@@ -1083,6 +1360,7 @@ type EventInput struct {
 	Manifest   *ocispec.Manifest   `json:"manifest,omitempty"`
 	Config     *ocispec.Image      `json:"config,omitempty"`
 	TarEntry   *TarEntry           `json:"tarEntry,omitempty"`
+	Dir        string              `json:"dir,omitempty"` // root filesystem directory (DiffRootFS)
 }
 
 type EventType string
@@ -1095,6 +1373,16 @@ const (
 	EventTypeConfigBlobMismatch   = EventType("ConfigBlobMismatch")
 	EventTypeLayerBlobMismatch    = EventType("LayerBlobMismatch")
 	EventTypeTarEntryMismatch     = EventType("TarEntryMismatch")
+	// EventTypeDeletedPathMismatch is raised for a whiteout ("foo/.wh.bar") instead of EventTypeTarEntryMismatch.
+	// Event.Path is the deleted path ("foo/bar").
+	EventTypeDeletedPathMismatch = EventType("DeletedPathMismatch")
+	// EventTypeOpaqueDirectoryMismatch is raised for an opaque whiteout ("foo/.wh..wh..opq") instead of EventTypeTarEntryMismatch.
+	// Event.Path is the opaque directory ("foo").
+	EventTypeOpaqueDirectoryMismatch = EventType("OpaqueDirectoryMismatch")
+	// EventTypeGoBuildInfoMismatch is raised as a child of EventTypeTarEntryMismatch for each differing field
+	// of the build information of the Go executables (GoBuildInfo).
+	// Event.GoBuildInfo describes the field.
+	EventTypeGoBuildInfoMismatch = EventType("GoBuildInfoMismatch")
 )
 
 // MaxScale option is multiplied to these constants
@@ -1168,61 +1456,99 @@ func (h *defaultEventHandler) HandleEventTreeNode(ctx context.Context, node *Eve
 	case EventTypeLayerBlobMismatch:
 		fmt.Fprintln(h.tw, "Layer\t"+name+"\t"+d0+"\t"+d1)
 	case EventTypeTarEntryMismatch:
-		name := "?"
-		d0, d1 := "?", "?"
-		ent0, ent1 := in0.TarEntry, in1.TarEntry
-		if ent0 == nil {
-			d0 = "missing"
-		} else {
-			name = ent0.Header.Name
-		}
-		if ent1 == nil {
-			d1 = "missing"
-		} else if ent0 == nil {
-			name = ent1.Header.Name
-		}
-		if ent0 != nil && ent1 != nil {
-			hdr0, hdr1 := ent0.Header, ent1.Header
-			if hdr0.Name != hdr1.Name {
-				d0, d1 = hdr0.Name, hdr1.Name
-			} else if hdr0.Linkname != hdr1.Linkname {
-				d0, d1 = "Linkname "+hdr0.Linkname, "Linkname "+hdr1.Linkname
-			} else if hdr0.Mode != hdr1.Mode {
-				d0, d1 = fmt.Sprintf("Mode 0x%0x", hdr0.Mode), fmt.Sprintf("Mode 0x%0x", hdr1.Mode)
-			} else if hdr0.Uid != hdr1.Uid {
-				d0, d1 = fmt.Sprintf("Uid %d", hdr0.Uid), fmt.Sprintf("Uid %d", hdr1.Uid)
-			} else if hdr0.Gid != hdr1.Gid {
-				d0, d1 = fmt.Sprintf("Gid %d", hdr0.Gid), fmt.Sprintf("Gid %d", hdr1.Gid)
-			} else if hdr0.Uname != hdr1.Uname {
-				d0, d1 = "Uname "+hdr0.Uname, "Uname "+hdr1.Uname
-			} else if hdr0.Gname != hdr1.Gname {
-				d0, d1 = "Gname "+hdr0.Gname, "Gname "+hdr1.Gname
-			} else if hdr0.Devmajor != hdr1.Devmajor || hdr0.Devminor != hdr1.Devminor {
-				d0, d1 = fmt.Sprintf("Dev %d:%d", hdr0.Devmajor, hdr0.Devminor), fmt.Sprintf("Dev %d:%d", hdr1.Devmajor, hdr1.Devminor)
-			} else if ent0.Digest != ent1.Digest {
-				d0, d1 = ent0.Digest.String(), ent1.Digest.String()
-				d0, d1 = strings.TrimPrefix(d0, "sha256:"), strings.TrimPrefix(d1, "sha256:")
-			} else if !hdr0.ModTime.Equal(hdr1.ModTime) {
-				d0, d1 = hdr0.ModTime.String(), hdr1.ModTime.String()
-			} else if !hdr0.AccessTime.Equal(hdr1.AccessTime) {
-				d0, d1 = "Atime "+hdr0.AccessTime.String(), "Atime "+hdr1.AccessTime.String()
-			} else if !hdr0.ChangeTime.Equal(hdr1.ChangeTime) {
-				d0, d1 = "Ctime "+hdr0.ChangeTime.String(), "Ctime "+hdr1.ChangeTime.String()
-			} else if ent0.Index != ent1.Index {
-				d0, d1 = fmt.Sprintf("Index %d", ent0.Index), fmt.Sprintf("Index %d", ent1.Index)
-			} else if ent0.Header.Format != ent1.Header.Format {
-				d0 = fmt.Sprintf("Format %s (%d)", ent0.Header.Format, ent0.Header.Format)
-				d1 = fmt.Sprintf("Format %s (%d)", ent1.Header.Format, ent1.Header.Format)
-			}
-			// TODO: Xattrs
+		name, d0, d1 := tarEntryMismatchColumns(in0.TarEntry, in1.TarEntry)
+		if ev.ELF != nil && d0 == in0.TarEntry.Digest.Encoded() {
+			// Explain the difference of the contents instead of printing the digests
+			d0, d1 = ev.ELF.String(), ""
 		}
 		fmt.Fprintln(h.tw, "File\t"+name+"\t"+d0+"\t"+d1)
+	case EventTypeDeletedPathMismatch, EventTypeOpaqueDirectoryMismatch:
+		typ := "Deleted"
+		if ev.Type == EventTypeOpaqueDirectoryMismatch {
+			typ = "Opaque"
+		}
+		if in0.TarEntry != nil || in1.TarEntry != nil {
+			_, d0, d1 = tarEntryMismatchColumns(in0.TarEntry, in1.TarEntry)
+		}
+		fmt.Fprintln(h.tw, typ+"\t"+ev.Path+"\t"+d0+"\t"+d1)
+	case EventTypeGoBuildInfoMismatch:
+		if g := ev.GoBuildInfo; g != nil {
+			if in0.TarEntry != nil {
+				name = in0.TarEntry.Header.Name
+			}
+			name += " (" + g.Field + ")"
+			d0, d1 = goBuildInfoColumn(g.Values[0]), goBuildInfoColumn(g.Values[1])
+		}
+		fmt.Fprintln(h.tw, "GoBuild\t"+name+"\t"+d0+"\t"+d1)
 	default:
 		log.G(ctx).Warn("Unknown event: " + node.Event.String())
 	}
 	return nil
 }
 
+// goBuildInfoColumn returns the column for the value of a field of the Go build information.
+func goBuildInfoColumn(v *string) string {
+	switch {
+	case v == nil:
+		return "missing"
+	case *v == "":
+		return `""`
+	default:
+		return *v
+	}
+}
+
+// tarEntryMismatchColumns returns the name and the first differing attributes of the tar entries.
+func tarEntryMismatchColumns(ent0, ent1 *TarEntry) (name, d0, d1 string) {
+	name, d0, d1 = "?", "?", "?"
+	if ent0 == nil {
+		d0 = "missing"
+	} else {
+		name = ent0.Header.Name
+	}
+	if ent1 == nil {
+		d1 = "missing"
+	} else if ent0 == nil {
+		name = ent1.Header.Name
+	}
+	if ent0 != nil && ent1 != nil {
+		hdr0, hdr1 := ent0.Header, ent1.Header
+		if hdr0.Name != hdr1.Name {
+			d0, d1 = hdr0.Name, hdr1.Name
+		} else if hdr0.Linkname != hdr1.Linkname {
+			d0, d1 = "Linkname "+hdr0.Linkname, "Linkname "+hdr1.Linkname
+		} else if hdr0.Mode != hdr1.Mode {
+			d0, d1 = fmt.Sprintf("Mode 0x%0x", hdr0.Mode), fmt.Sprintf("Mode 0x%0x", hdr1.Mode)
+		} else if hdr0.Uid != hdr1.Uid {
+			d0, d1 = fmt.Sprintf("Uid %d", hdr0.Uid), fmt.Sprintf("Uid %d", hdr1.Uid)
+		} else if hdr0.Gid != hdr1.Gid {
+			d0, d1 = fmt.Sprintf("Gid %d", hdr0.Gid), fmt.Sprintf("Gid %d", hdr1.Gid)
+		} else if hdr0.Uname != hdr1.Uname {
+			d0, d1 = "Uname "+hdr0.Uname, "Uname "+hdr1.Uname
+		} else if hdr0.Gname != hdr1.Gname {
+			d0, d1 = "Gname "+hdr0.Gname, "Gname "+hdr1.Gname
+		} else if hdr0.Devmajor != hdr1.Devmajor || hdr0.Devminor != hdr1.Devminor {
+			d0, d1 = fmt.Sprintf("Dev %d:%d", hdr0.Devmajor, hdr0.Devminor), fmt.Sprintf("Dev %d:%d", hdr1.Devmajor, hdr1.Devminor)
+		} else if !sameContent(ent0, ent1) {
+			d0, d1 = ent0.Digest.String(), ent1.Digest.String()
+			d0, d1 = strings.TrimPrefix(d0, "sha256:"), strings.TrimPrefix(d1, "sha256:")
+		} else if !hdr0.ModTime.Equal(hdr1.ModTime) {
+			d0, d1 = hdr0.ModTime.String(), hdr1.ModTime.String()
+		} else if !hdr0.AccessTime.Equal(hdr1.AccessTime) {
+			d0, d1 = "Atime "+hdr0.AccessTime.String(), "Atime "+hdr1.AccessTime.String()
+		} else if !hdr0.ChangeTime.Equal(hdr1.ChangeTime) {
+			d0, d1 = "Ctime "+hdr0.ChangeTime.String(), "Ctime "+hdr1.ChangeTime.String()
+		} else if ent0.Index != ent1.Index {
+			d0, d1 = fmt.Sprintf("Index %d", ent0.Index), fmt.Sprintf("Index %d", ent1.Index)
+		} else if ent0.Header.Format != ent1.Header.Format {
+			d0 = fmt.Sprintf("Format %s (%d)", ent0.Header.Format, ent0.Header.Format)
+			d1 = fmt.Sprintf("Format %s (%d)", ent1.Header.Format, ent1.Header.Format)
+		}
+		// TODO: Xattrs
+	}
+	return name, d0, d1
+}
+
 func (h *defaultEventHandler) Flush() error {
 	return h.tw.Flush()
 }
@@ -1246,6 +1572,7 @@ const (
 	ReportDirReportJSON = "report.json"
 	ReportDirInput0     = "input-0"
 	ReportDirInput1     = "input-1"
+	ReportDirPatches    = "patches"
 )
 
 var ReportDirRootFilenames = []string{
@@ -1253,10 +1580,12 @@ var ReportDirRootFilenames = []string{
 	ReportDirReportJSON,
 	ReportDirInput0,
 	ReportDirInput1,
+	ReportDirPatches,
 }
 
 const ReportDirReadmeMDContent = `# diffoci report directory
 - input-0: Input 0
 - input-1: Input 1
+- patches: Unified diffs of the text files
 - report.json: report file (EXPERIMENTAL; the file format is subject to change)
 `
@@ -0,0 +1,1049 @@
+package diff_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/reproducible-containers/diffoci/cmd/diffoci/backend/memorybackend"
+	"github.com/reproducible-containers/diffoci/internal/testutil"
+	"github.com/reproducible-containers/diffoci/pkg/diff"
+)
+
+// testImageStore is a harness for [diff.Diff], backed by the memory backend.
+type testImageStore struct {
+	t  *testing.T
+	cs content.Store
+}
+
+func newTestImageStore(t *testing.T) *testImageStore {
+	return &testImageStore{t: t, cs: memorybackend.NewContentStore()}
+}
+
+func (s *testImageStore) writeBlob(mediaType string, b []byte) ocispec.Descriptor {
+	s.t.Helper()
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(b),
+		Size:      int64(len(b)),
+	}
+	if err := content.WriteBlob(context.Background(), s.cs, desc.Digest.String(), bytes.NewReader(b), desc); err != nil {
+		s.t.Fatal(err)
+	}
+	return desc
+}
+
+func (s *testImageStore) writeJSON(mediaType string, v any) ocispec.Descriptor {
+	s.t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return s.writeBlob(mediaType, b)
+}
+
+// image creates an image manifest with the layers, and returns the descriptor of the manifest.
+// mutateConfig may be nil.
+func (s *testImageStore) image(mutateConfig func(*ocispec.Image), layers ...[]byte) ocispec.Descriptor {
+	s.t.Helper()
+	created := testutil.ModTime
+	config := ocispec.Image{
+		Created:  &created,
+		Platform: platforms.DefaultSpec(),
+		RootFS:   ocispec.RootFS{Type: "layers"},
+	}
+	mani := ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+	}
+	mani.SchemaVersion = 2
+	for _, l := range layers {
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, digest.FromBytes(l))
+		config.History = append(config.History, ocispec.History{Created: &created, CreatedBy: "test"})
+		mani.Layers = append(mani.Layers, s.writeBlob(ocispec.MediaTypeImageLayer, l))
+	}
+	if mutateConfig != nil {
+		mutateConfig(&config)
+	}
+	mani.Config = s.writeJSON(ocispec.MediaTypeImageConfig, config)
+	return s.writeJSON(ocispec.MediaTypeImageManifest, mani)
+}
+
+// index creates an image index with the manifests, and returns the descriptor of the index.
+func (s *testImageStore) index(manifests ...ocispec.Descriptor) ocispec.Descriptor {
+	s.t.Helper()
+	idx := ocispec.Index{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: manifests,
+	}
+	idx.SchemaVersion = 2
+	return s.writeJSON(ocispec.MediaTypeImageIndex, idx)
+}
+
+// runDiff compares the images, and returns the events in the order of the event tree.
+// The events passed to the event handler must be in the same order, regardless of the concurrency.
+func (s *testImageStore) runDiff(descs [2]ocispec.Descriptor, opts diff.Options) []testutil.Event {
+	s.t.Helper()
+	h := &testutil.EventRecorder{}
+	opts.EventHandler = h
+	report, err := diff.Diff(context.Background(), s.cs, descs, platforms.All, &opts)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	events := testutil.FlattenTree(report)
+	if !equalEvents(events, h.Events()) {
+		s.t.Fatalf("the events passed to the handler %v differ from the event tree %v", h.Events(), events)
+	}
+	return events
+}
+
+func equalEvents(a, b []testutil.Event) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// entryEvents describes the events of the tar entries, sorted:
+// the name for the differing entries, "deleted:PATH" and "opaque:DIR" for the whiteouts,
+// and the note for the entries that only appear in either input.
+func entryEvents(events []testutil.Event) []string {
+	var res []string
+	for _, ev := range events {
+		switch ev.Type {
+		case diff.EventTypeTarEntryMismatch:
+			res = append(res, ev.Name)
+		case diff.EventTypeDeletedPathMismatch:
+			res = append(res, "deleted:"+ev.Name)
+		case diff.EventTypeOpaqueDirectoryMismatch:
+			res = append(res, "opaque:"+ev.Name)
+		case diff.EventTypeLayerBlobMismatch:
+			if ev.Note != "" {
+				res = append(res, ev.Note)
+			}
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+func TestDiff(t *testing.T) {
+	base := []testutil.File{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "etc/hostname", Body: "localhost\n"},
+		{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "usr/bin/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "usr/bin/sh", Body: "#!/bin/sh\n", Mode: 0o755},
+	}
+	modify := func(f func([]testutil.File) []testutil.File) []testutil.File {
+		return f(append([]testutil.File(nil), base...))
+	}
+	testCases := []struct {
+		name     string
+		files    []testutil.File
+		opts     diff.Options
+		expected []string // the names of the differing tar entries
+	}{
+		{
+			name:  "identical",
+			files: base,
+		},
+		{
+			name: "content",
+			files: modify(func(fs []testutil.File) []testutil.File {
+				fs[1].Body = "example.com\n"
+				return fs
+			}),
+			expected: []string{"etc/hostname"},
+		},
+		{
+			name: "mode",
+			files: modify(func(fs []testutil.File) []testutil.File {
+				fs[4].Mode = 0o700
+				return fs
+			}),
+			expected: []string{"usr/bin/sh"},
+		},
+		{
+			name: "added",
+			files: modify(func(fs []testutil.File) []testutil.File {
+				return append(fs, testutil.File{Name: "etc/motd", Body: "hello\n"})
+			}),
+			expected: []string{"length mismatch (5 vs 6)", `name "etc/motd" only appears in input 1`},
+		},
+		{
+			name: "timestamp",
+			files: modify(func(fs []testutil.File) []testutil.File {
+				fs[1].ModTime = testutil.ModTime.Add(time.Hour)
+				return fs
+			}),
+			expected: []string{"etc/hostname"},
+		},
+		{
+			name: "timestamp (ignored)",
+			files: modify(func(fs []testutil.File) []testutil.File {
+				fs[1].ModTime = testutil.ModTime.Add(time.Hour)
+				return fs
+			}),
+			opts: diff.Options{IgnoranceOptions: diff.IgnoranceOptions{IgnoreFileTimestamps: true}},
+		},
+		{
+			name: "order",
+			files: modify(func(fs []testutil.File) []testutil.File {
+				fs[0], fs[2] = fs[2], fs[0]
+				return fs
+			}),
+			// The entries are compared by the names, but the indexes differ
+			expected: []string{"etc/", "usr/"},
+		},
+		{
+			name: "order (ignored)",
+			files: modify(func(fs []testutil.File) []testutil.File {
+				fs[0], fs[2] = fs[2], fs[0]
+				return fs
+			}),
+			opts: diff.Options{IgnoranceOptions: diff.IgnoranceOptions{IgnoreFileOrder: true}},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestImageStore(t)
+			img0 := s.image(nil, testutil.Layer(t, base...))
+			img1 := s.image(nil, testutil.Layer(t, tc.files...))
+			events := s.runDiff([2]ocispec.Descriptor{img0, img1}, tc.opts)
+			got := entryEvents(events)
+			if strings.Join(got, ",") != strings.Join(tc.expected, ",") {
+				t.Fatalf("expected %v, got %v (events: %v)", tc.expected, got, events)
+			}
+			if img0.Digest == img1.Digest && len(events) > 0 {
+				t.Fatalf("expected no event for the identical images, got %v", events)
+			}
+		})
+	}
+}
+
+func TestDiffConfig(t *testing.T) {
+	s := newTestImageStore(t)
+	layer := testutil.Layer(t, testutil.File{Name: "foo", Body: "foo\n"})
+	img0 := s.image(nil, layer)
+	img1 := s.image(func(config *ocispec.Image) {
+		config.Config.Env = []string{"FOO=bar"}
+	}, layer)
+	events := s.runDiff([2]ocispec.Descriptor{img0, img1}, diff.Options{})
+	var types []string
+	for _, ev := range events {
+		types = append(types, string(ev.Type))
+	}
+	for _, expected := range []diff.EventType{diff.EventTypeManifestBlobMismatch, diff.EventTypeConfigBlobMismatch} {
+		found := false
+		for _, ev := range events {
+			found = found || ev.Type == expected
+		}
+		if !found {
+			t.Errorf("expected %q, got %v", expected, types)
+		}
+	}
+	if got := entryEvents(events); len(got) != 0 {
+		t.Errorf("expected no tar entry event, got %v", got)
+	}
+}
+
+// TestDiffSortedEvents tests that the events of the tar entries are raised in the sorted order of the names,
+// regardless of the order of the entries in the layers.
+func TestDiffSortedEvents(t *testing.T) {
+	testCases := []struct {
+		name     string
+		files    [2][]testutil.File
+		expected []string // the names and the notes, in the order of the events
+	}{
+		{
+			name: "differing",
+			files: [2][]testutil.File{
+				{{Name: "z", Body: "0"}, {Name: "a", Body: "0"}, {Name: "m", Body: "0"}},
+				{{Name: "z", Body: "1"}, {Name: "a", Body: "1"}, {Name: "m", Body: "1"}},
+			},
+			expected: []string{"a", "m", "z"},
+		},
+		{
+			name: "appearing in either input",
+			files: [2][]testutil.File{
+				{{Name: "d"}, {Name: "b"}},
+				{{Name: "d"}, {Name: "c"}, {Name: "a"}},
+			},
+			expected: []string{
+				"length mismatch (2 vs 3)",
+				`name "a" only appears in input 1`,
+				`name "b" only appears in input 0`,
+				`name "c" only appears in input 1`,
+			},
+		},
+		{
+			// The names that appear differently precede the differing entries,
+			// as the event tree does
+			name: "mixed",
+			files: [2][]testutil.File{
+				{{Name: "z", Body: "0"}, {Name: "b"}, {Name: "a", Body: "0"}},
+				{{Name: "z", Body: "1"}, {Name: "c"}, {Name: "a", Body: "1"}},
+			},
+			expected: []string{
+				`name "b" only appears in input 0`,
+				`name "c" only appears in input 1`,
+				"a",
+				"z",
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestImageStore(t)
+			descs := [2]ocispec.Descriptor{
+				s.image(nil, testutil.Layer(t, tc.files[0]...)),
+				s.image(nil, testutil.Layer(t, tc.files[1]...)),
+			}
+			var got []string
+			for _, ev := range s.runDiff(descs, diff.Options{}) {
+				switch ev.Type {
+				case diff.EventTypeTarEntryMismatch:
+					got = append(got, ev.Name)
+				case diff.EventTypeLayerBlobMismatch:
+					if ev.Note != "" {
+						got = append(got, ev.Note)
+					}
+				}
+			}
+			if strings.Join(got, ",") != strings.Join(tc.expected, ",") {
+				t.Fatalf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+// TestDiffReportFile tests that the report files of the same diff are byte-identical.
+func TestDiffReportFile(t *testing.T) {
+	s := newTestImageStore(t)
+	var files [2][]testutil.File
+	for i := range files {
+		for j := range 100 {
+			files[i] = append(files[i], testutil.File{Name: fmt.Sprintf("file%d", (j*37)%100), Body: fmt.Sprint(i)})
+		}
+	}
+	descs := [2]ocispec.Descriptor{
+		s.image(nil, testutil.Layer(t, files[0]...), testutil.Layer(t, files[1]...)),
+		s.image(nil, testutil.Layer(t, files[1]...), testutil.Layer(t, files[0]...)),
+	}
+	var reports []string
+	for _, concurrency := range []int{1, 1, 4, 4} {
+		reportFile := filepath.Join(t.TempDir(), "report.json")
+		s.runDiff(descs, diff.Options{ReportFile: reportFile, Concurrency: concurrency})
+		b, err := os.ReadFile(reportFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reports = append(reports, string(b))
+	}
+	for i := 1; i < len(reports); i++ {
+		if reports[i] != reports[0] {
+			t.Fatalf("report %d differs from report 0", i)
+		}
+	}
+}
+
+// TestDiffMemoryBudget tests that the memory budget does not change the events.
+func TestDiffMemoryBudget(t *testing.T) {
+	var files [2][]testutil.File
+	for i := range files {
+		for j := range 50 {
+			// The entries are aligned in the first half
+			k := j
+			if j >= 25 && i == 1 {
+				k = 74 - j
+			}
+			body := "same"
+			if k%5 == 0 {
+				body = fmt.Sprint(i)
+			}
+			files[i] = append(files[i], testutil.File{Name: fmt.Sprintf("file%02d", k), Body: body})
+		}
+	}
+	files[1] = append(files[1], testutil.File{Name: "only1", Body: "1"})
+	testCases := []struct {
+		name string
+		opts diff.Options
+	}{
+		{"aligned", diff.Options{}},
+		{"file order ignored", diff.Options{IgnoranceOptions: diff.IgnoranceOptions{IgnoreFileOrder: true}}},
+		{"report dir", diff.Options{}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestImageStore(t)
+			descs := [2]ocispec.Descriptor{
+				s.image(nil, testutil.Layer(t, files[0]...)),
+				s.image(nil, testutil.Layer(t, files[1]...)),
+			}
+			var expected []testutil.Event
+			for _, budget := range []int64{0, 1, 4096, 1 << 30} {
+				opts := tc.opts
+				opts.MemoryBudget = budget
+				if tc.name == "report dir" {
+					opts.ReportDir = t.TempDir()
+				}
+				events := s.runDiff(descs, opts)
+				if budget == 0 {
+					expected = events
+					if len(entryEvents(events)) == 0 {
+						t.Fatal("expected events")
+					}
+					continue
+				}
+				if !equalEvents(events, expected) {
+					t.Fatalf("budget %d: expected %v, got %v", budget, expected, events)
+				}
+			}
+		})
+	}
+}
+
+// countingProvider counts the bytes read from the blobs.
+type countingProvider struct {
+	content.Provider
+	mu    sync.Mutex
+	reads map[digest.Digest]int64
+}
+
+func (p *countingProvider) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	ra, err := p.Provider.ReaderAt(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	return &countingReaderAt{ReaderAt: ra, p: p, d: desc.Digest}, nil
+}
+
+type countingReaderAt struct {
+	content.ReaderAt
+	p *countingProvider
+	d digest.Digest
+}
+
+func (ra *countingReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	n, err := ra.ReaderAt.ReadAt(b, off)
+	ra.p.mu.Lock()
+	ra.p.reads[ra.d] += int64(n)
+	ra.p.mu.Unlock()
+	return n, err
+}
+
+// TestDiffLayerIndexCache tests that the cached layer indexes are used instead of the layer blobs,
+// without changing the events.
+func TestDiffLayerIndexCache(t *testing.T) {
+	s := newTestImageStore(t)
+	layers := [2][]byte{
+		testutil.Layer(t, testutil.File{Name: "foo", Body: "foo\n"}, testutil.File{Name: "bar", Body: "bar\n"}),
+		testutil.Layer(t, testutil.File{Name: "foo", Body: "foo2\n"}, testutil.File{Name: "baz", Body: "baz\n"}),
+	}
+	descs := [2]ocispec.Descriptor{s.image(nil, layers[0]), s.image(nil, layers[1])}
+	cache := diff.NewLayerIndexCache(t.TempDir())
+	testCases := []struct {
+		name       string
+		opts       diff.Options
+		layerReads bool
+	}{
+		{"no cache", diff.Options{}, true},
+		{"cache miss", diff.Options{LayerIndexCache: cache}, true},
+		{"cache hit", diff.Options{LayerIndexCache: cache}, false},
+		{"cache hit with ignorance options", diff.Options{LayerIndexCache: cache,
+			IgnoranceOptions: diff.IgnoranceOptions{IgnoreFileOrder: true, IgnoreFileTimestamps: true}}, false},
+		// The contents are needed for the report directory
+		{"report dir", diff.Options{LayerIndexCache: cache, ReportDir: t.TempDir()}, true},
+	}
+	var expected []string
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &countingProvider{Provider: s.cs, reads: make(map[digest.Digest]int64)}
+			h := &testutil.EventRecorder{}
+			opts := tc.opts
+			opts.EventHandler = h
+			if _, err := diff.Diff(context.Background(), p, descs, platforms.All, &opts); err != nil {
+				t.Fatal(err)
+			}
+			got := entryEvents(h.Events())
+			if expected == nil {
+				expected = got
+			} else if strings.Join(got, ",") != strings.Join(expected, ",") {
+				t.Fatalf("expected %v, got %v", expected, got)
+			}
+			for _, l := range layers {
+				// images.Check does not read the blobs
+				if read := p.reads[digest.FromBytes(l)] > 0; read != tc.layerReads {
+					t.Fatalf("expected layerReads=%v, got %d bytes", tc.layerReads, p.reads[digest.FromBytes(l)])
+				}
+			}
+		})
+	}
+}
+
+// TestDiffLayerIndexCacheNormalizers tests that the cached layer indexes retain the normalized digests,
+// and that they are not shared across the different normalizers.
+func TestDiffLayerIndexCacheNormalizers(t *testing.T) {
+	s := newTestImageStore(t)
+	// The pyc files only differ in the source mtimes
+	pyc := func(mtime string) string {
+		return "\xcb\x0d\r\n\x00\x00\x00\x00" + mtime + "\x10\x00\x00\x00body"
+	}
+	layers := [2][]byte{
+		testutil.Layer(t, testutil.File{Name: "foo.pyc", Body: pyc("\x01\x02\x03\x04")}),
+		testutil.Layer(t, testutil.File{Name: "foo.pyc", Body: pyc("\x05\x06\x07\x08")}),
+	}
+	descs := [2]ocispec.Descriptor{s.image(nil, layers[0]), s.image(nil, layers[1])}
+	cache := diff.NewLayerIndexCache(t.TempDir())
+	testCases := []struct {
+		name        string
+		normalizers []string
+		layerReads  bool
+		expected    []string
+	}{
+		{"cache miss", []string{"pyc"}, true, nil},
+		{"cache hit", []string{"pyc"}, false, nil},
+		{"cache miss without normalizers", nil, true, []string{"foo.pyc"}},
+		{"cache hit without normalizers", nil, false, []string{"foo.pyc"}},
+		{"cache miss with other normalizers", []string{"gzip", "pyc"}, true, nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &countingProvider{Provider: s.cs, reads: make(map[digest.Digest]int64)}
+			h := &testutil.EventRecorder{}
+			opts := diff.Options{EventHandler: h, LayerIndexCache: cache, Normalizers: tc.normalizers}
+			if _, err := diff.Diff(context.Background(), p, descs, platforms.All, &opts); err != nil {
+				t.Fatal(err)
+			}
+			if got := entryEvents(h.Events()); strings.Join(got, ",") != strings.Join(tc.expected, ",") {
+				t.Fatalf("expected %v, got %v", tc.expected, got)
+			}
+			for _, l := range layers {
+				if read := p.reads[digest.FromBytes(l)] > 0; read != tc.layerReads {
+					t.Fatalf("expected layerReads=%v, got %d bytes", tc.layerReads, p.reads[digest.FromBytes(l)])
+				}
+			}
+		})
+	}
+}
+
+func TestDiffAlignedLayers(t *testing.T) {
+	etc := testutil.Layer(t, testutil.File{Name: "etc/hostname", Body: "localhost\n"})
+	usr := testutil.Layer(t,
+		testutil.File{Name: "usr/bin/sh", Body: "sh\n"},
+		testutil.File{Name: "usr/lib/libc.so", Body: "libc\n"})
+	usrBin := testutil.Layer(t, testutil.File{Name: "usr/bin/sh", Body: "sh2\n"})
+	usrLib := testutil.Layer(t, testutil.File{Name: "usr/lib/libc.so", Body: "libc\n"})
+	varLog := testutil.Layer(t, testutil.File{Name: "var/log/x", Body: "x\n"})
+	varLog2 := testutil.Layer(t, testutil.File{Name: "var/log/x", Body: "x2\n"})
+	testCases := []struct {
+		name     string
+		layers   [2][][]byte
+		aligned  string
+		expected []string
+	}{
+		{
+			name:     "layer split",
+			layers:   [2][][]byte{{etc, usr, varLog}, {etc, usrBin, usrLib, varLog2}},
+			aligned:  "aligned as [0:0 1:1-2 2:3]",
+			expected: []string{"usr/bin/sh", "var/log/x"},
+		},
+		{
+			name:     "layer inserted",
+			layers:   [2][][]byte{{etc, varLog}, {etc, usrLib, varLog}},
+			aligned:  "aligned as [0:0 none:1 1:2]",
+			expected: []string{"length mismatch (0 vs 1)", `name "usr/lib/libc.so" only appears in input 1`},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestImageStore(t)
+			descs := [2]ocispec.Descriptor{s.image(nil, tc.layers[0]...), s.image(nil, tc.layers[1]...)}
+			events := s.runDiff(descs, diff.Options{})
+			var found bool
+			for _, ev := range events {
+				if ev.Type == diff.EventTypeManifestBlobMismatch && strings.HasSuffix(ev.Note, tc.aligned) {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("expected an event noting %q, got %v", tc.aligned, events)
+			}
+			if got := entryEvents(events); strings.Join(got, ",") != strings.Join(tc.expected, ",") {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestDiffWhiteouts(t *testing.T) {
+	etc := testutil.File{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0o755}
+	usr := testutil.File{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0o755}
+	testCases := []struct {
+		name     string
+		files    [2][]testutil.File
+		expected testutil.Event
+		column   string // the first column printed by the default event handler
+	}{
+		{
+			name:     "deleted only in input 1",
+			files:    [2][]testutil.File{{etc}, {etc, {Name: "etc/.wh.hostname"}}},
+			expected: testutil.Event{Type: diff.EventTypeDeletedPathMismatch, Name: "etc/hostname", Note: `path "etc/hostname" is deleted only in input 1`},
+			column:   "Deleted",
+		},
+		{
+			name:     "opaque only in input 0",
+			files:    [2][]testutil.File{{usr, {Name: "usr/.wh..wh..opq"}}, {usr}},
+			expected: testutil.Event{Type: diff.EventTypeOpaqueDirectoryMismatch, Name: "usr", Note: `directory "usr" is made opaque only in input 0`},
+			column:   "Opaque",
+		},
+		{
+			name:     "opaque root",
+			files:    [2][]testutil.File{{etc}, {etc, {Name: ".wh..wh..opq"}}},
+			expected: testutil.Event{Type: diff.EventTypeOpaqueDirectoryMismatch, Name: ".", Note: `directory "." is made opaque only in input 1`},
+			column:   "Opaque",
+		},
+		{
+			name: "differing whiteouts",
+			files: [2][]testutil.File{
+				{etc, {Name: "etc/.wh.hostname"}},
+				{etc, {Name: "etc/.wh.hostname", ModTime: testutil.ModTime.Add(time.Hour)}},
+			},
+			expected: testutil.Event{Type: diff.EventTypeDeletedPathMismatch, Name: "etc/hostname", Note: `deleted path "etc/hostname"`},
+			column:   "Deleted",
+		},
+		{
+			name: "differing opaque whiteouts",
+			files: [2][]testutil.File{
+				{usr, {Name: "usr/.wh..wh..opq"}},
+				{usr, {Name: "usr/.wh..wh..opq", Mode: 0o600}},
+			},
+			expected: testutil.Event{Type: diff.EventTypeOpaqueDirectoryMismatch, Name: "usr", Note: `opaque directory "usr"`},
+			column:   "Opaque",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestImageStore(t)
+			descs := [2]ocispec.Descriptor{
+				s.image(nil, testutil.Layer(t, tc.files[0]...)),
+				s.image(nil, testutil.Layer(t, tc.files[1]...)),
+			}
+			var got []testutil.Event
+			for _, ev := range s.runDiff(descs, diff.Options{}) {
+				switch ev.Type {
+				case diff.EventTypeTarEntryMismatch, diff.EventTypeDeletedPathMismatch, diff.EventTypeOpaqueDirectoryMismatch:
+					got = append(got, ev)
+				}
+			}
+			if len(got) != 1 || got[0] != tc.expected {
+				t.Fatalf("expected %v, got %v", tc.expected, got)
+			}
+
+			// The default event handler prints the target of the whiteout
+			var buf bytes.Buffer
+			h := diff.NewDefaultEventHandler(&buf)
+			reportFile := filepath.Join(t.TempDir(), "report.json")
+			opts := &diff.Options{EventHandler: h, ReportFile: reportFile}
+			if _, err := diff.Diff(context.Background(), s.cs, descs, platforms.All, opts); err != nil {
+				t.Fatal(err)
+			}
+			if err := h.(diff.Flusher).Flush(); err != nil {
+				t.Fatal(err)
+			}
+			var printed bool
+			for _, line := range strings.Split(buf.String(), "\n") {
+				if fields := strings.Fields(line); len(fields) >= 2 && fields[0] == tc.column && fields[1] == tc.expected.Name {
+					printed = true
+				}
+				if strings.Contains(line, ".wh.") {
+					t.Errorf("the whiteout is printed as a raw name: %q", line)
+				}
+			}
+			if !printed {
+				t.Errorf("expected a line %q for %q, got %q", tc.column, tc.expected.Name, buf.String())
+			}
+
+			// The report contains the target of the whiteout
+			b, err := os.ReadFile(reportFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var report diff.EventTreeNode
+			if err = json.Unmarshal(b, &report); err != nil {
+				t.Fatal(err)
+			}
+			var found bool
+			var walk func(node *diff.EventTreeNode)
+			walk = func(node *diff.EventTreeNode) {
+				if node.Type == tc.expected.Type && node.Path == tc.expected.Name && node.Note == tc.expected.Note {
+					found = true
+				}
+				for _, child := range node.Children {
+					walk(child)
+				}
+			}
+			walk(&report)
+			if !found {
+				t.Errorf("expected %v in the report, got %s", tc.expected, b)
+			}
+		})
+	}
+}
+
+// testZipBlob creates a zip archive of the regular files, with the modification time.
+func TestDiffRootFS(t *testing.T) {
+	uid, gid := os.Getuid(), os.Getgid()
+	if uid < 0 {
+		t.Skip("the owners of the files are not supported on this platform")
+	}
+	own := func(files ...testutil.File) []testutil.File {
+		for i := range files {
+			files[i].Uid, files[i].Gid = uid, gid
+		}
+		return files
+	}
+	base := own(
+		testutil.File{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0o755},
+		testutil.File{Name: "etc/hostname", Body: "localhost\n"},
+		testutil.File{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0o755},
+		testutil.File{Name: "usr/bin/", Typeflag: tar.TypeDir, Mode: 0o755},
+		testutil.File{Name: "usr/bin/sh", Body: "#!/bin/sh\n", Mode: 0o755},
+	)
+	testCases := []struct {
+		name     string
+		layers   [][]testutil.File
+		dir      []testutil.File
+		expected []string
+	}{
+		{
+			name:   "identical",
+			layers: [][]testutil.File{base},
+			dir:    base,
+		},
+		{
+			name:     "content",
+			layers:   [][]testutil.File{base},
+			dir:      append(base[:len(base)-1:len(base)-1], own(testutil.File{Name: "usr/bin/sh", Body: "#!/bin/bash\n", Mode: 0o755})...),
+			expected: []string{"usr/bin/sh"},
+		},
+		{
+			name:     "mode",
+			layers:   [][]testutil.File{base},
+			dir:      append(base[:len(base)-1:len(base)-1], own(testutil.File{Name: "usr/bin/sh", Body: "#!/bin/sh\n", Mode: 0o700})...),
+			expected: []string{"usr/bin/sh"},
+		},
+		{
+			name:     "only in the directory",
+			layers:   [][]testutil.File{base},
+			dir:      append(base[:len(base):len(base)], own(testutil.File{Name: "etc/passwd", Body: "root\n"})...),
+			expected: []string{"length mismatch (5 vs 6)", `name "etc/passwd" only appears in input 1`},
+		},
+		{
+			name:   "flattened",
+			layers: [][]testutil.File{append(base[:len(base):len(base)], own(testutil.File{Name: "etc/passwd", Body: "root\n"})...), own(testutil.File{Name: "etc/.wh.passwd"})},
+			dir:    base,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestImageStore(t)
+			var blobs [][]byte
+			for _, l := range tc.layers {
+				blobs = append(blobs, testutil.Layer(t, l...))
+			}
+			desc := s.image(nil, blobs...)
+			dir := t.TempDir()
+			for _, f := range tc.dir {
+				writeTestFile(t, dir, f)
+			}
+			// Set the timestamps after creating the children
+			if err := filepath.WalkDir(dir, func(p string, _ fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				return os.Chtimes(p, testutil.ModTime, testutil.ModTime)
+			}); err != nil {
+				t.Fatal(err)
+			}
+			h := &testutil.EventRecorder{}
+			report, err := diff.DiffRootFS(context.Background(), s.cs, desc, dir, platforms.All, &diff.Options{EventHandler: h})
+			if err != nil {
+				t.Fatal(err)
+			}
+			events := testutil.FlattenTree(report)
+			if !equalEvents(events, h.Events()) {
+				t.Fatalf("the events passed to the handler %v differ from the event tree %v", h.Events(), events)
+			}
+			if got := entryEvents(events); strings.Join(got, ",") != strings.Join(tc.expected, ",") {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func testZipBlob(t *testing.T, modTime time.Time, files ...testutil.File) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range files {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: f.Name, Method: zip.Deflate, Modified: modTime})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = io.WriteString(w, f.Body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testGzipBlob(t *testing.T, b []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDiffNestedArchives(t *testing.T) {
+	later := testutil.ModTime.Add(time.Hour)
+	manifest := testutil.File{Name: "META-INF/MANIFEST.MF", Body: "Manifest-Version: 1.0\n"}
+	manifest2 := testutil.File{Name: "META-INF/MANIFEST.MF", Body: "Manifest-Version: 2.0\n"}
+	class := testutil.File{Name: "Foo.class", Body: "\xca\xfe\xba\xbe"}
+	testCases := []struct {
+		name     string
+		files    [2][]testutil.File
+		opts     diff.Options
+		expected []string
+	}{
+		{
+			name: "zip entry",
+			files: [2][]testutil.File{
+				{{Name: "app.jar", Body: string(testZipBlob(t, testutil.ModTime, manifest, class))}},
+				{{Name: "app.jar", Body: string(testZipBlob(t, testutil.ModTime, manifest2, class))}},
+			},
+			opts:     diff.Options{NestedArchives: true},
+			expected: []string{"app.jar", "app.jar!/META-INF/MANIFEST.MF"},
+		},
+		{
+			name: "disabled",
+			files: [2][]testutil.File{
+				{{Name: "app.jar", Body: string(testZipBlob(t, testutil.ModTime, manifest, class))}},
+				{{Name: "app.jar", Body: string(testZipBlob(t, testutil.ModTime, manifest2, class))}},
+			},
+			expected: []string{"app.jar"},
+		},
+		{
+			name: "zip timestamps",
+			files: [2][]testutil.File{
+				{{Name: "app.jar", Body: string(testZipBlob(t, testutil.ModTime, manifest, class))}},
+				{{Name: "app.jar", Body: string(testZipBlob(t, later, manifest, class))}},
+			},
+			opts:     diff.Options{NestedArchives: true},
+			expected: []string{"app.jar", "app.jar!/Foo.class", "app.jar!/META-INF/MANIFEST.MF"},
+		},
+		{
+			// The archive files are equivalent, as their entries only differ in the ignored timestamps
+			name: "zip timestamps ignored",
+			files: [2][]testutil.File{
+				{{Name: "app.jar", Body: string(testZipBlob(t, testutil.ModTime, manifest, class))}},
+				{{Name: "app.jar", Body: string(testZipBlob(t, later, manifest, class))}},
+			},
+			opts: diff.Options{NestedArchives: true, IgnoranceOptions: diff.IgnoranceOptions{IgnoreFileTimestamps: true}},
+		},
+		{
+			name: "entry only in input 1",
+			files: [2][]testutil.File{
+				{{Name: "app.jar", Body: string(testZipBlob(t, testutil.ModTime, manifest))}},
+				{{Name: "app.jar", Body: string(testZipBlob(t, testutil.ModTime, manifest, class))}},
+			},
+			opts:     diff.Options{NestedArchives: true},
+			expected: []string{"app.jar", `name "app.jar!/Foo.class" only appears in input 1`},
+		},
+		{
+			name: "tar.gz in tar",
+			files: [2][]testutil.File{
+				{{Name: "src.tar", Body: string(testutil.Layer(t, testutil.File{Name: "foo.tar.gz", Body: string(testGzipBlob(t, testutil.Layer(t, manifest)))}))}},
+				{{Name: "src.tar", Body: string(testutil.Layer(t, testutil.File{Name: "foo.tar.gz", Body: string(testGzipBlob(t, testutil.Layer(t, manifest2)))}))}},
+			},
+			opts:     diff.Options{NestedArchives: true},
+			expected: []string{"src.tar", "src.tar!/foo.tar.gz", "src.tar!/foo.tar.gz!/META-INF/MANIFEST.MF"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestImageStore(t)
+			descs := [2]ocispec.Descriptor{
+				s.image(nil, testutil.Layer(t, tc.files[0]...)),
+				s.image(nil, testutil.Layer(t, tc.files[1]...)),
+			}
+			for _, concurrency := range []int{1, 4} {
+				opts := tc.opts
+				opts.Concurrency = concurrency
+				got := entryEvents(s.runDiff(descs, opts))
+				if strings.Join(got, ",") != strings.Join(tc.expected, ",") {
+					t.Errorf("concurrency %d: expected %v, got %v", concurrency, tc.expected, got)
+				}
+			}
+		})
+	}
+}
+
+func TestDiffNormalizers(t *testing.T) {
+	gz := testGzipBlob(t, []byte("foo\n"))
+	// The same gzip file with another mtime
+	gz2 := bytes.Clone(gz)
+	gz2[4] = 1
+	manifest := testutil.File{Name: "META-INF/MANIFEST.MF", Body: "Manifest-Version: 1.0\nBuild-Time: 2026-01-01\n"}
+	manifest2 := testutil.File{Name: "META-INF/MANIFEST.MF", Body: "Manifest-Version: 1.0\nBuild-Time: 2026-01-02T00:00:00Z\n"}
+	testCases := []struct {
+		name     string
+		files    [2][]testutil.File
+		opts     diff.Options
+		expected []string
+	}{
+		{
+			name:     "disabled",
+			files:    [2][]testutil.File{{{Name: "foo.gz", Body: string(gz)}}, {{Name: "foo.gz", Body: string(gz2)}}},
+			expected: []string{"foo.gz"},
+		},
+		{
+			name:  "gzip",
+			files: [2][]testutil.File{{{Name: "foo.gz", Body: string(gz)}}, {{Name: "foo.gz", Body: string(gz2)}}},
+			opts:  diff.Options{Normalizers: []string{"gzip"}},
+		},
+		{
+			name:     "gzip with other contents",
+			files:    [2][]testutil.File{{{Name: "foo.gz", Body: string(gz)}}, {{Name: "foo.gz", Body: string(testGzipBlob(t, []byte("bar\n")))}}},
+			opts:     diff.Options{Normalizers: []string{"gzip"}},
+			expected: []string{"foo.gz"},
+		},
+		{
+			name:     "gzip with another mtime of the tar entry",
+			files:    [2][]testutil.File{{{Name: "foo.gz", Body: string(gz)}}, {{Name: "foo.gz", Body: string(gz2), ModTime: testutil.ModTime.Add(time.Hour)}}},
+			opts:     diff.Options{Normalizers: []string{"gzip"}},
+			expected: []string{"foo.gz"},
+		},
+		{
+			// The sizes of the manifests differ too
+			name:  "jar manifest",
+			files: [2][]testutil.File{{manifest}, {manifest2}},
+			opts:  diff.Options{Normalizers: []string{"jar"}},
+		},
+		{
+			name: "jar manifest in a nested archive",
+			files: [2][]testutil.File{
+				{{Name: "app.jar", Body: string(testZipBlob(t, testutil.ModTime, manifest))}},
+				{{Name: "app.jar", Body: string(testZipBlob(t, testutil.ModTime, manifest2))}},
+			},
+			opts: diff.Options{NestedArchives: true, Normalizers: []string{"jar", "zip"}},
+		},
+		{
+			name: "zip timestamps",
+			files: [2][]testutil.File{
+				{{Name: "app.jar", Body: string(testZipBlob(t, testutil.ModTime, manifest))}},
+				{{Name: "app.jar", Body: string(testZipBlob(t, testutil.ModTime.Add(time.Hour), manifest))}},
+			},
+			opts: diff.Options{Normalizers: []string{"zip"}},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestImageStore(t)
+			descs := [2]ocispec.Descriptor{
+				s.image(nil, testutil.Layer(t, tc.files[0]...)),
+				s.image(nil, testutil.Layer(t, tc.files[1]...)),
+			}
+			for _, concurrency := range []int{1, 4} {
+				opts := tc.opts
+				opts.Concurrency = concurrency
+				got := entryEvents(s.runDiff(descs, opts))
+				if strings.Join(got, ",") != strings.Join(tc.expected, ",") {
+					t.Errorf("concurrency %d: expected %v, got %v", concurrency, tc.expected, got)
+				}
+			}
+		})
+	}
+}
+
+// TestDiffNormalizedDigests tests that the digests of the original contents are reported,
+// along with the digests of the normalized contents.
+func TestDiffNormalizedDigests(t *testing.T) {
+	gz := testGzipBlob(t, []byte("foo\n"))
+	gz2 := testGzipBlob(t, []byte("bar\n"))
+	// The mtimes are cleared by the normalizer
+	normalized := [][]byte{bytes.Clone(gz), bytes.Clone(gz2)}
+	gz[4], gz2[4] = 1, 2
+	s := newTestImageStore(t)
+	descs := [2]ocispec.Descriptor{
+		s.image(nil, testutil.Layer(t, testutil.File{Name: "foo.gz", Body: string(gz)})),
+		s.image(nil, testutil.Layer(t, testutil.File{Name: "foo.gz", Body: string(gz2)})),
+	}
+	reportFile := filepath.Join(t.TempDir(), "report.json")
+	s.runDiff(descs, diff.Options{Normalizers: []string{"gzip"}, ReportFile: reportFile})
+	b, err := os.ReadFile(reportFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report diff.EventTreeNode
+	if err = json.Unmarshal(b, &report); err != nil {
+		t.Fatal(err)
+	}
+	var ents [][2]*diff.TarEntry
+	var walk func(node *diff.EventTreeNode)
+	walk = func(node *diff.EventTreeNode) {
+		if node.Event.Type == diff.EventTypeTarEntryMismatch {
+			ents = append(ents, [2]*diff.TarEntry{node.Inputs[0].TarEntry, node.Inputs[1].TarEntry})
+		}
+		for _, child := range node.Children {
+			walk(child)
+		}
+	}
+	walk(&report)
+	if len(ents) != 1 {
+		t.Fatalf("expected 1 entry event, got %d", len(ents))
+	}
+	for i, blob := range [][]byte{gz, gz2} {
+		ent := ents[0][i]
+		if expected := digest.FromBytes(blob); ent.Digest != expected {
+			t.Errorf("input %d: expected the digest %s, got %s", i, expected, ent.Digest)
+		}
+		if expected := digest.FromBytes(normalized[i]); ent.NormalizedDigest != expected {
+			t.Errorf("input %d: expected the normalized digest %s, got %s", i, expected, ent.NormalizedDigest)
+		}
+		if ent.Normalizer != "gzip" {
+			t.Errorf("input %d: expected the normalizer %q, got %q", i, "gzip", ent.Normalizer)
+		}
+	}
+}
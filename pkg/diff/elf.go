@@ -0,0 +1,253 @@
+package diff
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/containerd/log"
+	"github.com/opencontainers/go-digest"
+)
+
+// elfMagic is the magic bytes of ELF files.
+var elfMagic = []byte("\x7fELF")
+
+// elfBuildIDSections are the sections that contain the build IDs.
+var elfBuildIDSections = map[string]struct{}{
+	".note.gnu.build-id": {},
+	".note.go.buildid":   {},
+}
+
+// isELFDebugSection returns true if the section only contains the debug information.
+func isELFDebugSection(name string) bool {
+	switch name {
+	case ".gnu_debuglink", ".gnu_debugaltlink", ".gnu_debugdata":
+		return true
+	}
+	return strings.HasPrefix(name, ".debug_") || strings.HasPrefix(name, ".zdebug_")
+}
+
+// ELFDiff describes the differences of the ELF files.
+type ELFDiff struct {
+	// Header is true if the file headers or the program headers differ.
+	Header bool `json:"header,omitempty"`
+	// Sections are the names of the differing sections, including the ones that only appear in either of the files.
+	Sections []string `json:"sections,omitempty"`
+	// Symbols is true if the symbol tables (including the dynamic symbol tables) differ.
+	Symbols bool `json:"symbols,omitempty"`
+	// BuildIDOnly is true if the files only differ in the build IDs.
+	BuildIDOnly bool `json:"buildIDOnly,omitempty"`
+	// DebugOnly is true if the files only differ in the debug sections (and in the build IDs, which are
+	// usually computed over the debug sections too).
+	DebugOnly bool `json:"debugOnly,omitempty"`
+}
+
+// String implements [fmt.Stringer].
+// The returned string is not machine-parsable.
+func (e *ELFDiff) String() string {
+	var what []string
+	if e.Header {
+		what = append(what, "headers")
+	}
+	if len(e.Sections) > 0 {
+		what = append(what, "sections "+strings.Join(e.Sections, " "))
+	}
+	if e.Symbols {
+		what = append(what, "symbols")
+	}
+	if len(what) == 0 {
+		return "ELF contents differ outside the sections"
+	}
+	s := "ELF " + strings.Join(what, ", ") + " differ"
+	switch {
+	case e.BuildIDOnly:
+		s += " (build ID only)"
+	case e.DebugOnly:
+		s += " (debug info only)"
+	}
+	return s
+}
+
+// ignorable returns true if the difference is ignored by o.
+func (e *ELFDiff) ignorable(o IgnoranceOptions) bool {
+	return (o.IgnoreELFBuildID && e.BuildIDOnly) || (o.IgnoreDebugSections && e.DebugOnly)
+}
+
+// elfEnabled returns true if the ELF files are compared section by section.
+func (o *Options) elfEnabled() bool {
+	return o.ELFSections || o.IgnoreELFBuildID || o.IgnoreDebugSections
+}
+
+// diffELF compares the regular files as ELF files.
+// Returns nil if the files are not ELF files, or are not available on local filesystem.
+func (d *differ) diffELF(ctx context.Context, ent0, ent1 *TarEntry) *ELFDiff {
+	if !d.o.elfEnabled() || ent0.Digest == ent1.Digest {
+		return nil
+	}
+	if ent0.Header.Typeflag != tar.TypeReg || ent1.Header.Typeflag != tar.TypeReg {
+		return nil
+	}
+	p0, p1 := ent0.localPath(), ent1.localPath()
+	if p0 == "" || p1 == "" {
+		return nil
+	}
+	var f [2]*elf.File
+	for i, p := range []string{p0, p1} {
+		var err error
+		f[i], err = elf.Open(p)
+		if err != nil {
+			var formatErr *elf.FormatError
+			if !errors.As(err, &formatErr) {
+				log.G(ctx).WithError(err).Warnf("Failed to open %q as an ELF file (input-%d)", ent0.Header.Name, i)
+			}
+			return nil
+		}
+		defer f[i].Close()
+	}
+	e, err := compareELFFiles(f[0], f[1])
+	if err != nil {
+		log.G(ctx).WithError(err).Warnf("Failed to compare %q as ELF files", ent0.Header.Name)
+		return nil
+	}
+	return e
+}
+
+func compareELFFiles(f0, f1 *elf.File) (*ELFDiff, error) {
+	var e ELFDiff
+	e.Header = !reflect.DeepEqual(f0.FileHeader, f1.FileHeader) || !equalProgs(f0.Progs, f1.Progs)
+
+	var secs [2]map[string]*elf.Section
+	for i, f := range []*elf.File{f0, f1} {
+		secs[i] = make(map[string]*elf.Section, len(f.Sections))
+		for _, s := range f.Sections {
+			key := s.Name
+			for k := 1; secs[i][key] != nil; k++ {
+				// duplicate names
+				key = fmt.Sprintf("%s#%d", s.Name, k)
+			}
+			secs[i][key] = s
+		}
+	}
+	for key, s0 := range secs[0] {
+		s1, ok := secs[1][key]
+		if !ok {
+			e.Sections = append(e.Sections, key)
+			continue
+		}
+		eq, err := equalSections(s0, s1)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compare section %q: %w", key, err)
+		}
+		if !eq {
+			e.Sections = append(e.Sections, key)
+		}
+	}
+	for key := range secs[1] {
+		if _, ok := secs[0][key]; !ok {
+			e.Sections = append(e.Sections, key)
+		}
+	}
+	sort.Strings(e.Sections)
+
+	var err error
+	if e.Symbols, err = symbolsDiffer(f0.Symbols, f1.Symbols); err != nil {
+		return nil, err
+	}
+	if !e.Symbols {
+		if e.Symbols, err = symbolsDiffer(f0.DynamicSymbols, f1.DynamicSymbols); err != nil {
+			return nil, err
+		}
+	}
+
+	if !e.Header && !e.Symbols && len(e.Sections) > 0 {
+		e.BuildIDOnly, e.DebugOnly = true, true
+		debug := false
+		// The section names differ when the debug sections are stripped
+		namesDebugOnly := equalNonDebugSectionNames(secs)
+		for _, name := range e.Sections {
+			name, _, _ = strings.Cut(name, "#")
+			_, buildID := elfBuildIDSections[name]
+			e.BuildIDOnly = e.BuildIDOnly && buildID
+			e.DebugOnly = e.DebugOnly && (buildID || isELFDebugSection(name) || (name == ".shstrtab" && namesDebugOnly))
+			debug = debug || isELFDebugSection(name)
+		}
+		e.DebugOnly = e.DebugOnly && debug
+	}
+	return &e, nil
+}
+
+// equalNonDebugSectionNames returns true if the files have the same sections other than the debug sections
+// and the section name table.
+func equalNonDebugSectionNames(secs [2]map[string]*elf.Section) bool {
+	var n [2]int
+	for i := range secs {
+		for key := range secs[i] {
+			name, _, _ := strings.Cut(key, "#")
+			if isELFDebugSection(name) || name == ".shstrtab" {
+				continue
+			}
+			n[i]++
+			if _, ok := secs[1-i][key]; !ok {
+				return false
+			}
+		}
+	}
+	return n[0] == n[1]
+}
+
+func equalProgs(p0, p1 []*elf.Prog) bool {
+	if len(p0) != len(p1) {
+		return false
+	}
+	for i := range p0 {
+		if p0[i].ProgHeader != p1[i].ProgHeader {
+			return false
+		}
+	}
+	return true
+}
+
+// equalSections compares the sections, except the offsets.
+func equalSections(s0, s1 *elf.Section) (bool, error) {
+	h0, h1 := s0.SectionHeader, s1.SectionHeader
+	h0.Offset, h1.Offset = 0, 0
+	if h0 != h1 {
+		return false, nil
+	}
+	if h0.Type == elf.SHT_NOBITS {
+		return true, nil
+	}
+	var dgst [2]digest.Digest
+	for i, s := range []*elf.Section{s0, s1} {
+		var err error
+		// Open decompresses the compressed sections
+		dgst[i], err = digest.SHA256.FromReader(s.Open())
+		if err != nil {
+			return false, err
+		}
+	}
+	return dgst[0] == dgst[1], nil
+}
+
+func symbolsDiffer(f0, f1 func() ([]elf.Symbol, error)) (bool, error) {
+	var syms [2][]elf.Symbol
+	for i, f := range []func() ([]elf.Symbol, error){f0, f1} {
+		var err error
+		syms[i], err = f()
+		if err != nil && !errors.Is(err, elf.ErrNoSymbols) {
+			return false, err
+		}
+	}
+	return !reflect.DeepEqual(syms[0], syms[1]), nil
+}
+
+// isELF returns true if head is the head of an ELF file.
+func isELF(head []byte) bool {
+	return bytes.HasPrefix(head, elfMagic)
+}
@@ -0,0 +1,355 @@
+package diff
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"debug/elf"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// testELFSection is a section of a test ELF file.
+type testELFSection struct {
+	name string
+	typ  elf.SectionType
+	data []byte
+	link string // the name of the linked section, e.g., ".strtab" for ".symtab"
+}
+
+// testELF creates a little-endian ELF64 file with the sections, without program headers.
+func testELF(t *testing.T, machine elf.Machine, sections ...testELFSection) []byte {
+	t.Helper()
+	const (
+		ehsize    = 64
+		shentsize = 64
+	)
+	sections = append(sections, testELFSection{name: ".shstrtab", typ: elf.SHT_STRTAB})
+	shstrtab := []byte{0}
+	nameOffsets := make([]uint32, len(sections))
+	for i, s := range sections {
+		nameOffsets[i] = uint32(len(shstrtab))
+		shstrtab = append(shstrtab, s.name...)
+		shstrtab = append(shstrtab, 0)
+	}
+	sections[len(sections)-1].data = shstrtab
+	index := func(name string) uint32 {
+		for i, s := range sections {
+			if s.name == name {
+				return uint32(i + 1) // the section 0 is the null section
+			}
+		}
+		return 0
+	}
+
+	var data bytes.Buffer
+	offsets := make([]uint64, len(sections))
+	for i, s := range sections {
+		offsets[i] = uint64(ehsize + data.Len())
+		if s.typ != elf.SHT_NOBITS {
+			data.Write(s.data)
+		}
+	}
+	shoff := uint64(ehsize + data.Len())
+
+	var buf bytes.Buffer
+	le := binary.LittleEndian
+	write := func(v any) {
+		if err := binary.Write(&buf, le, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var ident [elf.EI_NIDENT]byte
+	copy(ident[:], elf.ELFMAG)
+	ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	write(elf.Header64{
+		Ident:     ident,
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(machine),
+		Version:   uint32(elf.EV_CURRENT),
+		Shoff:     shoff,
+		Ehsize:    ehsize,
+		Phentsize: 56,
+		Shentsize: shentsize,
+		Shnum:     uint16(len(sections) + 1),
+		Shstrndx:  uint16(len(sections)),
+	})
+	buf.Write(data.Bytes())
+	write(elf.Section64{}) // the null section
+	for i, s := range sections {
+		sh := elf.Section64{
+			Name:      nameOffsets[i],
+			Type:      uint32(s.typ),
+			Off:       offsets[i],
+			Size:      uint64(len(s.data)),
+			Link:      index(s.link),
+			Addralign: 1,
+		}
+		if s.typ == elf.SHT_SYMTAB {
+			sh.Entsize = elf.Sym64Size
+		}
+		write(sh)
+	}
+	return buf.Bytes()
+}
+
+// testSymtab returns the .symtab and .strtab sections with the symbols of the values.
+func testSymtab(t *testing.T, values map[string]uint64) []testELFSection {
+	t.Helper()
+	var (
+		symtab bytes.Buffer
+		strtab = []byte{0}
+	)
+	if err := binary.Write(&symtab, binary.LittleEndian, elf.Sym64{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"main", "foo"} {
+		v, ok := values[name]
+		if !ok {
+			continue
+		}
+		sym := elf.Sym64{Name: uint32(len(strtab)), Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC), Value: v}
+		strtab = append(strtab, name...)
+		strtab = append(strtab, 0)
+		if err := binary.Write(&symtab, binary.LittleEndian, sym); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return []testELFSection{
+		{name: ".symtab", typ: elf.SHT_SYMTAB, data: symtab.Bytes(), link: ".strtab"},
+		{name: ".strtab", typ: elf.SHT_STRTAB, data: strtab},
+	}
+}
+
+func TestCompareELFFiles(t *testing.T) {
+	var (
+		text     = testELFSection{name: ".text", typ: elf.SHT_PROGBITS, data: []byte{0x90, 0xc3}}
+		text2    = testELFSection{name: ".text", typ: elf.SHT_PROGBITS, data: []byte{0x90, 0x90}}
+		rodata   = testELFSection{name: ".rodata", typ: elf.SHT_PROGBITS, data: []byte("foo")}
+		buildID  = testELFSection{name: ".note.gnu.build-id", typ: elf.SHT_NOTE, data: []byte("id-0")}
+		buildID2 = testELFSection{name: ".note.gnu.build-id", typ: elf.SHT_NOTE, data: []byte("id-1")}
+		goID     = testELFSection{name: ".note.go.buildid", typ: elf.SHT_NOTE, data: []byte("go-0")}
+		goID2    = testELFSection{name: ".note.go.buildid", typ: elf.SHT_NOTE, data: []byte("go-1")}
+		info     = testELFSection{name: ".debug_info", typ: elf.SHT_PROGBITS, data: []byte("info-0")}
+		info2    = testELFSection{name: ".debug_info", typ: elf.SHT_PROGBITS, data: []byte("info-1")}
+		line     = testELFSection{name: ".debug_line", typ: elf.SHT_PROGBITS, data: []byte("line")}
+		link     = testELFSection{name: ".gnu_debuglink", typ: elf.SHT_PROGBITS, data: []byte("foo.debug\x00")}
+		link2    = testELFSection{name: ".gnu_debuglink", typ: elf.SHT_PROGBITS, data: []byte("bar.debug\x00")}
+		bss      = testELFSection{name: ".bss", typ: elf.SHT_NOBITS, data: []byte{0, 0}}
+		bss2     = testELFSection{name: ".bss", typ: elf.SHT_NOBITS, data: []byte{1, 1}}
+	)
+	testCases := []struct {
+		name     string
+		sections [2][]testELFSection
+		machines [2]elf.Machine
+		expected ELFDiff
+	}{
+		{
+			name:     "identical",
+			sections: [2][]testELFSection{{text, rodata, buildID}, {text, rodata, buildID}},
+		},
+		{
+			name:     "text",
+			sections: [2][]testELFSection{{text, rodata, buildID}, {text2, rodata, buildID2}},
+			expected: ELFDiff{Sections: []string{".note.gnu.build-id", ".text"}},
+		},
+		{
+			name:     "build ID",
+			sections: [2][]testELFSection{{text, buildID, goID}, {text, buildID2, goID2}},
+			expected: ELFDiff{Sections: []string{".note.gnu.build-id", ".note.go.buildid"}, BuildIDOnly: true},
+		},
+		{
+			name:     "debug info and build ID",
+			sections: [2][]testELFSection{{text, buildID, info}, {text, buildID2, info2}},
+			expected: ELFDiff{Sections: []string{".debug_info", ".note.gnu.build-id"}, DebugOnly: true},
+		},
+		{
+			name:     "debug link",
+			sections: [2][]testELFSection{{text, link}, {text, link2}},
+			expected: ELFDiff{Sections: []string{".gnu_debuglink"}, DebugOnly: true},
+		},
+		{
+			name:     "stripped debug sections",
+			sections: [2][]testELFSection{{text, info, line}, {text}},
+			expected: ELFDiff{Sections: []string{".debug_info", ".debug_line", ".shstrtab"}, DebugOnly: true},
+		},
+		{
+			name:     "renamed section with debug info",
+			sections: [2][]testELFSection{{text, info}, {{name: ".text2", typ: elf.SHT_PROGBITS, data: text.data}, info2}},
+			expected: ELFDiff{Sections: []string{".debug_info", ".shstrtab", ".text", ".text2"}},
+		},
+		{
+			name:     "section only in input 1",
+			sections: [2][]testELFSection{{text}, {text, rodata}},
+			expected: ELFDiff{Sections: []string{".rodata", ".shstrtab"}},
+		},
+		{
+			// The contents of the NOBITS sections are not in the file
+			name:     "bss",
+			sections: [2][]testELFSection{{text, bss}, {text, bss2}},
+		},
+		{
+			name:     "duplicate names",
+			sections: [2][]testELFSection{{text, text}, {text, text2}},
+			expected: ELFDiff{Sections: []string{".text#1"}},
+		},
+		{
+			name:     "header",
+			sections: [2][]testELFSection{{text}, {text}},
+			machines: [2]elf.Machine{elf.EM_X86_64, elf.EM_AARCH64},
+			expected: ELFDiff{Header: true},
+		},
+		{
+			name: "symbols",
+			sections: [2][]testELFSection{
+				append([]testELFSection{text}, testSymtab(t, map[string]uint64{"main": 0x1000})...),
+				append([]testELFSection{text}, testSymtab(t, map[string]uint64{"main": 0x1000, "foo": 0x2000})...),
+			},
+			expected: ELFDiff{Sections: []string{".strtab", ".symtab"}, Symbols: true},
+		},
+		{
+			name: "identical symbols",
+			sections: [2][]testELFSection{
+				append([]testELFSection{text}, testSymtab(t, map[string]uint64{"main": 0x1000})...),
+				append([]testELFSection{text2}, testSymtab(t, map[string]uint64{"main": 0x1000})...),
+			},
+			expected: ELFDiff{Sections: []string{".text"}},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var f [2]*elf.File
+			for i := range f {
+				machine := tc.machines[i]
+				if machine == 0 {
+					machine = elf.EM_X86_64
+				}
+				var err error
+				f[i], err = elf.NewFile(bytes.NewReader(testELF(t, machine, tc.sections[i]...)))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := compareELFFiles(f[0], f[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*got, tc.expected) {
+				t.Errorf("expected %+v, got %+v", tc.expected, *got)
+			}
+		})
+	}
+}
+
+func TestELFDiffString(t *testing.T) {
+	testCases := []struct {
+		e        ELFDiff
+		expected string
+	}{
+		{ELFDiff{}, "ELF contents differ outside the sections"},
+		{ELFDiff{Header: true}, "ELF headers differ"},
+		{ELFDiff{Sections: []string{".note.gnu.build-id"}, BuildIDOnly: true}, "ELF sections .note.gnu.build-id differ (build ID only)"},
+		{ELFDiff{Sections: []string{".debug_info", ".note.gnu.build-id"}, DebugOnly: true}, "ELF sections .debug_info .note.gnu.build-id differ (debug info only)"},
+		{ELFDiff{Sections: []string{".strtab", ".symtab", ".text"}, Symbols: true}, "ELF sections .strtab .symtab .text, symbols differ"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.expected, func(t *testing.T) {
+			if got := tc.e.String(); got != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestELFDiffIgnorable(t *testing.T) {
+	buildIDOnly := ELFDiff{Sections: []string{".note.gnu.build-id"}, BuildIDOnly: true}
+	debugOnly := ELFDiff{Sections: []string{".debug_info", ".note.gnu.build-id"}, DebugOnly: true}
+	text := ELFDiff{Sections: []string{".text"}}
+	testCases := []struct {
+		name     string
+		e        ELFDiff
+		o        IgnoranceOptions
+		expected bool
+	}{
+		{"build ID not ignored", buildIDOnly, IgnoranceOptions{}, false},
+		{"build ID ignored", buildIDOnly, IgnoranceOptions{IgnoreELFBuildID: true}, true},
+		{"build ID with debug sections ignored", buildIDOnly, IgnoranceOptions{IgnoreDebugSections: true}, false},
+		{"debug info with build ID ignored", debugOnly, IgnoranceOptions{IgnoreELFBuildID: true}, false},
+		{"debug info ignored", debugOnly, IgnoranceOptions{IgnoreDebugSections: true}, true},
+		{"text", text, IgnoranceOptions{IgnoreELFBuildID: true, IgnoreDebugSections: true}, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.e.ignorable(tc.o); got != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestDiffELF(t *testing.T) {
+	text := testELFSection{name: ".text", typ: elf.SHT_PROGBITS, data: []byte{0x90, 0xc3}}
+	buildID := testELFSection{name: ".note.gnu.build-id", typ: elf.SHT_NOTE, data: []byte("id-0")}
+	buildID2 := testELFSection{name: ".note.gnu.build-id", typ: elf.SHT_NOTE, data: []byte("id-1")}
+	testCases := []struct {
+		name     string
+		contents [2][]byte
+		opts     Options
+		expected *ELFDiff
+	}{
+		{
+			name:     "build ID",
+			contents: [2][]byte{testELF(t, elf.EM_X86_64, text, buildID), testELF(t, elf.EM_X86_64, text, buildID2)},
+			opts:     Options{ELFSections: true},
+			expected: &ELFDiff{Sections: []string{".note.gnu.build-id"}, BuildIDOnly: true},
+		},
+		{
+			name:     "enabled by IgnoreELFBuildID",
+			contents: [2][]byte{testELF(t, elf.EM_X86_64, text, buildID), testELF(t, elf.EM_X86_64, text, buildID2)},
+			opts:     Options{IgnoranceOptions: IgnoranceOptions{IgnoreELFBuildID: true}},
+			expected: &ELFDiff{Sections: []string{".note.gnu.build-id"}, BuildIDOnly: true},
+		},
+		{
+			name:     "disabled",
+			contents: [2][]byte{testELF(t, elf.EM_X86_64, text, buildID), testELF(t, elf.EM_X86_64, text, buildID2)},
+		},
+		{
+			name:     "not ELF",
+			contents: [2][]byte{testELF(t, elf.EM_X86_64, text), []byte("#!/bin/sh\n")},
+			opts:     Options{ELFSections: true},
+		},
+		{
+			name:     "truncated",
+			contents: [2][]byte{testELF(t, elf.EM_X86_64, text), []byte("\x7fELF\x02\x01\x01")},
+			opts:     Options{ELFSections: true},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var ents [2]*TarEntry
+			for i, content := range tc.contents {
+				p := filepath.Join(t.TempDir(), "foo")
+				if err := os.WriteFile(p, content, 0o755); err != nil {
+					t.Fatal(err)
+				}
+				ents[i] = &TarEntry{
+					Header:      &tar.Header{Name: "bin/foo", Typeflag: tar.TypeReg, Size: int64(len(content))},
+					Digest:      digest.FromBytes(content),
+					contentPath: p,
+				}
+			}
+			d := &differ{o: tc.opts}
+			got := d.diffELF(context.Background(), ents[0], ents[1])
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected %+v, got %+v", tc.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,357 @@
+package diff
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// layerIndexVersion is the version of the format of the layer index files.
+const layerIndexVersion = "v2"
+
+// layerIndexMaxTextSize is the maximum size of the text files whose contents are stored in the layer indexes,
+// for the text diffs.
+const layerIndexMaxTextSize = 64 << 10
+
+// LayerIndexCache persists the indexes of the layers (the tar headers and the digests of the file contents),
+// keyed by the digest of the layer blob, so that the layers do not need to be decompressed again.
+// The contents of the small text files are stored too, for the text diffs.
+//
+// The headers are stored as they appear in the layer, so the indexes do not depend on [IgnoranceOptions].
+// The digests of the normalized contents are stored too, so the indexes are keyed by the names of
+// the normalizers (Options.Normalizers) as well.
+type LayerIndexCache struct {
+	dir string
+}
+
+// NewLayerIndexCache returns the cache that stores the indexes in dir.
+// The directory is created on the first write.
+func NewLayerIndexCache(dir string) *LayerIndexCache {
+	return &LayerIndexCache{dir: dir}
+}
+
+// layerIndexSuffix is the suffix of the layer index files.
+const layerIndexSuffix = ".jsonl.gz"
+
+// path returns the path of the index of the layer blob, for the normalizers.
+// The indexes for the normalizers are named like "<encoded>+<key>.jsonl.gz", where key is derived from
+// the names of the normalizers in the order.
+func (c *LayerIndexCache) path(dgst digest.Digest, normalizers []*Normalizer) string {
+	name := dgst.Encoded()
+	if len(normalizers) > 0 {
+		names := make([]string, len(normalizers))
+		for i, n := range normalizers {
+			names[i] = n.Name
+		}
+		name += "+" + digest.FromString(strings.Join(names, "\n")).Encoded()[:16]
+	}
+	return filepath.Join(c.dir, layerIndexVersion, dgst.Algorithm().String(), name+layerIndexSuffix)
+}
+
+// layerIndexEntry is a line of a layer index file.
+type layerIndexEntry struct {
+	Header           *tar.Header   `json:"header"`
+	Digest           digest.Digest `json:"digest"`
+	NormalizedDigest digest.Digest `json:"normalizedDigest,omitempty"`
+	Normalizer       string        `json:"normalizer,omitempty"`
+	Text             *string       `json:"text,omitempty"`
+}
+
+// open opens the index of the layer blob, for the normalizers.
+// Returns an error wrapping [errdefs.ErrNotFound] if the index is not cached.
+func (c *LayerIndexCache) open(dgst digest.Digest, normalizers []*Normalizer) (*layerIndexReader, error) {
+	if err := dgst.Validate(); err != nil {
+		return nil, err
+	}
+	p := c.path(dgst, normalizers)
+	f, err := os.Open(p)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = fmt.Errorf("layer index of %s: %w", dgst, errdefs.ErrNotFound)
+		}
+		return nil, err
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("failed to open %q: %w", p, err)
+	}
+	// Record the last use
+	now := time.Now()
+	_ = os.Chtimes(p, now, now)
+	return &layerIndexReader{f: f, gz: gz, dec: json.NewDecoder(gz)}, nil
+}
+
+// create creates the writer of the index of the layer blob, for the normalizers.
+func (c *LayerIndexCache) create(dgst digest.Digest, normalizers []*Normalizer) (*layerIndexWriter, error) {
+	if err := dgst.Validate(); err != nil {
+		return nil, err
+	}
+	p := c.path(dgst, normalizers)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), ".tmp-"+dgst.Encoded()+"-*")
+	if err != nil {
+		return nil, err
+	}
+	gz := gzip.NewWriter(f)
+	enc := json.NewEncoder(gz)
+	enc.SetEscapeHTML(false)
+	return &layerIndexWriter{path: p, f: f, gz: gz, enc: enc}, nil
+}
+
+// Remove removes the indexes of the layer blob for any normalizers, if exist.
+func (c *LayerIndexCache) Remove(dgst digest.Digest) error {
+	if err := dgst.Validate(); err != nil {
+		return err
+	}
+	p := c.path(dgst, nil)
+	// The encoded digest does not contain the glob metacharacters
+	paths, err := filepath.Glob(strings.TrimSuffix(p, layerIndexSuffix) + "+*" + layerIndexSuffix)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, p := range append(paths, p) {
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Walk calls f for each of the layer blobs with the cached indexes, with the last use of any of the indexes.
+func (c *LayerIndexCache) Walk(f func(dgst digest.Digest, lastUsed time.Time) error) error {
+	var (
+		dgsts    []digest.Digest
+		lastUsed = make(map[digest.Digest]time.Time)
+	)
+	err := filepath.WalkDir(filepath.Join(c.dir, layerIndexVersion), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name, ok := strings.CutSuffix(d.Name(), layerIndexSuffix)
+		if d.IsDir() || !ok {
+			return nil
+		}
+		name, _, _ = strings.Cut(name, "+")
+		alg := filepath.Base(filepath.Dir(p))
+		dgst := digest.NewDigestFromEncoded(digest.Algorithm(alg), name)
+		if dgst.Validate() != nil {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		t, ok := lastUsed[dgst]
+		if !ok {
+			dgsts = append(dgsts, dgst)
+		}
+		if !ok || fi.ModTime().After(t) {
+			lastUsed[dgst] = fi.ModTime()
+		}
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		// no index has been written yet
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, dgst := range dgsts {
+		if err := f(dgst, lastUsed[dgst]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// layerIndexReader is a tarReader that yields the headers of a cached layer index.
+// The contents are not available; the digests are loaded by loadDigests,
+// and the texts (if retained) are returned by entryText.
+type layerIndexReader struct {
+	f   *os.File
+	gz  *gzip.Reader
+	dec *json.Decoder
+	cur layerIndexEntry
+}
+
+func (r *layerIndexReader) Next() (*tar.Header, error) {
+	r.cur = layerIndexEntry{}
+	if err := r.dec.Decode(&r.cur); err != nil {
+		if !errors.Is(err, io.EOF) {
+			err = fmt.Errorf("failed to read the layer index %q: %w", r.f.Name(), err)
+		}
+		return nil, err
+	}
+	if r.cur.Header == nil {
+		return nil, fmt.Errorf("invalid layer index %q: missing header", r.f.Name())
+	}
+	hdr := r.cur.Header
+	// The tar reader returns the local time
+	for _, t := range []*time.Time{&hdr.ModTime, &hdr.AccessTime, &hdr.ChangeTime} {
+		if !t.IsZero() {
+			*t = t.Local()
+		}
+	}
+	return hdr, nil
+}
+
+func (r *layerIndexReader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+// loadDigests sets the digest and the normalized digest of the current entry to ent.
+func (r *layerIndexReader) loadDigests(ent *TarEntry) {
+	ent.Digest, ent.NormalizedDigest, ent.Normalizer = r.cur.Digest, r.cur.NormalizedDigest, r.cur.Normalizer
+}
+
+func (r *layerIndexReader) entryText() *string {
+	return r.cur.Text
+}
+
+func (r *layerIndexReader) Close() error {
+	return errors.Join(r.gz.Close(), r.f.Close())
+}
+
+// layerIndexWriter writes a layer index to a temporary file, and renames it on commit.
+type layerIndexWriter struct {
+	path string
+	f    *os.File
+	gz   *gzip.Writer
+	enc  *json.Encoder
+	err  error // the first error of add
+}
+
+func (w *layerIndexWriter) add(ent layerIndexEntry) {
+	if ent.Text != nil && len(*ent.Text) > layerIndexMaxTextSize {
+		ent.Text = nil
+	}
+	if w.err == nil {
+		w.err = w.enc.Encode(ent)
+	}
+}
+
+func (w *layerIndexWriter) commit() error {
+	if w.err != nil {
+		return errors.Join(w.err, w.abort())
+	}
+	if err := errors.Join(w.gz.Close(), w.f.Close()); err != nil {
+		return errors.Join(err, os.Remove(w.f.Name()))
+	}
+	return os.Rename(w.f.Name(), w.path)
+}
+
+func (w *layerIndexWriter) abort() error {
+	_ = w.gz.Close()
+	_ = w.f.Close()
+	return os.Remove(w.f.Name())
+}
+
+// indexingTarReader records the entries of the layer to a layerIndexWriter.
+type indexingTarReader struct {
+	tarReader
+	w   *layerIndexWriter
+	cur *tar.Header // the unmodified copy of the current header
+	eof bool
+}
+
+func (r *indexingTarReader) Next() (*tar.Header, error) {
+	hdr, err := r.tarReader.Next()
+	r.cur = nil
+	if errors.Is(err, io.EOF) {
+		r.eof = true
+	}
+	if err == nil {
+		// The header may be modified by loadEntry
+		r.cur = cloneHeader(hdr)
+	}
+	return hdr, err
+}
+
+// entryLoaded records the current entry with the digests of the loaded entry, and the text (if any).
+func (r *indexingTarReader) entryLoaded(ent *TarEntry, text *string) {
+	if r.cur != nil {
+		r.w.add(layerIndexEntry{
+			Header:           r.cur,
+			Digest:           ent.Digest,
+			NormalizedDigest: ent.NormalizedDigest,
+			Normalizer:       ent.Normalizer,
+			Text:             text,
+		})
+		r.cur = nil
+	}
+}
+
+// close commits the index if the whole layer has been loaded, otherwise discards it.
+func (r *indexingTarReader) close() error {
+	if r.eof {
+		return r.w.commit()
+	}
+	return r.w.abort()
+}
+
+func cloneHeader(hdr *tar.Header) *tar.Header {
+	clone := *hdr
+	clone.PAXRecords = maps.Clone(hdr.PAXRecords)
+	//nolint:staticcheck // SA1019: hdr.Xattrs has been deprecated since Go 1.10: Use PAXRecords instead.
+	clone.Xattrs = maps.Clone(hdr.Xattrs)
+	return &clone
+}
+
+// openLayerTarReader opens the tar reader of the layer.
+// When the layer index is cached, the index is used instead of decompressing the layer blob.
+// Otherwise the index is written to the cache when the whole layer has been read.
+//
+// The cache is not used when the files are extracted to the report directory or to the temporary directory
+// (NestedArchives, ELF, GoBuildInfo), or when the text diffs may need larger texts than the ones stored in the indexes,
+// as the indexes do not retain the contents.
+// The indexes are separated by the normalizers, as they store the digests of the normalized contents.
+func (d *differ) openLayerTarReader(ctx context.Context, desc ocispec.Descriptor) (tarReader, func() error, error) {
+	c := d.o.LayerIndexCache
+	if c == nil || d.o.ReportDir != "" || d.spoolDir != "" || d.o.TextDiffMaxSize > layerIndexMaxTextSize {
+		return openTarReader(ctx, d.cs, desc, d.o.MaxScale)
+	}
+	ir, err := c.open(desc.Digest, d.normalizers)
+	if err == nil {
+		log.G(ctx).Debugf("Using the cached layer index of %s", desc.Digest)
+		return ir, ir.Close, nil
+	}
+	if !errors.Is(err, errdefs.ErrNotFound) {
+		log.G(ctx).WithError(err).Warnf("Failed to open the cached layer index of %s", desc.Digest)
+	}
+	tr, closer, err := openTarReader(ctx, d.cs, desc, d.o.MaxScale)
+	if err != nil {
+		return nil, nil, err
+	}
+	w, err := c.create(desc.Digest, d.normalizers)
+	if err != nil {
+		log.G(ctx).WithError(err).Warnf("Failed to create the layer index of %s", desc.Digest)
+		return tr, closer, nil
+	}
+	itr := &indexingTarReader{tarReader: tr, w: w}
+	return itr, func() error {
+		if err := itr.close(); err != nil {
+			log.G(ctx).WithError(err).Warnf("Failed to write the layer index of %s", desc.Digest)
+		}
+		return closer()
+	}, nil
+}
@@ -0,0 +1,245 @@
+package diff
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+)
+
+func testTarReader(t *testing.T, files map[string]string, names ...string) tarReader {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		body := files[name]
+		hdr := &tar.Header{
+			Name:       name,
+			Typeflag:   tar.TypeReg,
+			Mode:       0o644,
+			Size:       int64(len(body)),
+			ModTime:    time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+			PAXRecords: map[string]string{"SCHILY.xattr.user.foo": "bar"},
+			Format:     tar.FormatPAX,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return tar.NewReader(&buf)
+}
+
+func TestLayerIndexCache(t *testing.T) {
+	files := map[string]string{
+		"foo":   "foo\n",
+		"large": strings.Repeat("x", layerIndexMaxTextSize+1),
+	}
+	testCases := []struct {
+		name     string
+		names    []string
+		readAll  bool
+		expected bool // cached
+	}{
+		{"complete", []string{"foo", "large"}, true, true},
+		{"empty", nil, true, true},
+		{"incomplete", []string{"foo", "large"}, false, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewLayerIndexCache(t.TempDir())
+			dgst := digest.FromString(tc.name)
+			if _, err := c.open(dgst, nil); !errors.Is(err, errdefs.ErrNotFound) {
+				t.Fatalf("expected ErrNotFound, got %v", err)
+			}
+			w, err := c.create(dgst, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			itr := &indexingTarReader{tarReader: testTarReader(t, files, tc.names...), w: w}
+			for i := 0; tc.readAll || i < len(tc.names)-1; i++ {
+				hdr, err := itr.Next()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				// loadEntry may modify the header, but the index must record the original one
+				hdr.PAXRecords["SCHILY.xattr.user.foo"] = "modified"
+				text := files[hdr.Name]
+				itr.entryLoaded(&TarEntry{Digest: digest.FromString(text)}, &text)
+			}
+			if err = itr.close(); err != nil {
+				t.Fatal(err)
+			}
+
+			var walked []digest.Digest
+			if err = c.Walk(func(d digest.Digest, _ time.Time) error {
+				walked = append(walked, d)
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if cached := len(walked) == 1 && walked[0] == dgst; cached != tc.expected {
+				t.Fatalf("expected cached=%v, got %v", tc.expected, walked)
+			}
+			ir, err := c.open(dgst, nil)
+			if !tc.expected {
+				if !errors.Is(err, errdefs.ErrNotFound) {
+					t.Fatalf("expected ErrNotFound, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ir.Close()
+			for _, name := range tc.names {
+				hdr, err := ir.Next()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if hdr.Name != name || hdr.PAXRecords["SCHILY.xattr.user.foo"] != "bar" {
+					t.Fatalf("unexpected header %+v", hdr)
+				}
+				var ent TarEntry
+				ir.loadDigests(&ent)
+				if ent.Digest != digest.FromString(files[name]) {
+					t.Fatalf("%s: unexpected digest %s", name, ent.Digest)
+				}
+				// The large texts are not stored
+				if text := ir.entryText(); (text != nil) != (len(files[name]) <= layerIndexMaxTextSize) {
+					t.Fatalf("%s: unexpected text %v", name, text != nil)
+				}
+			}
+			if _, err = ir.Next(); !errors.Is(err, io.EOF) {
+				t.Fatalf("expected EOF, got %v", err)
+			}
+
+			if err = c.Remove(dgst); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = c.open(dgst, nil); !errors.Is(err, errdefs.ErrNotFound) {
+				t.Fatalf("expected ErrNotFound after removal, got %v", err)
+			}
+		})
+	}
+}
+
+func TestLayerIndexCacheNormalizers(t *testing.T) {
+	c := NewLayerIndexCache(t.TempDir())
+	dgst := digest.FromString("layer")
+	pyc, err := lookupNormalizers([]string{"pyc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{"foo.pyc": "normalized"}
+	for _, normalizers := range [][]*Normalizer{nil, pyc} {
+		w, err := c.create(dgst, normalizers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		itr := &indexingTarReader{tarReader: testTarReader(t, files, "foo.pyc"), w: w}
+		for {
+			if _, err = itr.Next(); errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			ent := &TarEntry{Digest: digest.FromString("original")}
+			if len(normalizers) > 0 {
+				ent.NormalizedDigest, ent.Normalizer = digest.FromString("normalized"), "pyc"
+			}
+			itr.entryLoaded(ent, nil)
+		}
+		if err = itr.close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, normalizers := range [][]*Normalizer{nil, pyc} {
+		ir, err := c.open(dgst, normalizers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = ir.Next(); err != nil {
+			t.Fatal(err)
+		}
+		var ent TarEntry
+		ir.loadDigests(&ent)
+		_ = ir.Close()
+		if ent.Digest != digest.FromString("original") {
+			t.Fatalf("unexpected digest %s", ent.Digest)
+		}
+		if normalized := ent.NormalizedDigest == digest.FromString("normalized") && ent.Normalizer == "pyc"; normalized != (len(normalizers) > 0) {
+			t.Fatalf("unexpected normalized digest %q (%q)", ent.NormalizedDigest, ent.Normalizer)
+		}
+	}
+	others, err := lookupNormalizers([]string{"gzip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.open(dgst, others); !errors.Is(err, errdefs.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for other normalizers, got %v", err)
+	}
+
+	// The indexes of the same layer are walked once, and removed together
+	var walked []digest.Digest
+	if err = c.Walk(func(d digest.Digest, _ time.Time) error {
+		walked = append(walked, d)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(walked) != 1 || walked[0] != dgst {
+		t.Fatalf("expected [%s], got %v", dgst, walked)
+	}
+	if err = c.Remove(dgst); err != nil {
+		t.Fatal(err)
+	}
+	for _, normalizers := range [][]*Normalizer{nil, pyc} {
+		if _, err = c.open(dgst, normalizers); !errors.Is(err, errdefs.ErrNotFound) {
+			t.Fatalf("expected ErrNotFound after removal, got %v", err)
+		}
+	}
+}
+
+func TestLayerIndexCacheInvalid(t *testing.T) {
+	dir := t.TempDir()
+	c := NewLayerIndexCache(dir)
+	for _, dgst := range []digest.Digest{"", "sha256:foo", "../../etc/passwd"} {
+		if _, err := c.open(dgst, nil); err == nil || errors.Is(err, errdefs.ErrNotFound) {
+			t.Errorf("%q: expected an invalid digest error, got %v", dgst, err)
+		}
+		if _, err := c.create(dgst, nil); err == nil {
+			t.Errorf("%q: expected an error", dgst)
+		}
+	}
+	// A corrupted index is an error, not a cache miss
+	dgst := digest.FromString("corrupted")
+	w, err := c.create(dgst, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(c.path(dgst, nil), []byte("corrupted"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.open(dgst, nil); err == nil || errors.Is(err, errdefs.ErrNotFound) {
+		t.Fatalf("expected an error, got %v", err)
+	}
+}
@@ -0,0 +1,523 @@
+package diff
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// Normalizer maps the content of a file to a canonical byte stream before the digest is computed,
+// so that the files that only differ in nondeterministic bits (e.g., embedded timestamps) are treated as equal.
+type Normalizer struct {
+	// Name is the name for Options.Normalizers, e.g., "gzip".
+	Name string
+	// Patterns are the path globs (see [path.Match]) of the files.
+	// A pattern is matched against the trailing path components of a file,
+	// e.g., "*.pyc" matches "usr/lib/foo.pyc", and "META-INF/MANIFEST.MF" matches "app.jar!/META-INF/MANIFEST.MF".
+	Patterns []string
+	// Magics are the magic bytes at the head of the files.
+	// Magics longer than normalizerHeadSize never match.
+	Magics [][]byte
+	// Normalize writes the normalized content of r to w.
+	// Malformed contents should be written as they are, rather than returning errors.
+	Normalize func(w io.Writer, r io.Reader) error
+}
+
+// normalizerHeadSize is the size of the head of a file for matching Normalizer.Magics.
+const normalizerHeadSize = 64
+
+// match returns true if the file with the name and the head matches the normalizer.
+func (n *Normalizer) match(name string, head []byte) bool {
+	for _, pattern := range n.Patterns {
+		if matchPathGlob(pattern, name) {
+			return true
+		}
+	}
+	for _, magic := range n.Magics {
+		if bytes.HasPrefix(head, magic) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPathGlob returns true if the pattern matches the trailing path components of the name.
+func matchPathGlob(pattern, name string) bool {
+	n := strings.Count(pattern, "/") + 1
+	comps := strings.Split(name, "/")
+	if len(comps) < n {
+		return false
+	}
+	ok, _ := path.Match(pattern, strings.Join(comps[len(comps)-n:], "/"))
+	return ok
+}
+
+var (
+	normalizers   = make(map[string]*Normalizer)
+	normalizersMu sync.RWMutex
+)
+
+// RegisterNormalizer registers the normalizer.
+// Panics if the name is empty or already registered.
+func RegisterNormalizer(n *Normalizer) {
+	normalizersMu.Lock()
+	defer normalizersMu.Unlock()
+	if n.Name == "" || n.Normalize == nil {
+		panic("diff: invalid normalizer")
+	}
+	if _, ok := normalizers[n.Name]; ok {
+		panic(fmt.Sprintf("diff: normalizer %q is already registered", n.Name))
+	}
+	normalizers[n.Name] = n
+}
+
+// NormalizerNames returns the sorted names of the registered normalizers.
+func NormalizerNames() []string {
+	normalizersMu.RLock()
+	defer normalizersMu.RUnlock()
+	names := make([]string, 0, len(normalizers))
+	for name := range normalizers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookupNormalizers returns the registered normalizers with the names.
+func lookupNormalizers(names []string) ([]*Normalizer, error) {
+	res := make([]*Normalizer, 0, len(names))
+	for _, name := range names {
+		normalizersMu.RLock()
+		n, ok := normalizers[name]
+		normalizersMu.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown normalizer %q (available: %s)", name, strings.Join(NormalizerNames(), ","))
+		}
+		res = append(res, n)
+	}
+	return res, nil
+}
+
+// normalizeContent returns the reader of the normalized content of the regular file,
+// when one of the normalizers in Options.Normalizers matches the file.
+// The returned function must be called after reading the content, and returns the digest of the original content
+// and the name of the normalizer (or an empty digest and an empty string if the content is not normalized).
+func (d *differ) normalizeContent(hdr *tar.Header, r io.Reader) (io.Reader, func() (digest.Digest, string, error)) {
+	nop := func() (digest.Digest, string, error) { return "", "", nil }
+	if len(d.normalizers) == 0 || hdr.Typeflag != tar.TypeReg {
+		return r, nop
+	}
+	br := bufio.NewReaderSize(r, normalizerHeadSize)
+	head, _ := br.Peek(normalizerHeadSize) // may be shorter than normalizerHeadSize
+	var n *Normalizer
+	for _, f := range d.normalizers {
+		if f.match(hdr.Name, head) {
+			n = f
+			break
+		}
+	}
+	if n == nil {
+		return br, nop
+	}
+	digester := digest.Canonical.Digester()
+	tr := io.TeeReader(br, digester.Hash())
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		bw := bufio.NewWriter(pw)
+		err := n.Normalize(bw, tr)
+		if err == nil {
+			err = bw.Flush()
+		}
+		if err == nil {
+			// The original digest covers the bytes not consumed by the normalizer too
+			_, err = io.Copy(io.Discard, tr)
+		}
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	return pr, func() (digest.Digest, string, error) {
+		pr.Close()
+		if err := <-done; err != nil {
+			return "", "", fmt.Errorf("failed to normalize %q with the %q normalizer: %w", hdr.Name, n.Name, err)
+		}
+		return digester.Digest(), n.Name, nil
+	}
+}
+
+// digestNormalizedContent sets the digest of the content r of ent,
+// and the digest of the normalized content when one of the normalizers matches ent.
+// The (normalized) content is also returned if it looks like a text and its size does not exceed textLimit.
+func (d *differ) digestNormalizedContent(ent *TarEntry, r io.Reader, textLimit int64) (*string, error) {
+	nr, normalized := d.normalizeContent(ent.Header, r)
+	dgst, text, err := digestContent(nr, textLimit)
+	origDgst, normalizer, normalizeErr := normalized()
+	if err = errors.Join(err, normalizeErr); err != nil {
+		return nil, err
+	}
+	if normalizer == "" {
+		ent.Digest = dgst
+	} else {
+		ent.Digest, ent.NormalizedDigest, ent.Normalizer = origDgst, dgst, normalizer
+	}
+	return text, nil
+}
+
+// sameContent returns true if the contents of the entries are equal.
+// The normalized contents are compared, if both the entries are normalized by the same normalizer.
+func sameContent(ent0, ent1 *TarEntry) bool {
+	if ent0.Normalizer != "" && ent0.Normalizer == ent1.Normalizer {
+		return ent0.NormalizedDigest == ent1.NormalizedDigest
+	}
+	return ent0.Digest == ent1.Digest
+}
+
+func init() {
+	for _, n := range []*Normalizer{
+		{Name: "pyc", Patterns: []string{"*.pyc"}, Normalize: normalizePyc},
+		{Name: "gzip", Magics: [][]byte{gzipMagic}, Normalize: normalizeGzip},
+		{Name: "ar", Magics: [][]byte{arMagic}, Normalize: normalizeAr},
+		{Name: "zip", Magics: [][]byte{[]byte("PK\x03\x04"), []byte("PK\x05\x06")}, Normalize: normalizeZip},
+		{Name: "jar", Patterns: []string{"META-INF/MANIFEST.MF"}, Normalize: normalizeJarManifest},
+	} {
+		RegisterNormalizer(n)
+	}
+}
+
+// normalizePyc clears the source mtime in the header of a Python bytecode file.
+// The hash-based pyc files (PEP 552) are not modified.
+func normalizePyc(w io.Writer, r io.Reader) error {
+	head := make([]byte, 16)
+	n, err := io.ReadFull(r, head)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+	head = head[:n]
+	if n >= 8 && head[2] == '\r' && head[3] == '\n' {
+		switch magic := binary.LittleEndian.Uint16(head); {
+		case magic >= 3390 && magic < 20000:
+			// Python 3.7 and later: magic, flags, mtime, source size (or magic, flags, hash)
+			if n >= 12 && binary.LittleEndian.Uint32(head[4:8]) == 0 {
+				clear(head[8:12])
+			}
+		default:
+			// Python 2 and Python 3.6 and earlier: magic, mtime, (source size)
+			clear(head[4:8])
+		}
+	}
+	if _, err = w.Write(head); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// gzipMagic is the magic bytes of gzip members.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// normalizeGzip clears the mtimes (and the header checksums) in the headers of all the gzip members.
+// The compressed data are not modified.
+func normalizeGzip(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	for {
+		ok, err := normalizeGzipMember(w, br)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		if head, _ := br.Peek(len(gzipMagic)); !bytes.Equal(head, gzipMagic) {
+			break
+		}
+	}
+	// The rest of a malformed member, or the trailing garbage
+	_, err := io.Copy(w, br)
+	return err
+}
+
+// normalizeGzipMember normalizes a gzip member.
+// Returns false if the member is malformed; the consumed bytes have been written to w as they are.
+func normalizeGzipMember(w io.Writer, br *bufio.Reader) (bool, error) {
+	const (
+		flagHCRC    = 1 << 1
+		flagExtra   = 1 << 2
+		flagName    = 1 << 3
+		flagComment = 1 << 4
+	)
+	peeked, _ := br.Peek(10)
+	if len(peeked) < 10 || !bytes.HasPrefix(peeked, gzipMagic) || peeked[2] != 8 /* deflate */ {
+		return false, nil
+	}
+	hdr := bytes.Clone(peeked)
+	flags := hdr[3]
+	clear(hdr[4:8]) // MTIME
+	if _, err := br.Discard(len(hdr)); err != nil {
+		return false, err
+	}
+	if _, err := w.Write(hdr); err != nil {
+		return false, err
+	}
+	tr := &teeByteReader{r: br, w: w}
+	ok := true
+	if flags&flagExtra != 0 {
+		var xlen [2]byte
+		if _, err := io.ReadFull(tr, xlen[:]); err != nil {
+			ok = false
+		} else if _, err = io.CopyN(io.Discard, tr, int64(binary.LittleEndian.Uint16(xlen[:]))); err != nil {
+			ok = false
+		}
+	}
+	for _, f := range []byte{flagName, flagComment} {
+		if ok && flags&f != 0 {
+			// zero-terminated
+			if _, err := tr.readBytes(0); err != nil {
+				ok = false
+			}
+		}
+	}
+	if ok && flags&flagHCRC != 0 {
+		// The header checksum covers the MTIME, so it is cleared too
+		tr.w = io.Discard
+		var crc [2]byte
+		if _, err := io.ReadFull(tr, crc[:]); err != nil {
+			ok = false
+		} else if _, err = w.Write(make([]byte, len(crc))); err != nil {
+			return false, err
+		}
+		tr.w = w
+	}
+	if ok {
+		if _, err := io.Copy(io.Discard, flate.NewReader(tr)); err != nil {
+			ok = false
+		}
+	}
+	if ok {
+		// CRC32 and ISIZE
+		if _, err := io.CopyN(io.Discard, tr, 8); err != nil {
+			ok = false
+		}
+	}
+	return ok, tr.err
+}
+
+// teeByteReader writes the bytes read from r to w.
+// Unlike [io.TeeReader], teeByteReader implements [io.ByteReader], so that [flate.NewReader] does not read ahead.
+type teeByteReader struct {
+	r   *bufio.Reader
+	w   io.Writer
+	err error // the error other than io.EOF
+}
+
+func (t *teeByteReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	t.write(p[:n])
+	t.record(err)
+	return n, err
+}
+
+func (t *teeByteReader) ReadByte() (byte, error) {
+	c, err := t.r.ReadByte()
+	if err == nil {
+		t.write([]byte{c})
+	}
+	t.record(err)
+	return c, err
+}
+
+func (t *teeByteReader) readBytes(delim byte) ([]byte, error) {
+	b, err := t.r.ReadBytes(delim)
+	t.write(b)
+	t.record(err)
+	return b, err
+}
+
+func (t *teeByteReader) write(b []byte) {
+	if len(b) == 0 || t.err != nil {
+		return
+	}
+	if _, err := t.w.Write(b); err != nil {
+		t.err = err
+	}
+}
+
+func (t *teeByteReader) record(err error) {
+	if err != nil && !errors.Is(err, io.EOF) && t.err == nil {
+		t.err = err
+	}
+}
+
+// arMagic is the magic bytes of ar archives, including Debian packages and static libraries.
+var arMagic = []byte("!<arch>\n")
+
+// normalizeAr clears the mtimes in the headers of the members of an ar archive.
+func normalizeAr(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(len(arMagic)); bytes.Equal(magic, arMagic) {
+		if _, err := io.CopyN(w, br, int64(len(arMagic))); err != nil {
+			return err
+		}
+		for {
+			hdr, _ := br.Peek(60)
+			if len(hdr) < 60 || string(hdr[58:60]) != "`\n" {
+				break
+			}
+			size, err := strconv.ParseInt(strings.TrimSpace(string(hdr[48:58])), 10, 64)
+			if err != nil || size < 0 {
+				break
+			}
+			hdr = bytes.Clone(hdr)
+			copy(hdr[16:28], fmt.Sprintf("%-12d", 0))
+			if _, err = br.Discard(len(hdr)); err != nil {
+				return err
+			}
+			if _, err = w.Write(hdr); err != nil {
+				return err
+			}
+			// The data is padded to an even size
+			if _, err = io.CopyN(w, br, size+size%2); err != nil {
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				return err
+			}
+		}
+	}
+	// The rest of a malformed archive
+	_, err := io.Copy(w, br)
+	return err
+}
+
+// zipNormalizerMaxSize is the maximum size of the zip files to be normalized.
+// The zip files are read into memory, as the central directory is at the end of the files.
+const zipNormalizerMaxSize = 256 << 20
+
+// normalizeZip clears the modification times in the local file headers, in the central directory,
+// and in the timestamp extra fields.
+// The compressed data are not modified.
+func normalizeZip(w io.Writer, r io.Reader) error {
+	b, err := io.ReadAll(io.LimitReader(r, zipNormalizerMaxSize+1))
+	if err != nil {
+		return err
+	}
+	if len(b) <= zipNormalizerMaxSize {
+		normalizeZipBytes(b)
+	}
+	if _, err = w.Write(b); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// normalizeZipBytes normalizes the zip file b in place.
+// Zip64 archives and malformed archives are left as they are.
+func normalizeZipBytes(b []byte) {
+	const (
+		eocdLen        = 22
+		cdHeaderLen    = 46
+		localHeaderLen = 30
+	)
+	le := binary.LittleEndian
+	tail := max(0, len(b)-(eocdLen+0xFFFF))
+	i := bytes.LastIndex(b[tail:], []byte("PK\x05\x06"))
+	if i < 0 || tail+i+eocdLen > len(b) {
+		return
+	}
+	eocd := b[tail+i:]
+	count := int(le.Uint16(eocd[10:]))
+	p := int64(le.Uint32(eocd[16:])) // offset of the central directory
+	for k := 0; k < count; k++ {
+		if p+cdHeaderLen > int64(len(b)) || !bytes.HasPrefix(b[p:], []byte("PK\x01\x02")) {
+			return
+		}
+		cd := b[p:]
+		clear(cd[12:16]) // last mod file time, last mod file date
+		nameLen, extraLen, commentLen := int64(le.Uint16(cd[28:])), int64(le.Uint16(cd[30:])), int64(le.Uint16(cd[32:]))
+		if next := p + cdHeaderLen + nameLen + extraLen; next <= int64(len(b)) {
+			normalizeZipExtra(b[p+cdHeaderLen+nameLen : next])
+		}
+		if off := int64(le.Uint32(cd[42:])); off+localHeaderLen <= int64(len(b)) && bytes.HasPrefix(b[off:], []byte("PK\x03\x04")) {
+			local := b[off:]
+			clear(local[10:14]) // last mod file time, last mod file date
+			lNameLen, lExtraLen := int64(le.Uint16(local[26:])), int64(le.Uint16(local[28:]))
+			if next := off + localHeaderLen + lNameLen + lExtraLen; next <= int64(len(b)) {
+				normalizeZipExtra(b[off+localHeaderLen+lNameLen : next])
+			}
+		}
+		p += cdHeaderLen + nameLen + extraLen + commentLen
+	}
+}
+
+// normalizeZipExtra clears the timestamps in the extra fields in place.
+func normalizeZipExtra(extra []byte) {
+	le := binary.LittleEndian
+	for len(extra) >= 4 {
+		tag, size := le.Uint16(extra), int(le.Uint16(extra[2:]))
+		if 4+size > len(extra) {
+			return
+		}
+		data := extra[4 : 4+size]
+		switch tag {
+		case 0x5455: // extended timestamp: flags, mtime, atime, ctime
+			if len(data) > 1 {
+				clear(data[1:])
+			}
+		case 0x000d, 0x5855: // PKWARE Unix, Info-ZIP Unix (type 1): atime, mtime, ...
+			clear(data[:min(8, len(data))])
+		case 0x000a: // NTFS: reserved, attributes (mtime, atime, ctime)
+			if len(data) > 4 {
+				clear(data[4:])
+			}
+		}
+		extra = extra[4+size:]
+	}
+}
+
+// jarManifestTimestampAttrs are the (lower-cased) names of the main attributes of jar manifests
+// that contain the build timestamps.
+var jarManifestTimestampAttrs = map[string]struct{}{
+	"bnd-lastmodified":          {},
+	"build-date":                {},
+	"build-time":                {},
+	"build-timestamp":           {},
+	"implementation-build-date": {},
+}
+
+// normalizeJarManifest removes the attributes of the build timestamps from a jar manifest.
+func normalizeJarManifest(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	skip := false
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if !strings.HasPrefix(line, " ") {
+			// Not a continuation line
+			name, _, ok := strings.Cut(line, ":")
+			_, skip = jarManifestTimestampAttrs[strings.ToLower(name)]
+			skip = skip && ok
+		}
+		if !skip {
+			if _, err := io.WriteString(w, line); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			return nil
+		}
+	}
+}
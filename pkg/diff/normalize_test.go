@@ -0,0 +1,613 @@
+package diff
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestMatchPathGlob(t *testing.T) {
+	testCases := []struct {
+		pattern  string
+		name     string
+		expected bool
+	}{
+		{"*.pyc", "foo.pyc", true},
+		{"*.pyc", "usr/lib/python3/__pycache__/foo.cpython-312.pyc", true},
+		{"*.pyc", "usr/lib/foo.py", false},
+		{"META-INF/MANIFEST.MF", "META-INF/MANIFEST.MF", true},
+		{"META-INF/MANIFEST.MF", "app.jar!/META-INF/MANIFEST.MF", true},
+		{"META-INF/MANIFEST.MF", "MANIFEST.MF", false},
+		{"META-INF/MANIFEST.MF", "app/OTHER-INF/MANIFEST.MF", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.pattern+" "+tc.name, func(t *testing.T) {
+			if got := matchPathGlob(tc.pattern, tc.name); got != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestLookupNormalizers(t *testing.T) {
+	testCases := []struct {
+		names    []string
+		expected []string
+		err      bool
+	}{
+		{names: nil, expected: nil},
+		{names: []string{"pyc", "gzip"}, expected: []string{"pyc", "gzip"}},
+		{names: []string{"pyc", "unknown"}, err: true},
+	}
+	for _, tc := range testCases {
+		t.Run(strings.Join(tc.names, ","), func(t *testing.T) {
+			res, err := lookupNormalizers(tc.names)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, n := range res {
+				got = append(got, n.Name)
+			}
+			if strings.Join(got, ",") != strings.Join(tc.expected, ",") {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+// normalizeString normalizes s with the registered normalizer.
+func normalizeString(t *testing.T, name string, s []byte) []byte {
+	t.Helper()
+	ns, err := lookupNormalizers([]string{name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = ns[0].Normalize(&buf, bytes.NewReader(s)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestNormalizePyc(t *testing.T) {
+	body := "\xe3\x00\x00\x00code"
+	testCases := []struct {
+		name     string
+		pyc      string
+		expected string
+	}{
+		{
+			// Python 3.12: magic, flags, mtime, source size
+			name:     "timestamp-based",
+			pyc:      "\xcb\x0d\r\n\x00\x00\x00\x00\x01\x02\x03\x04\x10\x00\x00\x00" + body,
+			expected: "\xcb\x0d\r\n\x00\x00\x00\x00\x00\x00\x00\x00\x10\x00\x00\x00" + body,
+		},
+		{
+			name:     "hash-based",
+			pyc:      "\xcb\x0d\r\n\x01\x00\x00\x00\x01\x02\x03\x04\x05\x06\x07\x08" + body,
+			expected: "\xcb\x0d\r\n\x01\x00\x00\x00\x01\x02\x03\x04\x05\x06\x07\x08" + body,
+		},
+		{
+			// Python 3.6: magic, mtime, source size
+			name:     "python 3.6",
+			pyc:      "\x33\x0d\r\n\x01\x02\x03\x04\x10\x00\x00\x00" + body,
+			expected: "\x33\x0d\r\n\x00\x00\x00\x00\x10\x00\x00\x00" + body,
+		},
+		{
+			// Python 2.7: magic, mtime
+			name:     "python 2.7",
+			pyc:      "\x03\xf3\r\n\x01\x02\x03\x04" + body,
+			expected: "\x03\xf3\r\n\x00\x00\x00\x00" + body,
+		},
+		{
+			name:     "not a pyc",
+			pyc:      "print('hello')\n",
+			expected: "print('hello')\n",
+		},
+		{
+			name:     "short",
+			pyc:      "\xcb\x0d\r",
+			expected: "\xcb\x0d\r",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := normalizeString(t, "pyc", []byte(tc.pyc)); string(got) != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+// testGzipMember is a gzip member for testing normalizeGzip.
+type testGzipMember struct {
+	mtime   uint32
+	extra   string // FEXTRA
+	name    string // FNAME
+	comment string // FCOMMENT
+	hcrc    bool   // FHCRC
+	body    string
+}
+
+func (m testGzipMember) bytes(t *testing.T) []byte {
+	t.Helper()
+	var flags byte
+	if m.hcrc {
+		flags |= 1 << 1
+	}
+	if m.extra != "" {
+		flags |= 1 << 2
+	}
+	if m.name != "" {
+		flags |= 1 << 3
+	}
+	if m.comment != "" {
+		flags |= 1 << 4
+	}
+	b := []byte{0x1f, 0x8b, 8, flags}
+	b = binary.LittleEndian.AppendUint32(b, m.mtime)
+	b = append(b, 0, 255)
+	if m.extra != "" {
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(m.extra)))
+		b = append(b, m.extra...)
+	}
+	for _, s := range []string{m.name, m.comment} {
+		if s != "" {
+			b = append(append(b, s...), 0)
+		}
+	}
+	if m.hcrc {
+		// The value is not verified by normalizeGzip
+		b = binary.LittleEndian.AppendUint16(b, uint16(m.mtime))
+	}
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.WriteString(fw, m.body); err != nil {
+		t.Fatal(err)
+	}
+	if err = fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b = append(b, buf.Bytes()...)
+	// CRC32 (not verified) and ISIZE
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	return binary.LittleEndian.AppendUint32(b, uint32(len(m.body)))
+}
+
+func TestNormalizeGzip(t *testing.T) {
+	concat := func(bs ...[]byte) []byte { return bytes.Join(bs, nil) }
+	foo := testGzipMember{mtime: 1, body: "foo\n"}
+	testCases := []struct {
+		name     string
+		gz       [2][]byte
+		expected bool // whether the normalized contents are equal
+	}{
+		{
+			name:     "mtime",
+			gz:       [2][]byte{foo.bytes(t), testGzipMember{mtime: 2, body: "foo\n"}.bytes(t)},
+			expected: true,
+		},
+		{
+			name: "optional fields",
+			gz: [2][]byte{
+				testGzipMember{mtime: 1, extra: "ex", name: "foo", comment: "c", hcrc: true, body: "foo\n"}.bytes(t),
+				testGzipMember{mtime: 2, extra: "ex", name: "foo", comment: "c", hcrc: true, body: "foo\n"}.bytes(t),
+			},
+			expected: true,
+		},
+		{
+			name: "multiple members",
+			gz: [2][]byte{
+				concat(foo.bytes(t), testGzipMember{mtime: 1, body: "bar\n"}.bytes(t)),
+				concat(testGzipMember{mtime: 2, body: "foo\n"}.bytes(t), testGzipMember{mtime: 3, body: "bar\n"}.bytes(t)),
+			},
+			expected: true,
+		},
+		{
+			name:     "body",
+			gz:       [2][]byte{foo.bytes(t), testGzipMember{mtime: 2, body: "bar\n"}.bytes(t)},
+			expected: false,
+		},
+		{
+			name:     "name",
+			gz:       [2][]byte{testGzipMember{mtime: 1, name: "foo", body: "foo\n"}.bytes(t), testGzipMember{mtime: 2, name: "bar", body: "foo\n"}.bytes(t)},
+			expected: false,
+		},
+		{
+			name:     "trailing garbage",
+			gz:       [2][]byte{concat(foo.bytes(t), []byte("x")), concat(testGzipMember{mtime: 2, body: "foo\n"}.bytes(t), []byte("x"))},
+			expected: true,
+		},
+		{
+			name: "compress/gzip",
+			gz: [2][]byte{
+				testGzip(t, []byte("foo\n")),
+				func() []byte {
+					var buf bytes.Buffer
+					gw := gzip.NewWriter(&buf)
+					gw.ModTime = testArchiveModTime.Add(time.Hour)
+					if _, err := io.WriteString(gw, "foo\n"); err != nil {
+						t.Fatal(err)
+					}
+					if err := gw.Close(); err != nil {
+						t.Fatal(err)
+					}
+					return buf.Bytes()
+				}(),
+			},
+			expected: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var got [2][]byte
+			for i, gz := range tc.gz {
+				got[i] = normalizeString(t, "gzip", gz)
+				if len(got[i]) != len(gz) {
+					t.Errorf("expected the size %d, got %d", len(gz), len(got[i]))
+				}
+			}
+			if equal := bytes.Equal(got[0], got[1]); equal != tc.expected {
+				t.Errorf("expected equal=%v, got %q and %q", tc.expected, got[0], got[1])
+			}
+		})
+	}
+}
+
+func TestNormalizeGzipMalformed(t *testing.T) {
+	foo := testGzipMember{mtime: 1, name: "foo", body: "foo\n"}.bytes(t)
+	testCases := []struct {
+		name string
+		gz   []byte
+	}{
+		{"not a gzip", []byte("foo\n")},
+		{"short header", foo[:8]},
+		{"unterminated name", foo[:12]},
+		{"truncated body", foo[:len(foo)-10]},
+		{"not deflate", append([]byte{0x1f, 0x8b, 7}, foo[3:]...)},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := normalizeString(t, "gzip", tc.gz)
+			// The malformed contents are written as they are, except the mtime of the valid header
+			expected := bytes.Clone(tc.gz)
+			if len(expected) >= 10 && expected[2] == 8 {
+				clear(expected[4:8])
+			}
+			if !bytes.Equal(got, expected) {
+				t.Errorf("expected %q, got %q", expected, got)
+			}
+		})
+	}
+}
+
+// testArMember is a member of an ar archive.
+type testArMember struct {
+	name  string
+	mtime int64
+	body  string
+}
+
+func testAr(members ...testArMember) []byte {
+	b := []byte("!<arch>\n")
+	for _, m := range members {
+		b = fmt.Appendf(b, "%-16s%-12d%-6d%-6d%-8o%-10d`\n", m.name, m.mtime, 0, 0, 0o644, len(m.body))
+		b = append(b, m.body...)
+		if len(m.body)%2 == 1 {
+			b = append(b, '\n')
+		}
+	}
+	return b
+}
+
+func TestNormalizeAr(t *testing.T) {
+	testCases := []struct {
+		name     string
+		ar       string
+		expected string
+	}{
+		{
+			name:     "members",
+			ar:       string(testAr(testArMember{"debian-binary", 1700000000, "2.0\n"}, testArMember{"control.tar.gz", 1700000001, "odd"})),
+			expected: string(testAr(testArMember{"debian-binary", 0, "2.0\n"}, testArMember{"control.tar.gz", 0, "odd"})),
+		},
+		{
+			name:     "empty",
+			ar:       "!<arch>\n",
+			expected: "!<arch>\n",
+		},
+		{
+			// The rest of the malformed archive is written as it is
+			name:     "malformed header",
+			ar:       string(testAr(testArMember{"foo", 1700000000, "foo\n"})) + "garbage",
+			expected: string(testAr(testArMember{"foo", 0, "foo\n"})) + "garbage",
+		},
+		{
+			name:     "truncated",
+			ar:       string(testAr(testArMember{"foo", 1700000000, "foo\n"}))[:70],
+			expected: string(testAr(testArMember{"foo", 0, "foo\n"}))[:70],
+		},
+		{
+			name:     "not an ar",
+			ar:       "foo\n",
+			expected: "foo\n",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := normalizeString(t, "ar", []byte(tc.ar)); string(got) != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestNormalizeZipBytes(t *testing.T) {
+	later := testArchiveModTime.Add(24 * time.Hour)
+	testCases := []struct {
+		name     string
+		zips     [2][]byte
+		expected bool // whether the normalized contents are equal
+	}{
+		{
+			// archive/zip writes the extended timestamp extra fields too
+			name: "modification times",
+			zips: [2][]byte{
+				testZip(t, testArchiveFile{name: "dir/"}, testArchiveFile{name: "dir/foo", body: "foo"}),
+				testZip(t, testArchiveFile{name: "dir/", modTime: later}, testArchiveFile{name: "dir/foo", body: "foo", modTime: later}),
+			},
+			expected: true,
+		},
+		{
+			name:     "empty",
+			zips:     [2][]byte{testZip(t), testZip(t)},
+			expected: true,
+		},
+		{
+			name: "body",
+			zips: [2][]byte{
+				testZip(t, testArchiveFile{name: "foo", body: "foo"}),
+				testZip(t, testArchiveFile{name: "foo", body: "bar", modTime: later}),
+			},
+			expected: false,
+		},
+		{
+			name: "name",
+			zips: [2][]byte{
+				testZip(t, testArchiveFile{name: "foo", body: "foo"}),
+				testZip(t, testArchiveFile{name: "bar", body: "foo", modTime: later}),
+			},
+			expected: false,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var got [2][]byte
+			for i, z := range tc.zips {
+				got[i] = bytes.Clone(z)
+				normalizeZipBytes(got[i])
+				if !bytes.Equal(normalizeString(t, "zip", z), got[i]) {
+					t.Error("the zip normalizer differs from normalizeZipBytes")
+				}
+			}
+			if equal := bytes.Equal(got[0], got[1]); equal != tc.expected {
+				t.Errorf("expected equal=%v, got %q and %q", tc.expected, got[0], got[1])
+			}
+		})
+	}
+}
+
+func TestNormalizeZipBytesMalformed(t *testing.T) {
+	z := testZip(t, testArchiveFile{name: "foo", body: "foo"}, testArchiveFile{name: "bar", body: "bar"})
+	eocd := bytes.LastIndex(z, []byte("PK\x05\x06"))
+	cd := int(binary.LittleEndian.Uint32(z[eocd+16:]))
+	testCases := []struct {
+		name string
+		zip  []byte
+	}{
+		{"not a zip", []byte("foo\n")},
+		{"truncated end of central directory", z[:len(z)-4]},
+		{"truncated central directory", append(bytes.Clone(z[:cd]), z[eocd:]...)},
+		{"central directory offset out of range", func() []byte {
+			b := bytes.Clone(z)
+			binary.LittleEndian.PutUint32(b[eocd+16:], uint32(len(b)))
+			return b
+		}()},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// The malformed archives are left as they are
+			got := bytes.Clone(tc.zip)
+			normalizeZipBytes(got)
+			if !bytes.Equal(got, tc.zip) {
+				t.Errorf("expected %q, got %q", tc.zip, got)
+			}
+		})
+	}
+}
+
+func TestNormalizeZipExtra(t *testing.T) {
+	field := func(tag uint16, data string) string {
+		b := binary.LittleEndian.AppendUint16(nil, tag)
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(data)))
+		return string(append(b, data...))
+	}
+	testCases := []struct {
+		name     string
+		extra    string
+		expected string
+	}{
+		{"extended timestamp", field(0x5455, "\x03mtimatim"), field(0x5455, "\x03\x00\x00\x00\x00\x00\x00\x00\x00")},
+		{"info-zip unix", field(0x5855, "atimmtimuigi"), field(0x5855, "\x00\x00\x00\x00\x00\x00\x00\x00uigi")},
+		{"ntfs", field(0x000a, "rsvd\x01\x00\x18\x00mtime...atime...ctime..."), field(0x000a, "rsvd"+strings.Repeat("\x00", 28))},
+		{"other", field(0xcafe, "data"), field(0xcafe, "data")},
+		{"multiple", field(0xcafe, "data") + field(0x5455, "\x01mtim"), field(0xcafe, "data") + field(0x5455, "\x01\x00\x00\x00\x00")},
+		{"truncated", field(0x5455, "\x01mtim")[:6], field(0x5455, "\x01mtim")[:6]},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := []byte(tc.extra)
+			normalizeZipExtra(got)
+			if string(got) != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestNormalizeJarManifest(t *testing.T) {
+	testCases := []struct {
+		name     string
+		manifest string
+		expected string
+	}{
+		{
+			name:     "timestamps",
+			manifest: "Manifest-Version: 1.0\r\nBuild-Time: 2026-01-01T00:00:00Z\r\nCreated-By: Maven\r\nBnd-LastModified: 1700000000000\r\n\r\n",
+			expected: "Manifest-Version: 1.0\r\nCreated-By: Maven\r\n\r\n",
+		},
+		{
+			name:     "continuation line",
+			manifest: "Manifest-Version: 1.0\nBuild-Date: 2026-01-01\n T00:00:00Z\nMain-Class: Foo\n",
+			expected: "Manifest-Version: 1.0\nMain-Class: Foo\n",
+		},
+		{
+			name:     "case-insensitive",
+			manifest: "BUILD-TIMESTAMP: 1\nmain-class: Foo\n",
+			expected: "main-class: Foo\n",
+		},
+		{
+			name:     "no trailing newline",
+			manifest: "Manifest-Version: 1.0\nBuild-Time: 1",
+			expected: "Manifest-Version: 1.0\n",
+		},
+		{
+			name:     "not an attribute",
+			manifest: "Build-Time\n",
+			expected: "Build-Time\n",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := normalizeString(t, "jar", []byte(tc.manifest)); string(got) != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestDigestNormalizedContent(t *testing.T) {
+	pyc := "\xcb\x0d\r\n\x00\x00\x00\x00\x01\x02\x03\x04\x10\x00\x00\x00"
+	normalizedPyc := "\xcb\x0d\r\n\x00\x00\x00\x00\x00\x00\x00\x00\x10\x00\x00\x00"
+	gz := testGzip(t, []byte("foo\n"))
+	normalizedGz := bytes.Clone(gz)
+	clear(normalizedGz[4:8])
+	testCases := []struct {
+		name             string
+		normalizers      []string
+		entry            string
+		typeflag         byte
+		content          string
+		normalizedDigest digest.Digest
+		normalizer       string
+	}{
+		{"disabled", nil, "foo.pyc", tar.TypeReg, pyc, "", ""},
+		{"path glob", []string{"pyc"}, "foo.pyc", tar.TypeReg, pyc, digest.FromString(normalizedPyc), "pyc"},
+		{"path glob mismatch", []string{"pyc"}, "foo.py", tar.TypeReg, pyc, "", ""},
+		{"magic", []string{"pyc", "gzip"}, "foo", tar.TypeReg, string(gz), digest.FromBytes(normalizedGz), "gzip"},
+		{"magic mismatch", []string{"gzip"}, "foo", tar.TypeReg, pyc, "", ""},
+		{"not a regular file", []string{"pyc"}, "foo.pyc", tar.TypeSymlink, "", "", ""},
+		{"empty", []string{"pyc"}, "foo.pyc", tar.TypeReg, "", digest.FromString(""), "pyc"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ns, err := lookupNormalizers(tc.normalizers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d := &differ{normalizers: ns}
+			ent := &TarEntry{Header: &tar.Header{Name: tc.entry, Typeflag: tc.typeflag, Size: int64(len(tc.content))}}
+			if _, err = d.digestNormalizedContent(ent, strings.NewReader(tc.content), 0); err != nil {
+				t.Fatal(err)
+			}
+			// Digest is always the digest of the original content
+			if expected := digest.FromString(tc.content); ent.Digest != expected {
+				t.Errorf("expected the digest %s, got %s", expected, ent.Digest)
+			}
+			if ent.NormalizedDigest != tc.normalizedDigest {
+				t.Errorf("expected the normalized digest %q, got %q", tc.normalizedDigest, ent.NormalizedDigest)
+			}
+			if ent.Normalizer != tc.normalizer {
+				t.Errorf("expected the normalizer %q, got %q", tc.normalizer, ent.Normalizer)
+			}
+		})
+	}
+}
+
+func TestDigestNormalizedContentError(t *testing.T) {
+	d := &differ{normalizers: []*Normalizer{{
+		Name:     "failing",
+		Patterns: []string{"*.fail"},
+		Normalize: func(io.Writer, io.Reader) error {
+			return io.ErrUnexpectedEOF
+		},
+	}}}
+	ent := &TarEntry{Header: &tar.Header{Name: "foo.fail", Typeflag: tar.TypeReg}}
+	if _, err := d.digestNormalizedContent(ent, strings.NewReader("foo"), 0); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestSameContent(t *testing.T) {
+	a, b := digest.FromString("a"), digest.FromString("b")
+	testCases := []struct {
+		name     string
+		ents     [2]TarEntry
+		expected bool
+	}{
+		{"same digests", [2]TarEntry{{Digest: a}, {Digest: a}}, true},
+		{"different digests", [2]TarEntry{{Digest: a}, {Digest: b}}, false},
+		{"same normalized digests", [2]TarEntry{
+			{Digest: a, NormalizedDigest: a, Normalizer: "gzip"},
+			{Digest: b, NormalizedDigest: a, Normalizer: "gzip"},
+		}, true},
+		{"different normalized digests", [2]TarEntry{
+			{Digest: a, NormalizedDigest: a, Normalizer: "gzip"},
+			{Digest: a, NormalizedDigest: b, Normalizer: "gzip"},
+		}, false},
+		{"different normalizers", [2]TarEntry{
+			{Digest: a, NormalizedDigest: a, Normalizer: "gzip"},
+			{Digest: b, NormalizedDigest: a, Normalizer: "zip"},
+		}, false},
+		{"normalized only in input 0", [2]TarEntry{
+			{Digest: a, NormalizedDigest: b, Normalizer: "gzip"},
+			{Digest: a},
+		}, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := sameContent(&tc.ents[0], &tc.ents[1]); got != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package diff
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// goOrRun runs f in a new goroutine if the concurrency limit allows, otherwise runs f in the current goroutine.
+// Running f in the current goroutine never blocks, even when the nested tasks are waiting for the tokens.
+func (d *differ) goOrRun(wg *sync.WaitGroup, f func()) {
+	select {
+	case d.sem <- struct{}{}:
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-d.sem
+				wg.Done()
+			}()
+			f()
+		}()
+	default:
+		f()
+	}
+}
+
+// childTask is a child comparison that may run concurrently with its siblings.
+type childTask struct {
+	node   *EventTreeNode
+	err    error
+	events *bufferedEventHandler // nil for no concurrency
+}
+
+// forTask returns the differ for the task.
+// When concurrency is enabled, the events are buffered, so that they can be replayed
+// in a deterministic order.
+func (d *differ) forTask(t *childTask) *differ {
+	if d.sem == nil {
+		return d
+	}
+	t.events = &bufferedEventHandler{}
+	dd := *d
+	dd.o.EventHandler = t.events
+	return &dd
+}
+
+// replay passes the buffered events to h, and returns the error of the task.
+func (t *childTask) replay(ctx context.Context, h EventHandler) error {
+	errs := []error{t.err}
+	if t.events != nil {
+		for _, node := range t.events.nodes {
+			if err := h.HandleEventTreeNode(ctx, node); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// finishTask passes the buffered events of the task to the handler, and appends the task node to node
+// if the task raised any event.
+// Without concurrency, finishTask has to be called right after running the task,
+// so that the task node is passed to the handler after its children, before the events of the next task.
+func (d *differ) finishTask(ctx context.Context, node *EventTreeNode, t *childTask) error {
+	errs := []error{t.replay(ctx, d.o.EventHandler)}
+	if len(t.node.Children) > 0 {
+		errs = append(errs, d.raiseEventWithEventTreeNode(ctx, node, t.node))
+	} // else no event happens
+	return errors.Join(errs...)
+}
+
+// bufferedEventHandler records the events.
+type bufferedEventHandler struct {
+	nodes []*EventTreeNode
+	mu    sync.Mutex
+}
+
+func (h *bufferedEventHandler) HandleEventTreeNode(_ context.Context, node *EventTreeNode) error {
+	h.mu.Lock()
+	h.nodes = append(h.nodes, node)
+	h.mu.Unlock()
+	return nil
+}
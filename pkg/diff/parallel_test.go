@@ -0,0 +1,63 @@
+package diff_test
+
+import (
+	"archive/tar"
+	"fmt"
+	"testing"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/reproducible-containers/diffoci/internal/testutil"
+	"github.com/reproducible-containers/diffoci/pkg/diff"
+)
+
+// TestDiffConcurrency tests that the events are raised in the same order regardless of the concurrency.
+// runDiff also checks that the handler receives the events in the order of the event tree.
+func TestDiffConcurrency(t *testing.T) {
+	s := newTestImageStore(t)
+	var descs [2]ocispec.Descriptor
+	for i := range descs {
+		var manifests []ocispec.Descriptor
+		for _, arch := range []string{"amd64", "arm64", "riscv64"} {
+			var layers [][]byte
+			for j := range 4 {
+				files := []testutil.File{
+					{Name: fmt.Sprintf("layer%d/", j), Typeflag: tar.TypeDir, Mode: 0o755},
+					{Name: fmt.Sprintf("layer%d/arch", j), Body: arch},
+				}
+				if j%2 == 1 {
+					// The odd layers differ
+					files = append(files, testutil.File{Name: fmt.Sprintf("layer%d/input", j), Body: fmt.Sprint(i)})
+				}
+				layers = append(layers, testutil.Layer(t, files...))
+			}
+			mani := s.image(nil, layers...)
+			mani.Platform = &ocispec.Platform{OS: "linux", Architecture: arch}
+			manifests = append(manifests, mani)
+		}
+		descs[i] = s.index(manifests...)
+	}
+
+	expected := s.runDiff(descs, diff.Options{})
+	if got := len(entryEvents(expected)); got != 6 {
+		t.Fatalf("expected 6 tar entry events, got %d: %v", got, expected)
+	}
+	testCases := []struct {
+		concurrency int
+		runs        int
+	}{
+		{1, 1},
+		{2, 10},
+		{4, 10},
+		{64, 10},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("concurrency=%d", tc.concurrency), func(t *testing.T) {
+			for range tc.runs {
+				got := s.runDiff(descs, diff.Options{Concurrency: tc.concurrency})
+				if !equalEvents(got, expected) {
+					t.Fatalf("expected %v, got %v", expected, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,501 @@
+package diff
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/log"
+	"github.com/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// DiffRootFS compares the flattened layers of an image (input 0) with a root filesystem directory (input 1).
+//
+// The layers are flattened with the OCI whiteout rules, and the last layer wins.
+// As a directory cannot retain some of the tar attributes, the following attributes are not compared:
+// the order of the entries, the tar format, the user and group names, atime, ctime, and the PAX records
+// except xattrs.
+// Hard links are compared as regular files.
+func DiffRootFS(ctx context.Context, cs content.Provider, desc ocispec.Descriptor, dir string,
+	platMC platforms.MatchComparer, opts *Options) (*EventTreeNode, error) {
+	if err := checkAvailable(ctx, cs, 0, desc, platMC); err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%q is not a directory", dir)
+	}
+	return run(ctx, cs, platMC, opts, func(ctx context.Context, d *differ, node *EventTreeNode) error {
+		return d.diffRootFS(ctx, node, desc, dir)
+	})
+}
+
+func (d *differ) diffRootFS(ctx context.Context, node *EventTreeNode, desc ocispec.Descriptor, dir string) error {
+	mani, err := images.Manifest(ctx, d.cs, desc, d.platMC)
+	if err != nil {
+		return fmt.Errorf("failed to read manifest (%v): %w", desc, err)
+	}
+	if len(mani.Layers) > int(maxLayers*d.o.MaxScale) {
+		return fmt.Errorf("too many layers (> %d)", int(maxLayers*d.o.MaxScale))
+	}
+	in := [2]EventInput{
+		{
+			Descriptor: &desc,
+			Manifest:   &mani,
+		}, {
+			Dir: dir,
+		},
+	}
+	l0, err := d.loadFlattenedLayers(ctx, node, 0, mani.Layers)
+	if err != nil {
+		return fmt.Errorf("failed to load layers (input-0): %w", err)
+	}
+	l1, err := d.loadDir(ctx, dir)
+	if err != nil {
+		return fmt.Errorf("failed to load directory (input-1): %w", err)
+	}
+	for _, l := range []*loadLayerResult{l0, l1} {
+		resolveHardLinks(l)
+		for _, ents := range l.entriesByName {
+			for _, ent := range ents {
+				normalizeRootFSEntry(ent)
+			}
+		}
+	}
+	return d.diffLoadedLayers(ctx, node, in, l0, l1)
+}
+
+// diffFlattenedLayers compares the root filesystems flattened from the layers of the manifests.
+// The events are raised under "flattened" of node.
+func (d *differ) diffFlattenedLayers(ctx context.Context, node *EventTreeNode, in [2]EventInput) error {
+	for i := 0; i < 2; i++ {
+		if len(in[i].Manifest.Layers) > int(maxLayers*d.o.MaxScale) {
+			return fmt.Errorf("too many layers (> %d) (input-%d)", int(maxLayers*d.o.MaxScale), i)
+		}
+	}
+	newNode := &EventTreeNode{
+		Context: path.Join(node.Context, "flattened"),
+		Event: Event{
+			Type:   EventTypeManifestBlobMismatch,
+			Inputs: in,
+			Note:   `field "Layers" (flattened)`,
+		},
+	}
+	var (
+		l     [2]*loadLayerResult
+		l1Err error
+		wg    sync.WaitGroup
+	)
+	d.goOrRun(&wg, func() {
+		l[1], l1Err = d.loadFlattenedLayers(ctx, newNode, 1, in[1].Manifest.Layers)
+	})
+	var err error
+	l[0], err = d.loadFlattenedLayers(ctx, newNode, 0, in[0].Manifest.Layers)
+	wg.Wait()
+	if err != nil {
+		return fmt.Errorf("failed to load layers (input-0): %w", err)
+	}
+	if l1Err != nil {
+		return fmt.Errorf("failed to load layers (input-1): %w", l1Err)
+	}
+	for _, ll := range l {
+		for _, ents := range ll.entriesByName {
+			for _, ent := range ents {
+				// The order of the entries is not meaningful across the layers
+				ent.Index = -1
+			}
+		}
+	}
+	errs := []error{d.diffLoadedLayers(ctx, newNode, in, l[0], l[1])}
+	if len(newNode.Children) > 0 {
+		errs = append(errs, d.raiseEventWithEventTreeNode(ctx, node, newNode))
+	} // else no event happens
+	return errors.Join(errs...)
+}
+
+func (d *differ) loadLayerWithDescriptor(ctx context.Context, node *EventTreeNode, inputIdx int, desc ocispec.Descriptor) (*loadLayerResult, error) {
+	tr, trCloser, err := d.openLayerTarReader(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if trCloserErr := trCloser(); trCloserErr != nil {
+			log.G(ctx).WithError(trCloserErr).Warnf("failed to close tar reader %d", inputIdx)
+		}
+	}()
+	return d.loadLayer(ctx, node, inputIdx, tr)
+}
+
+// OCI whiteouts.
+// https://github.com/opencontainers/image-spec/blob/v1.1.0/layer.md#whiteouts
+const (
+	whiteoutPrefix    = ".wh."
+	whiteoutOpaqueDir = ".wh..wh..opq"
+)
+
+// whiteoutTarget returns EventTypeDeletedPathMismatch and the deleted path for a whiteout,
+// EventTypeOpaqueDirectoryMismatch and the directory for an opaque whiteout,
+// or EventTypeNone for other names.
+// The root directory is returned as ".".
+func whiteoutTarget(name string) (EventType, string) {
+	name = cleanTarPath(name)
+	parent, base := path.Split(name)
+	parent = path.Clean("./" + parent)
+	switch {
+	case base == whiteoutOpaqueDir:
+		return EventTypeOpaqueDirectoryMismatch, parent
+	case strings.HasPrefix(base, whiteoutPrefix):
+		return EventTypeDeletedPathMismatch, path.Join(parent, strings.TrimPrefix(base, whiteoutPrefix))
+	default:
+		return EventTypeNone, ""
+	}
+}
+
+// loadFlattenedLayers loads the layers, and flattens them with the OCI whiteout rules.
+// The result contains a single entry per name.
+func (d *differ) loadFlattenedLayers(ctx context.Context, node *EventTreeNode, inputIdx int, descs []ocispec.Descriptor) (*loadLayerResult, error) {
+	return d.loadAppliedLayers(ctx, node, inputIdx, descs, false)
+}
+
+// loadMergedLayers loads the layers, and merges them into a single layer.
+// Unlike loadFlattenedLayers, the whiteouts are retained, as they may apply to the lower layers.
+func (d *differ) loadMergedLayers(ctx context.Context, node *EventTreeNode, inputIdx int, descs []ocispec.Descriptor) (*loadLayerResult, error) {
+	return d.loadAppliedLayers(ctx, node, inputIdx, descs, true)
+}
+
+func (d *differ) loadAppliedLayers(ctx context.Context, node *EventTreeNode, inputIdx int, descs []ocispec.Descriptor, keepWhiteouts bool) (*loadLayerResult, error) {
+	flat := newFlatTree()
+	res := &loadLayerResult{
+		entriesByName: flat.entriesByName,
+	}
+	for i, desc := range descs {
+		l, err := d.loadLayerWithDescriptor(ctx, node, inputIdx, desc)
+		if l != nil {
+			res.finalizers = append(res.finalizers, l.finalizers...)
+		}
+		if err != nil {
+			return res, fmt.Errorf("layer %d: %w", i, err)
+		}
+		applyLayer(flat, l, keepWhiteouts)
+	}
+	res.entries = len(res.entriesByName)
+	return res, nil
+}
+
+// cleanTarPath returns "foo/bar" for "foo/bar", "./foo/bar", "/foo/bar", and "foo/bar/".
+// Returns an empty string for the root.
+func cleanTarPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// flatTree is a flattened root filesystem, with the children of each directory indexed,
+// so that a whiteout does not need to scan all the names.
+type flatTree struct {
+	entriesByName map[string][]*TarEntry
+	// children maps a directory ("" for the root) to the names of its children.
+	// The directories without entries are indexed too, as the layers may omit the parent directories.
+	children map[string]map[string]struct{}
+}
+
+func newFlatTree() *flatTree {
+	return &flatTree{
+		entriesByName: make(map[string][]*TarEntry),
+		children:      make(map[string]map[string]struct{}),
+	}
+}
+
+// parentDir returns the parent directory of a cleaned name, or "" for the root.
+func parentDir(name string) string {
+	if parent := path.Dir(name); parent != "." {
+		return parent
+	}
+	return ""
+}
+
+// put replaces the entries of name.
+func (f *flatTree) put(name string, ents ...*TarEntry) {
+	f.entriesByName[name] = ents
+	for child := name; child != ""; {
+		parent := parentDir(child)
+		siblings, ok := f.children[parent]
+		if !ok {
+			siblings = make(map[string]struct{})
+			f.children[parent] = siblings
+		}
+		if _, ok := siblings[child]; ok {
+			// The ancestors are already indexed
+			break
+		}
+		siblings[child] = struct{}{}
+		child = parent
+	}
+}
+
+// removeTree removes name and its descendants, and returns the removed entries.
+func (f *flatTree) removeTree(name string) []*TarEntry {
+	removed := f.removeChildren(name)
+	if name != "" {
+		removed = append(removed, f.entriesByName[name]...)
+		delete(f.entriesByName, name)
+		delete(f.children[parentDir(name)], name)
+	}
+	return removed
+}
+
+// removeChildren removes the descendants of name, and returns the removed entries.
+func (f *flatTree) removeChildren(name string) []*TarEntry {
+	var removed []*TarEntry
+	for child := range f.children[name] {
+		removed = append(removed, f.removeChildren(child)...)
+		removed = append(removed, f.entriesByName[child]...)
+		delete(f.entriesByName, child)
+	}
+	delete(f.children, name)
+	return removed
+}
+
+// applyLayer applies the layer l onto the lower layers flattened in flat.
+// When keepWhiteouts is true, the whiteouts of l are retained in flat, unless the files are recreated.
+func applyLayer(flat *flatTree, l *loadLayerResult, keepWhiteouts bool) {
+	var (
+		upper   = make(map[string]*TarEntry)
+		removed []*TarEntry
+	)
+	for _, ents := range l.entriesByName {
+		for _, ent := range ents {
+			name := cleanTarPath(ent.Header.Name)
+			if name == "" {
+				continue
+			}
+			ent.Header.Name = name
+			parent, base := parentDir(name), path.Base(name)
+			switch {
+			case base == whiteoutOpaqueDir:
+				removed = append(removed, flat.removeChildren(parent)...)
+				if keepWhiteouts {
+					upper[name] = ent
+				} else {
+					removed = append(removed, ent)
+				}
+			case strings.HasPrefix(base, whiteoutPrefix):
+				removed = append(removed, flat.removeTree(path.Join(parent, strings.TrimPrefix(base, whiteoutPrefix)))...)
+				if keepWhiteouts {
+					upper[name] = ent
+				} else {
+					removed = append(removed, ent)
+				}
+			default:
+				if existing, ok := upper[name]; !ok || existing.Index < ent.Index {
+					upper[name] = ent
+				}
+			}
+		}
+	}
+	for name, ent := range upper {
+		if lowers, ok := flat.entriesByName[name]; ok && ent.Header.Typeflag != tar.TypeDir {
+			for _, lower := range lowers {
+				if lower.Header.Typeflag == tar.TypeDir {
+					removed = append(removed, flat.removeChildren(name)...)
+					break
+				}
+			}
+		}
+		flat.put(name, ent)
+		if keepWhiteouts && !strings.HasPrefix(path.Base(name), whiteoutPrefix) {
+			// The file is recreated
+			wh := path.Join(path.Dir(name), whiteoutPrefix+path.Base(name))
+			if _, ok := upper[wh]; !ok {
+				removed = append(removed, flat.removeTree(wh)...)
+			}
+		}
+	}
+	removeExtracted(removed, upper)
+}
+
+// removeExtracted removes the extracted files of the removed entries,
+// unless the files have been overwritten by the upper entries.
+func removeExtracted(removed []*TarEntry, upper map[string]*TarEntry) {
+	claimed := make(map[string]struct{})
+	for _, ent := range upper {
+		if ent.extractedPath != "" {
+			claimed[ent.extractedPath] = struct{}{}
+		}
+	}
+	var paths []string
+	for _, ent := range removed {
+		if ent.extractedPath == "" {
+			continue
+		}
+		if _, ok := claimed[ent.extractedPath]; !ok {
+			paths = append(paths, ent.extractedPath)
+		}
+	}
+	// Remove children before parents
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+	for _, p := range paths {
+		_ = os.Remove(p) // Not RemoveAll
+	}
+}
+
+// resolveHardLinks converts hard links to regular files, as the order of the entries is not meaningful
+// in a flattened root filesystem.
+func resolveHardLinks(l *loadLayerResult) {
+	for _, ents := range l.entriesByName {
+		for _, ent := range ents {
+			hdr := ent.Header
+			if hdr.Typeflag != tar.TypeLink {
+				continue
+			}
+			targets, ok := l.entriesByName[cleanTarPath(hdr.Linkname)]
+			if !ok || len(targets) != 1 || targets[0].Header.Typeflag != tar.TypeReg {
+				continue
+			}
+			target := targets[0]
+			hdr.Typeflag = tar.TypeReg
+			hdr.Linkname = ""
+			hdr.Size = target.Header.Size
+			ent.Digest = target.Digest
+			ent.NormalizedDigest = target.NormalizedDigest
+			ent.Normalizer = target.Normalizer
+			ent.text = target.text
+			ent.contentPath = target.contentPath
+		}
+	}
+}
+
+// normalizeRootFSEntry clears the attributes that cannot be retained in a directory.
+func normalizeRootFSEntry(ent *TarEntry) {
+	ent.Index = -1
+	hdr := ent.Header
+	hdr.Format = tar.FormatUnknown
+	hdr.Uname = ""
+	hdr.Gname = ""
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
+	var pax map[string]string
+	for k, v := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "SCHILY.xattr.") {
+			if pax == nil {
+				pax = make(map[string]string)
+			}
+			pax[k] = v
+		}
+	}
+	hdr.PAXRecords = pax
+	//nolint:staticcheck // SA1019: hdr.Xattrs has been deprecated since Go 1.10: Use PAXRecords instead.
+	if len(hdr.Xattrs) == 0 {
+		hdr.Xattrs = nil
+	}
+}
+
+// loadDir synthesizes the tar entries from a directory.
+func (d *differ) loadDir(ctx context.Context, dir string) (*loadLayerResult, error) {
+	res := &loadLayerResult{
+		entriesByName: make(map[string][]*TarEntry),
+	}
+	emptyDigest := digest.SHA256.FromBytes(nil)
+	err := filepath.WalkDir(dir, func(p string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		fi, err := de.Info()
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&fs.ModeSocket != 0 {
+			log.G(ctx).Debugf("Ignoring socket %q", p)
+			return nil
+		}
+		hdr, err := fileHeader(p, rel, fi)
+		if err != nil {
+			return err
+		}
+		dropSecurityXattrs(ctx, hdr)
+		ent := &TarEntry{
+			Index:  -1,
+			Header: hdr,
+			Digest: emptyDigest,
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if ent.text, err = d.digestFile(ent, p, d.o.TextDiffMaxSize); err != nil {
+				return err
+			}
+			ent.contentPath = p
+		}
+		// ent.extractedPath is kept empty, so that the files in dir are never removed
+		res.entries++
+		res.entriesByName[hdr.Name] = append(res.entriesByName[hdr.Name], ent)
+		return nil
+	})
+	return res, err
+}
+
+// fileHeader creates a tar header for the file p, with the name rel.
+// The xattrs are stored in the PAX records.
+func fileHeader(p, rel string, fi fs.FileInfo) (*tar.Header, error) {
+	var (
+		link string
+		err  error
+	)
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		if link, err = os.Readlink(p); err != nil {
+			return nil, err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a tar header for %q: %w", p, err)
+	}
+	hdr.Name = filepath.ToSlash(rel)
+	xattrs, err := readXattrs(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read xattrs of %q: %w", p, err)
+	}
+	for k, v := range xattrs {
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords["SCHILY.xattr."+k] = v
+		//nolint:staticcheck // SA1019: hdr.Xattrs has been deprecated since Go 1.10: Use PAXRecords instead.
+		if hdr.Xattrs == nil {
+			hdr.Xattrs = make(map[string]string)
+		}
+		//nolint:staticcheck // SA1019: hdr.Xattrs has been deprecated since Go 1.10: Use PAXRecords instead.
+		hdr.Xattrs[k] = v
+	}
+	return hdr, nil
+}
+
+// digestFile computes the digests of the content of the file p, which is the content of ent (see digestNormalizedContent).
+// The content is also returned if it looks like a text and its size does not exceed textLimit.
+func (d *differ) digestFile(ent *TarEntry, p string, textLimit int64) (*string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return d.digestNormalizedContent(ent, f, textLimit)
+}
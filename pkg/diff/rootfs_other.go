@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd || netbsd)
+
+package diff
+
+// readXattrs returns no xattr, as reading xattrs is not supported on this platform.
+func readXattrs(p string) (map[string]string, error) {
+	return nil, nil
+}
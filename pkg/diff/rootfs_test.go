@@ -0,0 +1,200 @@
+package diff
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestWhiteoutTarget(t *testing.T) {
+	testCases := []struct {
+		name           string
+		expectedType   EventType
+		expectedTarget string
+	}{
+		{"foo", EventTypeNone, ""},
+		{"foo/bar", EventTypeNone, ""},
+		{"foo/.wh.bar", EventTypeDeletedPathMismatch, "foo/bar"},
+		{"./foo/.wh.bar", EventTypeDeletedPathMismatch, "foo/bar"},
+		{"/foo/.wh.bar", EventTypeDeletedPathMismatch, "foo/bar"},
+		{".wh.foo", EventTypeDeletedPathMismatch, "foo"},
+		{"foo/.wh..wh..opq", EventTypeOpaqueDirectoryMismatch, "foo"},
+		{".wh..wh..opq", EventTypeOpaqueDirectoryMismatch, "."},
+		{"./.wh..wh..opq", EventTypeOpaqueDirectoryMismatch, "."},
+		// Only the base name is a whiteout
+		{".wh.foo/bar", EventTypeNone, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			evType, target := whiteoutTarget(tc.name)
+			if evType != tc.expectedType || target != tc.expectedTarget {
+				t.Errorf("expected (%q, %q), got (%q, %q)", tc.expectedType, tc.expectedTarget, evType, target)
+			}
+		})
+	}
+}
+
+// testLayerResult returns a layer with the names. The names ending with "/" are directories.
+func testLayerResult(names ...string) *loadLayerResult {
+	l := &loadLayerResult{
+		entriesByName: make(map[string][]*TarEntry),
+	}
+	for i, name := range names {
+		hdr := &tar.Header{Name: name, Typeflag: tar.TypeReg}
+		if strings.HasSuffix(name, "/") {
+			hdr.Typeflag = tar.TypeDir
+		}
+		l.entriesByName[name] = append(l.entriesByName[name], &TarEntry{Index: i, Header: hdr})
+	}
+	l.entries = len(names)
+	return l
+}
+
+func TestApplyLayer(t *testing.T) {
+	testCases := []struct {
+		name          string
+		layers        [][]string
+		keepWhiteouts bool
+		expected      []string
+	}{
+		{
+			name:     "single layer",
+			layers:   [][]string{{"./etc/", "./etc/hostname", "/usr/bin/sh"}},
+			expected: []string{"etc", "etc/hostname", "usr/bin/sh"},
+		},
+		{
+			name:     "overwrite",
+			layers:   [][]string{{"etc/", "etc/hostname"}, {"etc/hostname"}},
+			expected: []string{"etc", "etc/hostname"},
+		},
+		{
+			name:     "whiteout file",
+			layers:   [][]string{{"etc/", "etc/hostname", "etc/hosts"}, {"etc/.wh.hostname"}},
+			expected: []string{"etc", "etc/hosts"},
+		},
+		{
+			name:     "whiteout directory",
+			layers:   [][]string{{"etc/", "etc/foo/", "etc/foo/bar", "etc/foobar"}, {"etc/.wh.foo"}},
+			expected: []string{"etc", "etc/foobar"},
+		},
+		{
+			// The lower layer omits the parent directories
+			name:     "whiteout implicit directory",
+			layers:   [][]string{{"usr/bin/sh", "usr/lib/libc.so", "usrlocal"}, {".wh.usr"}},
+			expected: []string{"usrlocal"},
+		},
+		{
+			name:     "whiteout nonexistent",
+			layers:   [][]string{{"etc/"}, {"etc/.wh.foo"}},
+			expected: []string{"etc"},
+		},
+		{
+			name:     "opaque directory",
+			layers:   [][]string{{"etc/", "etc/foo/", "etc/foo/bar", "etc/hosts", "var/log"}, {"etc/", "etc/.wh..wh..opq", "etc/hostname"}},
+			expected: []string{"etc", "etc/hostname", "var/log"},
+		},
+		{
+			name:     "opaque root",
+			layers:   [][]string{{"etc/", "etc/hosts", "var/log"}, {".wh..wh..opq", "usr/"}},
+			expected: []string{"usr"},
+		},
+		{
+			name:     "whiteout and recreate in the same layer",
+			layers:   [][]string{{"etc/", "etc/foo/", "etc/foo/bar"}, {"etc/.wh.foo", "etc/foo/", "etc/foo/baz"}},
+			expected: []string{"etc", "etc/foo", "etc/foo/baz"},
+		},
+		{
+			name:     "whiteout and recreate in different layers",
+			layers:   [][]string{{"etc/foo/bar"}, {"etc/.wh.foo"}, {"etc/foo/", "etc/foo/baz"}, {"etc/foo/.wh.baz"}},
+			expected: []string{"etc/foo"},
+		},
+		{
+			name:     "directory replaced with file",
+			layers:   [][]string{{"etc/", "etc/foo/", "etc/foo/bar"}, {"etc/foo"}},
+			expected: []string{"etc", "etc/foo"},
+		},
+		{
+			name:     "file replaced with directory",
+			layers:   [][]string{{"etc/foo"}, {"etc/foo/", "etc/foo/bar"}},
+			expected: []string{"etc/foo", "etc/foo/bar"},
+		},
+		{
+			name:          "keep whiteouts",
+			layers:        [][]string{{"etc/", "etc/hostname", "etc/foo/", "etc/foo/bar"}, {"etc/.wh.hostname", "etc/foo/.wh..wh..opq"}},
+			keepWhiteouts: true,
+			expected:      []string{"etc", "etc/.wh.hostname", "etc/foo", "etc/foo/.wh..wh..opq"},
+		},
+		{
+			name:          "keep whiteouts of recreated files",
+			layers:        [][]string{{"etc/.wh.hostname", "etc/.wh.hosts"}, {"etc/hostname"}},
+			keepWhiteouts: true,
+			expected:      []string{"etc/.wh.hosts", "etc/hostname"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			flat := newFlatTree()
+			for _, names := range tc.layers {
+				applyLayer(flat, testLayerResult(names...), tc.keepWhiteouts)
+			}
+			var got []string
+			for name, ents := range flat.entriesByName {
+				if len(ents) != 1 {
+					t.Errorf("%q: expected 1 entry, got %d", name, len(ents))
+				}
+				got = append(got, name)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+			// Every entry must be reachable from the root in the index of the children
+			var walk func(dir string) int
+			walk = func(dir string) int {
+				var n int
+				for child := range flat.children[dir] {
+					if parentDir(child) != dir {
+						t.Errorf("%q is indexed as a child of %q", child, dir)
+					}
+					if _, ok := flat.entriesByName[child]; ok {
+						n++
+					}
+					n += walk(child)
+				}
+				return n
+			}
+			if n := walk(""); n != len(flat.entriesByName) {
+				t.Errorf("expected %d indexed entries, got %d", len(flat.entriesByName), n)
+			}
+		})
+	}
+}
+
+func TestApplyLayerRemoveExtracted(t *testing.T) {
+	dir := t.TempDir()
+	extract := func(l *loadLayerResult) {
+		for name, ents := range l.entriesByName {
+			p := filepath.Join(dir, name)
+			if err := os.WriteFile(p, nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			ents[0].extractedPath = p
+		}
+	}
+	lower := testLayerResult("foo", "bar")
+	extract(lower)
+	upper := testLayerResult(".wh.foo")
+	flat := newFlatTree()
+	applyLayer(flat, lower, false)
+	applyLayer(flat, upper, false)
+	if _, err := os.Stat(filepath.Join(dir, "foo")); !os.IsNotExist(err) {
+		t.Errorf("expected foo to be removed, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bar")); err != nil {
+		t.Errorf("expected bar to be kept, got %v", err)
+	}
+}
@@ -0,0 +1,46 @@
+//go:build linux || darwin || freebsd || netbsd
+
+package diff
+
+import (
+	"bytes"
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// readXattrs reads the xattrs of the file p, without following symlinks.
+func readXattrs(p string) (map[string]string, error) {
+	sz, err := unix.Llistxattr(p, nil)
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if sz == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, sz)
+	sz, err = unix.Llistxattr(p, buf)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]string)
+	for _, k := range bytes.Split(buf[:sz], []byte{0}) {
+		if len(k) == 0 {
+			continue
+		}
+		vsz, err := unix.Lgetxattr(p, string(k), nil)
+		if err != nil {
+			return nil, err
+		}
+		v := make([]byte, vsz)
+		vsz, err = unix.Lgetxattr(p, string(k), v)
+		if err != nil {
+			return nil, err
+		}
+		m[string(k)] = string(v[:vsz])
+	}
+	return m, nil
+}
@@ -0,0 +1,244 @@
+package diff
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	continuityfs "github.com/containerd/continuity/fs"
+	"github.com/containerd/log"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/identity"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Snapshotter provides the unpacked snapshots of the layers, such as the snapshots of containerd.
+type Snapshotter interface {
+	// WithSnapshot calls f with the read-only root directory of the committed snapshot for chainID.
+	// Returns an error wrapping [errdefs.ErrNotFound] if the snapshot does not exist.
+	WithSnapshot(ctx context.Context, chainID digest.Digest, f func(root string) error) error
+}
+
+// snapshotLayer is the chain ID of a layer and its parent.
+// The parent is empty for the first layer.
+type snapshotLayer struct {
+	chainID digest.Digest
+	parent  digest.Digest
+}
+
+// snapshotLayerKey identifies a layer by the pair of the manifest digests and the index in the manifests.
+// The layer digests are not unique, as the same layer may appear at different positions
+// (e.g., empty layers), with different chain IDs.
+type snapshotLayerKey struct {
+	manifests [2]digest.Digest
+	index     int
+}
+
+// snapshotLayerMap maps the layers to the snapshot layers.
+type snapshotLayerMap struct {
+	m  map[snapshotLayerKey][2]snapshotLayer
+	mu sync.Mutex
+}
+
+// snapshotManifestsKey is the context key for the pair of the manifest digests of the layers being compared.
+type snapshotManifestsKey struct{}
+
+// fieldIndexKey is the context key for the index of the descriptor in the slice field being compared.
+type fieldIndexKey struct{}
+
+// registerSnapshotLayers records the chain IDs of the layers of the manifests in in,
+// so that diffLayer can compare the snapshots instead of the layer blobs.
+// The returned context is to be passed to diffLayer.
+func (d *differ) registerSnapshotLayers(ctx context.Context, in [2]EventInput) (context.Context, error) {
+	var chainIDs [2][]digest.Digest
+	for i := 0; i < 2; i++ {
+		config, err := readBlobWithType[ocispec.Image](ctx, d.cs, in[i].Manifest.Config, d.o.MaxScale)
+		if err != nil {
+			return ctx, fmt.Errorf("failed to read config (%v): %w", in[i].Manifest.Config, err)
+		}
+		if len(config.RootFS.DiffIDs) != len(in[i].Manifest.Layers) {
+			log.G(ctx).Debugf("Not using snapshots, as the number of the DiffIDs (%d) does not match the number of the layers (%d)",
+				len(config.RootFS.DiffIDs), len(in[i].Manifest.Layers))
+			return ctx, nil
+		}
+		chainIDs[i] = identity.ChainIDs(config.RootFS.DiffIDs)
+	}
+	manifests := [2]digest.Digest{in[0].Descriptor.Digest, in[1].Descriptor.Digest}
+	d.snapshotLayers.mu.Lock()
+	defer d.snapshotLayers.mu.Unlock()
+	if d.snapshotLayers.m == nil {
+		d.snapshotLayers.m = make(map[snapshotLayerKey][2]snapshotLayer)
+	}
+	for j := range chainIDs[0] {
+		var sl [2]snapshotLayer
+		for i := 0; i < 2; i++ {
+			sl[i].chainID = chainIDs[i][j]
+			if j > 0 {
+				sl[i].parent = chainIDs[i][j-1]
+			}
+		}
+		d.snapshotLayers.m[snapshotLayerKey{manifests: manifests, index: j}] = sl
+	}
+	return context.WithValue(ctx, snapshotManifestsKey{}, manifests), nil
+}
+
+// lookupSnapshotLayers looks up the snapshot layers for the layer being compared in ctx.
+func (d *differ) lookupSnapshotLayers(ctx context.Context) ([2]snapshotLayer, bool) {
+	manifests, ok := ctx.Value(snapshotManifestsKey{}).([2]digest.Digest)
+	if !ok {
+		return [2]snapshotLayer{}, false
+	}
+	index, ok := ctx.Value(fieldIndexKey{}).(int)
+	if !ok {
+		return [2]snapshotLayer{}, false
+	}
+	d.snapshotLayers.mu.Lock()
+	defer d.snapshotLayers.mu.Unlock()
+	sl, ok := d.snapshotLayers.m[snapshotLayerKey{manifests: manifests, index: index}]
+	return sl, ok
+}
+
+// withSnapshots calls f with the root directories of the snapshots.
+// An empty chain ID is mapped to an empty root.
+func (d *differ) withSnapshots(ctx context.Context, chainIDs []digest.Digest, f func(roots []string) error) error {
+	if len(chainIDs) == 0 {
+		return f(nil)
+	}
+	wrap := func(root string) error {
+		return d.withSnapshots(ctx, chainIDs[1:], func(roots []string) error {
+			return f(append([]string{root}, roots...))
+		})
+	}
+	if chainIDs[0] == "" {
+		return wrap("")
+	}
+	return d.o.Snapshotter.WithSnapshot(ctx, chainIDs[0], wrap)
+}
+
+// diffLayerWithSnapshots compares the changes between the snapshots of the layers and their parents,
+// without decompressing the layer blobs.
+// Returns an error wrapping [errdefs.ErrNotFound] before raising any event, if the snapshots are not available.
+func (d *differ) diffLayerWithSnapshots(ctx context.Context, node *EventTreeNode, in [2]EventInput, sl [2]snapshotLayer) error {
+	var l [2]*loadLayerResult
+	chainIDs := []digest.Digest{sl[0].parent, sl[0].chainID, sl[1].parent, sl[1].chainID}
+	if err := d.withSnapshots(ctx, chainIDs, func(roots []string) error {
+		for i := 0; i < 2; i++ {
+			lower, upper := roots[2*i], roots[2*i+1]
+			tr, err := newChangesTarReader(ctx, lower, upper)
+			if err != nil {
+				return fmt.Errorf("failed to compute the changes of snapshot %s (input-%d): %w", sl[i].chainID, i, err)
+			}
+			l[i], err = d.loadLayer(ctx, node, i, tr)
+			if closeErr := tr.Close(); closeErr != nil {
+				log.G(ctx).WithError(closeErr).Warnf("failed to close tar reader %d", i)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to load snapshot %s (input-%d): %w", sl[i].chainID, i, err)
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, ll := range l {
+		for _, ents := range ll.entriesByName {
+			for _, ent := range ents {
+				normalizeRootFSEntry(ent)
+			}
+		}
+	}
+	return d.diffLoadedLayers(ctx, node, in, l[0], l[1])
+}
+
+type snapshotChange struct {
+	kind continuityfs.ChangeKind
+	path string // "/foo/bar"
+	fi   os.FileInfo
+}
+
+// changesTarReader synthesizes a layer tar stream from the changes between two directories.
+// The removed files are represented as OCI whiteouts.
+type changesTarReader struct {
+	upper   string
+	changes []snapshotChange
+	r       io.Reader
+	f       *os.File
+}
+
+// newChangesTarReader computes the changes from lower to upper.
+// lower may be empty.
+func newChangesTarReader(ctx context.Context, lower, upper string) (*changesTarReader, error) {
+	tr := &changesTarReader{upper: upper}
+	err := continuityfs.Changes(ctx, lower, upper, func(kind continuityfs.ChangeKind, p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if kind == continuityfs.ChangeKindUnmodified {
+			return nil
+		}
+		if fi != nil && fi.Mode()&fs.ModeSocket != 0 {
+			log.G(ctx).Debugf("Ignoring socket %q", p)
+			return nil
+		}
+		tr.changes = append(tr.changes, snapshotChange{kind: kind, path: p, fi: fi})
+		return nil
+	})
+	return tr, err
+}
+
+func (tr *changesTarReader) Next() (*tar.Header, error) {
+	if err := tr.Close(); err != nil {
+		return nil, err
+	}
+	tr.r = eofReader{}
+	if len(tr.changes) == 0 {
+		return nil, io.EOF
+	}
+	c := tr.changes[0]
+	tr.changes = tr.changes[1:]
+	rel := cleanTarPath(c.path)
+	if c.kind == continuityfs.ChangeKindDelete {
+		parent, base := path.Split(rel)
+		return &tar.Header{
+			Name:     parent + whiteoutPrefix + base,
+			Typeflag: tar.TypeReg,
+		}, nil
+	}
+	p := filepath.Join(tr.upper, filepath.FromSlash(rel))
+	hdr, err := fileHeader(p, rel, c.fi)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Typeflag == tar.TypeReg {
+		if tr.f, err = os.Open(p); err != nil {
+			return nil, err
+		}
+		tr.r = tr.f
+	}
+	return hdr, nil
+}
+
+func (tr *changesTarReader) Read(p []byte) (int, error) {
+	return tr.r.Read(p)
+}
+
+func (tr *changesTarReader) Close() error {
+	if tr.f == nil {
+		return nil
+	}
+	err := tr.f.Close()
+	tr.f = nil
+	return err
+}
+
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
@@ -0,0 +1,176 @@
+package diff_test
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/identity"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/reproducible-containers/diffoci/internal/testutil"
+	"github.com/reproducible-containers/diffoci/pkg/diff"
+)
+
+// testSnapshotter implements [diff.Snapshotter] with the directories extracted from the test layers.
+type testSnapshotter struct {
+	t     *testing.T
+	roots map[digest.Digest]string
+}
+
+func newTestSnapshotter(t *testing.T) *testSnapshotter {
+	return &testSnapshotter{
+		t:     t,
+		roots: make(map[digest.Digest]string),
+	}
+}
+
+// unpack extracts the layers cumulatively, and registers the directories for their chain IDs.
+// Whiteouts are not supported.
+func (sn *testSnapshotter) unpack(layers ...[]testutil.File) {
+	sn.t.Helper()
+	var diffIDs []digest.Digest
+	for _, l := range layers {
+		diffIDs = append(diffIDs, digest.FromBytes(testutil.Layer(sn.t, l...)))
+	}
+	chainIDs := identity.ChainIDs(diffIDs)
+	for j, chainID := range chainIDs {
+		root := sn.t.TempDir()
+		for _, l := range layers[:j+1] {
+			for _, f := range l {
+				writeTestFile(sn.t, root, f)
+			}
+		}
+		// Set the timestamps after creating the children
+		if err := filepath.WalkDir(root, func(p string, _ fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			return os.Chtimes(p, testutil.ModTime, testutil.ModTime)
+		}); err != nil {
+			sn.t.Fatal(err)
+		}
+		sn.roots[chainID] = root
+	}
+}
+
+func writeTestFile(t *testing.T, root string, f testutil.File) {
+	t.Helper()
+	p := filepath.Join(root, filepath.FromSlash(f.Name))
+	mode := fs.FileMode(f.Mode)
+	switch f.Typeflag {
+	case tar.TypeDir:
+		if mode == 0 {
+			mode = 0o755
+		}
+		if err := os.MkdirAll(p, mode); err != nil {
+			t.Fatal(err)
+		}
+	case 0, tar.TypeReg:
+		if mode == 0 {
+			mode = 0o644
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(f.Body), mode); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatalf("unsupported typeflag %q", f.Typeflag)
+	}
+	if err := os.Chmod(p, mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (sn *testSnapshotter) WithSnapshot(_ context.Context, chainID digest.Digest, f func(root string) error) error {
+	root, ok := sn.roots[chainID]
+	if !ok {
+		return fmt.Errorf("snapshot %s: %w", chainID, errdefs.ErrNotFound)
+	}
+	return f(root)
+}
+
+func TestDiffWithSnapshots(t *testing.T) {
+	etc := []testutil.File{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "etc/hostname", Body: "localhost\n"},
+	}
+	etc2 := []testutil.File{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "etc/hostname", Body: "localhost2\n"},
+	}
+	usr := []testutil.File{
+		{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "usr/bin/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "usr/bin/sh", Body: "#!/bin/sh\n", Mode: 0o755},
+	}
+	usr2 := []testutil.File{
+		{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "usr/bin/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "usr/bin/sh", Body: "#!/bin/bash\n", Mode: 0o755},
+	}
+	testCases := []struct {
+		name     string
+		layers   [2][][]testutil.File
+		unpacked [2]bool
+		expected []string
+	}{
+		{
+			name:     "identical",
+			layers:   [2][][]testutil.File{{etc, usr}, {etc, usr}},
+			unpacked: [2]bool{true, true},
+		},
+		{
+			name:     "content",
+			layers:   [2][][]testutil.File{{etc, usr}, {etc, usr2}},
+			unpacked: [2]bool{true, true},
+			expected: []string{"usr/bin/sh"},
+		},
+		{
+			// The same pair of the layers appears twice, with different chain IDs.
+			// The second appearance does not change the snapshot.
+			name:     "repeated layers",
+			layers:   [2][][]testutil.File{{etc, usr, etc}, {etc2, usr, etc2}},
+			unpacked: [2]bool{true, true},
+			expected: []string{"etc/hostname"},
+		},
+		{
+			// Falls back to the layer blobs
+			name:     "not unpacked",
+			layers:   [2][][]testutil.File{{etc, usr, etc}, {etc2, usr, etc2}},
+			unpacked: [2]bool{true, false},
+			expected: []string{"etc/hostname", "etc/hostname"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestImageStore(t)
+			sn := newTestSnapshotter(t)
+			var descs [2]ocispec.Descriptor
+			for i, layers := range tc.layers {
+				var blobs [][]byte
+				for _, l := range layers {
+					blobs = append(blobs, testutil.Layer(t, l...))
+				}
+				descs[i] = s.image(nil, blobs...)
+				if tc.unpacked[i] {
+					sn.unpack(layers...)
+				}
+			}
+			for _, concurrency := range []int{1, 4} {
+				events := s.runDiff(descs, diff.Options{Snapshotter: sn, Concurrency: concurrency})
+				if got := entryEvents(events); strings.Join(got, ",") != strings.Join(tc.expected, ",") {
+					t.Errorf("concurrency %d: expected %v, got %v", concurrency, tc.expected, got)
+				}
+			}
+		})
+	}
+}
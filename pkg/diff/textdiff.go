@@ -0,0 +1,166 @@
+package diff
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/containerd/log"
+	"github.com/opencontainers/go-digest"
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// isText returns true if b looks like a text file, i.e., a valid UTF-8 string
+// without control characters other than the common ones such as '\t' and '\n'.
+func isText(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, c := range b {
+		if c < 0x20 && !strings.ContainsRune("\t\n\v\f\r\b\x1b", rune(c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// splitLines splits the text into the lines, with the trailing newlines.
+// A newline is appended to the last line if missing.
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if last := len(lines) - 1; lines[last] == "" {
+		lines = lines[:last]
+	} else {
+		lines[last] += "\n"
+	}
+	return lines
+}
+
+// digestContent computes the digest of the content of a regular file.
+// The content is also returned if it looks like a text and its size does not exceed limit.
+func digestContent(r io.Reader, limit int64) (digest.Digest, *string, error) {
+	if limit <= 0 {
+		dgst, err := digest.SHA256.FromReader(r)
+		return dgst, nil, err
+	}
+	b, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return "", nil, err
+	}
+	digester := digest.SHA256.Digester()
+	digester.Hash().Write(b)
+	if int64(len(b)) > limit {
+		if _, err = io.Copy(digester.Hash(), r); err != nil {
+			return "", nil, err
+		}
+		return digester.Digest(), nil, nil
+	}
+	if !isText(b) {
+		return digester.Digest(), nil, nil
+	}
+	text := string(b)
+	return digester.Digest(), &text, nil
+}
+
+// textSizeLimit returns the maximum size of the contents of the entries to be read as texts from r.
+func (d *differ) textSizeLimit(hdr *tar.Header, r io.Reader) int64 {
+	if hdr.Typeflag != tar.TypeReg {
+		return 0
+	}
+	limit := d.o.TextDiffMaxSize
+	if _, ok := r.(*indexingTarReader); ok {
+		// The layer index retains the texts regardless of the options
+		limit = max(limit, layerIndexMaxTextSize)
+	}
+	return limit
+}
+
+// retainedText returns text if it can be retained for TextDiffMaxSize.
+func (d *differ) retainedText(text *string) *string {
+	if text == nil || d.o.TextDiffMaxSize <= 0 || int64(len(*text)) > d.o.TextDiffMaxSize {
+		return nil
+	}
+	return text
+}
+
+// entryText returns the content of the entry as a text.
+// Returns nil if the content is not a text, or is not available.
+func (d *differ) entryText(ctx context.Context, ent *TarEntry) *string {
+	if ent.text != nil || ent.extractedPath == "" || ent.Header.Typeflag != tar.TypeReg || ent.Header.Size > d.o.TextDiffMaxSize {
+		return ent.text
+	}
+	f, err := os.Open(ent.extractedPath)
+	if err != nil {
+		log.G(ctx).WithError(err).Debugf("Failed to open %q", ent.extractedPath)
+		return nil
+	}
+	defer f.Close()
+	_, text, err := digestContent(f, d.o.TextDiffMaxSize)
+	if err != nil {
+		log.G(ctx).WithError(err).Debugf("Failed to read %q", ent.extractedPath)
+		return nil
+	}
+	return text
+}
+
+// textDiff returns the unified diff of the contents of the regular files.
+// Returns an empty string if the contents are not texts, or exceed TextDiffMaxSize.
+// The diff is truncated to TextDiffMaxLines.
+func (d *differ) textDiff(ctx context.Context, name string, ent0, ent1 *TarEntry) string {
+	if d.o.TextDiffMaxSize <= 0 || sameContent(ent0, ent1) {
+		return ""
+	}
+	if ent0.Header.Typeflag != tar.TypeReg || ent1.Header.Typeflag != tar.TypeReg {
+		return ""
+	}
+	text0, text1 := d.entryText(ctx, ent0), d.entryText(ctx, ent1)
+	if text0 == nil || text1 == nil {
+		return ""
+	}
+	s, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        splitLines(*text0),
+		B:        splitLines(*text1),
+		FromFile: path.Join(ReportDirInput0, name),
+		ToFile:   path.Join(ReportDirInput1, name),
+		Context:  3,
+	})
+	if err != nil {
+		log.G(ctx).WithError(err).Debugf("Failed to compute the diff of %q", name)
+		return ""
+	}
+	if maxLines := d.o.TextDiffMaxLines; maxLines > 0 {
+		if lines := strings.SplitAfter(s, "\n"); len(lines) > maxLines+1 {
+			// The last element is empty
+			s = strings.Join(lines[:maxLines], "") + fmt.Sprintf("... (%d more lines)\n", len(lines)-1-maxLines)
+		}
+	}
+	return s
+}
+
+// writePatch writes the text diff of the entry to the report directory.
+// node is the node of the layer (or of the archive); the patch is placed along with the extracted files of the layer.
+func (d *differ) writePatch(ctx context.Context, node *EventTreeNode, name, textDiff string) {
+	if d.o.ReportDir == "" || textDiff == "" {
+		return
+	}
+	layerContext := node.Context
+	for path.Base(layerContext) == "tarentry" {
+		// The node of an archive entry (NestedArchives)
+		layerContext = path.Dir(layerContext)
+	}
+	dirx := filepath.Clean(path.Dir(layerContext)) // "/manifests-0/layers-0"
+	p := filepath.Join(d.o.ReportDir, ReportDirPatches, dirx, filepath.FromSlash(path.Clean("/"+name))+".patch")
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		log.G(ctx).WithError(err).Warnf("Failed to create the directory for %q", p)
+		return
+	}
+	if err := os.WriteFile(p, []byte(textDiff), 0644); err != nil {
+		log.G(ctx).WithError(err).Warnf("Failed to write %q", p)
+	}
+}
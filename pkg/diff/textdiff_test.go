@@ -0,0 +1,252 @@
+package diff
+
+import (
+	"archive/tar"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestIsText(t *testing.T) {
+	testCases := []struct {
+		name     string
+		b        string
+		expected bool
+	}{
+		{"empty", "", true},
+		{"ascii", "foo\nbar\n", true},
+		{"tab and crlf", "foo\tbar\r\n", true},
+		{"escape sequence", "\x1b[1mfoo\x1b[0m\n", true},
+		{"utf-8", "こんにちは\n", true},
+		{"nul", "foo\x00bar", false},
+		{"elf", "\x7fELF\x02\x01\x01", false},
+		{"invalid utf-8", "foo\xff\xfe", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isText([]byte(tc.b)); got != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestSplitLines(t *testing.T) {
+	testCases := []struct {
+		text     string
+		expected []string
+	}{
+		{"", nil},
+		{"foo", []string{"foo\n"}},
+		{"foo\n", []string{"foo\n"}},
+		{"foo\nbar", []string{"foo\n", "bar\n"}},
+		{"foo\n\nbar\n", []string{"foo\n", "\n", "bar\n"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.text, func(t *testing.T) {
+			got := splitLines(tc.text)
+			if len(got) == 0 && len(tc.expected) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestDigestContent(t *testing.T) {
+	testCases := []struct {
+		name     string
+		content  string
+		limit    int64
+		expected *string
+	}{
+		{"no limit", "foo\n", 0, nil},
+		{"text", "foo\n", 4, ptrTo("foo\n")},
+		{"empty", "", 4, ptrTo("")},
+		{"too large", "foo\n", 3, nil},
+		{"binary", "foo\x00", 4, nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dgst, text, err := digestContent(strings.NewReader(tc.content), tc.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The digest is computed from the whole content, regardless of the limit
+			if expected := digest.FromString(tc.content); dgst != expected {
+				t.Errorf("expected %s, got %s", expected, dgst)
+			}
+			if !reflect.DeepEqual(text, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, text)
+			}
+		})
+	}
+}
+
+func ptrTo[T any](v T) *T {
+	return &v
+}
+
+func TestRetainedText(t *testing.T) {
+	testCases := []struct {
+		name     string
+		maxSize  int64
+		text     *string
+		expected *string
+	}{
+		{"disabled", 0, ptrTo("foo\n"), nil},
+		{"disabled empty", 0, ptrTo(""), nil},
+		{"nil", 4, nil, nil},
+		{"retained", 4, ptrTo("foo\n"), ptrTo("foo\n")},
+		// The texts in the layer index may be larger than TextDiffMaxSize
+		{"too large", 3, ptrTo("foo\n"), nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &differ{o: Options{TextDiffMaxSize: tc.maxSize}}
+			if got := d.retainedText(tc.text); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+// testTextEntry returns a regular file entry with the text retained, or extracted to a file if extractDir is set.
+func testTextEntry(t *testing.T, name, content, extractDir string) *TarEntry {
+	t.Helper()
+	ent := &TarEntry{
+		Header: &tar.Header{Name: name, Typeflag: tar.TypeReg, Size: int64(len(content))},
+		Digest: digest.FromString(content),
+	}
+	if extractDir == "" {
+		ent.text = &content
+		return ent
+	}
+	ent.extractedPath = filepath.Join(extractDir, name)
+	if err := os.WriteFile(ent.extractedPath, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return ent
+}
+
+func TestTextDiff(t *testing.T) {
+	testCases := []struct {
+		name     string
+		contents [2]string
+		maxSize  int64
+		maxLines int
+		extract  bool
+		expected string
+	}{
+		{
+			name:     "changed",
+			contents: [2]string{"foo\nbar\n", "foo\nbaz\n"},
+			maxSize:  1024,
+			expected: "--- input-0/etc/foo\n+++ input-1/etc/foo\n@@ -1,2 +1,2 @@\n foo\n-bar\n+baz\n",
+		},
+		{
+			name:     "extracted",
+			contents: [2]string{"foo\nbar\n", "foo\nbaz\n"},
+			maxSize:  1024,
+			extract:  true,
+			expected: "--- input-0/etc/foo\n+++ input-1/etc/foo\n@@ -1,2 +1,2 @@\n foo\n-bar\n+baz\n",
+		},
+		{
+			name:     "missing newline",
+			contents: [2]string{"foo", "bar"},
+			maxSize:  1024,
+			expected: "--- input-0/etc/foo\n+++ input-1/etc/foo\n@@ -1 +1 @@\n-foo\n+bar\n",
+		},
+		{
+			name:     "truncated",
+			contents: [2]string{"a\nb\nc\n", "x\ny\nz\n"},
+			maxSize:  1024,
+			maxLines: 4,
+			expected: "--- input-0/etc/foo\n+++ input-1/etc/foo\n@@ -1,3 +1,3 @@\n-a\n... (5 more lines)\n",
+		},
+		{
+			name:     "identical",
+			contents: [2]string{"foo\n", "foo\n"},
+			maxSize:  1024,
+		},
+		{
+			name:     "disabled",
+			contents: [2]string{"foo\n", "bar\n"},
+		},
+		{
+			name:     "extracted too large",
+			contents: [2]string{"foo\n", "bar\n"},
+			maxSize:  3,
+			extract:  true,
+		},
+		{
+			name:     "binary",
+			contents: [2]string{"foo\n", "bar\x00"},
+			maxSize:  1024,
+			extract:  true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var ents [2]*TarEntry
+			for i, content := range tc.contents {
+				var extractDir string
+				if tc.extract {
+					extractDir = t.TempDir()
+				}
+				ents[i] = testTextEntry(t, "foo", content, extractDir)
+				if !tc.extract && !isText([]byte(content)) {
+					ents[i].text = nil
+				}
+			}
+			d := &differ{o: Options{TextDiffMaxSize: tc.maxSize, TextDiffMaxLines: tc.maxLines}}
+			if got := d.textDiff(context.Background(), "etc/foo", ents[0], ents[1]); got != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestTextDiffNotRegular(t *testing.T) {
+	d := &differ{o: Options{TextDiffMaxSize: 1024}}
+	ent0 := testTextEntry(t, "foo", "foo\n", "")
+	ent1 := testTextEntry(t, "foo", "bar\n", "")
+	ent1.Header.Typeflag = tar.TypeSymlink
+	if got := d.textDiff(context.Background(), "foo", ent0, ent1); got != "" {
+		t.Errorf("expected no diff, got %q", got)
+	}
+}
+
+func TestWritePatch(t *testing.T) {
+	testCases := []struct {
+		name     string
+		context  string
+		entry    string
+		expected string
+	}{
+		{"layer", "/manifests-0/layers-1/layer", "etc/foo", "patches/manifests-0/layers-1/etc/foo.patch"},
+		{"archive entry", "/manifests-0/layers-1/layer/tarentry", "app.jar!/META-INF/MANIFEST.MF", "patches/manifests-0/layers-1/app.jar!/META-INF/MANIFEST.MF.patch"},
+		{"absolute name", "/manifests-0/layers-0/layer", "/../etc/foo", "patches/manifests-0/layers-0/etc/foo.patch"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			d := &differ{o: Options{ReportDir: dir}}
+			d.writePatch(context.Background(), &EventTreeNode{Context: tc.context}, tc.entry, "patch\n")
+			b, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(tc.expected)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != "patch\n" {
+				t.Errorf("expected %q, got %q", "patch\n", b)
+			}
+		})
+	}
+}
@@ -0,0 +1,347 @@
+// Package dockerengine provides a minimal client for the Docker Engine API.
+package dockerengine
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// DefaultHost is used when $DOCKER_HOST is not set.
+const DefaultHost = "unix:///var/run/docker.sock"
+
+// API versions that added the platform filters to `GET /images/get`.
+const (
+	apiVersionSaveSinglePlatform = "1.48" // Docker v28
+	apiVersionSaveMultiPlatform  = "1.52" // Docker v29
+)
+
+// Client is a client for the Docker Engine API.
+type Client struct {
+	host       string
+	httpClient *http.Client
+	baseURL    string
+	apiVersion string // Negotiated lazily
+}
+
+// NewFromEnv creates a client for $DOCKER_HOST, or for the endpoint of the current Docker context
+// ($DOCKER_CONTEXT, or "currentContext" in $DOCKER_CONFIG/config.json).
+//
+// TLS is enabled for tcp:// hosts when $DOCKER_TLS_VERIFY or $DOCKER_TLS is set,
+// with the certificates in $DOCKER_CERT_PATH (default: $DOCKER_CONFIG).
+func NewFromEnv() (*Client, error) {
+	if host := os.Getenv("DOCKER_HOST"); host != "" {
+		tlsConfig, err := tlsConfigFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		return New(host, tlsConfig)
+	}
+	ep, err := currentContextEndpoint()
+	if err != nil {
+		return nil, err
+	}
+	if ep != nil {
+		return New(ep.host, ep.tlsConfig)
+	}
+	return New(DefaultHost, nil)
+}
+
+// New creates a client for host, such as "unix:///var/run/docker.sock" or "tcp://127.0.0.1:2376".
+// tlsConfig may be nil.
+// Hosts other than unix:// and tcp:// (e.g., ssh://, npipe://) are reported as [errdefs.ErrNotImplemented].
+func New(host string, tlsConfig *tls.Config) (*Client, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the Docker host %q: %w", host, err)
+	}
+	var (
+		transport = &http.Transport{}
+		baseURL   string
+	)
+	switch u.Scheme {
+	case "unix":
+		sock := u.Path
+		if sock == "" {
+			return nil, fmt.Errorf("empty socket path in the Docker host %q", host)
+		}
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", sock)
+		}
+		// The host part is ignored by the dialer
+		baseURL = "http://docker"
+	case "tcp", "http", "https":
+		scheme := "http"
+		if tlsConfig != nil || u.Scheme == "https" {
+			transport.TLSClientConfig = tlsConfig
+			scheme = "https"
+		}
+		baseURL = scheme + "://" + u.Host
+	default:
+		return nil, fmt.Errorf("unsupported Docker host %q (only unix:// and tcp:// are supported): %w", host, errdefs.ErrNotImplemented)
+	}
+	c := &Client{
+		host:       host,
+		httpClient: &http.Client{Transport: transport},
+		baseURL:    baseURL,
+	}
+	return c, nil
+}
+
+// IsLocal returns true if the daemon is connected via a local unix:// socket.
+func (c *Client) IsLocal() bool {
+	return strings.HasPrefix(c.host, "unix://")
+}
+
+// Host returns the host string.
+func (c *Client) Host() string {
+	return c.host
+}
+
+// Error is an error returned by the Docker Engine API.
+type Error struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Message    string
+}
+
+// Error implements [error].
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s %s: %d %s: %s", e.Method, e.Path, e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Unwrap returns the errdefs error that corresponds to the status code.
+func (e *Error) Unwrap() error {
+	switch e.StatusCode {
+	case http.StatusBadRequest:
+		return errdefs.ErrInvalidArgument
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return errdefs.ErrPermissionDenied
+	case http.StatusNotFound:
+		return errdefs.ErrNotFound
+	case http.StatusConflict:
+		return errdefs.ErrConflict
+	case http.StatusNotImplemented:
+		return errdefs.ErrNotImplemented
+	case http.StatusServiceUnavailable:
+		return errdefs.ErrUnavailable
+	default:
+		return errdefs.ErrUnknown
+	}
+}
+
+func (c *Client) do(ctx context.Context, method, path string, query url.Values) (*http.Response, error) {
+	u := c.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	log.G(ctx).Debugf("Docker Engine API: %s %s", method, u)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the Docker daemon at %q (Hint: set $DOCKER_HOST): %w", c.host, err)
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		apiErr := &Error{
+			Method:     method,
+			Path:       path,
+			StatusCode: resp.StatusCode,
+		}
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		var msg struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(b, &msg) == nil && msg.Message != "" {
+			apiErr.Message = msg.Message
+		} else {
+			apiErr.Message = strings.TrimSpace(string(b))
+		}
+		return nil, apiErr
+	}
+	return resp, nil
+}
+
+// Version is the response of `GET /version`.
+type Version struct {
+	Version       string `json:"Version"`
+	APIVersion    string `json:"ApiVersion"`
+	MinAPIVersion string `json:"MinAPIVersion,omitempty"`
+	Os            string `json:"Os,omitempty"`
+	Arch          string `json:"Arch,omitempty"`
+}
+
+// Version calls `GET /version`.
+func (c *Client) Version(ctx context.Context) (*Version, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/version", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var v Version
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return nil, fmt.Errorf("failed to decode the version of the Docker daemon: %w", err)
+	}
+	return &v, nil
+}
+
+// Info is the response of `GET /info`.
+// Only the fields used by diffoci are defined.
+type Info struct {
+	ID           string      `json:"ID"`
+	Driver       string      `json:"Driver"`
+	DriverStatus [][2]string `json:"DriverStatus,omitempty"`
+	Containerd   *struct {
+		Address    string `json:"Address,omitempty"`
+		Namespaces struct {
+			Containers string `json:"Containers,omitempty"`
+			Plugins    string `json:"Plugins,omitempty"`
+		} `json:"Namespaces"`
+	} `json:"Containerd,omitempty"`
+}
+
+// ContainerdSnapshotterDriverType is the "driver-type" in [Info.DriverStatus]
+// when the daemon uses the containerd image store.
+const ContainerdSnapshotterDriverType = "io.containerd.snapshotter.v1"
+
+// DefaultContainerdNamespace is the containerd namespace used by the daemon by default.
+const DefaultContainerdNamespace = "moby"
+
+// UsesContainerdImageStore returns true if the daemon stores the images in containerd.
+func (info *Info) UsesContainerdImageStore() bool {
+	for _, kv := range info.DriverStatus {
+		if kv[0] == "driver-type" && kv[1] == ContainerdSnapshotterDriverType {
+			return true
+		}
+	}
+	return false
+}
+
+// Info calls `GET /info`.
+func (c *Client) Info(ctx context.Context) (*Info, error) {
+	apiVersion, err := c.negotiate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(ctx, http.MethodGet, "/v"+apiVersion+"/info", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var info Info
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("failed to decode the info of the Docker daemon: %w", err)
+	}
+	return &info, nil
+}
+
+// ImageInspect is the response of `GET /images/{name}/json`.
+// Only the fields used by diffoci are defined.
+type ImageInspect struct {
+	// ID is the digest of the image config, or the digest of the image index
+	// when the daemon uses the containerd image store.
+	ID string `json:"Id"`
+}
+
+// ImageInspect calls `GET /images/{name}/json`.
+func (c *Client) ImageInspect(ctx context.Context, name string) (*ImageInspect, error) {
+	apiVersion, err := c.negotiate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(ctx, http.MethodGet, "/v"+apiVersion+"/images/"+name+"/json", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect image %q: %w", name, err)
+	}
+	defer resp.Body.Close()
+	var inspect ImageInspect
+	if err := json.NewDecoder(resp.Body).Decode(&inspect); err != nil {
+		return nil, fmt.Errorf("failed to decode the inspection of image %q: %w", name, err)
+	}
+	return &inspect, nil
+}
+
+func (c *Client) negotiate(ctx context.Context) (string, error) {
+	if c.apiVersion != "" {
+		return c.apiVersion, nil
+	}
+	v, err := c.Version(ctx)
+	if err != nil {
+		return "", err
+	}
+	if v.APIVersion == "" {
+		return "", errors.New("the Docker daemon did not return the API version")
+	}
+	log.G(ctx).Debugf("Docker Engine version %q, API version %q", v.Version, v.APIVersion)
+	c.apiVersion = v.APIVersion
+	return c.apiVersion, nil
+}
+
+// Save calls `GET /images/get` to export the image as a tar archive.
+//
+// The platforms are passed to the daemon when the API version supports them.
+// Otherwise the archive may contain blobs for other platforms, or lack blobs for the specified platforms,
+// so the caller has to filter the platforms.
+func (c *Client) Save(ctx context.Context, name string, plats []ocispec.Platform) (io.ReadCloser, error) {
+	apiVersion, err := c.negotiate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{}
+	query.Set("names", name)
+	if len(plats) > 0 {
+		switch {
+		case versionAtLeast(apiVersion, apiVersionSaveMultiPlatform),
+			len(plats) == 1 && versionAtLeast(apiVersion, apiVersionSaveSinglePlatform):
+			for _, p := range plats {
+				b, err := json.Marshal(p)
+				if err != nil {
+					return nil, err
+				}
+				query.Add("platform", string(b))
+			}
+		default:
+			log.G(ctx).Debugf("Docker Engine API version %s does not support filtering %d platform(s) on saving images", apiVersion, len(plats))
+		}
+	}
+	resp, err := c.do(ctx, http.MethodGet, "/v"+apiVersion+"/images/get", query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save image %q: %w", name, err)
+	}
+	return resp.Body, nil
+}
+
+// versionAtLeast compares API versions such as "1.48".
+func versionAtLeast(v, min string) bool {
+	vMajor, vMinor := parseAPIVersion(v)
+	minMajor, minMinor := parseAPIVersion(min)
+	if vMajor != minMajor {
+		return vMajor > minMajor
+	}
+	return vMinor >= minMinor
+}
+
+func parseAPIVersion(v string) (int, int) {
+	majorStr, minorStr, _ := strings.Cut(v, ".")
+	major, _ := strconv.Atoi(majorStr)
+	minor, _ := strconv.Atoi(minorStr)
+	return major, minor
+}
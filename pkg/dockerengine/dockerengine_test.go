@@ -0,0 +1,251 @@
+package dockerengine
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/containerd/errdefs"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// fakeEngine serves a subset of the Docker Engine API.
+type fakeEngine struct {
+	apiVersion string
+	mu         sync.Mutex
+	versions   int               // requests of /version
+	saveQuery  []string          // "platform" of the last request of /images/get
+	images     map[string]string // name -> archive
+}
+
+func (e *fakeEngine) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if req.URL.Path == "/version" {
+		e.versions++
+		_ = json.NewEncoder(w).Encode(Version{Version: "0.0.0-fake", APIVersion: e.apiVersion})
+		return
+	}
+	switch strings.TrimPrefix(req.URL.Path, "/v"+e.apiVersion) {
+	case "/info":
+		_ = json.NewEncoder(w).Encode(Info{ID: "fake", Driver: "overlayfs"})
+	case "/images/get":
+		e.saveQuery = req.URL.Query()["platform"]
+		name := req.URL.Query().Get("names")
+		archive, ok := e.images[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]string{"message": "No such image: " + name})
+			return
+		}
+		_, _ = io.WriteString(w, archive)
+	case "/images/docker.io/library/foo:latest/json":
+		_ = json.NewEncoder(w).Encode(ImageInspect{ID: "sha256:" + strings.Repeat("0", 64)})
+	default:
+		http.Error(w, "page not found", http.StatusNotFound)
+	}
+}
+
+// newFakeEngine starts a fake daemon on a unix socket.
+func newFakeEngine(t *testing.T, apiVersion string) (*fakeEngine, *Client) {
+	e := &fakeEngine{
+		apiVersion: apiVersion,
+		images:     map[string]string{"docker.io/library/foo:latest": "archive"},
+	}
+	sock := filepath.Join(t.TempDir(), "docker.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skipf("unix sockets are not available: %v", err)
+	}
+	srv := httptest.NewUnstartedServer(e)
+	srv.Listener = l
+	srv.Start()
+	t.Cleanup(srv.Close)
+	c, err := New("unix://"+sock, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsLocal() {
+		t.Fatal("expected a local client")
+	}
+	return e, c
+}
+
+func TestNegotiate(t *testing.T) {
+	ctx := context.Background()
+	e, c := newFakeEngine(t, "1.47")
+	for range 3 {
+		info, err := c.Info(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.ID != "fake" || info.Driver != "overlayfs" {
+			t.Fatalf("unexpected info: %+v", info)
+		}
+	}
+	if e.versions != 1 {
+		t.Fatalf("the API version must be negotiated once, got %d requests", e.versions)
+	}
+}
+
+func TestImageInspect(t *testing.T) {
+	_, c := newFakeEngine(t, "1.52")
+	inspect, err := c.ImageInspect(context.Background(), "docker.io/library/foo:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inspect.ID != "sha256:"+strings.Repeat("0", 64) {
+		t.Fatalf("unexpected ID %q", inspect.ID)
+	}
+	if _, err = c.ImageInspect(context.Background(), "docker.io/library/bar:latest"); !errors.Is(err, errdefs.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestSave(t *testing.T) {
+	amd64 := ocispec.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := ocispec.Platform{OS: "linux", Architecture: "arm64"}
+	testCases := []struct {
+		apiVersion string
+		plats      []ocispec.Platform
+		expected   int // the number of "platform" queries
+	}{
+		{"1.47", []ocispec.Platform{amd64}, 0},
+		{"1.48", nil, 0},
+		{"1.48", []ocispec.Platform{amd64}, 1},
+		{"1.48", []ocispec.Platform{amd64, arm64}, 0},
+		{"1.51", []ocispec.Platform{amd64, arm64}, 0},
+		{"1.52", []ocispec.Platform{amd64, arm64}, 2},
+		{"2.0", []ocispec.Platform{amd64, arm64}, 2},
+	}
+	for _, tc := range testCases {
+		e, c := newFakeEngine(t, tc.apiVersion)
+		rc, err := c.Save(context.Background(), "docker.io/library/foo:latest", tc.plats)
+		if err != nil {
+			t.Fatalf("%s %v: %v", tc.apiVersion, tc.plats, err)
+		}
+		b, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "archive" {
+			t.Fatalf("unexpected archive %q", b)
+		}
+		if len(e.saveQuery) != tc.expected {
+			t.Fatalf("%s %v: expected %d platform queries, got %v", tc.apiVersion, tc.plats, tc.expected, e.saveQuery)
+		}
+		for i, q := range e.saveQuery {
+			var p ocispec.Platform
+			if err := json.Unmarshal([]byte(q), &p); err != nil {
+				t.Fatal(err)
+			}
+			if p.OS != tc.plats[i].OS || p.Architecture != tc.plats[i].Architecture {
+				t.Fatalf("unexpected platform query %q", q)
+			}
+		}
+	}
+}
+
+func TestError(t *testing.T) {
+	_, c := newFakeEngine(t, "1.52")
+	_, err := c.Save(context.Background(), "docker.io/library/bar:latest", nil)
+	if !errors.Is(err, errdefs.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("expected *Error, got %T", err)
+	}
+	if apiErr.StatusCode != http.StatusNotFound || apiErr.Message != "No such image: docker.io/library/bar:latest" {
+		t.Fatalf("unexpected error: %+v", apiErr)
+	}
+}
+
+func TestNewUnsupported(t *testing.T) {
+	for _, host := range []string{"ssh://user@example.com", "npipe:////./pipe/docker_engine"} {
+		if _, err := New(host, nil); !errors.Is(err, errdefs.ErrNotImplemented) {
+			t.Fatalf("%s: expected ErrNotImplemented, got %v", host, err)
+		}
+	}
+	c, err := New("tcp://127.0.0.1:2376", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.IsLocal() {
+		t.Fatal("tcp:// must not be local")
+	}
+}
+
+func TestTLSFromEnv(t *testing.T) {
+	srv := httptest.NewTLSServer(&fakeEngine{apiVersion: "1.52"})
+	t.Cleanup(srv.Close)
+	certDir := t.TempDir()
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(filepath.Join(certDir, "ca.pem"), caPEM, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DOCKER_HOST", "tcp://"+srv.Listener.Addr().String())
+	t.Setenv("DOCKER_TLS_VERIFY", "1")
+	t.Setenv("DOCKER_CERT_PATH", certDir)
+	c, err := NewFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := c.Version(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.APIVersion != "1.52" {
+		t.Fatalf("unexpected version %+v", v)
+	}
+
+	// Without TLS, the server rejects the plain HTTP request
+	t.Setenv("DOCKER_TLS_VERIFY", "")
+	c, err = NewFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Version(context.Background()); err == nil {
+		t.Fatal("expected an error without TLS")
+	}
+}
+
+func TestContext(t *testing.T) {
+	configDir := t.TempDir()
+	t.Setenv("DOCKER_CONFIG", configDir)
+	t.Setenv("DOCKER_HOST", "")
+	t.Setenv("DOCKER_CONTEXT", "")
+	meta := `{"Name":"remote","Endpoints":{"docker":{"Host":"ssh://user@example.com"}}}`
+	metaDir := filepath.Join(configDir, "contexts", "meta", contextID("remote"))
+	if err := os.MkdirAll(metaDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(metaDir, "meta.json"), []byte(meta), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(configDir, "config.json"), []byte(`{"currentContext":"remote"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFromEnv(); !errors.Is(err, errdefs.ErrNotImplemented) {
+		t.Fatalf("expected ErrNotImplemented for the ssh:// context, got %v", err)
+	}
+	t.Setenv("DOCKER_CONTEXT", "default")
+	c, err := NewFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Host() != DefaultHost {
+		t.Fatalf("unexpected host %q", c.Host())
+	}
+}
@@ -0,0 +1,122 @@
+package dockerengine
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	dockerconfig "github.com/docker/cli/cli/config"
+)
+
+// tlsConfigFromEnv returns the TLS config for $DOCKER_TLS_VERIFY, $DOCKER_TLS, and $DOCKER_CERT_PATH,
+// in the same way as the Docker CLI.
+// Returns nil if TLS is not enabled.
+func tlsConfigFromEnv() (*tls.Config, error) {
+	verify := os.Getenv("DOCKER_TLS_VERIFY") != ""
+	if !verify && os.Getenv("DOCKER_TLS") == "" {
+		return nil, nil
+	}
+	certPath := os.Getenv("DOCKER_CERT_PATH")
+	if certPath == "" {
+		certPath = dockerconfig.Dir()
+	}
+	return loadTLSConfig(certPath, !verify)
+}
+
+// loadTLSConfig loads "ca.pem", "cert.pem", and "key.pem" in dir, if they exist.
+func loadTLSConfig(dir string, insecureSkipVerify bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: insecureSkipVerify, //nolint:gosec // Same as DOCKER_TLS without DOCKER_TLS_VERIFY
+	}
+	caPEM, err := os.ReadFile(filepath.Join(dir, "ca.pem"))
+	switch {
+	case err == nil:
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("failed to parse %q", filepath.Join(dir, "ca.pem"))
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if _, err = os.Stat(certFile); err == nil {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the client certificate in %q: %w", dir, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// endpoint is the Docker endpoint of a context.
+type endpoint struct {
+	host      string
+	tlsConfig *tls.Config
+}
+
+// contextMeta is the metadata of a Docker context ($DOCKER_CONFIG/contexts/meta/<sha256(NAME)>/meta.json).
+type contextMeta struct {
+	Name      string `json:"Name"`
+	Endpoints struct {
+		Docker struct {
+			Host          string `json:"Host"`
+			SkipTLSVerify bool   `json:"SkipTLSVerify"`
+		} `json:"docker"`
+	} `json:"Endpoints"`
+}
+
+// currentContextEndpoint returns the endpoint of the current Docker context ($DOCKER_CONTEXT, or "currentContext"
+// in config.json).
+// Returns nil for the "default" context.
+func currentContextEndpoint() (*endpoint, error) {
+	name := os.Getenv("DOCKER_CONTEXT")
+	if name == "" {
+		// Load does not raise an error on ENOENT
+		cfg, err := dockerconfig.Load("")
+		if err != nil {
+			return nil, err
+		}
+		name = cfg.CurrentContext
+	}
+	if name == "" || name == "default" {
+		return nil, nil
+	}
+	id := contextID(name)
+	contextsDir := filepath.Join(dockerconfig.Dir(), "contexts")
+	metaFile := filepath.Join(contextsDir, "meta", id, "meta.json")
+	b, err := os.ReadFile(metaFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the Docker context %q: %w", name, err)
+	}
+	var meta contextMeta
+	if err = json.Unmarshal(b, &meta); err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %w", metaFile, err)
+	}
+	ep := &endpoint{
+		host: meta.Endpoints.Docker.Host,
+	}
+	if ep.host == "" {
+		return nil, fmt.Errorf("the Docker context %q has no Docker endpoint", name)
+	}
+	tlsDir := filepath.Join(contextsDir, "tls", id, "docker")
+	if _, err = os.Stat(tlsDir); err == nil || meta.Endpoints.Docker.SkipTLSVerify {
+		if ep.tlsConfig, err = loadTLSConfig(tlsDir, meta.Endpoints.Docker.SkipTLSVerify); err != nil {
+			return nil, err
+		}
+	}
+	return ep, nil
+}
+
+// contextID returns the directory name of the context in the context store.
+func contextID(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:])
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/containerd/log"
 )
@@ -43,3 +44,16 @@ func Bool(envName string, defaultValue bool) bool {
 	}
 	return b
 }
+
+func Duration(envName string, defaultValue time.Duration) time.Duration {
+	v, ok := os.LookupEnv(envName)
+	if !ok {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.L.WithError(err).Warnf("Failed to parse %q ($%s) as a duration", v, envName)
+		return defaultValue
+	}
+	return d
+}
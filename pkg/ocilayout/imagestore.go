@@ -0,0 +1,214 @@
+package ocilayout
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/errdefs"
+	refdocker "github.com/distribution/reference"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Init creates an empty OCI image layout in dir, unless it already exists.
+func Init(dir string) error {
+	if err := os.MkdirAll(filepath.Join(dir, ocispec.ImageBlobsDir), 0755); err != nil {
+		return err
+	}
+	layoutFile := filepath.Join(dir, ocispec.ImageLayoutFile)
+	if _, err := os.Stat(layoutFile); err == nil {
+		return Validate(dir)
+	}
+	b, err := json.Marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(layoutFile, b, 0644); err != nil {
+		return err
+	}
+	idx := ocispec.Index{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{},
+	}
+	idx.SchemaVersion = 2
+	return writeIndex(dir, &idx)
+}
+
+// writeIndex writes index.json atomically.
+func writeIndex(dir string, idx *ocispec.Index) error {
+	b, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, "."+ocispec.ImageIndexFile+"-")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err = os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(dir, ocispec.ImageIndexFile))
+}
+
+// ImageStore implements [images.Store] with index.json.
+//
+// The image name is stored in the "io.containerd.image.name" annotation,
+// and the tag is stored in the "org.opencontainers.image.ref.name" annotation,
+// as in the archives exported by containerd.
+// Image labels are not stored.
+type ImageStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewImageStore returns the image store for dir.
+func NewImageStore(dir string) *ImageStore {
+	return &ImageStore{dir: dir}
+}
+
+func imageName(desc ocispec.Descriptor) string {
+	if name := desc.Annotations[images.AnnotationImageName]; name != "" {
+		return name
+	}
+	return desc.Annotations[ocispec.AnnotationRefName]
+}
+
+func (s *ImageStore) image(desc ocispec.Descriptor) images.Image {
+	target := desc
+	target.Annotations = nil
+	return images.Image{
+		Name:   imageName(desc),
+		Target: target,
+	}
+}
+
+// Get implements [images.Store].
+func (s *ImageStore) Get(ctx context.Context, name string) (images.Image, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	idx, err := ReadIndex(s.dir)
+	if err != nil {
+		return images.Image{}, err
+	}
+	for _, desc := range idx.Manifests {
+		if imageName(desc) == name {
+			return s.image(desc), nil
+		}
+	}
+	return images.Image{}, fmt.Errorf("image %q not found in %q: %w", name, s.dir, errdefs.ErrNotFound)
+}
+
+// List implements [images.Store].
+// Filters are not supported.
+func (s *ImageStore) List(ctx context.Context, filters ...string) ([]images.Image, error) {
+	if len(filters) > 0 {
+		return nil, fmt.Errorf("filters are not supported: %w", errdefs.ErrNotImplemented)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	idx, err := ReadIndex(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var res []images.Image
+	for _, desc := range idx.Manifests {
+		if imageName(desc) == "" {
+			continue
+		}
+		res = append(res, s.image(desc))
+	}
+	return res, nil
+}
+
+func descriptorForImage(image images.Image) ocispec.Descriptor {
+	desc := image.Target
+	desc.Annotations = map[string]string{
+		images.AnnotationImageName: image.Name,
+	}
+	if ref, err := refdocker.ParseDockerRef(image.Name); err == nil {
+		if tagged, ok := ref.(refdocker.Tagged); ok {
+			desc.Annotations[ocispec.AnnotationRefName] = tagged.Tag()
+		}
+	}
+	return desc
+}
+
+// Create implements [images.Store].
+func (s *ImageStore) Create(ctx context.Context, image images.Image) (images.Image, error) {
+	if image.Name == "" {
+		return images.Image{}, fmt.Errorf("image name must not be empty: %w", errdefs.ErrInvalidArgument)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	idx, err := ReadIndex(s.dir)
+	if err != nil {
+		return images.Image{}, err
+	}
+	for _, desc := range idx.Manifests {
+		if imageName(desc) == image.Name {
+			return images.Image{}, fmt.Errorf("image %q already exists in %q: %w", image.Name, s.dir, errdefs.ErrAlreadyExists)
+		}
+	}
+	idx.Manifests = append(idx.Manifests, descriptorForImage(image))
+	if err = writeIndex(s.dir, idx); err != nil {
+		return images.Image{}, err
+	}
+	now := time.Now()
+	image.CreatedAt, image.UpdatedAt = now, now
+	return image, nil
+}
+
+// Update implements [images.Store].
+// Only the target can be updated.
+func (s *ImageStore) Update(ctx context.Context, image images.Image, fieldpaths ...string) (images.Image, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	idx, err := ReadIndex(s.dir)
+	if err != nil {
+		return images.Image{}, err
+	}
+	for i, desc := range idx.Manifests {
+		if imageName(desc) == image.Name {
+			idx.Manifests[i] = descriptorForImage(image)
+			if err = writeIndex(s.dir, idx); err != nil {
+				return images.Image{}, err
+			}
+			image.UpdatedAt = time.Now()
+			return image, nil
+		}
+	}
+	return images.Image{}, fmt.Errorf("image %q not found in %q: %w", image.Name, s.dir, errdefs.ErrNotFound)
+}
+
+// Delete implements [images.Store].
+// The blobs are not removed.
+func (s *ImageStore) Delete(ctx context.Context, name string, opts ...images.DeleteOpt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	idx, err := ReadIndex(s.dir)
+	if err != nil {
+		return err
+	}
+	for i, desc := range idx.Manifests {
+		if imageName(desc) == name {
+			idx.Manifests = append(idx.Manifests[:i], idx.Manifests[i+1:]...)
+			return writeIndex(s.dir, idx)
+		}
+	}
+	return fmt.Errorf("image %q not found in %q: %w", name, s.dir, errdefs.ErrNotFound)
+}
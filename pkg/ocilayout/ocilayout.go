@@ -0,0 +1,187 @@
+package ocilayout
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	contentlocal "github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Ref is a reference to an image in an OCI image layout directory.
+type Ref struct {
+	Dir    string
+	Tag    string        // Optional
+	Digest digest.Digest // Optional
+}
+
+// String implements [fmt.Stringer].
+func (r Ref) String() string {
+	s := r.Dir
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest.String()
+	}
+	return s
+}
+
+// ParseRef parses "/path/to/dir[:tag|@digest]".
+// A colon that precedes the last slash is treated as a part of the path.
+func ParseRef(s string) (*Ref, error) {
+	if s == "" {
+		return nil, errors.New("empty OCI layout reference")
+	}
+	var ref Ref
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		d, err := digest.Parse(s[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the digest of %q: %w", s, err)
+		}
+		ref.Digest = d
+		s = s[:i]
+	}
+	if i := strings.LastIndex(s, ":"); i >= 0 && i > strings.LastIndex(s, "/") {
+		if s[i+1:] == "" {
+			return nil, fmt.Errorf("empty tag in %q", s)
+		}
+		ref.Tag = s[i+1:]
+		s = s[:i]
+	}
+	if s == "" {
+		return nil, errors.New("empty OCI layout directory")
+	}
+	ref.Dir = filepath.Clean(s)
+	return &ref, nil
+}
+
+// Validate checks that dir looks like an OCI image layout.
+func Validate(dir string) error {
+	b, err := os.ReadFile(filepath.Join(dir, ocispec.ImageLayoutFile))
+	if err != nil {
+		return fmt.Errorf("%q does not seem an OCI image layout: %w", dir, err)
+	}
+	var layout ocispec.ImageLayout
+	if err := json.Unmarshal(b, &layout); err != nil {
+		return fmt.Errorf("failed to parse %q: %w", ocispec.ImageLayoutFile, err)
+	}
+	if layout.Version != ocispec.ImageLayoutVersion {
+		return fmt.Errorf("unsupported OCI image layout version %q", layout.Version)
+	}
+	return nil
+}
+
+// ReadIndex reads index.json in dir.
+func ReadIndex(dir string) (*ocispec.Index, error) {
+	b, err := os.ReadFile(filepath.Join(dir, ocispec.ImageIndexFile))
+	if err != nil {
+		return nil, err
+	}
+	var idx ocispec.Index
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %w", ocispec.ImageIndexFile, err)
+	}
+	return &idx, nil
+}
+
+// NewProvider returns a content store for the blobs in dir.
+// The store does not write anything to dir unless a writer is opened.
+func NewProvider(dir string) (content.Store, error) {
+	if err := Validate(dir); err != nil {
+		return nil, err
+	}
+	return contentlocal.NewStore(dir)
+}
+
+// Resolve resolves ref into a descriptor, using index.json.
+//
+// When the tag is specified, the descriptor is looked up by the
+// "org.opencontainers.image.ref.name" annotation (or "io.containerd.image.name").
+// When the digest is specified, the descriptor is looked up by the digest.
+// When neither is specified, index.json must contain exactly one descriptor.
+func Resolve(ctx context.Context, ref Ref) (*ocispec.Descriptor, error) {
+	idx, err := ReadIndex(ref.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []ocispec.Descriptor
+	for _, desc := range idx.Manifests {
+		if ref.Tag != "" && !matchTag(desc, ref.Tag) {
+			continue
+		}
+		if ref.Digest != "" && desc.Digest != ref.Digest {
+			continue
+		}
+		candidates = append(candidates, desc)
+	}
+	switch len(candidates) {
+	case 0:
+		if ref.Digest != "" && ref.Tag == "" {
+			// The digest may refer to a manifest that is not listed in index.json,
+			// such as a platform-specific manifest of a multi-platform image.
+			if _, err := os.Stat(blobPath(ref.Dir, ref.Digest)); err == nil {
+				return resolveUnlisted(ref)
+			}
+		}
+		return nil, fmt.Errorf("image %q not found in %q: %w", ref.String(), ocispec.ImageIndexFile, errdefs.ErrNotFound)
+	case 1:
+		return &candidates[0], nil
+	default:
+		return nil, fmt.Errorf("image %q is ambiguous (%d candidates found in %q, specify a tag or a digest)",
+			ref.String(), len(candidates), ocispec.ImageIndexFile)
+	}
+}
+
+func matchTag(desc ocispec.Descriptor, tag string) bool {
+	if desc.Annotations == nil {
+		return false
+	}
+	if desc.Annotations[ocispec.AnnotationRefName] == tag {
+		return true
+	}
+	if desc.Annotations[images.AnnotationImageName] == tag {
+		return true
+	}
+	return false
+}
+
+func blobPath(dir string, d digest.Digest) string {
+	return filepath.Join(dir, ocispec.ImageBlobsDir, d.Algorithm().String(), d.Encoded())
+}
+
+func resolveUnlisted(ref Ref) (*ocispec.Descriptor, error) {
+	if err := ref.Digest.Validate(); err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(blobPath(ref.Dir, ref.Digest))
+	if err != nil {
+		return nil, err
+	}
+	if got := ref.Digest.Algorithm().FromBytes(b); got != ref.Digest {
+		return nil, fmt.Errorf("blob %s has an unexpected digest %s", ref.Digest, got)
+	}
+	var probe struct {
+		MediaType string `json:"mediaType,omitempty"`
+	}
+	if err := json.Unmarshal(b, &probe); err != nil {
+		return nil, fmt.Errorf("blob %s is not a JSON: %w", ref.Digest, err)
+	}
+	if !images.IsIndexType(probe.MediaType) && !images.IsManifestType(probe.MediaType) {
+		return nil, fmt.Errorf("blob %s has an unexpected media type %q", ref.Digest, probe.MediaType)
+	}
+	return &ocispec.Descriptor{
+		MediaType: probe.MediaType,
+		Digest:    ref.Digest,
+		Size:      int64(len(b)),
+	}, nil
+}
@@ -0,0 +1,152 @@
+package ocilayout
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestParseRef(t *testing.T) {
+	dgst := digest.FromString("foo")
+	testCases := []struct {
+		s        string
+		expected *Ref // nil for an error
+	}{
+		{"/tmp/foo", &Ref{Dir: "/tmp/foo"}},
+		{"/tmp/foo/", &Ref{Dir: "/tmp/foo"}},
+		{"/tmp/foo:latest", &Ref{Dir: "/tmp/foo", Tag: "latest"}},
+		{"/tmp/foo@" + dgst.String(), &Ref{Dir: "/tmp/foo", Digest: dgst}},
+		{"/tmp/foo:latest@" + dgst.String(), &Ref{Dir: "/tmp/foo", Tag: "latest", Digest: dgst}},
+		{"foo:v1.0", &Ref{Dir: "foo", Tag: "v1.0"}},
+		// The colon before the last slash is a part of the path
+		{"/tmp/a:b/foo", &Ref{Dir: "/tmp/a:b/foo"}},
+		{"/tmp/a:b/foo:latest", &Ref{Dir: "/tmp/a:b/foo", Tag: "latest"}},
+		{"", nil},
+		{"/tmp/foo:", nil},
+		{":latest", nil},
+		{"/tmp/foo@sha256:invalid", nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.s, func(t *testing.T) {
+			ref, err := ParseRef(tc.s)
+			if tc.expected == nil {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", ref)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *ref != *tc.expected {
+				t.Errorf("expected %+v, got %+v", tc.expected, ref)
+			}
+		})
+	}
+}
+
+// testLayout creates an OCI image layout with the blobs, and the descriptors in index.json.
+func testLayout(t *testing.T, blobs [][]byte, descs ...ocispec.Descriptor) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := Init(dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range blobs {
+		d := digest.FromBytes(b)
+		p := blobPath(dir, d)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	idx := ocispec.Index{MediaType: ocispec.MediaTypeImageIndex, Manifests: descs}
+	idx.SchemaVersion = 2
+	if err := writeIndex(dir, &idx); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestResolve(t *testing.T) {
+	manifest := func(s string) []byte {
+		b, err := json.Marshal(ocispec.Manifest{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Config:    ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig, Digest: digest.FromString(s)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	descOf := func(b []byte, annotations map[string]string) ocispec.Descriptor {
+		return ocispec.Descriptor{
+			MediaType:   ocispec.MediaTypeImageManifest,
+			Digest:      digest.FromBytes(b),
+			Size:        int64(len(b)),
+			Annotations: annotations,
+		}
+	}
+	m0, m1, m2, unlisted := manifest("0"), manifest("1"), manifest("2"), manifest("unlisted")
+	d0 := descOf(m0, map[string]string{ocispec.AnnotationRefName: "v0"})
+	d1 := descOf(m1, map[string]string{ocispec.AnnotationRefName: "v1"})
+	// Tagged by containerd, with the same tag as d1
+	d2 := descOf(m2, map[string]string{images.AnnotationImageName: "v1"})
+	dir := testLayout(t, [][]byte{m0, m1, m2, unlisted, []byte("not a json")}, d0, d1, d2)
+	single := testLayout(t, [][]byte{m0}, d0)
+
+	testCases := []struct {
+		name     string
+		ref      Ref
+		expected *ocispec.Descriptor // nil for an error
+		notFound bool
+	}{
+		{name: "tag", ref: Ref{Dir: dir, Tag: "v0"}, expected: &d0},
+		{name: "digest", ref: Ref{Dir: dir, Digest: d1.Digest}, expected: &d1},
+		{name: "tag and digest", ref: Ref{Dir: dir, Tag: "v1", Digest: d2.Digest}, expected: &d2},
+		{name: "single image", ref: Ref{Dir: single}, expected: &d0},
+		{
+			// e.g., a platform-specific manifest of a multi-platform image
+			name:     "digest not listed in index.json",
+			ref:      Ref{Dir: dir, Digest: descOf(unlisted, nil).Digest},
+			expected: &ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(unlisted), Size: int64(len(unlisted))},
+		},
+		{name: "digest missing", ref: Ref{Dir: dir, Digest: digest.FromString("missing")}, notFound: true},
+		{name: "digest of a non-manifest blob", ref: Ref{Dir: dir, Digest: digest.FromString("not a json")}},
+		{name: "digest not matching the tag", ref: Ref{Dir: dir, Tag: "v0", Digest: d1.Digest}, notFound: true},
+		{name: "tag missing", ref: Ref{Dir: dir, Tag: "v2"}, notFound: true},
+		{name: "ambiguous tag", ref: Ref{Dir: dir, Tag: "v1"}},
+		{name: "ambiguous", ref: Ref{Dir: dir}},
+		{name: "no index.json", ref: Ref{Dir: t.TempDir()}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			desc, err := Resolve(context.Background(), tc.ref)
+			if tc.expected == nil {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", desc)
+				}
+				if notFound := errors.Is(err, errdefs.ErrNotFound); notFound != tc.notFound {
+					t.Errorf("expected notFound=%v, got %v", tc.notFound, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if desc.Digest != tc.expected.Digest || desc.MediaType != tc.expected.MediaType || desc.Size != tc.expected.Size {
+				t.Errorf("expected %+v, got %+v", tc.expected, desc)
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+// Package registryprovider provides a content provider that fetches blobs from a registry lazily.
+package registryprovider
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+	"github.com/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// maxCachedBlobSize is the maximum size of a non-layer blob cached in memory.
+const maxCachedBlobSize = 16 * 1024 * 1024
+
+// Provider implements [content.Provider].
+//
+// Non-layer blobs (indexes, manifests, and configs) are fetched eagerly by Prefetch, and cached in memory.
+// Layer blobs are fetched on the first ReadAt call, so that identical layers are never fetched.
+type Provider struct {
+	fetcher remotes.Fetcher
+	mu      sync.RWMutex
+	cache   map[digest.Digest][]byte
+	layers  map[digest.Digest]struct{} // Known by Prefetch, but not fetched yet
+}
+
+// New resolves ref with resolver, and returns the provider with the descriptor of ref.
+func New(ctx context.Context, resolver remotes.Resolver, ref string) (*Provider, *ocispec.Descriptor, error) {
+	name, desc, err := resolver.Resolve(ctx, ref)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to resolve %q: %w", ref, err)
+	}
+	fetcher, err := resolver.Fetcher(ctx, name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create a fetcher for %q: %w", name, err)
+	}
+	p := &Provider{
+		fetcher: fetcher,
+		cache:   make(map[digest.Digest][]byte),
+		layers:  make(map[digest.Digest]struct{}),
+	}
+	return p, &desc, nil
+}
+
+// Prefetch fetches the non-layer blobs reachable from desc for the platforms.
+func (p *Provider) Prefetch(ctx context.Context, desc ocispec.Descriptor, platMC platforms.MatchComparer) error {
+	handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		if images.IsLayerType(desc.MediaType) {
+			p.mu.Lock()
+			p.layers[desc.Digest] = struct{}{}
+			p.mu.Unlock()
+			return nil, nil
+		}
+		if _, err := p.fetchToCache(ctx, desc); err != nil {
+			return nil, err
+		}
+		if images.IsConfigType(desc.MediaType) {
+			return nil, nil
+		}
+		return images.Children(ctx, p, desc)
+	})
+	return images.Walk(ctx, images.FilterPlatforms(handler, platMC), desc)
+}
+
+func (p *Provider) fetchToCache(ctx context.Context, desc ocispec.Descriptor) ([]byte, error) {
+	p.mu.RLock()
+	b, ok := p.cache[desc.Digest]
+	p.mu.RUnlock()
+	if ok {
+		return b, nil
+	}
+	if desc.Size > maxCachedBlobSize {
+		return nil, fmt.Errorf("too large blob %s (%d > %d bytes)", desc.Digest, desc.Size, maxCachedBlobSize)
+	}
+	log.G(ctx).Debugf("Fetching %s (%s)", desc.Digest, desc.MediaType)
+	rc, err := p.fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %w", desc.Digest, err)
+	}
+	defer rc.Close()
+	b, err = io.ReadAll(io.LimitReader(rc, desc.Size+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %w", desc.Digest, err)
+	}
+	if int64(len(b)) != desc.Size {
+		return nil, fmt.Errorf("blob %s: expected %d bytes, got %d bytes", desc.Digest, desc.Size, len(b))
+	}
+	if got := desc.Digest.Algorithm().FromBytes(b); got != desc.Digest {
+		return nil, fmt.Errorf("blob %s: unexpected digest %s", desc.Digest, got)
+	}
+	p.mu.Lock()
+	p.cache[desc.Digest] = b
+	p.mu.Unlock()
+	return b, nil
+}
+
+// ReaderAt implements [content.Provider].
+// No network access happens until ReadAt is called.
+// Blobs that were not visited by Prefetch are reported as [errdefs.ErrNotFound].
+func (p *Provider) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid digest %q: %w", desc.Digest, errdefs.ErrInvalidArgument)
+	}
+	p.mu.RLock()
+	b, ok := p.cache[desc.Digest]
+	_, isLayer := p.layers[desc.Digest]
+	p.mu.RUnlock()
+	if ok {
+		return &bytesReaderAt{Reader: bytes.NewReader(b)}, nil
+	}
+	if !isLayer {
+		return nil, fmt.Errorf("blob %s: %w", desc.Digest, errdefs.ErrNotFound)
+	}
+	return &lazyReaderAt{
+		ctx:      ctx,
+		fetcher:  p.fetcher,
+		desc:     desc,
+		digester: desc.Digest.Algorithm().Digester(),
+	}, nil
+}
+
+type bytesReaderAt struct {
+	*bytes.Reader
+}
+
+func (ra *bytesReaderAt) Close() error {
+	return nil
+}
+
+// lazyReaderAt fetches the blob on the first ReadAt call.
+// Sequential reads are served from a single HTTP stream, and verified on reaching the end of the blob.
+type lazyReaderAt struct {
+	ctx      context.Context
+	fetcher  remotes.Fetcher
+	desc     ocispec.Descriptor
+	mu       sync.Mutex
+	rc       io.ReadCloser
+	off      int64
+	digester digest.Digester // nil after a non-sequential read
+}
+
+func (ra *lazyReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	if off >= ra.desc.Size {
+		return 0, io.EOF
+	}
+	if ra.rc == nil {
+		log.G(ra.ctx).Debugf("Fetching %s (%s)", ra.desc.Digest, ra.desc.MediaType)
+		rc, err := ra.fetcher.Fetch(ra.ctx, ra.desc)
+		if err != nil {
+			return 0, fmt.Errorf("failed to fetch %s: %w", ra.desc.Digest, err)
+		}
+		ra.rc = rc
+	}
+	if off != ra.off {
+		if err := ra.seek(off); err != nil {
+			return 0, err
+		}
+	}
+	n, err := io.ReadFull(ra.rc, p[:min(int64(len(p)), ra.desc.Size-off)])
+	if ra.digester != nil {
+		ra.digester.Hash().Write(p[:n])
+	}
+	ra.off += int64(n)
+	if err != nil {
+		return n, err
+	}
+	if ra.off == ra.desc.Size {
+		if ra.digester != nil {
+			if got := ra.digester.Digest(); got != ra.desc.Digest {
+				return n, fmt.Errorf("blob %s: unexpected digest %s", ra.desc.Digest, got)
+			}
+		}
+		if n < len(p) {
+			return n, io.EOF
+		}
+	}
+	return n, nil
+}
+
+func (ra *lazyReaderAt) seek(off int64) error {
+	ra.digester = nil
+	if seeker, ok := ra.rc.(io.Seeker); ok {
+		if _, err := seeker.Seek(off, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to seek %s to %d: %w", ra.desc.Digest, off, err)
+		}
+		ra.off = off
+		return nil
+	}
+	if off < ra.off {
+		return fmt.Errorf("blob %s: cannot seek backward from %d to %d: %w", ra.desc.Digest, ra.off, off, errdefs.ErrNotImplemented)
+	}
+	if _, err := io.CopyN(io.Discard, ra.rc, off-ra.off); err != nil {
+		return err
+	}
+	ra.off = off
+	return nil
+}
+
+func (ra *lazyReaderAt) Size() int64 {
+	return ra.desc.Size
+}
+
+func (ra *lazyReaderAt) Close() error {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	if ra.rc == nil {
+		return nil
+	}
+	err := ra.rc.Close()
+	ra.rc = nil
+	return err
+}
@@ -0,0 +1,239 @@
+package registryprovider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// fakeRegistry serves the blobs of a single repository "test", with the manifest tagged as "latest".
+type fakeRegistry struct {
+	t        *testing.T
+	manifest ocispec.Descriptor
+	blobs    map[digest.Digest][]byte
+	mu       sync.Mutex
+	gets     map[digest.Digest]int // GET requests of the blobs
+	ranges   int                   // GET requests with the Range header
+}
+
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	return &fakeRegistry{
+		t:     t,
+		blobs: make(map[digest.Digest][]byte),
+		gets:  make(map[digest.Digest]int),
+	}
+}
+
+func (r *fakeRegistry) add(mediaType string, b []byte) ocispec.Descriptor {
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(b),
+		Size:      int64(len(b)),
+	}
+	r.blobs[desc.Digest] = b
+	return desc
+}
+
+func (r *fakeRegistry) addJSON(mediaType string, v any) ocispec.Descriptor {
+	b, err := json.Marshal(v)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return r.add(mediaType, b)
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/v2/" {
+		return
+	}
+	s, ok := strings.CutPrefix(req.URL.Path, "/v2/test/")
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	kind, ref, _ := strings.Cut(s, "/")
+	dgst := digest.Digest(ref)
+	if kind == "manifests" && ref == "latest" {
+		dgst = r.manifest.Digest
+	}
+	b, ok := r.blobs[dgst]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method == http.MethodGet {
+		r.mu.Lock()
+		r.gets[dgst]++
+		if req.Header.Get("Range") != "" {
+			r.ranges++
+		}
+		r.mu.Unlock()
+	}
+	if kind == "manifests" {
+		w.Header().Set("Content-Type", r.manifest.MediaType)
+	}
+	w.Header().Set("Docker-Content-Digest", dgst.String())
+	http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(b))
+}
+
+func (r *fakeRegistry) getCount(dgst digest.Digest) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.gets[dgst]
+}
+
+// setupImage adds an image with a single layer, and returns the descriptor of the layer.
+func setupImage(t *testing.T, r *fakeRegistry, layer []byte) ocispec.Descriptor {
+	config := r.addJSON(ocispec.MediaTypeImageConfig, ocispec.Image{
+		Platform: platforms.DefaultSpec(),
+		RootFS:   ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{digest.FromBytes(layer)}},
+	})
+	layerDesc := r.add(ocispec.MediaTypeImageLayer, layer)
+	mani := ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{layerDesc},
+	}
+	mani.SchemaVersion = 2
+	r.manifest = r.addJSON(ocispec.MediaTypeImageManifest, mani)
+	return layerDesc
+}
+
+func newTestProvider(t *testing.T, r *fakeRegistry) (*Provider, ocispec.Descriptor) {
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	resolver := docker.NewResolver(docker.ResolverOptions{
+		Hosts: docker.ConfigureDefaultRegistries(docker.WithPlainHTTP(docker.MatchAllHosts)),
+	})
+	ref := strings.TrimPrefix(srv.URL, "http://") + "/test:latest"
+	p, desc, err := New(context.Background(), resolver, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, *desc
+}
+
+func TestPrefetch(t *testing.T) {
+	ctx := context.Background()
+	r := newFakeRegistry(t)
+	layer := setupImage(t, r, bytes.Repeat([]byte("layer"), 1000))
+	p, desc := newTestProvider(t, r)
+	if err := p.Prefetch(ctx, desc, platforms.All); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.getCount(layer.Digest); got != 0 {
+		t.Fatalf("the layer must not be fetched by Prefetch, got %d requests", got)
+	}
+	manifest, err := images.Manifest(ctx, p, desc, platforms.All)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gets := r.getCount(manifest.Config.Digest)
+	if _, err := content.ReadBlob(ctx, p, manifest.Config); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.getCount(manifest.Config.Digest); got != gets {
+		t.Fatalf("the config must be served from the cache, got %d requests (expected %d)", got, gets)
+	}
+	if _, err := p.ReaderAt(ctx, ocispec.Descriptor{Digest: digest.FromString("unknown"), Size: 1}); err == nil {
+		t.Fatal("expected an error for an unknown blob")
+	}
+}
+
+func TestReadAt(t *testing.T) {
+	ctx := context.Background()
+	r := newFakeRegistry(t)
+	b := make([]byte, 100000)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	layer := setupImage(t, r, b)
+	p, desc := newTestProvider(t, r)
+	if err := p.Prefetch(ctx, desc, platforms.All); err != nil {
+		t.Fatal(err)
+	}
+
+	// sequential read, verified on reaching the end
+	ra, err := p.ReaderAt(ctx, layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(content.NewReader(ra))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ra.Close()
+	if !bytes.Equal(got, b) {
+		t.Fatal("unexpected content")
+	}
+
+	// range reads
+	ra, err = p.ReaderAt(ctx, layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ra.Close()
+	for _, off := range []int64{50000, 10, 99990} {
+		buf := make([]byte, 10)
+		n, err := ra.ReadAt(buf, off)
+		if err != nil && err != io.EOF {
+			t.Fatalf("ReadAt(%d): %v", off, err)
+		}
+		if !bytes.Equal(buf[:n], b[off:off+int64(n)]) || n != 10 {
+			t.Fatalf("ReadAt(%d): unexpected content %v", off, buf[:n])
+		}
+	}
+	r.mu.Lock()
+	ranges := r.ranges
+	r.mu.Unlock()
+	if ranges == 0 {
+		t.Fatal("expected range requests")
+	}
+	if _, err := ra.ReadAt(make([]byte, 1), layer.Size); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestDigestMismatch(t *testing.T) {
+	ctx := context.Background()
+	r := newFakeRegistry(t)
+	layer := setupImage(t, r, []byte("genuine content"))
+	r.blobs[layer.Digest] = []byte("tampered content")[:layer.Size]
+	p, desc := newTestProvider(t, r)
+	if err := p.Prefetch(ctx, desc, platforms.All); err != nil {
+		t.Fatal(err)
+	}
+	ra, err := p.ReaderAt(ctx, layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ra.Close()
+	if _, err = io.ReadAll(content.NewReader(ra)); err == nil || !strings.Contains(err.Error(), "unexpected digest") {
+		t.Fatalf("expected a digest mismatch, got %v", err)
+	}
+
+	// tampered config
+	manifest, err := images.Manifest(ctx, p, desc, platforms.All)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.blobs[manifest.Config.Digest] = bytes.Repeat([]byte(" "), int(manifest.Config.Size))
+	p, desc = newTestProvider(t, r)
+	if err := p.Prefetch(ctx, desc, platforms.All); err == nil || !strings.Contains(err.Error(), "unexpected digest") {
+		t.Fatalf("expected a digest mismatch, got %v", err)
+	}
+}
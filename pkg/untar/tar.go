@@ -107,13 +107,20 @@ func Entry(ctx context.Context, root string, hdr *tar.Header, r io.Reader) (*Ent
 	// Directory mtimes must be handled at the end to avoid further
 	// file creation in them to modify the directory mtime
 	if hdr.Typeflag == tar.TypeDir {
+		atime, mtime := hdr.AccessTime, hdr.ModTime
 		res.Finalizer = func() error {
-			return chtimes(path, boundTime(latestTime(hdr.AccessTime, hdr.ModTime)), boundTime(hdr.ModTime))
+			return SetDirTimes(path, atime, mtime)
 		}
 	}
 	return res, nil
 }
 
+// SetDirTimes sets the timestamps of a directory extracted by [Entry].
+// This is what [EntryResult.Finalizer] does, for the callers that record the timestamps instead of the finalizers.
+func SetDirTimes(path string, atime, mtime time.Time) error {
+	return chtimes(path, boundTime(latestTime(atime, mtime)), boundTime(mtime))
+}
+
 // removeAllUnderRoot is a 'safe' version of os.RemoveAll
 // it makes sure that we don't accidentally delete files on the host system.
 // it is not strictly necessary as all paths should be safe already